@@ -9,6 +9,13 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "export" {
+		if err := autodemo.ExportCommand(os.Args[2:], os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	app := autodemo.InitializeApp("test.db")
 	defer app.Close()
 
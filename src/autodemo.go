@@ -23,6 +23,7 @@ import (
 	"github.com/gorilla/websocket"
 	"github.com/koeng101/autodemo/src/autodemosql"
 	libb "github.com/koeng101/autodemo/src/libB"
+	"github.com/koeng101/autodemo/src/ot2"
 	_ "github.com/ncruces/go-sqlite3/driver"
 	_ "github.com/ncruces/go-sqlite3/embed"
 	"github.com/sashabaranov/go-openai"
@@ -32,6 +33,7 @@ import (
 // export MODEL="meta-llama/Llama-3.3-70B-Instruct-Turbo"
 // export BASE_URL="https://api.deepinfra.com/v1/openai"
 // export PORT=8080
+// export OT2_URL="http://ot2.local:8000" # optional, to run scripts on an OT-2
 
 /******************************************************************************
 
@@ -60,10 +62,12 @@ tool: 16
 user: How many base pairs are in "ATGC"?
 assistant: <lua_sandbox>
 print(#"ATGC")
-<lua_sandbox>
+</lua_sandbox>
 tool: 4
 
-The script mode is the one for creating biological protocols. It is more advanced, and comes preloaded with the libB library. Here is some example usage:
+Sandbox output shows everything printed, messages logged with libB.log.info, libB.log.warn and libB.log.error, any values the code returns, and, if the code fails, the error with a traceback after whatever was output before it.
+
+The script mode is the one for creating biological protocols. It is more advanced, and comes preloaded with the libB library. Scripts are type checked against libB before they start: if a call into libB has the wrong arguments or a variable is never defined, the protocol is not started and the tool message lists each problem as line:column: message. Output from every step of a protocol is recorded alongside the step, so use print and libB.log to explain which branch a step took; the output of main, or its error and traceback if it fails, is shown when the protocol starts. Here is some example usage:
 
 user: Home my robot for me
 assistant: <lua_script>
@@ -77,13 +81,13 @@ function main() -- scripts always initiate at main
 	commands:home()
 	script:add_commands(commands)
 
-	-- there are always 5 returns from scripts:
-	-- 1. a status code: 0 for success, 1 for failure, and 2 for continuation
-	-- 2. a comment for the user
-	-- 3. the next function to run (may be blank)
-	-- 4. the script json
-	-- 5. data to be passed into the next function
-	return 0, "Homing the robot", "", script:to_json(), ""
+	-- scripts always return a table with:
+	-- status: libB.status.SUCCESS, libB.status.FAILURE, or libB.status.CONTINUE to wait for data
+	-- comment: a comment for the user
+	-- next: the next function to run (required for CONTINUE)
+	-- script: the libB.Script to run
+	-- passthrough: data to be passed into the next function
+	return { status = libB.status.SUCCESS, comment = "Homing the robot", script = script }
 end
 </lua_script>
 
@@ -99,7 +103,6 @@ function main()
     local human_commands = libB.HumanCommands.new()
     human_commands:quantify(data_id, "nest_96_wellplate_100ul_pcr_full_skirt", "7", "A1")
     script:add_commands(human_commands)
-    local script_json = script:to_json()
 
     -- Define what data we want to retrieve later
     local data = libB.json.encode({
@@ -107,21 +110,46 @@ function main()
         data_id = data_id
     })
 
-    return 2, "Requesting DNA quantification in well", "process_dna", script_json, data
+    return { status = libB.status.CONTINUE, comment = "Requesting DNA quantification in well", next = "process_dna", script = script, passthrough = data }
 end
 
 function process_dna(input_data)
     local data = libB.json.decode(input_data)
-    -- Now we can directly use the data table since keys match our DATA structure
-    local dna_ng = libB.json.decode(DATA[data["script_id"]][data["data_id"]])
+    -- libB.data.get returns the decoded result uploaded for a script and data id
+    local dna_ng = libB.data.get(data["script_id"], data["data_id"])
+    if dna_ng["ng_per_ul"] > 25 then
+        return { status = libB.status.SUCCESS, comment = "High DNA concentration" }
+    else
+        return { status = libB.status.FAILURE, comment = "Low DNA concentration" }
+    end
+end
+</lua_script>
+
+libB.data.get(script_id, data_id) returns the decoded result for any data id uploaded earlier in the protocol, not just in the step that just finished, or nil if it hasn't been uploaded yet. The raw JSON strings are in DATA[script_id][data_id].
+
+Every result is checked against its human command's result schema before it is uploaded, so you can rely on its shape. A quantify result is always a libB.QuantifyResult: {"ng_per_ul": number}, with ng_per_ul never negative.
+
+Instead of splitting a protocol into separate functions, main can also wait for results inline with libB.await(script). It pauses the protocol until the script's results are uploaded, then returns them as JSON strings keyed by return key. Protocols using libB.await must stay inside main. Here is the same protocol written with libB.await:
+
+assistant: <lua_script>
+function main()
+    local script = libB.Script.new(libB.uuid.generate())
+    local data_id = libB.uuid.generate()
+    local human_commands = libB.HumanCommands.new()
+    human_commands:quantify(data_id, "nest_96_wellplate_100ul_pcr_full_skirt", "7", "A1")
+    script:add_commands(human_commands)
+
+    local results = libB.await(script, "Requesting DNA quantification in well")
+    local dna_ng = libB.json.decode(results[data_id])
     if dna_ng["ng_per_ul"] > 25 then
-        return 0, "High DNA concentration", "", "", ""
+        return { status = libB.status.SUCCESS, comment = "High DNA concentration" }
     else
-        return 1, "Low DNA concentration", "", "", ""
+        return { status = libB.status.FAILURE, comment = "Low DNA concentration" }
     end
 end
 </lua_script>
 
+Every script a step returns is checked by simulating the deck: aspirating or dispensing without a tip, dispensing into the thermocycler plate while its lid is closed, volumes outside a pipette's range, or two different labware in one deck slot fail the step with "Unsafe script" and the problems found. Warnings, such as touching the thermocycler plate before tc_open_lid, are added to the step's log. Run the same check in the sandbox with libB.validate(script), which returns a list of issues with severity, group, command, kind and message. To sanity-check reaction volumes, libB.simulate(script, initial) follows the liquid from initial, a list of { deck_slot, address, liquid, volume } declaring what the source wells start with, and returns { wells, issues }: each well's volume, contents by liquid and a description such as "A1 of ... contains 10 uL mastermix + 2 uL primers", along with any well aspirated past empty or filled past its capacity.
 
 
 Here is a much more complicated user interaction. Notice the back-and-forth between the user and the assistant. The assistant (tool) will be run by the lua sandbox, as defined above.
@@ -206,7 +234,6 @@ function main()
 	-- Update script
 	script:add_commands(opentrons_commands)
 	script:add_commands(human_commands)
-	local script_json = script:to_json()
 
 	-- Define what data we want to retrieve later
     local data = libB.json.encode({
@@ -214,19 +241,19 @@ function main()
         data_id = data_id
     })
 
-	return 2, "PCR, then quantify DNA", "process_results", script_json, data
+	return { status = libB.status.CONTINUE, comment = "PCR, then quantify DNA", next = "process_results", script = script, passthrough = data }
 end
 
 function process_results(input_data)
 	local data = libB.json.decode(input_data)
-	local dna_ng = libB.json.decode(DATA[data["script_id"]][data["data_id"]])
+	local dna_ng = libB.data.get(data["script_id"], data["data_id"])
 	if dna_ng["ng_per_ul"] > 25 then
-        return 0, "High DNA concentration", "", "", ""
+        return { status = libB.status.SUCCESS, comment = "High DNA concentration" }
     else
-        return 1, "Low DNA concentration", "", "", ""
+        return { status = libB.status.FAILURE, comment = "Low DNA concentration" }
     end
 end
-<lua_script>
+</lua_script>
 
 ### EOT ###
 
@@ -271,7 +298,7 @@ It appears that the melting temperature is too high. I'll rewrite the script wit
 </thinking>
 <lua_script>
 -- main sets up the PCR reaction, then passes outputs to process_dna
-local function main()
+function main()
 	local script_id = libB.uuid.generate()
 	local script = libB.Script.new(script_id)
 
@@ -311,14 +338,13 @@ local function main()
 		:tc_open_lid()
 
 	-- Human code
-	local human_commands = HumanCommands.new()
+	local human_commands = libB.HumanCommands.new()
 	local data_id = libB.uuid.generate()
 	human_commands:quantify(data_id, destination.labware, destination.deck_slot, "A1")
 
 	-- Update script
 	script:add_commands(opentrons_commands)
 	script:add_commands(human_commands)
-	local script_json = script:to_json()
 
 	-- Define what data we want to retrieve later
     local data = libB.json.encode({
@@ -326,19 +352,19 @@ local function main()
         data_id = data_id
     })
 
-	return 2, "PCR, then quantify DNA (2nd attempt)", "process_results", script_json, data
+	return { status = libB.status.CONTINUE, comment = "PCR, then quantify DNA (2nd attempt)", next = "process_results", script = script, passthrough = data }
 end
 
 function process_results(input_data)
 	local data = libB.json.decode(input_data)
-	local dna_ng = libB.json.decode(DATA[data["script_id"]][data["data_id"]])
+	local dna_ng = libB.data.get(data["script_id"], data["data_id"])
 	if dna_ng["ng_per_ul"] > 25 then
-        return 0, "High DNA concentration", "", "", ""
+        return { status = libB.status.SUCCESS, comment = "High DNA concentration" }
     else
-        return 1, "Low DNA concentration", "", "", ""
+        return { status = libB.status.FAILURE, comment = "Low DNA concentration" }
     end
 end
-<lua_script>
+</lua_script>
 
 ### EOT ###
 
@@ -373,7 +399,10 @@ var upgrader = websocket.Upgrader{
 }
 
 func (app *App) Close() error {
-	app.cancel() // Cancel context to stop watchers
+	app.cancel() // Cancel context to stop the engine
+	app.Engine.Stop()
+	app.Dispatcher.Stop()
+	app.Webhooks.Stop()
 	if err := app.WDB.Close(); err != nil {
 		return fmt.Errorf("failed to close write DB: %w", err)
 	}
@@ -384,17 +413,22 @@ func (app *App) Close() error {
 }
 
 type App struct {
-	ctx     context.Context
-	cancel  context.CancelFunc
-	Router  *http.ServeMux
-	Logger  *slog.Logger
-	DB      *sql.DB
-	WDB     *WriteDB
-	Runner  *ProtocolRunner
-	Watcher *StepWatcher
+	ctx        context.Context
+	cancel     context.CancelFunc
+	Router     *http.ServeMux
+	Logger     *slog.Logger
+	DB         *sql.DB
+	WDB        *WriteDB
+	Runner     *ProtocolRunner
+	Engine     *Engine
+	Dispatcher *Dispatcher
+	Webhooks   *WebhookSender
 }
 
-// Modify InitializeApp to include runner and watcher setup
+// InitializeApp sets up the routes, databases, protocol engine, dispatcher and
+// webhook sender.
+// If OT2_URL is set, opentrons command groups are run on the ot2 server at that
+// URL, and otherwise they are simulated.
 func InitializeApp(dbLocation string) *App {
 	ctx, cancel := context.WithCancel(context.Background())
 	var app App
@@ -405,10 +439,30 @@ func InitializeApp(dbLocation string) *App {
 	app.Router.HandleFunc("/chat/{projectID}/ws", app.ChatHandler)
 	app.Router.HandleFunc("/status/{projectID}", app.StatusHandler)
 	app.Router.HandleFunc("/upload/{stepID}", app.UploadHandler)
+	app.Router.HandleFunc("/upload/{stepID}/{returnKey}", app.UploadResultHandler)
 	app.Router.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
 		http.ServeFile(w, r, "upload.html")
 	})
 	app.Router.HandleFunc("/backend/{codestep}", app.CodeStepHandler)
+	app.Router.HandleFunc("/export/{stepID}", app.ExportHandler)
+	app.Router.HandleFunc("/runs/{runID}/retry", app.RetryRunHandler)
+	app.Router.HandleFunc("/queue", app.QueuePageHandler)
+	app.Router.HandleFunc("/queue/items", app.QueueHandler)
+	app.Router.HandleFunc("/queue/items/{itemID}/claim", app.ClaimWorkItemHandler)
+	app.Router.HandleFunc("/queue/items/{itemID}/unclaim", app.UnclaimWorkItemHandler)
+	app.Router.HandleFunc("/queue/items/{itemID}/assignee", app.AssignWorkItemHandler)
+	app.Router.HandleFunc("/queue/items/{itemID}/due", app.DueWorkItemHandler)
+	app.Router.HandleFunc("/queue/items/{itemID}/complete", app.CompleteWorkItemHandler)
+	app.Router.HandleFunc("/webhooks/{projectID}", app.WebhooksHandler)
+	app.Router.HandleFunc("/webhooks/{projectID}/{webhookID}", app.WebhookHandler)
+	app.Router.HandleFunc("/webhooks/{projectID}/{webhookID}/deliveries", app.WebhookDeliveriesHandler)
+	app.Router.HandleFunc("/scripts", app.SubmitScriptsHandler)
+	app.Router.HandleFunc("/scripts/{codeID}", app.ScriptSubmissionHandler)
+
+	// Compile libB and warm up Lua states before the first chat message
+	if err := libb.Warm(); err != nil {
+		panic(err)
+	}
 
 	// Initialize database
 	writeDB, err := sql.Open("sqlite3", dbLocation)
@@ -424,15 +478,78 @@ func InitializeApp(dbLocation string) *App {
 	}
 	app.DB = readDB
 
-	// Initialize protocol runner and watcher
+	// Initialize protocol runner, and continue any protocols which had data
+	// uploaded while the server was down
 	app.Runner = NewProtocolRunner(w)
-	app.Watcher = NewStepWatcher(app.Runner)
+	app.Engine = NewEngine(app.Runner, readDB)
+	if url := os.Getenv("OT2_URL"); url != "" {
+		app.Runner.Executors["opentrons"] = NewRobotExecutor(ot2.NewClient(url))
+	}
+	app.Dispatcher = NewDispatcher(app.Runner, readDB)
+	app.Webhooks = NewWebhookSender(w, readDB)
+	app.Runner.OnStep = func() {
+		app.Dispatcher.Notify()
+		app.Webhooks.Notify()
+	}
+	app.Dispatcher.OnRunFailed = app.Webhooks.Notify
+	app.Dispatcher.Start(ctx)
+	app.Webhooks.Start(ctx)
+	app.Engine.Start(ctx)
 
 	app.ctx = ctx
 	app.cancel = cancel
 	return &app
 }
 
+// StepLog is the log of the Lua execution which created a step.
+type StepLog struct {
+	Function   string
+	Stdout     []string
+	Logs       []libb.LogEntry
+	WallTimeMs int64
+	Error      string
+	Traceback  string
+	Truncated  bool
+}
+
+// String renders the log the same way sandbox output is shown to the model.
+func (l *StepLog) String() string {
+	capture := libb.Capture{Stdout: l.Stdout, Logs: l.Logs, Error: l.Error, Traceback: l.Traceback}
+	output := capture.String()
+	if l.Truncated {
+		output += "[output truncated]\n"
+	}
+	return output
+}
+
+// newStepLog decodes a code_step_log row.
+func newStepLog(row autodemosql.CodeStepLog) (*StepLog, error) {
+	stepLog := &StepLog{
+		Function:   row.FunctionName,
+		WallTimeMs: row.WallTimeMs,
+		Error:      row.Error.String,
+		Traceback:  row.Traceback.String,
+		Truncated:  row.Truncated,
+	}
+	if row.Stdout != "" {
+		stepLog.Stdout = strings.Split(strings.TrimSuffix(row.Stdout, "\n"), "\n")
+	}
+	if err := json.Unmarshal([]byte(row.Logs), &stepLog.Logs); err != nil {
+		return nil, fmt.Errorf("failed to parse logs of step %d: %v", row.CodeStep, err)
+	}
+	return stepLog, nil
+}
+
+// StepStatus is a step along with the log of the execution which created it,
+// the runs of its script's command groups and, for steps waiting on a script,
+// the return keys still waiting for data.
+type StepStatus struct {
+	autodemosql.CodeStep
+	Log         *StepLog
+	Runs        []autodemosql.CodeStepRun
+	Outstanding map[string][]string // script ID -> return keys
+}
+
 func (app *App) StatusHandler(w http.ResponseWriter, r *http.Request) {
 	projectID := r.PathValue("projectID")
 	if projectID == "" {
@@ -446,9 +563,37 @@ func (app *App) StatusHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	logRows, err := queries.GetLatestStepLogsForProject(r.Context(), projectID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logs := make(map[int64]*StepLog, len(logRows))
+	for _, row := range logRows {
+		logs[row.CodeStep], err = newStepLog(row)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	statuses := make([]StepStatus, len(steps))
+	for i, step := range steps {
+		outstanding, err := outstandingKeys(step)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		runs, err := queries.GetCodeStepRuns(r.Context(), step.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		statuses[i] = StepStatus{CodeStep: step, Log: logs[step.ID], Runs: runs, Outstanding: outstanding}
+	}
 
 	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(steps)
+	json.NewEncoder(w).Encode(statuses)
 }
 
 func (app *App) UploadHandler(w http.ResponseWriter, r *http.Request) {
@@ -471,18 +616,135 @@ func (app *App) UploadHandler(w http.ResponseWriter, r *http.Request) {
 
 	buf := new(bytes.Buffer)
 	_, _ = buf.ReadFrom(r.Body)
+	data, err := parseStepData(buf.String())
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Invalid data: %v", err), http.StatusBadRequest)
+		return
+	}
+	script, err := app.stepScript(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if script != nil {
+		if errs := script.ValidateData(data); len(errs) > 0 {
+			writeFieldErrors(w, errs)
+			return
+		}
+	}
 
-	if err := app.WDB.CreateData(r.Context(), id, buf.String()); err != nil {
+	err = app.WDB.CreateData(r.Context(), id, buf.String())
+	if errors.Is(err, ErrStepNotPending) {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
-	err = app.Watcher.UpdateStep(id, buf.String())
+	// The data is stored, so the protocol continues even if the engine is
+	// restarted before it gets to it.
+	app.dataUploaded()
+	w.WriteHeader(http.StatusOK)
+}
+
+// dataUploaded nudges the dispatcher and engine once data has been stored for
+// a step: the dispatcher completes the command groups waiting on it, and the
+// protocol continues once they have.
+func (app *App) dataUploaded() {
+	if app.Dispatcher != nil {
+		app.Dispatcher.Notify()
+	}
+	app.Engine.Notify()
+}
+
+// stepScript returns the script a step is waiting on, so that uploads can be
+// validated before they are stored. It returns nil if there's no such step or
+// the step has no script; storing the upload reports the former. Steps which
+// return no script store it as null.
+func (app *App) stepScript(ctx context.Context, stepID int64) (*libb.Script, error) {
+	step, err := autodemosql.New(app.DB).GetCodeStep(ctx, stepID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get step: %v", err)
+	}
+	if step.Script == "" || step.Script == "null" {
+		return nil, nil
+	}
+	var script libb.Script
+	if err := json.Unmarshal([]byte(step.Script), &script); err != nil {
+		return nil, fmt.Errorf("failed to parse script: %v", err)
+	}
+	return &script, nil
+}
+
+// UploadErrors is the body of an upload rejected for not matching the result
+// schemas of the step's human commands.
+type UploadErrors struct {
+	Errors []libb.FieldError `json:"errors"`
+}
+
+func writeFieldErrors(w http.ResponseWriter, errs []libb.FieldError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(UploadErrors{Errors: errs})
+}
+
+// UploadResultHandler stores the result of a single human command, keyed by
+// its return key, so that each command's result can be uploaded separately.
+// The protocol continues once results for every return key are uploaded.
+func (app *App) UploadResultHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	id, err := strconv.ParseInt(r.PathValue("stepID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid step ID", http.StatusBadRequest)
+		return
+	}
+	returnKey := r.PathValue("returnKey")
+	if returnKey == "" {
+		http.Error(w, "Return key required", http.StatusBadRequest)
+		return
+	}
+
+	buf := new(bytes.Buffer)
+	_, _ = buf.ReadFrom(r.Body)
+	if !json.Valid(buf.Bytes()) {
+		http.Error(w, "Invalid data: result must be JSON", http.StatusBadRequest)
+		return
+	}
+	script, err := app.stepScript(r.Context(), id)
 	if err != nil {
-		fmt.Println("failed to update step")
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if script != nil {
+		if errs := script.ValidateResult(returnKey, buf.String()); len(errs) > 0 {
+			writeFieldErrors(w, errs)
+			return
+		}
+	}
+
+	err = app.WDB.MergeData(r.Context(), id, returnKey, buf.String())
+	switch {
+	case errors.Is(err, ErrUnknownReturnKey):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case errors.Is(err, ErrStepNotPending), errors.Is(err, ErrResultUploaded):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
 
+	app.dataUploaded()
 	w.WriteHeader(http.StatusOK)
 }
 
@@ -678,7 +940,7 @@ func (app *App) ChatHandler(w http.ResponseWriter, r *http.Request) {
 
 				// Check if we got a sandbox to execute
 				if strings.Contains(llmResponse, "<lua_sandbox>") {
-					output := app.executeLuaSandbox(llmResponse)
+					output := app.executeLuaSandbox(r.Context(), llmResponse)
 					toolOutput := fmt.Sprintf("tool:\n%s", output)
 					toolMsg := fmt.Sprintf("\n<|eot_id|>\n<|start_header_id|>assistant<|end_header_id|>\n%s", toolOutput)
 
@@ -714,7 +976,7 @@ func (app *App) ChatHandler(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
-func (app *App) executeLuaSandbox(msg string) string {
+func (app *App) executeLuaSandbox(ctx context.Context, msg string) string {
 	luaPrefix := "<lua_sandbox>"
 	codeSuffix := "</lua_sandbox>"
 
@@ -730,11 +992,15 @@ func (app *App) executeLuaSandbox(msg string) string {
 	}
 
 	luaCode := msg[luaStartIndex+len(luaPrefix) : luaStartIndex+len(luaPrefix)+luaEndIndex]
-	output, err := libb.ExecuteLua(luaCode)
-	if err != nil {
-		return fmt.Sprintf("Got error: %s", err.Error())
+	capture := libb.CaptureLua(ctx, luaCode)
+	output := capture.String()
+	var limitErr *libb.LimitError
+	if errors.As(capture.Err, &limitErr) {
+		output += "Sandbox stopped. Sandbox code must finish quickly; do less work or avoid unbounded loops.\n"
+	}
+	if output == "" {
+		return "(no output)"
 	}
-
 	return output
 }
 
@@ -755,7 +1021,15 @@ func (app *App) executeLuaScript(ctx context.Context, historyID int64, msg strin
 
 	scriptCode := msg[scriptStartIndex+len(scriptPrefix) : scriptStartIndex+len(scriptPrefix)+scriptEndIndex]
 
-	err := app.Runner.StartProtocol(ctx, historyID, scriptCode)
+	diagnostics, err := libb.CheckScript(ctx, scriptCode)
+	if err != nil {
+		return fmt.Sprintf("Failed to check script: %s", err.Error())
+	}
+	if len(diagnostics) > 0 {
+		return fmt.Sprintf("Script failed type checking, protocol not started:\n%s", libb.FormatDiagnostics(diagnostics))
+	}
+
+	err = app.Runner.StartProtocol(ctx, historyID, scriptCode)
 	if err != nil {
 		return fmt.Sprintf("Failed to start protocol: %s", err.Error())
 	}
@@ -770,10 +1044,23 @@ func (app *App) executeLuaScript(ctx context.Context, historyID int64, msg strin
 	}
 
 	initialStep := steps[len(steps)-1]
-	app.Watcher.WatchStep(ctx, initialStep.ID)
 
-	return fmt.Sprintf("Protocol started with step ID: %d\nStatus: %d\nComment: %s",
+	result := fmt.Sprintf("Protocol started with step ID: %d\nStatus: %d\nComment: %s",
 		initialStep.ID, initialStep.Status, initialStep.StepComment)
+
+	// Show the model what main printed, logged or failed with
+	logRow, err := queries.GetCodeStepLog(ctx, initialStep.ID)
+	if err != nil {
+		return result
+	}
+	stepLog, err := newStepLog(logRow)
+	if err != nil {
+		return result
+	}
+	if output := stepLog.String(); output != "" {
+		result += "\nOutput of main:\n" + output
+	}
+	return result
 }
 
 // constructConversationContext helper function to construct conversation context in the expected format
@@ -865,13 +1152,26 @@ Technician backend
 type CommandGroupDisplay struct {
 	Type string
 	JSON string
+	Run  *autodemosql.CodeStepRun // the group's run by its executor, if any
 }
 
 // TemplateData holds the data for the template
 type CodeStepTemplateData struct {
 	StepID        int64
 	ScriptID      string
+	Status        int64
+	Comment       string
 	CommandGroups []CommandGroupDisplay
+	Log           *StepLog // nil for steps created before logs were kept
+	Outstanding   []OutstandingResult
+}
+
+// OutstandingResult is a return key still waiting for data, along with the
+// fields of the result to upload for it. Fields is empty if the command has no
+// result schema, in which case any JSON can be uploaded.
+type OutstandingResult struct {
+	ReturnKey string
+	Fields    []libb.ResultField
 }
 
 //go:embed codestep.html
@@ -912,10 +1212,50 @@ func (app *App) CodeStepHandler(w http.ResponseWriter, r *http.Request) {
 	templateData := CodeStepTemplateData{
 		StepID:   stepID,
 		ScriptID: script.ID,
+		Status:   step.Status,
+		Comment:  step.StepComment,
+	}
+
+	outstanding, err := outstandingKeys(step)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, returnKey := range outstanding[script.ID] {
+		templateData.Outstanding = append(templateData.Outstanding, OutstandingResult{
+			ReturnKey: returnKey,
+			Fields:    script.ResultFields(returnKey),
+		})
+	}
+
+	// Get the log of the execution which created the step
+	logRow, err := queries.GetCodeStepLog(r.Context(), stepID)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Error getting code step log: %v", err), http.StatusInternalServerError)
+		return
+	default:
+		templateData.Log, err = newStepLog(logRow)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	// Get the runs of the script's groups by their executors
+	runs, err := queries.GetCodeStepRuns(r.Context(), stepID)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error getting code step runs: %v", err), http.StatusInternalServerError)
+		return
+	}
+	runByGroup := make(map[int64]*autodemosql.CodeStepRun, len(runs))
+	for i := range runs {
+		runByGroup[runs[i].CommandGroup] = &runs[i]
 	}
 
 	// Process each command group
-	for _, cmdGroup := range script.Commands {
+	for i, cmdGroup := range script.Commands {
 		// Convert the command group to JSON
 		cmdJSON, err := json.MarshalIndent(cmdGroup, "", "    ")
 		if err != nil {
@@ -926,6 +1266,7 @@ func (app *App) CodeStepHandler(w http.ResponseWriter, r *http.Request) {
 		displayGroup := CommandGroupDisplay{
 			Type: cmdGroup.CommandType,
 			JSON: string(cmdJSON),
+			Run:  runByGroup[int64(i)],
 		}
 		templateData.CommandGroups = append(templateData.CommandGroups, displayGroup)
 	}
@@ -996,16 +1337,23 @@ single goroutine is operating on. This application-level handling of
 transactions means we never encounter a case where SQLite could error from
 a busy row.
 
+Each request still runs inside a real transaction: since only the writer
+goroutine ever begins one, and it finishes each transaction before starting
+the next, the single connection is never shared between transactions. If a
+request returns an error or panics, everything it wrote is rolled back, so a
+request either happens completely or not at all.
 
 It is important that RunTx does not have any long requests: if it does, it
-blocks ALL writes on the system.
+blocks ALL writes on the system. In particular, Lua is never executed inside
+RunTx; see the step execution section of state.go for how protocols are moved
+forward around the writer.
 
 ******************************************************************************/
 
 // WriteRequest is a request to run a function writing directly to the
 // database. Only one WriteRequest is ever run at a time.
 type WriteRequest struct {
-	Func         func(db *sql.DB, ctx context.Context) error
+	Func         func(queries *autodemosql.Queries, ctx context.Context) error
 	ResponseChan chan error
 }
 
@@ -1026,11 +1374,37 @@ func (w *WriteDB) write(requestChan <-chan WriteRequest) error {
 			if !ok {
 				return nil
 			}
-			req.ResponseChan <- req.Func(w.DB, w.CTX)
+			req.ResponseChan <- w.runTx(req.Func)
 		}
 	}
 }
 
+// runTx runs fn inside a transaction, committing if it succeeds and rolling
+// back if it returns an error or panics.
+func (w *WriteDB) runTx(fn func(queries *autodemosql.Queries, ctx context.Context) error) (err error) {
+	tx, err := w.DB.BeginTx(w.CTX, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %v", err)
+	}
+	defer func() {
+		if p := recover(); p != nil {
+			_ = tx.Rollback()
+			err = fmt.Errorf("transaction panicked: %v", p)
+		}
+	}()
+
+	if err := fn(autodemosql.New(tx), w.CTX); err != nil {
+		if rollbackErr := tx.Rollback(); rollbackErr != nil {
+			return fmt.Errorf("%w (rollback failed: %v)", err, rollbackErr)
+		}
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit transaction: %v", err)
+	}
+	return nil
+}
+
 func InitWriteDB(db *sql.DB, ctx context.Context) *WriteDB {
 	g, ctx := errgroup.WithContext(ctx)
 	requestChan := make(chan WriteRequest) // explicitly NOT buffered.
@@ -1062,7 +1436,8 @@ func (w *WriteDB) Close() error {
 	return w.DB.Close()
 }
 
-// RunTx runs a transaction. It is vital that this is a short function without
+// RunTx runs fn in a transaction, which is rolled back if fn returns an error
+// or panics. It is vital that this is a short function without
 // much compute: it blocks all write database operations for the entire
 // service. If normal writes are being used, this shouldn't be a problem
 // (SQLite can handle a lot of writes.)
@@ -1070,7 +1445,7 @@ func (w *WriteDB) Close() error {
 // As per https://www.sqlite.org/faq.html#q19 , each insert is rather
 // expensive! If possible, group together inserts into one big transaction
 // like in writeDB.CreateFastq.
-func (w *WriteDB) RunTx(fn func(db *sql.DB, ctx context.Context) error) error {
+func (w *WriteDB) RunTx(fn func(queries *autodemosql.Queries, ctx context.Context) error) error {
 	responseChan := make(chan error, 1)
 	req := WriteRequest{Func: fn, ResponseChan: responseChan}
 	w.WriteRequestChan <- req
@@ -1081,8 +1456,7 @@ func (w *WriteDB) RunTx(fn func(db *sql.DB, ctx context.Context) error) error {
 
 // CreateProject inserts a new project into the database
 func (w *WriteDB) CreateProject(ctx context.Context, projectID string) error {
-	return w.RunTx(func(db *sql.DB, ctx context.Context) error {
-		queries := autodemosql.New(db)
+	return w.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
 		err := queries.CreateProject(ctx, projectID)
 		return err
 	})
@@ -1091,8 +1465,7 @@ func (w *WriteDB) CreateProject(ctx context.Context, projectID string) error {
 // AddMessageHistory adds a new message history entry and returns the created ID and timestamp
 func (w *WriteDB) AddMessageHistory(ctx context.Context, projectID string, content string) (int64, int64, error) {
 	var id, createdAt int64
-	err := w.RunTx(func(db *sql.DB, ctx context.Context) error {
-		queries := autodemosql.New(db)
+	err := w.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
 		result, err := queries.AddMessageHistory(ctx, autodemosql.AddMessageHistoryParams{ProjectID: projectID, Content: content})
 		if err != nil {
 			return err
@@ -1103,15 +1476,94 @@ func (w *WriteDB) AddMessageHistory(ctx context.Context, projectID string, conte
 	})
 	return id, createdAt, err
 }
+
+// ErrStepNotPending is returned when uploading data for a step which isn't
+// waiting for data, either because it never needed any or because its data
+// has already been uploaded.
+var ErrStepNotPending = errors.New("step is not waiting for data")
+
+// CreateData stores the data uploaded for a step waiting for data.
 func (w *WriteDB) CreateData(ctx context.Context, codeStepID int64, data string) error {
-	err := w.RunTx(func(db *sql.DB, ctx context.Context) error {
-		var err error
-		queries := autodemosql.New(db)
-		err = queries.UpdateStepData(ctx, autodemosql.UpdateStepDataParams{
+	err := w.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		updated, err := queries.UpdatePendingStepData(ctx, autodemosql.UpdatePendingStepDataParams{
 			ID:   codeStepID,
 			Data: sql.NullString{Valid: true, String: data},
 		})
-		return err
+		if err != nil {
+			return err
+		}
+		if updated == 0 {
+			return ErrStepNotPending
+		}
+		uploaded, err := parseStepData(data)
+		if err != nil {
+			return err
+		}
+		return completeWorkItems(queries, ctx, codeStepID, uploaded)
 	})
 	return err
 }
+
+// ErrUnknownReturnKey is returned when uploading a result under a return key
+// which none of the step's human commands declare.
+var ErrUnknownReturnKey = errors.New("step's script has no such return key")
+
+// ErrResultUploaded is returned when uploading a result for a return key which
+// already has one.
+var ErrResultUploaded = errors.New("result has already been uploaded")
+
+// MergeData stores the result for one return key of a step waiting for data,
+// merging it into the data already uploaded for the step.
+func (w *WriteDB) MergeData(ctx context.Context, codeStepID int64, returnKey string, result string) error {
+	return w.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		step, err := queries.GetCodeStep(ctx, codeStepID)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrStepNotPending
+		}
+		if err != nil {
+			return err
+		}
+		later, err := queries.CountStepsAfter(ctx, autodemosql.CountStepsAfterParams{Code: step.Code, ID: step.ID})
+		if err != nil {
+			return err
+		}
+		if step.Status != int64(libb.StatusContinue) || later > 0 {
+			return ErrStepNotPending
+		}
+
+		var script libb.Script
+		if err := json.Unmarshal([]byte(step.Script), &script); err != nil {
+			return fmt.Errorf("failed to parse script: %v", err)
+		}
+		if !script.GetReturnKeys()[script.ID][returnKey] {
+			return fmt.Errorf("%w: %q", ErrUnknownReturnKey, returnKey)
+		}
+		data, err := parseStepData(step.Data.String)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			data = make(map[string]map[string]string)
+		}
+		if _, ok := data[script.ID][returnKey]; ok {
+			return fmt.Errorf("%w: %q", ErrResultUploaded, returnKey)
+		}
+		if data[script.ID] == nil {
+			data[script.ID] = make(map[string]string)
+		}
+		data[script.ID][returnKey] = result
+
+		merged, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		err = queries.UpdateStepData(ctx, autodemosql.UpdateStepDataParams{
+			ID:   codeStepID,
+			Data: sql.NullString{Valid: true, String: string(merged)},
+		})
+		if err != nil {
+			return err
+		}
+		return completeWorkItems(queries, ctx, codeStepID, map[string]map[string]string{script.ID: {returnKey: result}})
+	})
+}
@@ -2,10 +2,14 @@ package autodemo
 
 import (
 	"context"
+	"database/sql"
+	"errors"
 	"os"
+	"strings"
 	"testing"
 
 	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
 	"github.com/sashabaranov/go-openai"
 )
 
@@ -40,6 +44,55 @@ func TestCreateProject(t *testing.T) {
 	}
 }
 
+func TestRunTxRollback(t *testing.T) {
+	dbPath := "test_tx.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	queries := autodemosql.New(db)
+	errBoom := errors.New("boom")
+
+	// An error rolls back everything written before it.
+	err := wdb.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		if err := queries.CreateProject(ctx, "rolled-back"); err != nil {
+			return err
+		}
+		return errBoom
+	})
+	if !errors.Is(err, errBoom) {
+		t.Errorf("Expected the transaction's error, got %v", err)
+	}
+	if _, err := queries.GetProjectByID(ctx, "rolled-back"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected project to be rolled back, got %v", err)
+	}
+
+	// So does a panic, which is returned as an error.
+	err = wdb.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		if err := queries.CreateProject(ctx, "panicked"); err != nil {
+			return err
+		}
+		panic("boom")
+	})
+	if err == nil || !strings.Contains(err.Error(), "panicked: boom") {
+		t.Errorf("Expected the panic as an error, got %v", err)
+	}
+	if _, err := queries.GetProjectByID(ctx, "panicked"); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("Expected project to be rolled back, got %v", err)
+	}
+
+	// The writer keeps working afterwards.
+	if err := wdb.CreateProject(ctx, "committed"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	if _, err := queries.GetProjectByID(ctx, "committed"); err != nil {
+		t.Errorf("Expected project to be committed, got %v", err)
+	}
+}
+
 func TestAddMessageHistory(t *testing.T) {
 	dbPath := "test.db"
 	db, wdb := MakeTestDatabase(dbPath)
@@ -139,3 +192,39 @@ Assistant message`,
 		})
 	}
 }
+
+func TestLuaPromptScripts(t *testing.T) {
+	// Extract the example scripts the same way executeLuaScript does: each
+	// closing tag ends the script started by the last opening tag before it.
+	chunks := strings.Split(LuaPrompt, "</lua_script>")
+	if len(chunks) < 2 {
+		t.Fatal("no example scripts found in LuaPrompt")
+	}
+	for i, chunk := range chunks[:len(chunks)-1] {
+		script := chunk[strings.LastIndex(chunk, "<lua_script>")+len("<lua_script>"):]
+		if strings.TrimSpace(script) == "-- Your code here!" {
+			continue
+		}
+		diagnostics, err := libb.CheckScript(context.Background(), script)
+		if err != nil {
+			t.Fatalf("script %d: CheckScript failed: %v", i, err)
+		}
+		if len(diagnostics) > 0 {
+			t.Errorf("script %d failed type checking:\n%s", i, libb.FormatDiagnostics(diagnostics))
+		}
+		if _, err := libb.ExecuteLuaStep(context.Background(), script, libb.StepInput{Function: "main"}); err != nil {
+			t.Errorf("script %d failed to start: %v", i, err)
+		}
+	}
+}
+
+func TestExecuteLuaSandbox(t *testing.T) {
+	app := &App{}
+	output := app.executeLuaSandbox(context.Background(), "<lua_sandbox>\nprint(8+8)\nerror('boom')\n</lua_sandbox>")
+	if !strings.HasPrefix(output, "16\nError: ") || !strings.Contains(output, "boom") {
+		t.Errorf("Expected partial output followed by the error, got:\n%s", output)
+	}
+	if !strings.Contains(output, "stack traceback") {
+		t.Errorf("Expected a traceback, got:\n%s", output)
+	}
+}
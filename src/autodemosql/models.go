@@ -13,6 +13,7 @@ type Code struct {
 	ProjectMessageHistoryID int64
 	Code                    string
 	Complete                bool
+	Language                string
 }
 
 type CodeStep struct {
@@ -24,6 +25,31 @@ type CodeStep struct {
 	Script          string
 	DataPassthrough string
 	Data            sql.NullString
+	Seed            int64
+}
+
+type CodeStepLog struct {
+	ID           int64
+	CodeStep     int64
+	FunctionName string
+	Stdout       string
+	Logs         string
+	WallTimeMs   int64
+	Error        sql.NullString
+	Traceback    sql.NullString
+	Truncated    bool
+	CreatedAt    int64
+}
+
+type CodeStepRun struct {
+	ID            int64
+	CodeStep      int64
+	CommandGroup  int64
+	RunID         int64
+	Status        string
+	StatusMessage string
+	CreatedAt     int64
+	UpdatedAt     int64
 }
 
 type Project struct {
@@ -37,3 +63,50 @@ type ProjectMessageHistory struct {
 	CreatedAt int64
 	Content   string
 }
+
+type ProjectWebhook struct {
+	ID        int64
+	ProjectID string
+	Url       string
+	Secret    string
+	Active    bool
+	CreatedAt int64
+}
+
+type WebhookDelivery struct {
+	ID            int64
+	Webhook       int64
+	Event         string
+	Payload       string
+	Status        string
+	Attempts      int64
+	NextAttemptAt int64
+	DeliveredAt   sql.NullInt64
+	CreatedAt     int64
+}
+
+type WebhookDeliveryAttempt struct {
+	ID           int64
+	Delivery     int64
+	ResponseCode sql.NullInt64
+	Error        sql.NullString
+	DurationMs   int64
+	CreatedAt    int64
+}
+
+type WorkItem struct {
+	ID           int64
+	CodeStep     int64
+	CommandGroup int64
+	CommandIndex int64
+	CommandType  string
+	Command      string
+	ReturnKey    string
+	Assignee     sql.NullString
+	ClaimedBy    sql.NullString
+	ClaimedAt    sql.NullInt64
+	DueAt        sql.NullInt64
+	Result       sql.NullString
+	CompletedAt  sql.NullInt64
+	CreatedAt    int64
+}
@@ -33,24 +33,84 @@ func (q *Queries) AddMessageHistory(ctx context.Context, arg AddMessageHistoryPa
 	return i, err
 }
 
+const claimWorkItem = `-- name: ClaimWorkItem :exec
+UPDATE work_item SET claimed_by = ?, claimed_at = unixepoch() WHERE id = ?
+`
+
+type ClaimWorkItemParams struct {
+	ClaimedBy sql.NullString
+	ID        int64
+}
+
+func (q *Queries) ClaimWorkItem(ctx context.Context, arg ClaimWorkItemParams) error {
+	_, err := q.db.ExecContext(ctx, claimWorkItem, arg.ClaimedBy, arg.ID)
+	return err
+}
+
+const completeWorkItem = `-- name: CompleteWorkItem :exec
+UPDATE work_item SET result = ?, completed_at = unixepoch() WHERE id = ? AND completed_at IS NULL
+`
+
+type CompleteWorkItemParams struct {
+	Result sql.NullString
+	ID     int64
+}
+
+func (q *Queries) CompleteWorkItem(ctx context.Context, arg CompleteWorkItemParams) error {
+	_, err := q.db.ExecContext(ctx, completeWorkItem, arg.Result, arg.ID)
+	return err
+}
+
+const completeWorkItemsForKey = `-- name: CompleteWorkItemsForKey :exec
+UPDATE work_item SET result = ?, completed_at = unixepoch() WHERE code_step = ? AND return_key = ? AND completed_at IS NULL
+`
+
+type CompleteWorkItemsForKeyParams struct {
+	Result    sql.NullString
+	CodeStep  int64
+	ReturnKey string
+}
+
+func (q *Queries) CompleteWorkItemsForKey(ctx context.Context, arg CompleteWorkItemsForKeyParams) error {
+	_, err := q.db.ExecContext(ctx, completeWorkItemsForKey, arg.Result, arg.CodeStep, arg.ReturnKey)
+	return err
+}
+
+const countStepsAfter = `-- name: CountStepsAfter :one
+SELECT COUNT(*) FROM code_step WHERE code = ? AND id > ?
+`
+
+type CountStepsAfterParams struct {
+	Code int64
+	ID   int64
+}
+
+func (q *Queries) CountStepsAfter(ctx context.Context, arg CountStepsAfterParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, countStepsAfter, arg.Code, arg.ID)
+	var count int64
+	err := row.Scan(&count)
+	return count, err
+}
+
 const createCode = `-- name: CreateCode :one
-INSERT INTO code(project_message_history_id, code) VALUES (?, ?) RETURNING id
+INSERT INTO code(project_message_history_id, code, language) VALUES (?, ?, ?) RETURNING id
 `
 
 type CreateCodeParams struct {
 	ProjectMessageHistoryID int64
 	Code                    string
+	Language                string
 }
 
 func (q *Queries) CreateCode(ctx context.Context, arg CreateCodeParams) (int64, error) {
-	row := q.db.QueryRowContext(ctx, createCode, arg.ProjectMessageHistoryID, arg.Code)
+	row := q.db.QueryRowContext(ctx, createCode, arg.ProjectMessageHistoryID, arg.Code, arg.Language)
 	var id int64
 	err := row.Scan(&id)
 	return id, err
 }
 
 const createCodeStep = `-- name: CreateCodeStep :one
-INSERT INTO code_step(code, status, step_comment, next_function, script, data_passthrough) VALUES (?, ?, ?, ?, ?, ?) RETURNING id
+INSERT INTO code_step(code, status, step_comment, next_function, script, data_passthrough, seed) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id
 `
 
 type CreateCodeStepParams struct {
@@ -60,6 +120,7 @@ type CreateCodeStepParams struct {
 	NextFunction    string
 	Script          string
 	DataPassthrough string
+	Seed            int64
 }
 
 func (q *Queries) CreateCodeStep(ctx context.Context, arg CreateCodeStepParams) (int64, error) {
@@ -70,6 +131,61 @@ func (q *Queries) CreateCodeStep(ctx context.Context, arg CreateCodeStepParams)
 		arg.NextFunction,
 		arg.Script,
 		arg.DataPassthrough,
+		arg.Seed,
+	)
+	var id int64
+	err := row.Scan(&id)
+	return id, err
+}
+
+const createCodeStepLog = `-- name: CreateCodeStepLog :exec
+INSERT INTO code_step_log(code_step, function_name, stdout, logs, wall_time_ms, error, traceback, truncated) VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+`
+
+type CreateCodeStepLogParams struct {
+	CodeStep     int64
+	FunctionName string
+	Stdout       string
+	Logs         string
+	WallTimeMs   int64
+	Error        sql.NullString
+	Traceback    sql.NullString
+	Truncated    bool
+}
+
+func (q *Queries) CreateCodeStepLog(ctx context.Context, arg CreateCodeStepLogParams) error {
+	_, err := q.db.ExecContext(ctx, createCodeStepLog,
+		arg.CodeStep,
+		arg.FunctionName,
+		arg.Stdout,
+		arg.Logs,
+		arg.WallTimeMs,
+		arg.Error,
+		arg.Traceback,
+		arg.Truncated,
+	)
+	return err
+}
+
+const createCodeStepRun = `-- name: CreateCodeStepRun :one
+INSERT INTO code_step_run(code_step, command_group, run_id, status, status_message) VALUES (?, ?, ?, ?, ?) RETURNING id
+`
+
+type CreateCodeStepRunParams struct {
+	CodeStep      int64
+	CommandGroup  int64
+	RunID         int64
+	Status        string
+	StatusMessage string
+}
+
+func (q *Queries) CreateCodeStepRun(ctx context.Context, arg CreateCodeStepRunParams) (int64, error) {
+	row := q.db.QueryRowContext(ctx, createCodeStepRun,
+		arg.CodeStep,
+		arg.CommandGroup,
+		arg.RunID,
+		arg.Status,
+		arg.StatusMessage,
 	)
 	var id int64
 	err := row.Scan(&id)
@@ -85,8 +201,98 @@ func (q *Queries) CreateProject(ctx context.Context, id string) error {
 	return err
 }
 
+const createProjectWebhook = `-- name: CreateProjectWebhook :one
+INSERT INTO project_webhook(project_id, url, secret) VALUES (?, ?, ?) RETURNING id, project_id, url, secret, active, created_at
+`
+
+type CreateProjectWebhookParams struct {
+	ProjectID string
+	Url       string
+	Secret    string
+}
+
+func (q *Queries) CreateProjectWebhook(ctx context.Context, arg CreateProjectWebhookParams) (ProjectWebhook, error) {
+	row := q.db.QueryRowContext(ctx, createProjectWebhook, arg.ProjectID, arg.Url, arg.Secret)
+	var i ProjectWebhook
+	err := row.Scan(
+		&i.ID,
+		&i.ProjectID,
+		&i.Url,
+		&i.Secret,
+		&i.Active,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const createWebhookDelivery = `-- name: CreateWebhookDelivery :exec
+INSERT INTO webhook_delivery(webhook, event, payload) VALUES (?, ?, ?)
+`
+
+type CreateWebhookDeliveryParams struct {
+	Webhook int64
+	Event   string
+	Payload string
+}
+
+func (q *Queries) CreateWebhookDelivery(ctx context.Context, arg CreateWebhookDeliveryParams) error {
+	_, err := q.db.ExecContext(ctx, createWebhookDelivery, arg.Webhook, arg.Event, arg.Payload)
+	return err
+}
+
+const createWebhookDeliveryAttempt = `-- name: CreateWebhookDeliveryAttempt :exec
+INSERT INTO webhook_delivery_attempt(delivery, response_code, error, duration_ms) VALUES (?, ?, ?, ?)
+`
+
+type CreateWebhookDeliveryAttemptParams struct {
+	Delivery     int64
+	ResponseCode sql.NullInt64
+	Error        sql.NullString
+	DurationMs   int64
+}
+
+func (q *Queries) CreateWebhookDeliveryAttempt(ctx context.Context, arg CreateWebhookDeliveryAttemptParams) error {
+	_, err := q.db.ExecContext(ctx, createWebhookDeliveryAttempt, arg.Delivery, arg.ResponseCode, arg.Error, arg.DurationMs)
+	return err
+}
+
+const createWorkItem = `-- name: CreateWorkItem :exec
+INSERT INTO work_item(code_step, command_group, command_index, command_type, command, return_key) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (code_step, command_group, command_index) DO NOTHING
+`
+
+type CreateWorkItemParams struct {
+	CodeStep     int64
+	CommandGroup int64
+	CommandIndex int64
+	CommandType  string
+	Command      string
+	ReturnKey    string
+}
+
+func (q *Queries) CreateWorkItem(ctx context.Context, arg CreateWorkItemParams) error {
+	_, err := q.db.ExecContext(ctx, createWorkItem,
+		arg.CodeStep,
+		arg.CommandGroup,
+		arg.CommandIndex,
+		arg.CommandType,
+		arg.Command,
+		arg.ReturnKey,
+	)
+	return err
+}
+
+const deleteCodeStepRun = `-- name: DeleteCodeStepRun :exec
+DELETE FROM code_step_run WHERE id = ?
+`
+
+func (q *Queries) DeleteCodeStepRun(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, deleteCodeStepRun, id)
+	return err
+}
+
 const getAllStepsForCodeFromProjectHistoryID = `-- name: GetAllStepsForCodeFromProjectHistoryID :many
-SELECT cs.id, cs.code, cs.status, cs.step_comment, cs.next_function, cs.script, cs.data_passthrough, cs.data
+SELECT cs.id, cs.code, cs.status, cs.step_comment, cs.next_function, cs.script, cs.data_passthrough, cs.data, cs.seed
 FROM code_step AS cs
 JOIN code AS c ON c.id = cs.code
 WHERE c.project_message_history_id = ?
@@ -110,6 +316,7 @@ func (q *Queries) GetAllStepsForCodeFromProjectHistoryID(ctx context.Context, pr
 			&i.Script,
 			&i.DataPassthrough,
 			&i.Data,
+			&i.Seed,
 		); err != nil {
 			return nil, err
 		}
@@ -125,7 +332,7 @@ func (q *Queries) GetAllStepsForCodeFromProjectHistoryID(ctx context.Context, pr
 }
 
 const getCode = `-- name: GetCode :one
-SELECT id, project_message_history_id, code, complete FROM code WHERE id = ?
+SELECT id, project_message_history_id, code, complete, language FROM code WHERE id = ?
 `
 
 func (q *Queries) GetCode(ctx context.Context, id int64) (Code, error) {
@@ -136,12 +343,13 @@ func (q *Queries) GetCode(ctx context.Context, id int64) (Code, error) {
 		&i.ProjectMessageHistoryID,
 		&i.Code,
 		&i.Complete,
+		&i.Language,
 	)
 	return i, err
 }
 
 const getCodeStep = `-- name: GetCodeStep :one
-SELECT id, code, status, step_comment, next_function, script, data_passthrough, data FROM code_step WHERE id = ?
+SELECT id, code, status, step_comment, next_function, script, data_passthrough, data, seed FROM code_step WHERE id = ?
 `
 
 func (q *Queries) GetCodeStep(ctx context.Context, id int64) (CodeStep, error) {
@@ -156,10 +364,89 @@ func (q *Queries) GetCodeStep(ctx context.Context, id int64) (CodeStep, error) {
 		&i.Script,
 		&i.DataPassthrough,
 		&i.Data,
+		&i.Seed,
 	)
 	return i, err
 }
 
+const getCodeStepLog = `-- name: GetCodeStepLog :one
+SELECT id, code_step, function_name, stdout, logs, wall_time_ms, error, traceback, truncated, created_at FROM code_step_log WHERE code_step = ?
+`
+
+func (q *Queries) GetCodeStepLog(ctx context.Context, codeStep int64) (CodeStepLog, error) {
+	row := q.db.QueryRowContext(ctx, getCodeStepLog, codeStep)
+	var i CodeStepLog
+	err := row.Scan(
+		&i.ID,
+		&i.CodeStep,
+		&i.FunctionName,
+		&i.Stdout,
+		&i.Logs,
+		&i.WallTimeMs,
+		&i.Error,
+		&i.Traceback,
+		&i.Truncated,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getCodeStepRun = `-- name: GetCodeStepRun :one
+SELECT id, code_step, command_group, run_id, status, status_message, created_at, updated_at FROM code_step_run WHERE id = ?
+`
+
+func (q *Queries) GetCodeStepRun(ctx context.Context, id int64) (CodeStepRun, error) {
+	row := q.db.QueryRowContext(ctx, getCodeStepRun, id)
+	var i CodeStepRun
+	err := row.Scan(
+		&i.ID,
+		&i.CodeStep,
+		&i.CommandGroup,
+		&i.RunID,
+		&i.Status,
+		&i.StatusMessage,
+		&i.CreatedAt,
+		&i.UpdatedAt,
+	)
+	return i, err
+}
+
+const getCodeStepRuns = `-- name: GetCodeStepRuns :many
+SELECT id, code_step, command_group, run_id, status, status_message, created_at, updated_at FROM code_step_run WHERE code_step = ? ORDER BY command_group
+`
+
+func (q *Queries) GetCodeStepRuns(ctx context.Context, codeStep int64) ([]CodeStepRun, error) {
+	rows, err := q.db.QueryContext(ctx, getCodeStepRuns, codeStep)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CodeStepRun
+	for rows.Next() {
+		var i CodeStepRun
+		if err := rows.Scan(
+			&i.ID,
+			&i.CodeStep,
+			&i.CommandGroup,
+			&i.RunID,
+			&i.Status,
+			&i.StatusMessage,
+			&i.CreatedAt,
+			&i.UpdatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getDataForStep = `-- name: GetDataForStep :one
 SELECT data FROM code_step WHERE id = ?
 `
@@ -171,6 +458,63 @@ func (q *Queries) GetDataForStep(ctx context.Context, id int64) (sql.NullString,
 	return data, err
 }
 
+const getDueWebhookDeliveries = `-- name: GetDueWebhookDeliveries :many
+SELECT wd.id, wd.webhook, wd.event, wd.payload, wd.status, wd.attempts, wd.next_attempt_at, wd.delivered_at, wd.created_at, pw.url, pw.secret
+FROM webhook_delivery wd
+JOIN project_webhook pw ON pw.id = wd.webhook
+WHERE wd.status = 'PENDING' AND wd.next_attempt_at <= ? AND pw.active
+ORDER BY wd.id
+`
+
+type GetDueWebhookDeliveriesRow struct {
+	ID            int64
+	Webhook       int64
+	Event         string
+	Payload       string
+	Status        string
+	Attempts      int64
+	NextAttemptAt int64
+	DeliveredAt   sql.NullInt64
+	CreatedAt     int64
+	Url           string
+	Secret        string
+}
+
+func (q *Queries) GetDueWebhookDeliveries(ctx context.Context, nextAttemptAt int64) ([]GetDueWebhookDeliveriesRow, error) {
+	rows, err := q.db.QueryContext(ctx, getDueWebhookDeliveries, nextAttemptAt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetDueWebhookDeliveriesRow
+	for rows.Next() {
+		var i GetDueWebhookDeliveriesRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.Webhook,
+			&i.Event,
+			&i.Payload,
+			&i.Status,
+			&i.Attempts,
+			&i.NextAttemptAt,
+			&i.DeliveredAt,
+			&i.CreatedAt,
+			&i.Url,
+			&i.Secret,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getLastMessageForProject = `-- name: GetLastMessageForProject :one
 SELECT pmh.id, pmh.content, pmh.created_at
 FROM project_message_history AS pmh
@@ -192,8 +536,51 @@ func (q *Queries) GetLastMessageForProject(ctx context.Context, projectID string
 	return i, err
 }
 
+const getLatestStepLogsForProject = `-- name: GetLatestStepLogsForProject :many
+SELECT csl.id, csl.code_step, csl.function_name, csl.stdout, csl.logs, csl.wall_time_ms, csl.error, csl.traceback, csl.truncated, csl.created_at FROM code_step_log csl
+JOIN code_step cs ON csl.code_step = cs.id
+JOIN code c ON cs.code = c.id
+JOIN project_message_history pmh ON c.project_message_history_id = pmh.id
+WHERE pmh.project_id = ?
+ORDER BY csl.code_step DESC
+`
+
+func (q *Queries) GetLatestStepLogsForProject(ctx context.Context, projectID string) ([]CodeStepLog, error) {
+	rows, err := q.db.QueryContext(ctx, getLatestStepLogsForProject, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CodeStepLog
+	for rows.Next() {
+		var i CodeStepLog
+		if err := rows.Scan(
+			&i.ID,
+			&i.CodeStep,
+			&i.FunctionName,
+			&i.Stdout,
+			&i.Logs,
+			&i.WallTimeMs,
+			&i.Error,
+			&i.Traceback,
+			&i.Truncated,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getLatestStepsForProject = `-- name: GetLatestStepsForProject :many
-SELECT cs.id, cs.code, cs.status, cs.step_comment, cs.next_function, cs.script, cs.data_passthrough, cs.data FROM code_step cs
+SELECT cs.id, cs.code, cs.status, cs.step_comment, cs.next_function, cs.script, cs.data_passthrough, cs.data, cs.seed FROM code_step cs
 JOIN code c ON cs.code = c.id
 JOIN project_message_history pmh ON c.project_message_history_id = pmh.id
 WHERE pmh.project_id = ? 
@@ -218,6 +605,7 @@ func (q *Queries) GetLatestStepsForProject(ctx context.Context, projectID string
 			&i.Script,
 			&i.DataPassthrough,
 			&i.Data,
+			&i.Seed,
 		); err != nil {
 			return nil, err
 		}
@@ -248,6 +636,90 @@ func (q *Queries) GetMessageHistoryByID(ctx context.Context, id int64) (ProjectM
 	return i, err
 }
 
+const getNextWebhookAttempt = `-- name: GetNextWebhookAttempt :one
+SELECT wd.next_attempt_at
+FROM webhook_delivery wd
+JOIN project_webhook pw ON pw.id = wd.webhook
+WHERE wd.status = 'PENDING' AND pw.active
+ORDER BY wd.next_attempt_at
+LIMIT 1
+`
+
+func (q *Queries) GetNextWebhookAttempt(ctx context.Context) (int64, error) {
+	row := q.db.QueryRowContext(ctx, getNextWebhookAttempt)
+	var next_attempt_at int64
+	err := row.Scan(&next_attempt_at)
+	return next_attempt_at, err
+}
+
+const getOpenWorkItems = `-- name: GetOpenWorkItems :many
+SELECT wi.id, wi.code_step, wi.command_group, wi.command_index, wi.command_type, wi.command, wi.return_key, wi.assignee, wi.claimed_by, wi.claimed_at, wi.due_at, wi.result, wi.completed_at, wi.created_at, pmh.project_id
+FROM work_item wi
+JOIN code_step cs ON cs.id = wi.code_step
+JOIN code c ON c.id = cs.code
+JOIN project_message_history pmh ON pmh.id = c.project_message_history_id
+WHERE wi.completed_at IS NULL
+AND NOT EXISTS (SELECT 1 FROM code_step later WHERE later.code = cs.code AND later.id > cs.id)
+ORDER BY wi.due_at IS NULL, wi.due_at, wi.id
+`
+
+type GetOpenWorkItemsRow struct {
+	ID           int64
+	CodeStep     int64
+	CommandGroup int64
+	CommandIndex int64
+	CommandType  string
+	Command      string
+	ReturnKey    string
+	Assignee     sql.NullString
+	ClaimedBy    sql.NullString
+	ClaimedAt    sql.NullInt64
+	DueAt        sql.NullInt64
+	Result       sql.NullString
+	CompletedAt  sql.NullInt64
+	CreatedAt    int64
+	ProjectID    string
+}
+
+func (q *Queries) GetOpenWorkItems(ctx context.Context) ([]GetOpenWorkItemsRow, error) {
+	rows, err := q.db.QueryContext(ctx, getOpenWorkItems)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []GetOpenWorkItemsRow
+	for rows.Next() {
+		var i GetOpenWorkItemsRow
+		if err := rows.Scan(
+			&i.ID,
+			&i.CodeStep,
+			&i.CommandGroup,
+			&i.CommandIndex,
+			&i.CommandType,
+			&i.Command,
+			&i.ReturnKey,
+			&i.Assignee,
+			&i.ClaimedBy,
+			&i.ClaimedAt,
+			&i.DueAt,
+			&i.Result,
+			&i.CompletedAt,
+			&i.CreatedAt,
+			&i.ProjectID,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
 const getProjectByID = `-- name: GetProjectByID :one
 SELECT id, created_at FROM project WHERE id = ?
 `
@@ -259,6 +731,478 @@ func (q *Queries) GetProjectByID(ctx context.Context, id string) (Project, error
 	return i, err
 }
 
+const getProjectWebhook = `-- name: GetProjectWebhook :one
+SELECT id, project_id, url, secret, active, created_at FROM project_webhook WHERE id = ? AND project_id = ?
+`
+
+type GetProjectWebhookParams struct {
+	ID        int64
+	ProjectID string
+}
+
+func (q *Queries) GetProjectWebhook(ctx context.Context, arg GetProjectWebhookParams) (ProjectWebhook, error) {
+	row := q.db.QueryRowContext(ctx, getProjectWebhook, arg.ID, arg.ProjectID)
+	var i ProjectWebhook
+	err := row.Scan(
+		&i.ID,
+		&i.ProjectID,
+		&i.Url,
+		&i.Secret,
+		&i.Active,
+		&i.CreatedAt,
+	)
+	return i, err
+}
+
+const getProjectWebhooks = `-- name: GetProjectWebhooks :many
+SELECT id, project_id, url, secret, active, created_at FROM project_webhook WHERE project_id = ? AND active ORDER BY id
+`
+
+func (q *Queries) GetProjectWebhooks(ctx context.Context, projectID string) ([]ProjectWebhook, error) {
+	rows, err := q.db.QueryContext(ctx, getProjectWebhooks, projectID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ProjectWebhook
+	for rows.Next() {
+		var i ProjectWebhook
+		if err := rows.Scan(
+			&i.ID,
+			&i.ProjectID,
+			&i.Url,
+			&i.Secret,
+			&i.Active,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getReadySteps = `-- name: GetReadySteps :many
+SELECT cs.id, cs.code, cs.status, cs.step_comment, cs.next_function, cs.script, cs.data_passthrough, cs.data, cs.seed FROM code_step cs
+WHERE cs.status = 2 AND cs.data IS NOT NULL
+AND NOT EXISTS (SELECT 1 FROM code_step later WHERE later.code = cs.code AND later.id > cs.id)
+AND (SELECT COUNT(*) FROM code_step_run run WHERE run.code_step = cs.id AND run.status = 'COMPLETED') >= COALESCE(json_array_length(cs.script, '$.commands'), 0)
+ORDER BY cs.id
+`
+
+func (q *Queries) GetReadySteps(ctx context.Context) ([]CodeStep, error) {
+	rows, err := q.db.QueryContext(ctx, getReadySteps)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CodeStep
+	for rows.Next() {
+		var i CodeStep
+		if err := rows.Scan(
+			&i.ID,
+			&i.Code,
+			&i.Status,
+			&i.StepComment,
+			&i.NextFunction,
+			&i.Script,
+			&i.DataPassthrough,
+			&i.Data,
+			&i.Seed,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getStepsForCode = `-- name: GetStepsForCode :many
+SELECT id, code, status, step_comment, next_function, script, data_passthrough, data, seed FROM code_step WHERE code = ? ORDER BY id
+`
+
+func (q *Queries) GetStepsForCode(ctx context.Context, code int64) ([]CodeStep, error) {
+	rows, err := q.db.QueryContext(ctx, getStepsForCode, code)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CodeStep
+	for rows.Next() {
+		var i CodeStep
+		if err := rows.Scan(
+			&i.ID,
+			&i.Code,
+			&i.Status,
+			&i.StepComment,
+			&i.NextFunction,
+			&i.Script,
+			&i.DataPassthrough,
+			&i.Data,
+			&i.Seed,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getStepsToDispatch = `-- name: GetStepsToDispatch :many
+SELECT cs.id, cs.code, cs.status, cs.step_comment, cs.next_function, cs.script, cs.data_passthrough, cs.data, cs.seed FROM code_step cs
+WHERE (NOT EXISTS (SELECT 1 FROM code_step later WHERE later.code = cs.code AND later.id > cs.id) AND (
+	cs.status IN (2, 3)
+	OR (cs.script NOT IN ('', 'null')
+		AND NOT EXISTS (SELECT 1 FROM code_step_run run WHERE run.code_step = cs.id AND run.status = 'FAILED')
+		AND (SELECT COUNT(*) FROM code_step_run run WHERE run.code_step = cs.id AND run.status = 'COMPLETED') < COALESCE(json_array_length(cs.script, '$.commands'), 0))))
+OR EXISTS (SELECT 1 FROM code_step_run run WHERE run.code_step = cs.id AND run.status = 'RUNNING')
+ORDER BY cs.id
+`
+
+func (q *Queries) GetStepsToDispatch(ctx context.Context) ([]CodeStep, error) {
+	rows, err := q.db.QueryContext(ctx, getStepsToDispatch)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []CodeStep
+	for rows.Next() {
+		var i CodeStep
+		if err := rows.Scan(
+			&i.ID,
+			&i.Code,
+			&i.Status,
+			&i.StepComment,
+			&i.NextFunction,
+			&i.Script,
+			&i.DataPassthrough,
+			&i.Data,
+			&i.Seed,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getWebhookDeliveries = `-- name: GetWebhookDeliveries :many
+SELECT id, webhook, event, payload, status, attempts, next_attempt_at, delivered_at, created_at FROM webhook_delivery WHERE webhook = ? ORDER BY id DESC
+`
+
+func (q *Queries) GetWebhookDeliveries(ctx context.Context, webhook int64) ([]WebhookDelivery, error) {
+	rows, err := q.db.QueryContext(ctx, getWebhookDeliveries, webhook)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WebhookDelivery
+	for rows.Next() {
+		var i WebhookDelivery
+		if err := rows.Scan(
+			&i.ID,
+			&i.Webhook,
+			&i.Event,
+			&i.Payload,
+			&i.Status,
+			&i.Attempts,
+			&i.NextAttemptAt,
+			&i.DeliveredAt,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getWebhookDeliveryAttempts = `-- name: GetWebhookDeliveryAttempts :many
+SELECT id, delivery, response_code, error, duration_ms, created_at FROM webhook_delivery_attempt WHERE delivery = ? ORDER BY id
+`
+
+func (q *Queries) GetWebhookDeliveryAttempts(ctx context.Context, delivery int64) ([]WebhookDeliveryAttempt, error) {
+	rows, err := q.db.QueryContext(ctx, getWebhookDeliveryAttempts, delivery)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WebhookDeliveryAttempt
+	for rows.Next() {
+		var i WebhookDeliveryAttempt
+		if err := rows.Scan(
+			&i.ID,
+			&i.Delivery,
+			&i.ResponseCode,
+			&i.Error,
+			&i.DurationMs,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getWebhooksForCode = `-- name: GetWebhooksForCode :many
+SELECT pw.id, pw.project_id, pw.url, pw.secret, pw.active, pw.created_at
+FROM project_webhook pw
+JOIN project_message_history pmh ON pmh.project_id = pw.project_id
+JOIN code c ON c.project_message_history_id = pmh.id
+WHERE c.id = ? AND pw.active
+ORDER BY pw.id
+`
+
+func (q *Queries) GetWebhooksForCode(ctx context.Context, id int64) ([]ProjectWebhook, error) {
+	rows, err := q.db.QueryContext(ctx, getWebhooksForCode, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []ProjectWebhook
+	for rows.Next() {
+		var i ProjectWebhook
+		if err := rows.Scan(
+			&i.ID,
+			&i.ProjectID,
+			&i.Url,
+			&i.Secret,
+			&i.Active,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const getWorkItem = `-- name: GetWorkItem :one
+SELECT wi.id, wi.code_step, wi.command_group, wi.command_index, wi.command_type, wi.command, wi.return_key, wi.assignee, wi.claimed_by, wi.claimed_at, wi.due_at, wi.result, wi.completed_at, wi.created_at, pmh.project_id
+FROM work_item wi
+JOIN code_step cs ON cs.id = wi.code_step
+JOIN code c ON c.id = cs.code
+JOIN project_message_history pmh ON pmh.id = c.project_message_history_id
+WHERE wi.id = ?
+`
+
+type GetWorkItemRow struct {
+	ID           int64
+	CodeStep     int64
+	CommandGroup int64
+	CommandIndex int64
+	CommandType  string
+	Command      string
+	ReturnKey    string
+	Assignee     sql.NullString
+	ClaimedBy    sql.NullString
+	ClaimedAt    sql.NullInt64
+	DueAt        sql.NullInt64
+	Result       sql.NullString
+	CompletedAt  sql.NullInt64
+	CreatedAt    int64
+	ProjectID    string
+}
+
+func (q *Queries) GetWorkItem(ctx context.Context, id int64) (GetWorkItemRow, error) {
+	row := q.db.QueryRowContext(ctx, getWorkItem, id)
+	var i GetWorkItemRow
+	err := row.Scan(
+		&i.ID,
+		&i.CodeStep,
+		&i.CommandGroup,
+		&i.CommandIndex,
+		&i.CommandType,
+		&i.Command,
+		&i.ReturnKey,
+		&i.Assignee,
+		&i.ClaimedBy,
+		&i.ClaimedAt,
+		&i.DueAt,
+		&i.Result,
+		&i.CompletedAt,
+		&i.CreatedAt,
+		&i.ProjectID,
+	)
+	return i, err
+}
+
+const getWorkItemsForGroup = `-- name: GetWorkItemsForGroup :many
+SELECT id, code_step, command_group, command_index, command_type, command, return_key, assignee, claimed_by, claimed_at, due_at, result, completed_at, created_at FROM work_item WHERE code_step = ? AND command_group = ? ORDER BY command_index
+`
+
+type GetWorkItemsForGroupParams struct {
+	CodeStep     int64
+	CommandGroup int64
+}
+
+func (q *Queries) GetWorkItemsForGroup(ctx context.Context, arg GetWorkItemsForGroupParams) ([]WorkItem, error) {
+	rows, err := q.db.QueryContext(ctx, getWorkItemsForGroup, arg.CodeStep, arg.CommandGroup)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var items []WorkItem
+	for rows.Next() {
+		var i WorkItem
+		if err := rows.Scan(
+			&i.ID,
+			&i.CodeStep,
+			&i.CommandGroup,
+			&i.CommandIndex,
+			&i.CommandType,
+			&i.Command,
+			&i.ReturnKey,
+			&i.Assignee,
+			&i.ClaimedBy,
+			&i.ClaimedAt,
+			&i.DueAt,
+			&i.Result,
+			&i.CompletedAt,
+			&i.CreatedAt,
+		); err != nil {
+			return nil, err
+		}
+		items = append(items, i)
+	}
+	if err := rows.Close(); err != nil {
+		return nil, err
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return items, nil
+}
+
+const removeProjectWebhook = `-- name: RemoveProjectWebhook :execrows
+UPDATE project_webhook SET active = FALSE WHERE id = ? AND project_id = ? AND active
+`
+
+type RemoveProjectWebhookParams struct {
+	ID        int64
+	ProjectID string
+}
+
+func (q *Queries) RemoveProjectWebhook(ctx context.Context, arg RemoveProjectWebhookParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, removeProjectWebhook, arg.ID, arg.ProjectID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+const setWorkItemAssignee = `-- name: SetWorkItemAssignee :exec
+UPDATE work_item SET assignee = ? WHERE id = ?
+`
+
+type SetWorkItemAssigneeParams struct {
+	Assignee sql.NullString
+	ID       int64
+}
+
+func (q *Queries) SetWorkItemAssignee(ctx context.Context, arg SetWorkItemAssigneeParams) error {
+	_, err := q.db.ExecContext(ctx, setWorkItemAssignee, arg.Assignee, arg.ID)
+	return err
+}
+
+const setWorkItemDue = `-- name: SetWorkItemDue :exec
+UPDATE work_item SET due_at = ? WHERE id = ?
+`
+
+type SetWorkItemDueParams struct {
+	DueAt sql.NullInt64
+	ID    int64
+}
+
+func (q *Queries) SetWorkItemDue(ctx context.Context, arg SetWorkItemDueParams) error {
+	_, err := q.db.ExecContext(ctx, setWorkItemDue, arg.DueAt, arg.ID)
+	return err
+}
+
+const unclaimWorkItem = `-- name: UnclaimWorkItem :exec
+UPDATE work_item SET claimed_by = NULL, claimed_at = NULL WHERE id = ?
+`
+
+func (q *Queries) UnclaimWorkItem(ctx context.Context, id int64) error {
+	_, err := q.db.ExecContext(ctx, unclaimWorkItem, id)
+	return err
+}
+
+const updateCodeStepRun = `-- name: UpdateCodeStepRun :exec
+UPDATE code_step_run SET status = ?, status_message = ?, updated_at = unixepoch() WHERE id = ?
+`
+
+type UpdateCodeStepRunParams struct {
+	Status        string
+	StatusMessage string
+	ID            int64
+}
+
+func (q *Queries) UpdateCodeStepRun(ctx context.Context, arg UpdateCodeStepRunParams) error {
+	_, err := q.db.ExecContext(ctx, updateCodeStepRun, arg.Status, arg.StatusMessage, arg.ID)
+	return err
+}
+
+const updatePendingStepData = `-- name: UpdatePendingStepData :execrows
+UPDATE code_step SET data = ? WHERE id = ? AND status = 2 AND data IS NULL
+`
+
+type UpdatePendingStepDataParams struct {
+	Data sql.NullString
+	ID   int64
+}
+
+func (q *Queries) UpdatePendingStepData(ctx context.Context, arg UpdatePendingStepDataParams) (int64, error) {
+	result, err := q.db.ExecContext(ctx, updatePendingStepData, arg.Data, arg.ID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
 const updateStepData = `-- name: UpdateStepData :exec
 UPDATE code_step SET data = ? WHERE id = ?
 `
@@ -286,3 +1230,20 @@ func (q *Queries) UpdateStepStatus(ctx context.Context, arg UpdateStepStatusPara
 	_, err := q.db.ExecContext(ctx, updateStepStatus, arg.Status, arg.ID)
 	return err
 }
+
+const updateWebhookDelivery = `-- name: UpdateWebhookDelivery :exec
+UPDATE webhook_delivery SET status = ?, attempts = ?, next_attempt_at = ?, delivered_at = ? WHERE id = ?
+`
+
+type UpdateWebhookDeliveryParams struct {
+	Status        string
+	Attempts      int64
+	NextAttemptAt int64
+	DeliveredAt   sql.NullInt64
+	ID            int64
+}
+
+func (q *Queries) UpdateWebhookDelivery(ctx context.Context, arg UpdateWebhookDeliveryParams) error {
+	_, err := q.db.ExecContext(ctx, updateWebhookDelivery, arg.Status, arg.Attempts, arg.NextAttemptAt, arg.DeliveredAt, arg.ID)
+	return err
+}
@@ -0,0 +1,340 @@
+package autodemo
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+/******************************************************************************
+
+Dispatcher
+
+The dispatcher hands the command groups of each open step's script to their
+executors, one group at a time and in order, since each group carries on from
+where the one before it left the lab. Like the engine, it keeps no state of
+its own: every run it starts is recorded in code_step_run, so after a restart
+it picks up runs which were RUNNING, skips groups which have COMPLETED, and
+never restarts a group which FAILED. A failed run holds its step until someone
+deals with it, and is sent to the project's webhooks as step.failed. Once the
+lab is set right, POST /runs/{runID}/retry clears the failed run, and the
+group is started again.
+
+Once every group of a step has completed, the step is continued: a step with
+status 3 straight away, and a step with status 2 once its data is all in. The
+last step of a protocol, with status 0 or 1, may still hand over a script,
+such as one homing the robot; it is executed the same way, but there is
+nothing to continue afterwards.
+
+******************************************************************************/
+
+// Dispatcher executes the command groups of steps as they are recorded.
+type Dispatcher struct {
+	runner *ProtocolRunner
+	db     *sql.DB
+	wake   chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	// PollInterval is how often runs are checked on while any are RUNNING,
+	// and how soon failures to dispatch are retried.
+	PollInterval time.Duration
+
+	// OnRunFailed, if set, is called after a run is recorded as FAILED, such
+	// as to nudge the webhook sender. Set it before calling Start.
+	OnRunFailed func()
+}
+
+// NewDispatcher creates a dispatcher executing groups with runner's executors,
+// recording runs and continuing steps with runner, and reading steps from db.
+func NewDispatcher(runner *ProtocolRunner, db *sql.DB) *Dispatcher {
+	return &Dispatcher{
+		runner:       runner,
+		db:           db,
+		wake:         make(chan struct{}, 1),
+		done:         make(chan struct{}),
+		PollInterval: 5 * time.Second,
+	}
+}
+
+// Start dispatches every open step, then does so again whenever Notify is
+// called, until ctx is cancelled or Stop is called. While runs are going, or
+// dispatching fails, it does so every PollInterval too.
+func (d *Dispatcher) Start(ctx context.Context) {
+	ctx, d.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(d.done)
+		for {
+			var poll <-chan time.Time
+			if d.dispatchAll(ctx) {
+				poll = time.After(d.PollInterval)
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-d.wake:
+			case <-poll:
+			}
+		}
+	}()
+}
+
+// Notify tells the dispatcher that a step has been recorded.
+func (d *Dispatcher) Notify() {
+	select {
+	case d.wake <- struct{}{}:
+	default:
+		// A wake up is already pending, which will see this step too.
+	}
+}
+
+// Stop stops the dispatcher, waiting for the step being dispatched to finish.
+// Runs carry on, and are picked up again on the next start.
+func (d *Dispatcher) Stop() {
+	if d.cancel == nil {
+		return
+	}
+	d.cancel()
+	<-d.done
+}
+
+// dispatchAll dispatches every open step, and every step with a run going,
+// oldest first. It reports whether any run is still going or any step failed
+// to dispatch, so that it should be called again soon.
+func (d *Dispatcher) dispatchAll(ctx context.Context) bool {
+	steps, err := autodemosql.New(d.db).GetStepsToDispatch(ctx)
+	if err != nil {
+		log.Printf("Failed to get steps to dispatch: %v", err)
+		return true
+	}
+	again := false
+	for _, step := range steps {
+		if ctx.Err() != nil {
+			return again
+		}
+		running, err := d.DispatchStep(ctx, step)
+		if err != nil {
+			log.Printf("Error dispatching step %d: %v", step.ID, err)
+		}
+		again = again || running || err != nil
+	}
+	return again
+}
+
+// DispatchStep moves a step's groups along: it checks on the run of the
+// group being executed and, once that run completes, starts the next group.
+// When every group has completed, it continues the protocol. It reports
+// whether a run is still going. Steps which have already been continued only
+// have their runs checked on.
+func (d *Dispatcher) DispatchStep(ctx context.Context, step autodemosql.CodeStep) (bool, error) {
+	if step.Script == "" || step.Script == "null" {
+		return false, nil
+	}
+	var script libb.Script
+	if err := json.Unmarshal([]byte(step.Script), &script); err != nil {
+		return false, fmt.Errorf("failed to parse script: %v", err)
+	}
+	queries := autodemosql.New(d.db)
+	later, err := queries.CountStepsAfter(ctx, autodemosql.CountStepsAfterParams{Code: step.Code, ID: step.ID})
+	if err != nil {
+		return false, fmt.Errorf("failed to count later steps: %v", err)
+	}
+	open := later == 0
+	runs, err := queries.GetCodeStepRuns(ctx, step.ID)
+	if err != nil {
+		return false, fmt.Errorf("failed to get runs: %v", err)
+	}
+	runByGroup := make(map[int64]autodemosql.CodeStepRun, len(runs))
+	for _, run := range runs {
+		runByGroup[run.CommandGroup] = run
+	}
+
+	for i, group := range script.Commands {
+		executor, ok := d.runner.Executors[group.CommandType]
+		if !ok {
+			return false, fmt.Errorf("no executor for command_type %q", group.CommandType)
+		}
+		job := Job{Step: step, Script: &script, Index: i, Group: group}
+		run, started := runByGroup[int64(i)]
+		switch {
+		case !started && !open:
+			return false, nil
+		case !started:
+			runID, err := executor.Start(ctx, job)
+			if errors.Is(err, ErrExecutorBusy) {
+				return true, nil
+			}
+			if err != nil {
+				// Anything but a busy executor, such as a robot rejecting the
+				// group, fails the run rather than being retried forever.
+				_, err = d.createRun(step.ID, int64(i), 0, Progress{Status: RunFailed, Message: err.Error()})
+				return false, err
+			}
+			run, err = d.createRun(step.ID, int64(i), runID, Progress{Status: RunRunning})
+			if err != nil {
+				return false, err
+			}
+		case run.Status == RunCompleted:
+			continue
+		case run.Status == RunFailed:
+			return false, nil
+		}
+
+		progress, err := executor.Progress(ctx, job, run.RunID)
+		if err != nil {
+			return true, fmt.Errorf("failed to get progress of command group %d: %v", i, err)
+		}
+		if err := d.recordProgress(ctx, step.ID, run, progress); err != nil {
+			return true, err
+		}
+		if progress.Status != RunCompleted {
+			return progress.Status == RunRunning, nil
+		}
+	}
+
+	if !open || (step.Status != int64(libb.StatusContinue) && step.Status != int64(libb.StatusContinueNoData)) {
+		return false, nil
+	}
+	// The engine, or another dispatch, may have continued the step already,
+	// and a step with status 2 may still be waiting on uploads.
+	err = d.runner.ContinueStep(ctx, step.ID)
+	if errors.Is(err, ErrStepAdvanced) || errors.Is(err, ErrStepIncomplete) {
+		return false, nil
+	}
+	return false, err
+}
+
+// createRun records a run which has just started, as RUNNING, or which failed
+// to start, as FAILED. A restart between starting a run and recording it
+// starts the group again.
+func (d *Dispatcher) createRun(stepID, commandGroup, runID int64, progress Progress) (autodemosql.CodeStepRun, error) {
+	run := autodemosql.CodeStepRun{
+		CodeStep:      stepID,
+		CommandGroup:  commandGroup,
+		RunID:         runID,
+		Status:        progress.Status,
+		StatusMessage: progress.Message,
+	}
+	failed := run.Status == RunFailed
+	err := d.runner.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		var err error
+		run.ID, err = queries.CreateCodeStepRun(ctx, autodemosql.CreateCodeStepRunParams{
+			CodeStep:      run.CodeStep,
+			CommandGroup:  run.CommandGroup,
+			RunID:         run.RunID,
+			Status:        run.Status,
+			StatusMessage: run.StatusMessage,
+		})
+		if err != nil || !failed {
+			return err
+		}
+		return queueRunFailedEvent(queries, ctx, stepID, run)
+	})
+	if err != nil {
+		return run, fmt.Errorf("failed to record run of command group %d: %v", commandGroup, err)
+	}
+	if failed && d.OnRunFailed != nil {
+		d.OnRunFailed()
+	}
+	return run, nil
+}
+
+// recordProgress records how far a run has got, if that has changed, after
+// merging the results it yielded into the step's data.
+func (d *Dispatcher) recordProgress(ctx context.Context, stepID int64, run autodemosql.CodeStepRun, progress Progress) error {
+	if progress.Status == run.Status && progress.Message == run.StatusMessage {
+		return nil
+	}
+	if progress.Status == RunCompleted {
+		for returnKey, result := range progress.Data {
+			// Results merged before a restart are merged again after it, and
+			// steps which have moved on have no use for results.
+			err := d.runner.db.MergeData(ctx, stepID, returnKey, result)
+			if err != nil && !errors.Is(err, ErrResultUploaded) && !errors.Is(err, ErrStepNotPending) {
+				return fmt.Errorf("failed to merge result for %q: %v", returnKey, err)
+			}
+		}
+	}
+	failed := progress.Status == RunFailed && run.Status != RunFailed
+	err := d.runner.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		err := queries.UpdateCodeStepRun(ctx, autodemosql.UpdateCodeStepRunParams{
+			Status:        progress.Status,
+			StatusMessage: progress.Message,
+			ID:            run.ID,
+		})
+		if err != nil || !failed {
+			return err
+		}
+		run.Status, run.StatusMessage = progress.Status, progress.Message
+		return queueRunFailedEvent(queries, ctx, stepID, run)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record progress of command group %d: %v", run.CommandGroup, err)
+	}
+	if failed && d.OnRunFailed != nil {
+		d.OnRunFailed()
+	}
+	return nil
+}
+
+/******************************************************************************
+
+Retrying failed runs
+
+******************************************************************************/
+
+// ErrRunNotFailed is returned when retrying a run which hasn't failed.
+var ErrRunNotFailed = errors.New("run has not failed")
+
+// RetryRun clears a failed run, so that the dispatcher starts its group again.
+func (w *WriteDB) RetryRun(ctx context.Context, id int64) error {
+	return w.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		run, err := queries.GetCodeStepRun(ctx, id)
+		if err != nil {
+			return err
+		}
+		if run.Status != RunFailed {
+			return ErrRunNotFailed
+		}
+		return queries.DeleteCodeStepRun(ctx, id)
+	})
+}
+
+// RetryRunHandler retries a failed run of a command group, once whatever made
+// it fail has been dealt with.
+func (app *App) RetryRunHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("runID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid run ID", http.StatusBadRequest)
+		return
+	}
+	err = app.WDB.RetryRun(r.Context(), id)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Run not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrRunNotFailed):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if app.Dispatcher != nil {
+		app.Dispatcher.Notify()
+	}
+	w.WriteHeader(http.StatusOK)
+}
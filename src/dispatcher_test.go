@@ -0,0 +1,461 @@
+package autodemo
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
+	"github.com/koeng101/autodemo/src/ot2"
+)
+
+// robotProtocol runs the opentrons group of the example protocol, then, with
+// human set, waits on its human group.
+const robotProtocol = `
+function main()
+	if HUMAN then
+		return libB.status.CONTINUE, "PCR, then quantify", "next", libB.generate_protocol(), ""
+	end
+	local script = libB.json.decode(libB.generate_protocol())
+	script.commands = {script.commands[1]}
+	return libB.status.CONTINUE_NO_DATA, "PCR", "next", libB.json.encode(script), ""
+end
+
+function next()
+	return libB.status.SUCCESS, "Done", "", nil, ""
+end
+`
+
+// awaitRobotProtocol awaits a script for the robot alone, which returns
+// nothing.
+const awaitRobotProtocol = `
+function main()
+	local pcr = libB.Script.new("pcr")
+	pcr:add_commands(libB.OpentronsCommands.new():home())
+	local result = libB.await(pcr)
+	return libB.status.SUCCESS, "PCR done with " .. #libB.json.encode(result) .. " bytes of results", "", nil, ""
+end
+`
+
+// homeProtocol finishes straight away, handing over a script to home the
+// robot, like the example in LuaPrompt.
+const homeProtocol = `
+function main()
+	local script = libB.Script.new("home")
+	local commands = libB.OpentronsCommands.new()
+	commands:home()
+	script:add_commands(commands)
+	return { status = libB.status.SUCCESS, comment = "Homing the robot", script = script }
+end
+`
+
+// waitForRun waits until the run of a step's command group has status, and
+// its executor's message has been recorded, and returns it.
+func waitForRun(t *testing.T, queries *autodemosql.Queries, stepID, commandGroup int64, status string) autodemosql.CodeStepRun {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		runs, err := queries.GetCodeStepRuns(context.Background(), stepID)
+		if err != nil {
+			t.Fatalf("Failed to get runs: %v", err)
+		}
+		for _, run := range runs {
+			if run.CommandGroup == commandGroup && run.Status == status && run.StatusMessage != "" {
+				return run
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for a %s run of group %d, got %+v", status, commandGroup, runs)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatchToRobot(t *testing.T) {
+	dbPath := "test_robot.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	fake := ot2.NewFakeRobot()
+	defer fake.Close()
+	fake.PollsToComplete = 2
+	client := ot2.NewClient(fake.URL)
+	client.PollInterval = time.Millisecond
+
+	runner := NewProtocolRunner(wdb)
+	runner.Executors["opentrons"] = NewRobotExecutor(client)
+	dispatcher := NewDispatcher(runner, db)
+	dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = dispatcher.Notify
+	dispatcher.Start(ctx)
+	defer dispatcher.Stop()
+	queries := autodemosql.New(db)
+	start := func(code string) int64 {
+		t.Helper()
+		historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+		if err != nil {
+			t.Fatalf("Failed to create message history: %v", err)
+		}
+		if err := runner.StartProtocol(ctx, historyID, code); err != nil {
+			t.Fatalf("Failed to start protocol: %v", err)
+		}
+		return historyID
+	}
+
+	// A step with status 3 continues once its group has run on the robot.
+	historyID := start(robotProtocol)
+	steps := waitForSteps(t, queries, historyID, 2)
+	if run := waitForRun(t, queries, steps[0].ID, 0, RunCompleted); run.RunID != 1 || run.StatusMessage != "Completed protocol successfully." {
+		t.Errorf("Expected robot run 1 to complete, got %+v", run)
+	}
+	if steps[1].Status != int64(libb.StatusSuccess) || steps[1].StepComment != "Done" {
+		t.Errorf("Expected the protocol to finish, got status %d: %s", steps[1].Status, steps[1].StepComment)
+	}
+
+	// The robot runs opentrons groups, and people the rest.
+	historyID = start("HUMAN = true\n" + robotProtocol)
+	steps = waitForSteps(t, queries, historyID, 1)
+	waitForRun(t, queries, steps[0].ID, 0, RunCompleted)
+	if run := waitForRun(t, queries, steps[0].ID, 1, RunRunning); run.StatusMessage != "Waiting for b6885800-f454-4f19-9c60-ff725aa2d51a" {
+		t.Errorf("Expected the human group to wait for its result, got %+v", run)
+	}
+	if groups := fake.Groups(); len(groups) != 2 || groups[1].CommandType != "opentrons" {
+		t.Errorf("Expected the robot to run 2 opentrons groups, got %+v", groups)
+	}
+
+	// A failed run is recorded with its message, holds the protocol, and is
+	// queued for the project's webhooks.
+	webhook := registerWebhook(t, &App{DB: db, WDB: wdb}, "test-project-1", `{"url": "http://localhost/hook", "secret": "shh"}`)
+	fake.Fail = func(libb.CommandGroup) error { return errors.New("tip not found") }
+	historyID = start(robotProtocol)
+	steps = waitForSteps(t, queries, historyID, 1)
+	if run := waitForRun(t, queries, steps[0].ID, 0, RunFailed); run.StatusMessage != "tip not found" {
+		t.Errorf("Expected the run to fail with its message, got %+v", run)
+	}
+	var deliveries []autodemosql.WebhookDelivery
+	err := wdb.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		var err error
+		deliveries, err = queries.GetWebhookDeliveries(ctx, webhook.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to get webhook deliveries: %v", err)
+	}
+	var failed []WebhookEvent
+	for _, delivery := range deliveries {
+		var event WebhookEvent
+		if err := json.Unmarshal([]byte(delivery.Payload), &event); err != nil {
+			t.Fatalf("Failed to parse delivery: %v", err)
+		}
+		if delivery.Event == EventStepFailed {
+			failed = append(failed, event)
+		}
+	}
+	if len(failed) != 1 || failed[0].Step.ID != steps[0].ID || failed[0].Run == nil || failed[0].Run.Status != RunFailed || failed[0].Run.StatusMessage != "tip not found" {
+		t.Errorf("Expected a step.failed delivery of the failed run, got %+v", failed)
+	}
+	// Failed groups aren't resubmitted.
+	dispatcher.Notify()
+	time.Sleep(50 * time.Millisecond)
+	if groups := fake.Groups(); len(groups) != 3 {
+		t.Errorf("Expected the failed group not to be resubmitted, got %d runs", len(groups))
+	}
+	if steps := waitForSteps(t, queries, historyID, 1); len(steps) != 1 {
+		t.Errorf("Expected the protocol to stop at its first step, got %d steps", len(steps))
+	}
+
+	// A robot-only script awaited by main continues once it has run, and main
+	// replays with an empty result.
+	fake.Fail = nil
+	historyID = start(awaitRobotProtocol)
+	steps = waitForSteps(t, queries, historyID, 2)
+	if steps[0].Status != int64(libb.StatusContinueNoData) || steps[0].NextFunction != libb.AwaitFunction || steps[0].StepComment != "Waiting for script pcr to run" {
+		t.Errorf("Expected main to wait on the robot, got %+v", steps[0])
+	}
+	waitForRun(t, queries, steps[0].ID, 0, RunCompleted)
+	if steps[1].Status != int64(libb.StatusSuccess) || steps[1].StepComment != "PCR done with 2 bytes of results" {
+		t.Errorf("Expected the protocol to finish, got status %d: %s", steps[1].Status, steps[1].StepComment)
+	}
+	if state, err := runner.ReplayStep(ctx, steps[1].ID); err != nil || state.Comments != steps[1].StepComment {
+		t.Errorf("Expected the last step to replay, got %+v, %v", state, err)
+	}
+
+	// A protocol which finishes with a script, like homing the robot, still
+	// has it run.
+	historyID = start(homeProtocol)
+	steps = waitForSteps(t, queries, historyID, 1)
+	if run := waitForRun(t, queries, steps[0].ID, 0, RunCompleted); run.StatusMessage != "Completed protocol successfully." {
+		t.Errorf("Expected the final script to run, got %+v", run)
+	}
+	if groups := fake.Groups(); len(groups) != 5 || groups[4].Payload[0].Kind() != "home" {
+		t.Errorf("Expected the robot to home, got %+v", groups)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if steps := waitForSteps(t, queries, historyID, 1); len(steps) != 1 || steps[0].Status != int64(libb.StatusSuccess) {
+		t.Errorf("Expected the protocol to stay finished, got %+v", steps)
+	}
+	if groups := fake.Groups(); len(groups) != 5 {
+		t.Errorf("Expected the final script to run once, got %d runs", len(groups))
+	}
+}
+
+// rejectExecutor refuses to start any group, like a robot rejecting a
+// protocol it can't run.
+type rejectExecutor struct {
+	starts atomic.Int64
+}
+
+func (e *rejectExecutor) Start(ctx context.Context, job Job) (int64, error) {
+	e.starts.Add(1)
+	return 0, errors.New("protocol rejected")
+}
+
+func (e *rejectExecutor) Progress(ctx context.Context, job Job, runID int64) (Progress, error) {
+	return Progress{}, errors.New("never started")
+}
+
+// TestDispatchStartFailure checks that a group its executor refuses to start
+// fails its run, rather than being started again on every poll.
+func TestDispatchStartFailure(t *testing.T) {
+	dbPath := "test_robot_reject.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	webhook := registerWebhook(t, &App{DB: db, WDB: wdb}, "test-project-1", `{"url": "http://localhost/hook", "secret": "shh"}`)
+
+	executor := &rejectExecutor{}
+	runner := NewProtocolRunner(wdb)
+	runner.Executors["opentrons"] = executor
+	dispatcher := NewDispatcher(runner, db)
+	dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = dispatcher.Notify
+	dispatcher.Start(ctx)
+	defer dispatcher.Stop()
+	if err := runner.StartProtocol(ctx, historyID, robotProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	queries := autodemosql.New(db)
+	steps := waitForSteps(t, queries, historyID, 1)
+	if run := waitForRun(t, queries, steps[0].ID, 0, RunFailed); run.StatusMessage != "protocol rejected" {
+		t.Errorf("Expected the run to fail with the executor's error, got %+v", run)
+	}
+
+	var deliveries []autodemosql.WebhookDelivery
+	err = wdb.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		var err error
+		deliveries, err = queries.GetWebhookDeliveries(ctx, webhook.ID)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("Failed to get webhook deliveries: %v", err)
+	}
+	failed := 0
+	for _, delivery := range deliveries {
+		if delivery.Event == EventStepFailed {
+			failed++
+		}
+	}
+	if failed != 1 {
+		t.Errorf("Expected a step.failed delivery of the failed run, got %d", failed)
+	}
+
+	dispatcher.Notify()
+	time.Sleep(50 * time.Millisecond)
+	if starts := executor.starts.Load(); starts != 1 {
+		t.Errorf("Expected the group to be started once, got %d", starts)
+	}
+}
+
+// TestDispatcherRestart checks that a run still going on the robot when the
+// server stops is picked up again on restart, rather than submitted twice.
+func TestDispatcherRestart(t *testing.T) {
+	dbPath := "test_robot_restart.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	fake := ot2.NewFakeRobot()
+	defer fake.Close()
+	fake.PollsToComplete = 1 << 30
+	client := ot2.NewClient(fake.URL)
+	client.PollInterval = time.Millisecond
+
+	runner := NewProtocolRunner(wdb)
+	if err := runner.StartProtocol(ctx, historyID, robotProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	queries := autodemosql.New(db)
+	steps := waitForSteps(t, queries, historyID, 1)
+
+	// The server stops while the run is going.
+	runner.Executors["opentrons"] = NewRobotExecutor(client)
+	dispatcher := NewDispatcher(runner, db)
+	dispatcher.PollInterval = time.Millisecond
+	dispatcher.Start(ctx)
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		runs, err := queries.GetCodeStepRuns(ctx, steps[0].ID)
+		if err != nil {
+			t.Fatalf("Failed to get runs: %v", err)
+		}
+		if len(runs) == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the run to start")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	dispatcher.Stop()
+
+	// After a restart, the dispatcher waits on the same run.
+	fake.PollsToComplete = 0
+	dispatcher = NewDispatcher(runner, db)
+	dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = dispatcher.Notify
+	dispatcher.Start(ctx)
+	defer dispatcher.Stop()
+	steps = waitForSteps(t, queries, historyID, 2)
+	waitForRun(t, queries, steps[0].ID, 0, RunCompleted)
+	if groups := fake.Groups(); len(groups) != 1 {
+		t.Errorf("Expected the group to be submitted once, got %d", len(groups))
+	}
+	if steps[1].StepComment != "Done" {
+		t.Errorf("Expected the protocol to finish, got %s", steps[1].StepComment)
+	}
+}
+
+// TestUploadDuringRobotRun checks that results uploaded for a step's human
+// group don't continue the protocol while its robot run is going, or once it
+// has failed.
+func TestUploadDuringRobotRun(t *testing.T) {
+	dbPath := "test_robot_upload.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	fake := ot2.NewFakeRobot()
+	defer fake.Close()
+	fake.PollsToComplete = 1 << 30
+	client := ot2.NewClient(fake.URL)
+	client.PollInterval = time.Millisecond
+
+	runner := NewProtocolRunner(wdb)
+	runner.Executors["opentrons"] = NewRobotExecutor(client)
+	engine := NewEngine(runner, db)
+	engine.Start(ctx)
+	defer engine.Stop()
+	dispatcher := NewDispatcher(runner, db)
+	dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = dispatcher.Notify
+	dispatcher.Start(ctx)
+	if err := runner.StartProtocol(ctx, historyID, "HUMAN = true\n"+robotProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	queries := autodemosql.New(db)
+	steps := waitForSteps(t, queries, historyID, 1)
+	waitForRun(t, queries, steps[0].ID, 0, RunRunning)
+
+	// Every result is in while the robot is still running.
+	if err := wdb.MergeData(ctx, steps[0].ID, "b6885800-f454-4f19-9c60-ff725aa2d51a", `{"ng_per_ul": 30}`); err != nil {
+		t.Fatalf("Failed to upload result: %v", err)
+	}
+	held := func(when string) {
+		t.Helper()
+		engine.Notify()
+		dispatcher.Notify()
+		time.Sleep(50 * time.Millisecond)
+		if steps := waitForSteps(t, queries, historyID, 1); len(steps) != 1 {
+			t.Errorf("Expected the protocol to wait %s, got %d steps", when, len(steps))
+		}
+	}
+	held("while the robot runs")
+
+	// The robot run fails, which holds the protocol for good.
+	dispatcher.Stop()
+	fake.PollsToComplete = 0
+	fake.Fail = func(libb.CommandGroup) error { return errors.New("tip not found") }
+	dispatcher = NewDispatcher(runner, db)
+	dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = dispatcher.Notify
+	dispatcher.Start(ctx)
+	defer dispatcher.Stop()
+	failed := waitForRun(t, queries, steps[0].ID, 0, RunFailed)
+	held("once the robot run has failed")
+
+	// Retrying the failed run starts its group again, and the protocol
+	// continues once it completes.
+	app := &App{DB: db, WDB: wdb, Engine: engine, Dispatcher: dispatcher}
+	retry := func(runID int64) int {
+		t.Helper()
+		req := httptest.NewRequest("POST", fmt.Sprintf("/runs/%d/retry", runID), nil)
+		req.SetPathValue("runID", fmt.Sprint(runID))
+		rec := httptest.NewRecorder()
+		app.RetryRunHandler(rec, req)
+		return rec.Code
+	}
+	fake.Fail = nil
+	if code := retry(failed.ID); code != http.StatusOK {
+		t.Fatalf("Failed to retry run: %d", code)
+	}
+	steps = waitForSteps(t, queries, historyID, 2)
+	completed := waitForRun(t, queries, steps[0].ID, 0, RunCompleted)
+	if groups := fake.Groups(); len(groups) != 2 {
+		t.Errorf("Expected the group to be submitted again, got %d runs", len(groups))
+	}
+	if steps[1].StepComment != "Done" {
+		t.Errorf("Expected the protocol to finish, got %s", steps[1].StepComment)
+	}
+	if code := retry(completed.ID); code != http.StatusConflict {
+		t.Errorf("Expected retrying a completed run to conflict, got %d", code)
+	}
+	if code := retry(failed.ID); code != http.StatusNotFound {
+		t.Errorf("Expected retrying a cleared run to be not found, got %d", code)
+	}
+}
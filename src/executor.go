@@ -0,0 +1,181 @@
+package autodemo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+/******************************************************************************
+
+Executors
+
+Each command group of a script is executed by whatever handles its
+command_type: an OT-2 for opentrons groups, a technician for human groups, or
+a simulator when there is no robot. Each of these is an Executor, registered
+for its command type in Executors.
+
+Executors only choose how a group runs, not which groups exist: libB decodes
+every command into its own types, and scripts must match ScriptSchema, so the
+command types are fixed there. An instrument with commands of its own needs
+them added to libB (command.go, types.go and schema.json) before an executor
+can be registered for them.
+
+Executions last far longer than any server process, so executors keep no
+state of their own either. Starting a group returns an ID for its run, which
+the dispatcher records in code_step_run, and executors are asked how a run is
+going by that ID. A run which completes may yield results for its group's
+return keys, which are merged into the step's data just like uploads.
+
+******************************************************************************/
+
+// Run statuses, as recorded in code_step_run.
+const (
+	RunRunning   = "RUNNING"
+	RunFailed    = "FAILED"
+	RunCompleted = "COMPLETED"
+)
+
+// ErrExecutorBusy is returned by Executor.Start when the executor can't take
+// a group yet, such as while a robot is running another one. Starting the
+// group is tried again later.
+var ErrExecutorBusy = errors.New("executor is busy")
+
+// Job is a command group to execute, along with the step it belongs to.
+type Job struct {
+	Step   autodemosql.CodeStep
+	Script *libb.Script
+	Index  int // the group's index in Script.Commands
+	Group  libb.CommandGroup
+}
+
+// Progress is how far a run has got.
+type Progress struct {
+	Status  string // RunRunning, RunFailed or RunCompleted
+	Message string
+	Data    map[string]string // results yielded by a completed run, keyed by return key
+}
+
+// Executor executes the command groups of a command type.
+type Executor interface {
+	// Start starts executing a job, and returns the ID of its run.
+	Start(ctx context.Context, job Job) (int64, error)
+	// Progress reports how far the run of a job has got.
+	Progress(ctx context.Context, job Job, runID int64) (Progress, error)
+}
+
+// Executors holds the executor of each command type.
+type Executors map[string]Executor
+
+// DefaultExecutors returns the executors used without a robot: technicians
+// execute human groups through db's work queue, and opentrons groups are
+// simulated.
+func DefaultExecutors(db *WriteDB) Executors {
+	return Executors{
+		"opentrons": SimulatorExecutor{},
+		"human":     NewHumanExecutor(db),
+	}
+}
+
+// Check returns an error if a script has groups of a command type without an
+// executor, which would never run.
+func (e Executors) Check(script *libb.Script) error {
+	var missing []string
+	seen := make(map[string]bool)
+	for _, group := range script.Commands {
+		if _, ok := e[group.CommandType]; !ok && !seen[group.CommandType] {
+			seen[group.CommandType] = true
+			missing = append(missing, fmt.Sprintf("%q", group.CommandType))
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no executor for command_type %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// HumanExecutor executes groups through technicians, by adding a work item
+// for each of the group's commands to the work queue. A run completes once
+// every item is done, which for commands with results is once their results
+// are uploaded.
+type HumanExecutor struct {
+	db *WriteDB
+}
+
+// NewHumanExecutor creates an executor adding work items to db.
+func NewHumanExecutor(db *WriteDB) *HumanExecutor {
+	return &HumanExecutor{db: db}
+}
+
+// Start adds the group's commands to the work queue.
+func (h *HumanExecutor) Start(ctx context.Context, job Job) (int64, error) {
+	err := h.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		return createWorkItems(queries, ctx, job)
+	})
+	return 0, err
+}
+
+// Progress checks which of the group's work items are done.
+func (h *HumanExecutor) Progress(ctx context.Context, job Job, runID int64) (Progress, error) {
+	items, err := autodemosql.New(h.db.DB).GetWorkItemsForGroup(ctx, autodemosql.GetWorkItemsForGroupParams{
+		CodeStep:     job.Step.ID,
+		CommandGroup: int64(job.Index),
+	})
+	if err != nil {
+		return Progress{}, fmt.Errorf("failed to get work items: %v", err)
+	}
+	var waiting []string
+	for _, item := range items {
+		if item.CompletedAt.Valid {
+			continue
+		}
+		if item.ReturnKey != "" {
+			waiting = append(waiting, item.ReturnKey)
+		} else {
+			waiting = append(waiting, fmt.Sprintf("work item %d", item.ID))
+		}
+	}
+	if len(waiting) > 0 {
+		sort.Strings(waiting)
+		return Progress{Status: RunRunning, Message: "Waiting for " + strings.Join(waiting, ", ")}, nil
+	}
+	return Progress{Status: RunCompleted, Message: "Work items completed"}, nil
+}
+
+// SimulatorExecutor executes opentrons groups by checking them with
+// libb.ValidateDeck and libb.Simulate instead of running them on a robot. A
+// run fails if the group does anything either finds unsafe.
+type SimulatorExecutor struct{}
+
+// Start does nothing, since simulating is quick enough to do in Progress.
+func (SimulatorExecutor) Start(ctx context.Context, job Job) (int64, error) {
+	return 0, nil
+}
+
+// Progress simulates the script up to the group, since the deck is left as
+// the groups before it left it, and reports the issues in the group itself.
+func (SimulatorExecutor) Progress(ctx context.Context, job Job, runID int64) (Progress, error) {
+	script := &libb.Script{ID: job.Script.ID, Commands: job.Script.Commands[:job.Index+1]}
+	var issues []libb.DeckIssue
+	for _, issue := range append(libb.ValidateDeck(script), libb.Simulate(script, nil).Issues...) {
+		if issue.Group == job.Index {
+			issues = append(issues, issue)
+		}
+	}
+	if err := libb.DeckErrors(issues); err != nil {
+		return Progress{Status: RunFailed, Message: fmt.Sprintf("Simulation failed: %v", err)}, nil
+	}
+	switch len(issues) {
+	case 0:
+		return Progress{Status: RunCompleted, Message: "Simulated"}, nil
+	case 1:
+		return Progress{Status: RunCompleted, Message: "Simulated with 1 warning: " + issues[0].String()}, nil
+	default:
+		return Progress{Status: RunCompleted, Message: fmt.Sprintf("Simulated with %d warnings", len(issues))}, nil
+	}
+}
@@ -0,0 +1,117 @@
+package autodemo
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+// quantifyExecutor executes human groups by yielding a reading for every
+// return key.
+type quantifyExecutor struct{}
+
+func (quantifyExecutor) Start(ctx context.Context, job Job) (int64, error) {
+	return 7, nil
+}
+
+func (quantifyExecutor) Progress(ctx context.Context, job Job, runID int64) (Progress, error) {
+	data := make(map[string]string)
+	for _, command := range job.Group.Payload {
+		if result, ok := command.(libb.ResultCommand); ok {
+			data[result.ResultKey()] = `{"ng_per_ul": 42}`
+		}
+	}
+	return Progress{Status: RunCompleted, Message: "Quantified", Data: data}, nil
+}
+
+// quantifyProtocol runs the example protocol, then reports the concentration
+// it quantified.
+const quantifyProtocol = `
+function main()
+	return libB.status.CONTINUE, "PCR, then quantify", "report", libB.generate_protocol(), ""
+end
+
+function report()
+	for _, results in pairs(DATA) do
+		for _, result in pairs(results) do
+			return libB.status.SUCCESS, "Got " .. libB.json.decode(result).ng_per_ul .. " ng/uL", "", nil, ""
+		end
+	end
+end
+`
+
+func TestExecutors(t *testing.T) {
+	dbPath := "test_executors.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	runner := NewProtocolRunner(wdb)
+	dispatcher := NewDispatcher(runner, db)
+	dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = dispatcher.Notify
+	dispatcher.Start(ctx)
+	defer dispatcher.Stop()
+	queries := autodemosql.New(db)
+	start := func(code string) int64 {
+		t.Helper()
+		historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+		if err != nil {
+			t.Fatalf("Failed to create message history: %v", err)
+		}
+		if err := runner.StartProtocol(ctx, historyID, code); err != nil {
+			t.Fatalf("Failed to start protocol: %v", err)
+		}
+		return historyID
+	}
+
+	// Without a robot, opentrons groups are simulated, and human groups wait
+	// for technicians to upload their results.
+	historyID := start(quantifyProtocol)
+	steps := waitForSteps(t, queries, historyID, 1)
+	if run := waitForRun(t, queries, steps[0].ID, 0, RunCompleted); run.StatusMessage != "Simulated with 6 warnings" {
+		t.Errorf("Expected the opentrons group to be simulated, got %+v", run)
+	}
+	waitForRun(t, queries, steps[0].ID, 1, RunRunning)
+	if err := wdb.MergeData(ctx, steps[0].ID, "b6885800-f454-4f19-9c60-ff725aa2d51a", `{"ng_per_ul": 30}`); err != nil {
+		t.Fatalf("Failed to upload result: %v", err)
+	}
+	dispatcher.Notify()
+	if run := waitForRun(t, queries, steps[0].ID, 1, RunCompleted); run.StatusMessage != "Work items completed" {
+		t.Errorf("Expected the human group to complete, got %+v", run)
+	}
+	steps = waitForSteps(t, queries, historyID, 2)
+	if steps[1].StepComment != "Got 30 ng/uL" {
+		t.Errorf("Expected the protocol to continue with the upload, got %s", steps[1].StepComment)
+	}
+
+	// Results yielded by executors are merged into the step's data.
+	runner.Executors["human"] = quantifyExecutor{}
+	historyID = start(quantifyProtocol)
+	steps = waitForSteps(t, queries, historyID, 2)
+	if run := waitForRun(t, queries, steps[0].ID, 1, RunCompleted); run.RunID != 7 || run.StatusMessage != "Quantified" {
+		t.Errorf("Expected the human group to be quantified, got %+v", run)
+	}
+	if steps[1].StepComment != "Got 42 ng/uL" {
+		t.Errorf("Expected the protocol to continue with the yielded result, got %s", steps[1].StepComment)
+	}
+
+	// Scripts with groups nothing can execute fail their step.
+	delete(runner.Executors, "human")
+	historyID = start(quantifyProtocol)
+	steps = waitForSteps(t, queries, historyID, 1)
+	if steps[0].Status != int64(libb.StatusFailure) || !strings.Contains(steps[0].StepComment, `Unexecutable script: no executor for command_type "human"`) {
+		t.Errorf("Expected the step to fail, got status %d: %s", steps[0].Status, steps[0].StepComment)
+	}
+}
@@ -0,0 +1,109 @@
+package autodemo
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+// ExportHandler downloads a step's script as an Opentrons Python protocol,
+// for labs running scripts without the ot2 server.
+func (app *App) ExportHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("stepID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid step ID", http.StatusBadRequest)
+		return
+	}
+	script, err := app.stepScript(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if script == nil {
+		http.Error(w, "Step has no script", http.StatusNotFound)
+		return
+	}
+	protocol, err := libb.ExportOpentrons(script)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/x-python; charset=utf-8")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=\"step-%d.py\"", id))
+	_, _ = w.Write(protocol)
+}
+
+// ExportCommand implements the export subcommand, which writes a script as an
+// Opentrons Python protocol. The script is either a step's, read from the
+// database, or read as JSON from a file:
+//
+//	autodemo export [-db test.db] [-o protocol.py] <step id>
+//	autodemo export -script script.json [-o protocol.py]
+func ExportCommand(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	dbPath := flags.String("db", "test.db", "database to read the step from")
+	scriptPath := flags.String("script", "", "export this script JSON file instead of a step (- for stdin)")
+	outPath := flags.String("o", "", "write the protocol to this file instead of stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	var script *libb.Script
+	switch {
+	case *scriptPath != "" && flags.NArg() == 0:
+		var data []byte
+		var err error
+		if *scriptPath == "-" {
+			data, err = io.ReadAll(os.Stdin)
+		} else {
+			data, err = os.ReadFile(*scriptPath)
+		}
+		if err != nil {
+			return fmt.Errorf("failed to read script: %v", err)
+		}
+		script, err = libb.ParseScript(data)
+		if err != nil {
+			return err
+		}
+	case *scriptPath == "" && flags.NArg() == 1:
+		id, err := strconv.ParseInt(flags.Arg(0), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid step ID %q", flags.Arg(0))
+		}
+		db, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", *dbPath))
+		if err != nil {
+			return fmt.Errorf("failed to open database: %v", err)
+		}
+		defer db.Close()
+		app := &App{DB: db}
+		script, err = app.stepScript(context.Background(), id)
+		if err != nil {
+			return err
+		}
+		if script == nil {
+			return fmt.Errorf("step %d has no script", id)
+		}
+	default:
+		flags.Usage()
+		return errors.New("export needs either a step ID or -script")
+	}
+
+	protocol, err := libb.ExportOpentrons(script)
+	if err != nil {
+		return err
+	}
+	if *outPath != "" {
+		return os.WriteFile(*outPath, protocol, 0644)
+	}
+	_, err = stdout.Write(protocol)
+	return err
+}
@@ -0,0 +1,99 @@
+package autodemo
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+)
+
+func TestExport(t *testing.T) {
+	dbPath := "test_export.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	err = NewProtocolRunner(wdb).StartProtocol(ctx, historyID, `
+function main()
+	return libB.status.CONTINUE, "PCR, then quantify", "next", libB.generate_protocol(), ""
+end
+
+function next()
+	return libB.status.SUCCESS, "Done", "", nil, ""
+end
+`)
+	if err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	steps, err := autodemosql.New(db).GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil || len(steps) != 1 {
+		t.Fatalf("Expected 1 step, got %d: %v", len(steps), err)
+	}
+	stepID := steps[0].ID
+	want, err := os.ReadFile("libB/testdata/export/example.py")
+	if err != nil {
+		t.Fatalf("Failed to read golden file: %v", err)
+	}
+
+	app := &App{DB: db, WDB: wdb}
+	get := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/export/"+id, nil)
+		req.SetPathValue("stepID", id)
+		rec := httptest.NewRecorder()
+		app.ExportHandler(rec, req)
+		return rec
+	}
+	rec := get(fmt.Sprint(stepID))
+	if rec.Code != http.StatusOK || rec.Body.String() != string(want) {
+		t.Errorf("Expected the exported example, got %d:\n%s", rec.Code, rec.Body.String())
+	}
+	if disposition := rec.Header().Get("Content-Disposition"); disposition != fmt.Sprintf("attachment; filename=\"step-%d.py\"", stepID) {
+		t.Errorf("Unexpected Content-Disposition %q", disposition)
+	}
+	if rec := get("999"); rec.Code != http.StatusNotFound {
+		t.Errorf("Expected 404 for a missing step, got %d", rec.Code)
+	}
+	if rec := get("x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected 400 for a bad step ID, got %d", rec.Code)
+	}
+
+	// The CLI exports the same protocol, from a step or a script file.
+	var out bytes.Buffer
+	if err := ExportCommand([]string{"-db", dbPath, fmt.Sprint(stepID)}, &out); err != nil {
+		t.Fatalf("Failed to export step: %v", err)
+	}
+	if out.String() != string(want) {
+		t.Errorf("Expected the exported example from the CLI, got:\n%s", out.String())
+	}
+	scriptPath := filepath.Join(t.TempDir(), "script.json")
+	if err := os.WriteFile(scriptPath, []byte(steps[0].Script), 0644); err != nil {
+		t.Fatalf("Failed to write script: %v", err)
+	}
+	outPath := filepath.Join(t.TempDir(), "protocol.py")
+	if err := ExportCommand([]string{"-script", scriptPath, "-o", outPath}, &out); err != nil {
+		t.Fatalf("Failed to export script: %v", err)
+	}
+	if got, err := os.ReadFile(outPath); err != nil || string(got) != string(want) {
+		t.Errorf("Expected the exported example in %s, got %v:\n%s", outPath, err, got)
+	}
+	if err := ExportCommand(nil, &out); err == nil || !strings.Contains(err.Error(), "step ID or -script") {
+		t.Errorf("Expected a usage error, got %v", err)
+	}
+}
@@ -0,0 +1,396 @@
+package libb
+
+import (
+	"io"
+	"math"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/ast"
+	"github.com/yuin/gopher-lua/parse"
+	"github.com/yuin/gopher-lua/pm"
+)
+
+/******************************************************************************
+
+Allocation guards.
+
+A single instruction or library call can allocate far more than the cap, and
+a string doubled in a loop outgrows any cap in a few dozen instructions. So
+everything which can build a large string from small inputs reserves the size
+of its result from the budget before it allocates:
+
+- The .. operator. gopher-lua runs it inside the VM, out of our reach, so code
+  is compiled with every .. rewritten into a call to sandboxedConcat.
+- string.rep, string.format, string.gsub and table.concat, which are replaced
+  with wrappers computing an upper bound of what they allocate.
+
+Reservations are added up over the execution, and never given back when a
+string is collected, so the cap bounds everything the execution builds rather
+than what it holds at once. Only the execution's own reservations count, so
+it isn't stopped by other executions or requests allocating alongside it.
+
+******************************************************************************/
+
+// concatName is the local holding sandboxedConcat in compiled code. It can't
+// be written in Lua source, like the compiler's own hidden locals.
+const concatName = "(concat)"
+
+// reserve is called before allocating n bytes. It reports whether they fit in
+// the budget, and stops the execution if they don't.
+func (c *budgetContext) reserve(n uint64) bool {
+	if c.limits.MaxAllocBytes == 0 {
+		return true
+	}
+	c.reserved = addBytes(c.reserved, n)
+	if c.reserved > c.limits.MaxAllocBytes {
+		c.exceed(ErrMemoryLimit)
+		return false
+	}
+	return true
+}
+
+// reserveAlloc raises an error if allocating n bytes would take the running
+// execution past its allocation cap.
+func reserveAlloc(L *lua.LState, n uint64) {
+	if budget, ok := L.Context().(*budgetContext); ok && !budget.reserve(n) {
+		L.RaiseError("%v", ErrMemoryLimit)
+	}
+}
+
+// mulBytes multiplies two sizes, saturating rather than overflowing.
+func mulBytes(a, b uint64) uint64 {
+	if a != 0 && b > math.MaxUint64/a {
+		return math.MaxUint64
+	}
+	return a * b
+}
+
+// addBytes adds two sizes, saturating rather than overflowing.
+func addBytes(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+	return a + b
+}
+
+/******************************************************************************
+
+Guarded ..
+
+******************************************************************************/
+
+// compileSandboxed parses and compiles Lua source with every .. guarded. The
+// prototype must be loaded with newSandboxedFunction.
+func compileSandboxed(source io.Reader, name string) (*lua.FunctionProto, error) {
+	chunk, err := parse.Parse(source, name)
+	if err != nil {
+		return nil, err
+	}
+	return lua.Compile(guardConcat(chunk), name)
+}
+
+// loadSandboxed compiles Lua source with every .. guarded, like L.LoadString.
+func loadSandboxed(L *lua.LState, source io.Reader) (*lua.LFunction, error) {
+	proto, err := compileSandboxed(source, "<string>")
+	if err != nil {
+		return nil, &lua.ApiError{Type: lua.ApiErrorSyntax, Object: lua.LString(err.Error()), Cause: err}
+	}
+	return newSandboxedFunction(L, proto)
+}
+
+// newSandboxedFunction returns the chunk compiled by compileSandboxed, bound
+// to sandboxedConcat.
+func newSandboxedFunction(L *lua.LState, proto *lua.FunctionProto) (*lua.LFunction, error) {
+	L.Push(L.NewFunctionFromProto(proto))
+	L.Push(L.NewFunction(sandboxedConcat))
+	if err := L.PCall(1, 1, nil); err != nil {
+		return nil, err
+	}
+	fn := L.Get(-1).(*lua.LFunction)
+	L.Pop(1)
+	return fn, nil
+}
+
+// guardConcat rewrites every .. in chunk into a call to the local concatName,
+// and wraps the chunk in a function taking that local, which returns the
+// original chunk as a closure.
+func guardConcat(chunk []ast.Stmt) []ast.Stmt {
+	guardStmts(chunk)
+	return []ast.Stmt{
+		&ast.LocalAssignStmt{Names: []string{concatName}, Exprs: []ast.Expr{&ast.Comma3Expr{}}},
+		&ast.ReturnStmt{Exprs: []ast.Expr{&ast.FunctionExpr{ParList: &ast.ParList{HasVargs: true}, Stmts: chunk}}},
+	}
+}
+
+func guardStmts(stmts []ast.Stmt) {
+	for _, stmt := range stmts {
+		switch s := stmt.(type) {
+		case *ast.AssignStmt:
+			guardExprs(s.Lhs)
+			guardExprs(s.Rhs)
+		case *ast.LocalAssignStmt:
+			guardExprs(s.Exprs)
+		case *ast.FuncCallStmt:
+			s.Expr = guardExpr(s.Expr)
+		case *ast.DoBlockStmt:
+			guardStmts(s.Stmts)
+		case *ast.WhileStmt:
+			s.Condition = guardExpr(s.Condition)
+			guardStmts(s.Stmts)
+		case *ast.RepeatStmt:
+			s.Condition = guardExpr(s.Condition)
+			guardStmts(s.Stmts)
+		case *ast.IfStmt:
+			s.Condition = guardExpr(s.Condition)
+			guardStmts(s.Then)
+			guardStmts(s.Else)
+		case *ast.NumberForStmt:
+			s.Init = guardExpr(s.Init)
+			s.Limit = guardExpr(s.Limit)
+			s.Step = guardExpr(s.Step)
+			guardStmts(s.Stmts)
+		case *ast.GenericForStmt:
+			guardExprs(s.Exprs)
+			guardStmts(s.Stmts)
+		case *ast.FuncDefStmt:
+			s.Name.Func = guardExpr(s.Name.Func)
+			s.Name.Receiver = guardExpr(s.Name.Receiver)
+			guardStmts(s.Func.Stmts)
+		case *ast.ReturnStmt:
+			guardExprs(s.Exprs)
+		}
+	}
+}
+
+func guardExprs(exprs []ast.Expr) {
+	for i := range exprs {
+		exprs[i] = guardExpr(exprs[i])
+	}
+}
+
+func guardExpr(expr ast.Expr) ast.Expr {
+	switch e := expr.(type) {
+	case *ast.StringConcatOpExpr:
+		fn := &ast.IdentExpr{Value: concatName}
+		// AdjustRet keeps the call to a single value, and out of tail calls,
+		// like the operator.
+		call := &ast.FuncCallExpr{Func: fn, Args: []ast.Expr{guardExpr(e.Lhs), guardExpr(e.Rhs)}, AdjustRet: true}
+		for _, node := range []ast.PositionHolder{fn, call} {
+			node.SetLine(e.Line())
+			node.SetLastLine(e.LastLine())
+		}
+		return call
+	case *ast.AttrGetExpr:
+		e.Object = guardExpr(e.Object)
+		e.Key = guardExpr(e.Key)
+	case *ast.TableExpr:
+		for _, field := range e.Fields {
+			field.Key = guardExpr(field.Key)
+			field.Value = guardExpr(field.Value)
+		}
+	case *ast.FuncCallExpr:
+		e.Func = guardExpr(e.Func)
+		e.Receiver = guardExpr(e.Receiver)
+		guardExprs(e.Args)
+	case *ast.LogicalOpExpr:
+		e.Lhs = guardExpr(e.Lhs)
+		e.Rhs = guardExpr(e.Rhs)
+	case *ast.RelationalOpExpr:
+		e.Lhs = guardExpr(e.Lhs)
+		e.Rhs = guardExpr(e.Rhs)
+	case *ast.ArithmeticOpExpr:
+		e.Lhs = guardExpr(e.Lhs)
+		e.Rhs = guardExpr(e.Rhs)
+	case *ast.UnaryMinusOpExpr:
+		e.Expr = guardExpr(e.Expr)
+	case *ast.UnaryNotOpExpr:
+		e.Expr = guardExpr(e.Expr)
+	case *ast.UnaryLenOpExpr:
+		e.Expr = guardExpr(e.Expr)
+	case *ast.FunctionExpr:
+		guardStmts(e.Stmts)
+	}
+	return expr
+}
+
+// sandboxedConcat is the .. operator, checking the size of its result first.
+func sandboxedConcat(L *lua.LState) int {
+	lhs, rhs := L.Get(1), L.Get(2)
+	if lua.LVCanConvToString(lhs) && lua.LVCanConvToString(rhs) {
+		l, r := lua.LVAsString(lhs), lua.LVAsString(rhs)
+		reserveAlloc(L, uint64(len(l))+uint64(len(r)))
+		L.Push(lua.LString(l + r))
+		return 1
+	}
+	op := L.GetMetaField(lhs, "__concat")
+	if op == lua.LNil {
+		op = L.GetMetaField(rhs, "__concat")
+	}
+	if op.Type() != lua.LTFunction {
+		L.RaiseError("cannot perform concat operation between %v and %v", lhs.Type().String(), rhs.Type().String())
+	}
+	L.Push(op)
+	L.Push(lhs)
+	L.Push(rhs)
+	L.Call(2, 1)
+	return 1
+}
+
+/******************************************************************************
+
+Guarded library functions
+
+******************************************************************************/
+
+// guardLibraries replaces the library functions which can allocate a lot in
+// a single call with guarded versions.
+func guardLibraries(L *lua.LState) {
+	if str, ok := L.GetGlobal("string").(*lua.LTable); ok {
+		str.RawSetString("rep", L.NewFunction(sandboxedStringRep))
+		for name, guard := range map[string]func(L *lua.LState) uint64{
+			"format": formatBytes,
+			"gsub":   gsubBytes,
+		} {
+			if fn, ok := str.RawGetString(name).(*lua.LFunction); ok {
+				str.RawSetString(name, L.NewFunction(guardFunction(fn.GFunction, guard)))
+			}
+		}
+	}
+	if table, ok := L.GetGlobal("table").(*lua.LTable); ok {
+		if fn, ok := table.RawGetString("concat").(*lua.LFunction); ok {
+			table.RawSetString("concat", L.NewFunction(guardFunction(fn.GFunction, tableConcatBytes)))
+		}
+	}
+}
+
+// guardFunction wraps a library function so that it reserves the bytes
+// computed by size from its arguments before it runs.
+func guardFunction(fn lua.LGFunction, size func(L *lua.LState) uint64) lua.LGFunction {
+	return func(L *lua.LState) int {
+		if _, ok := L.Context().(*budgetContext); ok {
+			reserveAlloc(L, size(L))
+		}
+		return fn(L)
+	}
+}
+
+// maxStringRepBytes is the largest string string.rep builds, even when the
+// allocation cap is disabled, so that a huge count can't panic the host.
+const maxStringRepBytes = 1 << 30
+
+// sandboxedStringRep is string.rep, but refuses to build a string larger than
+// what is left of the allocation cap of the running execution, or than
+// maxStringRepBytes.
+func sandboxedStringRep(L *lua.LState) int {
+	str := L.CheckString(1)
+	n := L.CheckInt(2)
+	if n <= 0 || len(str) == 0 {
+		L.Push(lua.LString(""))
+		return 1
+	}
+	size := mulBytes(uint64(len(str)), uint64(n))
+	if size > maxStringRepBytes {
+		L.RaiseError("resulting string too large")
+		return 0
+	}
+	reserveAlloc(L, size)
+	buf := make([]byte, 0, int(size))
+	for i := 0; i < n; i++ {
+		buf = append(buf, str...)
+	}
+	L.Push(lua.LString(buf))
+	return 1
+}
+
+// formatBytes bounds what string.format allocates. Like Lua's own, it only
+// takes widths and precisions of up to two digits, so each character of the
+// format makes at most a hundred bytes, and each argument at most a few
+// hundred more, apart from strings, which %q can quadruple.
+func formatBytes(L *lua.LState) uint64 {
+	format := L.CheckString(1)
+	digits := func(i int) int {
+		start := i
+		for i < len(format) && format[i] >= '0' && format[i] <= '9' {
+			i++
+		}
+		if i-start > 2 {
+			L.RaiseError("invalid format (width or precision too long)")
+		}
+		return i
+	}
+	for i := 0; i < len(format); i++ {
+		if format[i] != '%' {
+			continue
+		}
+		i++
+		for i < len(format) && strings.IndexByte("-+ #0", format[i]) >= 0 {
+			i++
+		}
+		i = digits(i)
+		if i < len(format) && format[i] == '.' {
+			i = digits(i + 1)
+		}
+	}
+
+	size := mulBytes(uint64(len(format)), 100)
+	for i := 2; i <= L.GetTop(); i++ {
+		if str, ok := L.Get(i).(lua.LString); ok {
+			size = addBytes(size, mulBytes(uint64(len(str)), 4)+2)
+		} else {
+			size = addBytes(size, 512)
+		}
+	}
+	return size
+}
+
+// gsubBytes bounds what string.gsub allocates. gopher-lua copies the whole
+// string for every replacement it makes, so this is twice the number of
+// matches times the largest the result can be.
+func gsubBytes(L *lua.LState) uint64 {
+	str := L.CheckString(1)
+	matches, err := pm.Find(L.CheckString(2), []byte(str), 0, L.OptInt(4, -1))
+	if err != nil || len(matches) == 0 {
+		return 0 // string.gsub raises the error, or returns str
+	}
+
+	// Each match is replaced by at most perMatch bytes, plus whatever its
+	// captures add: together no more than str for each %n.
+	var perMatch, captures uint64
+	switch repl := L.Get(3).(type) {
+	case lua.LString:
+		perMatch = uint64(len(repl))
+		for i := 0; i+1 < len(repl); i++ {
+			if repl[i] == '%' {
+				captures++
+				i++
+			}
+		}
+		perMatch += captures * 20 // for position captures
+	case *lua.LTable:
+		repl.ForEach(func(_, value lua.LValue) {
+			if lua.LVCanConvToString(value) {
+				perMatch = max(perMatch, uint64(len(lua.LVAsString(value))))
+			}
+		})
+	}
+	result := addBytes(uint64(len(str)), addBytes(mulBytes(uint64(len(matches)), perMatch), mulBytes(captures, uint64(len(str)))))
+	return mulBytes(2*uint64(len(matches)), result)
+}
+
+// tableConcatBytes bounds what table.concat allocates, which is the length of
+// the strings it joins. It stops at the first value table.concat will refuse.
+func tableConcatBytes(L *lua.LState) uint64 {
+	table := L.CheckTable(1)
+	sep := uint64(len(L.OptString(2, "")))
+	i, j := max(L.OptInt(3, 1), 1), min(L.OptInt(4, table.Len()), table.Len())
+	var size uint64
+	for ; i <= j; i++ {
+		value := table.RawGetInt(i)
+		if !lua.LVCanConvToString(value) {
+			break
+		}
+		size = addBytes(size, uint64(len(lua.LVAsString(value)))+sep)
+	}
+	return size
+}
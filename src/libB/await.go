@@ -0,0 +1,151 @@
+package libb
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/******************************************************************************
+
+Await.
+
+The original protocol style splits a protocol into one global function per
+step, threading state between them through a JSON passthrough string. With
+libB.await, main can instead hand a script to the lab and carry on with its
+results as if it were an ordinary function call:
+
+	function main()
+		local quantified = libB.await(script)
+		...
+	end
+
+Lua states don't survive between steps (or restarts), so we never keep a
+suspended coroutine around. Instead, main is always run from the start inside
+a coroutine, and every libB.await call is answered from the results recorded
+for previous steps, in order. The first libB.await call without a recorded
+result yields: its script becomes the next step, and the coroutine is thrown
+away. Once the results for that step are uploaded (or, for a script which
+returns nothing, once it has run), main is replayed again with one more
+recorded result, and so on until main returns.
+
+This only works if main is deterministic given its recorded results, so a
+replay which makes fewer libB.await calls than there are recorded results is
+an error. Script ids usually come from libB.uuid.generate, which can differ
+between replays, so recorded results are matched to the current script by
+position rather than by id.
+
+A protocol has to stay in main to use libB.await: after handing off to
+another function with a next_function, there is no way to replay it.
+
+******************************************************************************/
+
+// AwaitFunction is stored as the next function of steps waiting on a
+// libB.await call. Passing it as StepInput.Function replays main.
+const AwaitFunction = "libB.await"
+
+// AwaitResult is the recorded outcome of a single libB.await call.
+type AwaitResult struct {
+	Script *Script           // the script that was awaited
+	Data   map[string]string // return key -> JSON result
+}
+
+// awaitState tracks the libB.await calls made during one execution.
+type awaitState struct {
+	enabled bool
+	replay  []AwaitResult
+	next    int
+	pending *ProtocolState
+}
+
+// await implements libB.await. It answers from the recorded results while
+// there are any left, then yields with the script to wait on.
+func (a *awaitState) await(L *lua.LState) int {
+	if !a.enabled {
+		L.RaiseError("libB.await can only be used in main, not after handing off to another function")
+	}
+	script, err := scriptFromLua(L, L.CheckTable(1))
+	if err != nil {
+		L.RaiseError("libB.await: %v", err)
+	}
+	// Scripts which return nothing, such as robot-only ones, continue once
+	// they have run, and replay with an empty result.
+	status, comment := StatusContinue, fmt.Sprintf("Waiting for results of script %s", script.ID)
+	if len(script.returnKeys()) == 0 {
+		status, comment = StatusContinueNoData, fmt.Sprintf("Waiting for script %s to run", script.ID)
+	}
+	comment = L.OptString(2, comment)
+
+	if a.next < len(a.replay) {
+		result := a.replay[a.next]
+		a.next++
+		// pairs follows the order keys are inserted in, so they are
+		// inserted sorted for replays to loop over them the same.
+		data := remapResult(result.Script, script, result.Data)
+		table := L.NewTable()
+		for _, key := range slices.Sorted(maps.Keys(data)) {
+			table.RawSetString(key, lua.LString(data[key]))
+		}
+		L.Push(table)
+		return 1
+	}
+
+	a.pending = &ProtocolState{
+		Status:   status,
+		Comments: comment,
+		NextFunc: AwaitFunction,
+		Script:   script,
+	}
+	return L.Yield()
+}
+
+// finish checks that every recorded result was replayed.
+func (a *awaitState) finish() error {
+	if a.next < len(a.replay) {
+		return fmt.Errorf("protocol did not replay deterministically: %d results were recorded, but main only called libB.await %d times", len(a.replay), a.next)
+	}
+	return nil
+}
+
+// scriptFromLua converts a libB Script table into a Script.
+func scriptFromLua(L *lua.LState, table *lua.LTable) (*Script, error) {
+	toJSON, ok := L.GetField(table, "to_json").(*lua.LFunction)
+	if !ok {
+		return nil, fmt.Errorf("expected a libB.Script")
+	}
+	if err := L.CallByParam(lua.P{Fn: toJSON, NRet: 1, Protect: true}, table); err != nil {
+		return nil, err
+	}
+	scriptJSON := L.Get(-1).String()
+	L.Pop(1)
+
+	return ParseScript([]byte(scriptJSON))
+}
+
+// remapResult renames the return keys of a recorded result to the return keys
+// of the script being awaited now, in case they changed between replays. Keys
+// are matched up by the order of the commands declaring them, so they are only
+// renamed if both scripts declare the same number of keys.
+func remapResult(recorded *Script, current *Script, data map[string]string) map[string]string {
+	if recorded == nil || current == nil {
+		return data
+	}
+	from, to := recorded.returnKeys(), current.returnKeys()
+	if len(from) == 0 || len(from) != len(to) {
+		return data
+	}
+	renamed := make(map[string]string, len(from))
+	for i := range from {
+		renamed[from[i]] = to[i]
+	}
+	remapped := make(map[string]string, len(data))
+	for key, value := range data {
+		if newKey, ok := renamed[key]; ok {
+			key = newKey
+		}
+		remapped[key] = value
+	}
+	return remapped
+}
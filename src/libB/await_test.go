@@ -0,0 +1,197 @@
+package libb
+
+import (
+	"context"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+//go:embed data/await_test.lua
+var await_test string
+
+func TestAwaitReplay(t *testing.T) {
+	ctx := context.Background()
+	first := AwaitResult{Script: &Script{ID: "first"}, Data: map[string]string{"dna": `{"ng_per_ul": 30}`}}
+	second := AwaitResult{Script: &Script{ID: "second"}, Data: map[string]string{"diluted": `{"ng_per_ul": 10}`}}
+
+	// Starting the protocol waits on the first script.
+	state, err := ExecuteLuaStep(ctx, await_test, StepInput{Function: "main"})
+	if err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	if state.Status != 2 || state.NextFunc != AwaitFunction || state.Comments != "Quantify DNA" {
+		t.Errorf("Unexpected first state: %+v", state)
+	}
+	if state.Script == nil || state.Script.ID != "first" {
+		t.Fatalf("Expected to await script first, got %+v", state.Script)
+	}
+
+	// Replaying one result waits on the second script.
+	state, err = ExecuteLuaStep(ctx, await_test, StepInput{Function: AwaitFunction, Replay: []AwaitResult{first}})
+	if err != nil {
+		t.Fatalf("Failed to replay first result: %v", err)
+	}
+	if state.Status != 2 || state.NextFunc != AwaitFunction || state.Script == nil || state.Script.ID != "second" {
+		t.Errorf("Unexpected second state: %+v", state)
+	}
+
+	// Replaying both results finishes the protocol.
+	state, err = ExecuteLuaStep(ctx, await_test, StepInput{Function: AwaitFunction, Replay: []AwaitResult{first, second}})
+	if err != nil {
+		t.Fatalf("Failed to replay both results: %v", err)
+	}
+	if state.Status != 0 || state.Comments != "30 ng/uL, diluted to 10 ng/uL" {
+		t.Errorf("Unexpected final state: %+v", state)
+	}
+}
+
+func TestAwaitReplayRemapsReturnKeys(t *testing.T) {
+	// A result recorded under a different script id and return key is still
+	// handed to the matching libB.await call.
+	recorded := &Script{ID: "old", Commands: []CommandGroup{{
+		CommandType: "human",
+		Payload:     []Command{QuantifyCommand{Type: "quantify", Payload: QuantifyPayload{ReturnKey: "old_key"}}},
+	}}}
+	replay := []AwaitResult{{Script: recorded, Data: map[string]string{"old_key": `{"ng_per_ul": 10}`}}}
+
+	state, err := ExecuteLuaStep(context.Background(), await_test, StepInput{Function: AwaitFunction, Replay: replay})
+	if err != nil {
+		t.Fatalf("Failed to replay: %v", err)
+	}
+	if state.Status != 1 || state.Comments != "Low DNA concentration" {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+}
+
+func TestAwaitErrors(t *testing.T) {
+	first := AwaitResult{Script: &Script{ID: "first"}, Data: map[string]string{"dna": `{"ng_per_ul": 10}`}}
+	handoff := `
+function main()
+	return 2, "", "next", "", ""
+end
+
+function next()
+	libB.await(libB.Script.new("x"))
+end
+`
+	loop := `
+function main()
+	while true do end
+end
+`
+	tests := []struct {
+		name  string
+		code  string
+		input StepInput
+		want  string
+	}{
+		{"nondeterministic replay", await_test, StepInput{Function: AwaitFunction, Replay: []AwaitResult{first, first}}, "did not replay deterministically"},
+		{"await after hand-off", handoff, StepInput{Function: "next"}, "can only be used in main"},
+		{"not a script", "function main() libB.await({}) end", StepInput{Function: "main"}, "expected a libB.Script"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ExecuteLuaStep(context.Background(), tt.code, tt.input)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %v", tt.want, err)
+			}
+		})
+	}
+
+	// Limits still apply inside the coroutine.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := ExecuteLuaStep(ctx, loop, StepInput{Function: "main"})
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) {
+		t.Errorf("Expected a LimitError from an infinite loop, got %v", err)
+	}
+
+	// There is nothing to wait for in the sandbox.
+	_, err = ExecuteLua(context.Background(), `libB.await(libB.Script.new("x"))`)
+	if err == nil || !strings.Contains(err.Error(), "can only be used in a protocol script") {
+		t.Errorf("Expected libB.await to fail in the sandbox, got %v", err)
+	}
+}
+
+func TestAwaitTypeChecks(t *testing.T) {
+	diagnostics, err := CheckScript(context.Background(), await_test)
+	if err != nil {
+		t.Fatalf("CheckScript failed: %v", err)
+	}
+	if len(diagnostics) > 0 {
+		t.Errorf("Expected no diagnostics, got:\n%s", FormatDiagnostics(diagnostics))
+	}
+}
+
+func TestRemapResultMultipleKeys(t *testing.T) {
+	script := func(keys ...string) *Script {
+		var payload []Command
+		for _, key := range keys {
+			payload = append(payload, QuantifyCommand{Type: "quantify", Payload: QuantifyPayload{ReturnKey: key}})
+		}
+		return &Script{Commands: []CommandGroup{{CommandType: "human", Payload: payload}}}
+	}
+	data := map[string]string{"old_a": "1", "old_b": "2", "extra": "3"}
+
+	remapped := remapResult(script("old_a", "old_b"), script("new_a", "new_b"), data)
+	if !reflect.DeepEqual(remapped, map[string]string{"new_a": "1", "new_b": "2", "extra": "3"}) {
+		t.Errorf("Unexpected remapped result: %v", remapped)
+	}
+	// Keys can't be matched up if the number of commands changed.
+	if remapped := remapResult(script("old_a", "old_b"), script("new_a"), data); !reflect.DeepEqual(remapped, data) {
+		t.Errorf("Expected result to be left alone, got %v", remapped)
+	}
+}
+
+// awaitLoopProtocol draws a uuid for every result of an await, in the order
+// pairs visits them.
+const awaitLoopProtocol = `
+function main()
+	local plate = libB.Script.new("plate")
+	local human_commands = libB.HumanCommands.new()
+	for _, well in ipairs({"A1", "A2", "A3", "A4", "A5", "A6", "A7", "A8"}) do
+		human_commands:quantify(well, "nest_96_wellplate_100ul_pcr_full_skirt", "7", well)
+	end
+	plate:add_commands(human_commands)
+	local results = libB.await(plate)
+
+	local again = libB.Script.new("again")
+	human_commands = libB.HumanCommands.new()
+	for well in pairs(results) do
+		human_commands:quantify(well .. "/" .. libB.uuid.generate(), "nest_96_wellplate_100ul_pcr_full_skirt", "7", well)
+	end
+	again:add_commands(human_commands)
+	libB.await(again)
+	return libB.status.SUCCESS, "Done", "", nil, ""
+end
+`
+
+func TestAwaitResultOrderReplay(t *testing.T) {
+	data := make(map[string]string)
+	for i := 1; i <= 8; i++ {
+		data[fmt.Sprintf("A%d", i)] = `{"ng_per_ul": 10}`
+	}
+	var first string
+	for i := 0; i < 20; i++ {
+		state, err := ExecuteLuaStep(context.Background(), awaitLoopProtocol, StepInput{Function: AwaitFunction, Seed: 42, Replay: []AwaitResult{{Data: data}}})
+		if err != nil {
+			t.Fatalf("Failed to replay protocol: %v", err)
+		}
+		scriptJSON, err := json.Marshal(state.Script)
+		if err != nil {
+			t.Fatalf("Failed to marshal script: %v", err)
+		}
+		if i == 0 {
+			first = string(scriptJSON)
+		} else if string(scriptJSON) != first {
+			t.Fatalf("Replay %d looped over the results in a different order:\n%s\n%s", i, first, scriptJSON)
+		}
+	}
+}
@@ -0,0 +1,352 @@
+package libb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/******************************************************************************
+
+Output capture.
+
+A sandbox run is how the model inspects the world, so it needs to see as much
+of what happened as possible, even when the run fails halfway through. Every
+execution writes into a Capture: printed lines, messages logged through
+libB.log.info/warn/error, the chunk's return values rendered as JSON, how
+long it ran for and, on failure, the error along with its Lua traceback.
+Protocol steps are captured the same way with CaptureLuaStep, so the host can
+keep a record of why every step turned out the way it did.
+
+Output is capped at Limits.MaxOutputBytes. Past the cap, further output is
+dropped and the capture is marked as truncated, so a runaway print loop can't
+flood the model's context.
+
+******************************************************************************/
+
+// Log levels for libB.log.
+const (
+	LogInfo  = "info"
+	LogWarn  = "warn"
+	LogError = "error"
+)
+
+// LogEntry is a single message logged through libB.log.
+type LogEntry struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	After   int    `json:"after"` // the number of stdout lines printed before this entry
+}
+
+// Capture is everything observable about a single Lua execution.
+type Capture struct {
+	Stdout    []string          `json:"stdout"`
+	Logs      []LogEntry        `json:"logs"`
+	Returns   []json.RawMessage `json:"returns"`
+	Error     string            `json:"error,omitempty"`
+	Traceback string            `json:"traceback,omitempty"`
+	Truncated bool              `json:"truncated"`
+	WallTime  time.Duration     `json:"wall_time"`
+
+	// Err is the error the execution failed with, if any. It is a
+	// *LimitError if the execution was stopped by its limits.
+	Err error `json:"-"`
+
+	maxBytes int
+	bytes    int
+	partial  strings.Builder
+}
+
+// newCapture creates a capture holding at most maxBytes of output. Zero means
+// no limit.
+func newCapture(maxBytes int) *Capture {
+	return &Capture{maxBytes: maxBytes}
+}
+
+// reserve accounts for n more bytes of output, reporting whether they fit.
+func (c *Capture) reserve(n int) bool {
+	if c.Truncated {
+		return false
+	}
+	if c.maxBytes > 0 && c.bytes+n > c.maxBytes {
+		c.Truncated = true
+		return false
+	}
+	c.bytes += n
+	return true
+}
+
+// Write implements io.Writer for print, splitting output into lines.
+func (c *Capture) Write(p []byte) (int, error) {
+	for _, b := range p {
+		if b != '\n' {
+			c.partial.WriteByte(b)
+			continue
+		}
+		c.addLine(c.partial.String())
+		c.partial.Reset()
+	}
+	return len(p), nil
+}
+
+func (c *Capture) addLine(line string) {
+	if c.reserve(len(line) + 1) {
+		c.Stdout = append(c.Stdout, line)
+	}
+}
+
+// flush keeps any output printed without a trailing newline.
+func (c *Capture) flush() {
+	if c.partial.Len() > 0 {
+		c.addLine(c.partial.String())
+		c.partial.Reset()
+	}
+}
+
+func (c *Capture) log(level, message string) {
+	if c.reserve(len(level) + len(message) + 3) {
+		c.Logs = append(c.Logs, LogEntry{Level: level, Message: message, After: len(c.Stdout)})
+	}
+}
+
+// logFunction returns the libB.log function for a level.
+func (c *Capture) logFunction(level string) lua.LGFunction {
+	return func(L *lua.LState) int {
+		parts := make([]string, L.GetTop())
+		for i := range parts {
+			parts[i] = L.ToStringMeta(L.Get(i + 1)).String()
+		}
+		c.log(level, strings.Join(parts, "\t"))
+		return 0
+	}
+}
+
+// install routes print and libB.log on the state into the capture.
+func (c *Capture) install(L *lua.LState) {
+	L.SetGlobal("print", L.NewFunction(customPrint(c)))
+	if libB, ok := L.GetGlobal("libB").(*lua.LTable); ok {
+		logTable := L.NewTable()
+		for _, level := range []string{LogInfo, LogWarn, LogError} {
+			logTable.RawSetString(level, L.NewFunction(c.logFunction(level)))
+		}
+		libB.RawSetString("log", logTable)
+	}
+}
+
+// setReturns records values returned by the executed chunk.
+func (c *Capture) setReturns(values []lua.LValue) {
+	for _, value := range values {
+		encoded, err := json.Marshal(luaToJSON(value, 0))
+		if err != nil {
+			encoded, _ = json.Marshal(value.String())
+		}
+		if c.reserve(len(encoded)) {
+			c.Returns = append(c.Returns, encoded)
+		}
+	}
+}
+
+// setError records the error an execution failed with.
+func (c *Capture) setError(err error) {
+	c.Err = err
+	var apiErr *lua.ApiError
+	if errors.As(err, &apiErr) {
+		c.Error = apiErr.Object.String()
+		c.Traceback = apiErr.StackTrace
+		return
+	}
+	c.Error = err.Error()
+}
+
+// Output returns the printed output, one line per printed line.
+func (c *Capture) Output() string {
+	if len(c.Stdout) == 0 {
+		return ""
+	}
+	return strings.Join(c.Stdout, "\n") + "\n"
+}
+
+// String renders the capture for the model: printed lines interleaved with
+// log messages, then any return values, the error and a truncation notice.
+func (c *Capture) String() string {
+	var b strings.Builder
+	logs := c.Logs
+	writeLogs := func(printed int) {
+		for len(logs) > 0 && logs[0].After <= printed {
+			fmt.Fprintf(&b, "[%s] %s\n", logs[0].Level, logs[0].Message)
+			logs = logs[1:]
+		}
+	}
+	for i, line := range c.Stdout {
+		writeLogs(i)
+		b.WriteString(line)
+		b.WriteString("\n")
+	}
+	writeLogs(len(c.Stdout))
+
+	if len(c.Returns) > 0 {
+		values := make([]string, len(c.Returns))
+		for i, value := range c.Returns {
+			values[i] = string(value)
+		}
+		fmt.Fprintf(&b, "Returned: %s\n", strings.Join(values, ", "))
+	}
+	if c.Error != "" {
+		fmt.Fprintf(&b, "Error: %s\n", c.Error)
+		if c.Traceback != "" {
+			b.WriteString(c.Traceback)
+			b.WriteString("\n")
+		}
+	}
+	if c.Truncated {
+		fmt.Fprintf(&b, "[output truncated: only the first %d bytes of output were kept]\n", c.maxBytes)
+	}
+	return b.String()
+}
+
+// maxJSONDepth bounds how deeply nested tables are rendered.
+const maxJSONDepth = 16
+
+// luaToJSON converts a Lua value into something encoding/json can render.
+// Tables with keys 1..n become arrays, other tables become objects, and
+// values JSON can't represent become descriptive strings.
+func luaToJSON(value lua.LValue, depth int) interface{} {
+	switch v := value.(type) {
+	case *lua.LNilType:
+		return nil
+	case lua.LBool:
+		return bool(v)
+	case lua.LNumber:
+		f := float64(v)
+		if math.IsInf(f, 0) || math.IsNaN(f) {
+			return v.String()
+		}
+		return f
+	case lua.LString:
+		return string(v)
+	case *lua.LTable:
+		if depth >= maxJSONDepth {
+			return "<table nested too deeply>"
+		}
+		length := v.Len()
+		count := 0
+		v.ForEach(func(_, _ lua.LValue) { count++ })
+		if count == length && length > 0 {
+			array := make([]interface{}, length)
+			for i := 1; i <= length; i++ {
+				array[i-1] = luaToJSON(v.RawGetInt(i), depth+1)
+			}
+			return array
+		}
+		object := make(map[string]interface{}, count)
+		v.ForEach(func(key, value lua.LValue) {
+			object[key.String()] = luaToJSON(value, depth+1)
+		})
+		return object
+	}
+	return value.String()
+}
+
+// CaptureLua executes the provided Lua code with the compiled libB available,
+// bounded by ctx and DefaultLimits, and captures everything it outputs.
+func CaptureLua(ctx context.Context, code string) *Capture {
+	return CaptureLuaWithLimits(ctx, code, DefaultLimits)
+}
+
+// CaptureLuaWithLimits executes the provided Lua code with the compiled libB
+// available and captures everything it outputs. If the code runs past ctx or
+// limits, Capture.Err is a *LimitError.
+func CaptureLuaWithLimits(ctx context.Context, code string, limits Limits) *Capture {
+	capture := newCapture(limits.MaxOutputBytes)
+	pool, err := defaultStatePool()
+	if err != nil {
+		capture.setError(err)
+		return capture
+	}
+	L, err := pool.Get()
+	if err != nil {
+		capture.setError(err)
+		return capture
+	}
+
+	seedRandom(L, time.Now().UnixNano())
+	capture.install(L)
+	start := time.Now()
+
+	// Execute the user's code, keeping the traceback before a limit error
+	// replaces it.
+	var traceback string
+	err = runWithLimits(ctx, L, limits, func() error {
+		fn, err := loadSandboxed(L, strings.NewReader(code))
+		if err != nil {
+			return err
+		}
+		L.Push(fn)
+		if err := L.PCall(0, lua.MultRet, nil); err != nil {
+			var apiErr *lua.ApiError
+			if errors.As(err, &apiErr) {
+				traceback = apiErr.StackTrace
+			}
+			return err
+		}
+		values := make([]lua.LValue, L.GetTop())
+		for i := range values {
+			values[i] = L.Get(i + 1)
+		}
+		capture.setReturns(values)
+		return nil
+	})
+	capture.WallTime = time.Since(start)
+	capture.flush()
+	if err != nil {
+		capture.setError(err)
+		if capture.Traceback == "" {
+			capture.Traceback = traceback
+		}
+		pool.Close(L)
+		return capture
+	}
+
+	pool.Put(L)
+	return capture
+}
+
+// traceback renders the call stack of L in the style of debug.traceback. It
+// is used for coroutines, whose errors don't carry a traceback.
+func traceback(L *lua.LState) string {
+	lines := []string{"stack traceback:"}
+	for level := 0; ; level++ {
+		dbg, ok := L.GetStack(level)
+		if !ok {
+			break
+		}
+		if _, err := L.GetInfo("Sln", dbg, lua.LNil); err != nil {
+			break
+		}
+		if dbg.What == "G" {
+			if dbg.Name == "" {
+				lines = append(lines, "\t[G]: ?")
+			} else {
+				lines = append(lines, fmt.Sprintf("\t[G]: in function '%s'", dbg.Name))
+			}
+			continue
+		}
+		// The bottom of a coroutine is the function it was started with,
+		// which has no name to report.
+		name := fmt.Sprintf("function <%s:%d>", dbg.Source, dbg.LineDefined)
+		if dbg.What != "main" && dbg.Name != "" {
+			name = fmt.Sprintf("function '%s'", dbg.Name)
+		}
+		lines = append(lines, fmt.Sprintf("\t%s:%d: in %s", dbg.Source, dbg.CurrentLine, name))
+		if dbg.What == "main" {
+			break
+		}
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,147 @@
+package libb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestCaptureLua(t *testing.T) {
+	capture := CaptureLua(context.Background(), `
+print("first", true, nil)
+libB.log.warn("low volume:", 5)
+print("second")
+libB.log.info("done")
+return 1, "two", { a = 1, b = { 1, 2 } }
+`)
+	if capture.Err != nil {
+		t.Fatalf("Unexpected error: %v", capture.Err)
+	}
+	expected := `first	true	nil
+[warn] low volume:	5
+second
+[info] done
+Returned: 1, "two", {"a":1,"b":[1,2]}
+`
+	if got := capture.String(); got != expected {
+		t.Errorf("Unexpected capture:\n%s\nwant:\n%s", got, expected)
+	}
+	if len(capture.Logs) != 2 || capture.Logs[0].Level != LogWarn || capture.Logs[1].Level != LogInfo {
+		t.Errorf("Unexpected logs: %+v", capture.Logs)
+	}
+}
+
+func TestCaptureLuaError(t *testing.T) {
+	capture := CaptureLua(context.Background(), `
+print("before")
+local function explode()
+	error("boom")
+end
+explode()
+print("after")
+`)
+	if capture.Err == nil {
+		t.Fatal("Expected an error")
+	}
+	if len(capture.Stdout) != 1 || capture.Stdout[0] != "before" {
+		t.Errorf("Expected output printed before the error to be kept, got %q", capture.Stdout)
+	}
+	if !strings.Contains(capture.Error, "boom") {
+		t.Errorf("Expected error to mention boom, got %q", capture.Error)
+	}
+	if !strings.Contains(capture.Traceback, "explode") {
+		t.Errorf("Expected traceback to mention explode, got %q", capture.Traceback)
+	}
+	if !strings.Contains(capture.String(), "before\nError: ") {
+		t.Errorf("Expected partial output followed by the error, got:\n%s", capture.String())
+	}
+}
+
+func TestCaptureLuaTruncation(t *testing.T) {
+	limits := DefaultLimits
+	limits.MaxOutputBytes = 100
+	capture := CaptureLuaWithLimits(context.Background(), `
+for i = 1, 1000 do
+	print("line " .. i)
+end
+`, limits)
+	if capture.Err != nil {
+		t.Fatalf("Unexpected error: %v", capture.Err)
+	}
+	if !capture.Truncated {
+		t.Error("Expected output to be truncated")
+	}
+	if len(capture.Stdout) == 0 || len(capture.Stdout) > 20 {
+		t.Errorf("Expected only the first lines to be kept, got %d", len(capture.Stdout))
+	}
+	if !strings.HasSuffix(capture.String(), "[output truncated: only the first 100 bytes of output were kept]\n") {
+		t.Errorf("Expected a truncation notice, got:\n%s", capture.String())
+	}
+}
+
+func TestCaptureLuaLimit(t *testing.T) {
+	limits := DefaultLimits
+	limits.MaxInstructions = 10_000
+	capture := CaptureLuaWithLimits(context.Background(), `
+print("started")
+while true do end
+`, limits)
+	var limitErr *LimitError
+	if !errors.As(capture.Err, &limitErr) {
+		t.Fatalf("Expected a LimitError, got %v", capture.Err)
+	}
+	if len(capture.Stdout) != 1 || !strings.Contains(capture.Error, "instruction budget exceeded") {
+		t.Errorf("Unexpected capture: %+v", capture)
+	}
+}
+
+func TestCaptureLuaStep(t *testing.T) {
+	code := `
+function main()
+	print("measuring")
+	libB.log.info("branching on", 30)
+	return libB.status.CONTINUE, "Check reading", "check", "", "30"
+end
+
+local function validate(reading)
+	if reading < 50 then
+		error("reading too low: " .. reading)
+	end
+end
+
+function check(passthrough)
+	pcall(error, "caught")
+	print("checking " .. passthrough)
+	validate(tonumber(passthrough))
+	return libB.status.SUCCESS, "", "", "", ""
+end
+`
+	state, capture := CaptureLuaStep(context.Background(), code, StepInput{Function: "main"})
+	if capture.Err != nil {
+		t.Fatalf("Unexpected error: %v", capture.Err)
+	}
+	if state.NextFunc != "check" {
+		t.Errorf("Expected next function check, got %q", state.NextFunc)
+	}
+	if got := capture.String(); got != "measuring\n[info] branching on\t30\n" {
+		t.Errorf("Unexpected capture:\n%s", got)
+	}
+	if capture.WallTime <= 0 {
+		t.Error("Expected wall time to be recorded")
+	}
+
+	state, capture = CaptureLuaStep(context.Background(), code, StepInput{Function: "check", Passthrough: "30"})
+	if state != nil || capture.Err == nil {
+		t.Fatalf("Expected check to fail, got %+v", state)
+	}
+	if len(capture.Stdout) != 1 || capture.Stdout[0] != "checking 30" {
+		t.Errorf("Expected output printed before the error to be kept, got %q", capture.Stdout)
+	}
+	if !strings.Contains(capture.Error, "reading too low: 30") {
+		t.Errorf("Expected error to mention the reading, got %q", capture.Error)
+	}
+	if !strings.Contains(capture.Traceback, "in function 'validate'") || strings.Contains(capture.Traceback, "caught") {
+		t.Errorf("Expected traceback through validate, got:\n%s", capture.Traceback)
+	}
+}
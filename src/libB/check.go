@@ -0,0 +1,184 @@
+package libb
+
+import (
+	"context"
+	_ "embed"
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/******************************************************************************
+
+Type checking.
+
+Scripts written by the model are plain Lua, but libB itself is written in
+Teal, so we know the type of everything a script can call. Before a protocol
+is started, the script is checked with the embedded Teal compiler against
+libB's declarations: calls with the wrong number or types of arguments,
+misspelled libB functions, reads of variables that are never defined and
+uses of anything the sandbox strips, such as io or os.time, are all reported
+with a line and column, without running anything.
+
+Checking libB.tl itself takes far longer than checking a script, so it is
+only done once per process. A single checker state is kept around and shared
+between callers. Scripts are as untrusted when checked as when run, so each
+check is bounded by DefaultLimits too, and holds up other checks for no
+longer than that.
+
+******************************************************************************/
+
+//go:embed check.lua
+var checkLua string
+
+// Diagnostic is a single problem found while checking a script.
+type Diagnostic struct {
+	Line    int    `json:"line"`
+	Column  int    `json:"column"`
+	Message string `json:"message"`
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d:%d: %s", d.Line, d.Column, d.Message)
+}
+
+// FormatDiagnostics formats diagnostics one per line.
+func FormatDiagnostics(diagnostics []Diagnostic) string {
+	lines := make([]string, len(diagnostics))
+	for i, d := range diagnostics {
+		lines[i] = d.String()
+	}
+	return strings.Join(lines, "\n")
+}
+
+// swapPattern matches Lua statements of the form `a, b = b, a`.
+var swapPattern = regexp.MustCompile(`(?m)^(\s*)(\w+), (\w+) = (\w+), (\w+)\s*$`)
+
+// patchSwaps rewrites `a, b = b, a` in the Teal compiler to use a temporary.
+// gopher-lua assigns both locals the same value for that statement, which
+// breaks Teal's handling of flipped comparison operators.
+func patchSwaps(source string) string {
+	return swapPattern.ReplaceAllStringFunc(source, func(line string) string {
+		m := swapPattern.FindStringSubmatch(line)
+		if m[2] != m[5] || m[3] != m[4] {
+			return line
+		}
+		return fmt.Sprintf("%sdo local swap_tmp = %s; %s = %s; %s = swap_tmp end", m[1], m[2], m[2], m[3], m[3])
+	})
+}
+
+// checker is a Lua state holding the Teal compiler with libB already checked.
+type checker struct {
+	mu    sync.Mutex
+	L     *lua.LState
+	check *lua.LFunction
+}
+
+var (
+	checkerOnce sync.Once
+	sharedCheck *checker
+	checkerErr  error
+)
+
+func defaultChecker() (*checker, error) {
+	checkerOnce.Do(func() {
+		L := lua.NewState()
+		if err := L.DoString(patchSwaps(tlCompiler)); err != nil {
+			L.Close()
+			checkerErr = fmt.Errorf("failed to load teal compiler: %v", err)
+			return
+		}
+		tl := L.Get(-1)
+		L.Pop(1)
+
+		fn, err := L.LoadString(checkLua)
+		if err != nil {
+			L.Close()
+			checkerErr = fmt.Errorf("failed to load checker: %v", err)
+			return
+		}
+		L.Push(fn)
+		L.Push(tl)
+		L.Push(lua.LString(tealContent))
+		L.Push(sandboxTable(L))
+		if err := L.PCall(3, 1, nil); err != nil {
+			L.Close()
+			checkerErr = fmt.Errorf("failed to check libB: %v", err)
+			return
+		}
+		check, ok := L.Get(-1).(*lua.LFunction)
+		L.Pop(1)
+		if !ok {
+			L.Close()
+			checkerErr = fmt.Errorf("checker did not return a function")
+			return
+		}
+		sharedCheck = &checker{L: L, check: check}
+	})
+	return sharedCheck, checkerErr
+}
+
+// sandboxTable describes the sandbox to check.lua: the globals scripts run
+// with, and the functions left in os.
+func sandboxTable(L *lua.LState) *lua.LTable {
+	set := func(names map[string]bool) *lua.LTable {
+		table := L.NewTable()
+		for name := range names {
+			table.RawSetString(name, lua.LTrue)
+		}
+		return table
+	}
+	sandbox := L.NewTable()
+	sandbox.RawSetString("globals", set(sandboxedBaseFunctions))
+	sandbox.RawSetString("os", set(sandboxedOsFunctions))
+	return sandbox
+}
+
+// CheckScript type checks a Lua script against libB. It returns the problems
+// found, sorted by position, or an error if the checker itself failed. A
+// script with no diagnostics is safe to start. The check is bounded by ctx
+// and DefaultLimits.
+func CheckScript(ctx context.Context, code string) ([]Diagnostic, error) {
+	c, err := defaultChecker()
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := ctx.Err(); err != nil {
+		// Given up on while waiting for another check.
+		return nil, fmt.Errorf("failed to check script: %w", err)
+	}
+
+	L := c.L
+	defer L.SetTop(0)
+	err = runWithLimits(ctx, L, DefaultLimits, func() error {
+		L.Push(c.check)
+		L.Push(lua.LString(code))
+		return L.PCall(1, 1, nil)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to check script: %w", err)
+	}
+	results, ok := L.Get(-1).(*lua.LTable)
+	if !ok {
+		return nil, fmt.Errorf("checker returned %s, expected table", L.Get(-1).Type())
+	}
+
+	var diagnostics []Diagnostic
+	results.ForEach(func(_, value lua.LValue) {
+		entry, ok := value.(*lua.LTable)
+		if !ok {
+			return
+		}
+		diagnostics = append(diagnostics, Diagnostic{
+			Line:    int(lua.LVAsNumber(entry.RawGetString("line"))),
+			Column:  int(lua.LVAsNumber(entry.RawGetString("column"))),
+			Message: lua.LVAsString(entry.RawGetString("message")),
+		})
+	})
+	return diagnostics, nil
+}
@@ -0,0 +1,140 @@
+-- check.lua type checks user scripts against libB's Teal declarations.
+--
+-- It is loaded once with the Teal compiler and libB's source, type checks
+-- libB, and returns a function which checks a single script. Scripts are
+-- checked in lax mode, so plain Lua without annotations is accepted, but every
+-- call into libB is checked against its declared types. Scripts are checked
+-- against the globals they run with, so anything the sandbox strips, such as
+-- io or os.time, is reported rather than failing mid-protocol.
+local tl, libB_source, sandbox = ...
+
+local function new_env()
+   return tl.new_env({ defaults = { feat_lax = "off", gen_target = "5.1", gen_compat = "off" } })
+end
+
+local libB_env = new_env()
+local libB_program, libB_syntax_errors = tl.parse(libB_source, "libB.tl", "tl")
+if #libB_syntax_errors > 0 then
+   local e = libB_syntax_errors[1]
+   error(string.format("libB.tl:%d:%d: %s", e.y, e.x, e.msg))
+end
+local libB_result = tl.check(libB_program, "libB.tl", libB_env.defaults, libB_env)
+if #libB_result.type_errors > 0 then
+   local e = libB_result.type_errors[1]
+   error(string.format("libB.tl:%d:%d: %s", e.y, e.x, e.msg))
+end
+local libB_type = libB_result.type
+
+-- The globals every script is run with.
+local prelude = [[
+global libB = require("libB")
+global DATA: {string:{string:string}}
+]]
+
+-- Names which only exist for the checker, or which the prelude declares.
+local checker_globals = { ["..."] = true, ["@is_va"] = true, FILE = true, metatable = true, libB = true, DATA = true }
+
+local function copy(t)
+   local c = {}
+   for k, v in pairs(t) do
+      c[k] = v
+   end
+   return setmetatable(c, getmetatable(t))
+end
+
+-- strip removes everything the sandbox strips from env's globals, and from
+-- os, leaving the types os declares.
+local function strip(env)
+   for name in pairs(env.globals) do
+      if not sandbox.globals[name] and not checker_globals[name] then
+         env.globals[name] = nil
+         env.modules[name] = nil
+      end
+   end
+   local os_var = env.globals["os"]
+   local os_t = copy(os_var.t)
+   local def = copy(os_t.def)
+   def.fields, def.field_order = {}, {}
+   for _, name in ipairs(os_t.def.field_order) do
+      local field = os_t.def.fields[name]
+      if sandbox.os[name] or field.typename == "typedecl" then
+         def.fields[name] = field
+         table.insert(def.field_order, name)
+      end
+   end
+   os_t.def = def
+   os_var = copy(os_var)
+   os_var.t = os_t
+   env.globals["os"] = os_var
+   env.modules["os"] = os_t
+end
+
+-- walk finds every variable read and every name assigned to in the AST.
+local function walk(node, reads, assigned, visited)
+   if type(node) ~= "table" or visited[node] then
+      return
+   end
+   visited[node] = true
+   if node.kind == "variable" and node.tk then
+      if node.is_lvalue then
+         assigned[node.tk] = true
+      else
+         reads[node.y .. ":" .. node.x] = node.tk
+      end
+   elseif node.kind == "global_function" and node.name then
+      assigned[node.name.tk] = true
+   end
+   for _, child in pairs(node) do
+      walk(child, reads, assigned, visited)
+   end
+end
+
+return function(code)
+   local diagnostics = {}
+   local function add(y, x, msg)
+      table.insert(diagnostics, { line = y, column = x, message = msg })
+   end
+
+   local env = new_env()
+   env.modules["libB"] = libB_type
+   tl.check_string(prelude, env, "prelude.tl")
+   strip(env)
+   env.defaults.feat_lax = "on"
+
+   local program, syntax_errors = tl.parse(code, "script.lua", "lua")
+   if #syntax_errors > 0 then
+      for _, e in ipairs(syntax_errors) do
+         add(e.y, e.x, e.msg)
+      end
+      return diagnostics
+   end
+
+   local reads, assigned = {}, {}
+   walk(program, reads, assigned, {})
+
+   local result = tl.check(program, "script.lua", env.defaults, env)
+   for _, e in ipairs(result.type_errors) do
+      add(e.y, e.x, e.msg)
+   end
+
+   -- Lax mode only warns about unknown variables. Reading a name that is
+   -- never assigned anywhere is always a bug, so report those as errors.
+   for _, w in ipairs(result.warnings or {}) do
+      local name = w.tag == "unknown" and w.msg:match("^unknown variable: (.+)$")
+      if name and reads[w.y .. ":" .. w.x] == name and not assigned[name] and not env.globals[name] then
+         add(w.y, w.x, "unknown variable: " .. name)
+      end
+   end
+
+   if not assigned["main"] then
+      add(1, 1, "script must define a global function main")
+   end
+
+   table.sort(diagnostics, function(a, b)
+      if a.line ~= b.line then
+         return a.line < b.line
+      end
+      return a.column < b.column
+   end)
+   return diagnostics
+end
@@ -0,0 +1,135 @@
+package libb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestCheckScript(t *testing.T) {
+	tests := []struct {
+		name string
+		code string
+		want []string // substrings of the expected diagnostics, in order
+	}{
+		{
+			name: "example protocol",
+			code: simple_test,
+		},
+		{
+			name: "forward references and globals",
+			code: `
+function main()
+	count = 1
+	helper(count)
+	return 0, "", "", "", ""
+end
+
+function helper(n)
+	print(n + count)
+end
+`,
+		},
+		{
+			name: "missing libB prefix",
+			code: `
+function main()
+	local human_commands = HumanCommands.new()
+	return 0, "", "", "", ""
+end
+`,
+			want: []string{"3:25: unknown variable: HumanCommands"},
+		},
+		{
+			name: "wrong arguments",
+			code: `
+function main()
+	local script = libB.Script.new(libB.uuid.generate(), "extra")
+	local labware = libB.Labware.new("opentrons_96_tiprack_20ul", 1)
+	return 0, "", "", script:to_json(), ""
+end
+`,
+			want: []string{
+				"3:32: wrong number of arguments (given 2, expects 1)",
+				"4:64: argument 2: got integer, expected string",
+			},
+		},
+		{
+			name: "unknown libB function",
+			code: `
+function main()
+	local commands = libB.OpentronsCommands.new()
+	commands:teleport()
+	return 0, "", "", "", ""
+end
+`,
+			want: []string{"4:11: invalid key 'teleport'"},
+		},
+		{
+			name: "functions the sandbox strips",
+			code: `
+function main()
+	local now = os.time()
+	io.write("hello")
+	local ok = os.difftime(now, now)
+	return 0, "", "", "", ""
+end
+`,
+			want: []string{"3:17: invalid key 'time'", "4:2: unknown variable: io"},
+		},
+		{
+			name: "local main",
+			code: `
+local function main()
+	return 0, "", "", "", ""
+end
+`,
+			want: []string{"1:1: script must define a global function main"},
+		},
+		{
+			name: "syntax error",
+			code: `function main(`,
+			want: []string{"1:15: syntax error"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			diagnostics, err := CheckScript(context.Background(), tt.code)
+			if err != nil {
+				t.Fatalf("CheckScript failed: %v", err)
+			}
+			if len(diagnostics) != len(tt.want) {
+				t.Fatalf("got %d diagnostics, want %d:\n%s", len(diagnostics), len(tt.want), FormatDiagnostics(diagnostics))
+			}
+			for i, want := range tt.want {
+				if got := diagnostics[i].String(); !strings.Contains(got, want) {
+					t.Errorf("diagnostic %d = %q, want it to contain %q", i, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCheckScriptLimits(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := CheckScript(ctx, simple_test); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected a cancelled check to fail, got %v", err)
+	}
+
+	// A script which takes too long to check is stopped at the deadline.
+	huge := "function main()\n" + strings.Repeat("local x = 1 + 2 * 3\n", 20000) + "return 0, \"\", \"\", nil, \"\"\nend\n"
+	ctx, cancel = context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := CheckScript(ctx, huge); !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected a slow check to time out, got %v", err)
+	}
+
+	// The shared checker still works afterwards.
+	diagnostics, err := CheckScript(context.Background(), simple_test)
+	if err != nil || len(diagnostics) != 0 {
+		t.Errorf("Expected the next check to pass, got %v, %s", err, FormatDiagnostics(diagnostics))
+	}
+}
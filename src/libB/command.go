@@ -0,0 +1,165 @@
+package libb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+/******************************************************************************
+
+Commands.
+
+Scripts arrive as JSON, from Lua or over HTTP, but everything done with them in
+Go - validating, simulating, exporting and executing - wants real types. So
+each command in a CommandGroup is decoded into the concrete type registered
+for its group's command_type and its own type, and kept behind the Command
+interface. Anything unknown, whether a group, a command or a command's field,
+is an error rather than being silently dropped, so nothing is lost by decoding.
+
+Groups are always encoded in one canonical form: compact, with fields in the
+order of types.go, numbers as Go writes them and optional fields left out
+rather than null. A group in canonical form round trips byte for byte, and any
+other group matching ScriptSchema is re-encoded in canonical form with the
+same value.
+
+******************************************************************************/
+
+// Command is a single command of a CommandGroup. Its concrete type is one of
+// the command types in types.go.
+type Command interface {
+	// Kind returns the command's type, such as "move_to".
+	Kind() string
+}
+
+// ResultCommand is a Command whose result is uploaded under a return key.
+type ResultCommand interface {
+	Command
+	ResultKey() string
+}
+
+func (c MoveToCommand) Kind() string           { return c.Type }
+func (c AspirateDispenseCommand) Kind() string { return c.Type }
+func (c PickUpTipCommand) Kind() string        { return c.Type }
+func (c DropTipCommand) Kind() string          { return c.Type }
+func (c HomeCommand) Kind() string             { return c.Type }
+func (c TCSetLidTempCommand) Kind() string     { return c.Type }
+func (c TCSetBlockTempCommand) Kind() string   { return c.Type }
+func (c TCExecuteProfileCommand) Kind() string { return c.Type }
+func (c TCSimpleCommand) Kind() string         { return c.Type }
+func (c QuantifyCommand) Kind() string         { return c.Type }
+
+func (c QuantifyCommand) ResultKey() string { return c.Payload.ReturnKey }
+
+// commandDecoder decodes a single command's JSON into its concrete type.
+type commandDecoder func(data []byte) (Command, error)
+
+// decodeCommand decodes a command into a T, rejecting unknown fields.
+func decodeCommand[T Command](data []byte) (Command, error) {
+	var command T
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&command); err != nil {
+		return nil, err
+	}
+	return command, nil
+}
+
+// commandTypes holds the decoder for each command type, keyed by the
+// command_type of the group it belongs to, then its type.
+var commandTypes = map[string]map[string]commandDecoder{
+	"opentrons": {
+		"home":                decodeCommand[HomeCommand],
+		"move_to":             decodeCommand[MoveToCommand],
+		"aspirate":            decodeCommand[AspirateDispenseCommand],
+		"dispense":            decodeCommand[AspirateDispenseCommand],
+		"pick_up_tip":         decodeCommand[PickUpTipCommand],
+		"drop_tip":            decodeCommand[DropTipCommand],
+		"tc_set_lid_temp":     decodeCommand[TCSetLidTempCommand],
+		"tc_set_block_temp":   decodeCommand[TCSetBlockTempCommand],
+		"tc_execute_profile":  decodeCommand[TCExecuteProfileCommand],
+		"tc_open_lid":         decodeCommand[TCSimpleCommand],
+		"tc_close_lid":        decodeCommand[TCSimpleCommand],
+		"tc_deactivate_lid":   decodeCommand[TCSimpleCommand],
+		"tc_deactivate_block": decodeCommand[TCSimpleCommand],
+	},
+	"human": {
+		"quantify": decodeCommand[QuantifyCommand],
+	},
+}
+
+// checkGroup returns an error unless every command is of a type decoded for
+// the command_type groupType.
+func checkGroup(groupType string, kinds []string) error {
+	decoders, ok := commandTypes[groupType]
+	if !ok {
+		return fmt.Errorf("unknown command_type %q", groupType)
+	}
+	for i, kind := range kinds {
+		if _, ok := decoders[kind]; !ok {
+			return fmt.Errorf("unknown %s command type %q at payload %d", groupType, kind, i)
+		}
+	}
+	return nil
+}
+
+// UnmarshalJSON decodes a CommandGroup, decoding each command into its
+// concrete type.
+func (g *CommandGroup) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		CommandType string            `json:"command_type"`
+		Payload     []json.RawMessage `json:"payload"`
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&raw); err != nil {
+		return fmt.Errorf("invalid command group: %v", err)
+	}
+
+	kinds := make([]string, len(raw.Payload))
+	for i, rawCommand := range raw.Payload {
+		var header struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(rawCommand, &header); err != nil {
+			return fmt.Errorf("invalid %s command at payload %d: %v", raw.CommandType, i, err)
+		}
+		kinds[i] = header.Type
+	}
+	if err := checkGroup(raw.CommandType, kinds); err != nil {
+		return err
+	}
+
+	payload := make([]Command, len(raw.Payload))
+	for i, rawCommand := range raw.Payload {
+		command, err := commandTypes[raw.CommandType][kinds[i]](rawCommand)
+		if err != nil {
+			return fmt.Errorf("invalid %s command at payload %d: %v", kinds[i], i, err)
+		}
+		payload[i] = command
+	}
+	if raw.Payload == nil {
+		// Keep a missing payload missing.
+		payload = nil
+	}
+	g.CommandType = raw.CommandType
+	g.Payload = payload
+	return nil
+}
+
+// MarshalJSON encodes a CommandGroup. Like decoding, it fails on commands of a
+// type the group doesn't have, so anything encoded can be decoded again.
+func (g CommandGroup) MarshalJSON() ([]byte, error) {
+	kinds := make([]string, len(g.Payload))
+	for i, command := range g.Payload {
+		if command == nil {
+			return nil, fmt.Errorf("nil %s command at payload %d", g.CommandType, i)
+		}
+		kinds[i] = command.Kind()
+	}
+	if err := checkGroup(g.CommandType, kinds); err != nil {
+		return nil, err
+	}
+	type commandGroup CommandGroup // without these methods
+	return json.Marshal(commandGroup(g))
+}
@@ -0,0 +1,133 @@
+package libb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestCommandGroupDecoding(t *testing.T) {
+	output, err := ExecuteLua(context.Background(), "print(libB.generate_protocol())")
+	if err != nil {
+		t.Fatalf("Failed to execute Lua code: %v", err)
+	}
+	script, err := ParseScript([]byte(output))
+	if err != nil {
+		t.Fatalf("Failed to parse script: %v", err)
+	}
+
+	opentrons := script.Commands[0].Payload
+	if _, ok := opentrons[0].(HomeCommand); !ok {
+		t.Errorf("Expected a HomeCommand, got %T", opentrons[0])
+	}
+	if aspirate, ok := opentrons[2].(AspirateDispenseCommand); !ok || aspirate.Kind() != "aspirate" || aspirate.Payload.Volume != 10 || aspirate.Payload.MoveTo.Address != "A1" {
+		t.Errorf("Expected an aspirate of 10 from A1, got %+v", opentrons[2])
+	}
+	var profile TCExecuteProfileCommand
+	for _, command := range opentrons {
+		if c, ok := command.(TCExecuteProfileCommand); ok {
+			profile = c
+		}
+	}
+	if len(profile.Payload.Steps) != 3 || profile.Payload.Repetitions != 30 || *profile.Payload.BlockMaxVolume != 50 {
+		t.Errorf("Unexpected thermocycler profile: %+v", profile)
+	}
+	quantify, ok := script.Commands[1].Payload[0].(QuantifyCommand)
+	if !ok || quantify.ResultKey() != "b6885800-f454-4f19-9c60-ff725aa2d51a" {
+		t.Errorf("Expected a quantify command, got %+v", script.Commands[1].Payload[0])
+	}
+
+	// Re-encoding what Go encoded is stable byte for byte.
+	encoded, err := json.Marshal(script)
+	if err != nil {
+		t.Fatalf("Failed to marshal script: %v", err)
+	}
+	var decoded Script
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		t.Fatalf("Failed to unmarshal script: %v", err)
+	}
+	again, err := json.Marshal(decoded)
+	if err != nil {
+		t.Fatalf("Failed to marshal script: %v", err)
+	}
+	if string(again) != string(encoded) {
+		t.Errorf("Round trip changed the script:\n%s\n%s", encoded, again)
+	}
+}
+
+func TestCommandGroupRoundTrip(t *testing.T) {
+	// Groups in canonical form round trip byte for byte.
+	groups := []string{
+		`{"command_type":"opentrons","payload":[{"type":"home"},{"type":"drop_tip","payload":{"pipette":{"pipette":"p20_single_gen2","side":"right"},"labware":"opentrons_96_tiprack_20ul","deck_slot":"1","address":"A1","trash":false}},{"type":"tc_set_block_temp","payload":{"temperature":4,"hold_time_seconds":30}},{"type":"tc_close_lid"}]}`,
+		`{"command_type":"opentrons","payload":[{"type":"move_to","payload":{"pipette":{"pipette":"p300_single_gen2","side":"left"},"labware":"nest_96_wellplate_100ul_pcr_full_skirt","deck_slot":"7","address":"H12","z":-1.5,"module":"thermocycler"}}]}`,
+		`{"command_type":"opentrons","payload":[{"type":"tc_execute_profile","payload":{"steps":[{"temperature":98,"hold_time_seconds":10},{"temperature":60.5,"hold_time_seconds":20}],"repetitions":30,"block_max_volume":50}}]}`,
+		`{"command_type":"human","payload":[{"type":"quantify","payload":{"labware":"nest_96_wellplate_100ul_pcr_full_skirt","deck_slot":"7","address":"A1","return_key":"dna"}}]}`,
+		`{"command_type":"human","payload":[]}`,
+	}
+	for _, group := range groups {
+		var decoded CommandGroup
+		if err := json.Unmarshal([]byte(group), &decoded); err != nil {
+			t.Errorf("Failed to unmarshal %s: %v", group, err)
+			continue
+		}
+		encoded, err := json.Marshal(decoded)
+		if err != nil {
+			t.Errorf("Failed to marshal %s: %v", group, err)
+			continue
+		}
+		if string(encoded) != group {
+			t.Errorf("Round trip changed the group:\n%s\n%s", group, encoded)
+		}
+	}
+
+	// Any other group is re-encoded in canonical form.
+	canonical := map[string]string{
+		`{ "payload": [ {"payload": {"temperature": 4.0, "hold_time_seconds": 3e1}, "type": "tc_set_block_temp"} ], "command_type": "opentrons" }`: `{"command_type":"opentrons","payload":[{"type":"tc_set_block_temp","payload":{"temperature":4,"hold_time_seconds":30}}]}`,
+		`{"command_type":"opentrons","payload":[{"type":"tc_execute_profile","payload":{"steps":[],"repetitions":1,"block_max_volume":null}}]}`:    `{"command_type":"opentrons","payload":[{"type":"tc_execute_profile","payload":{"steps":[],"repetitions":1}}]}`,
+	}
+	for group, want := range canonical {
+		var decoded CommandGroup
+		if err := json.Unmarshal([]byte(group), &decoded); err != nil {
+			t.Errorf("Failed to unmarshal %s: %v", group, err)
+			continue
+		}
+		encoded, err := json.Marshal(decoded)
+		if err != nil {
+			t.Errorf("Failed to marshal %s: %v", group, err)
+			continue
+		}
+		if string(encoded) != want {
+			t.Errorf("Expected %s to be re-encoded as\n%s\ngot\n%s", group, want, encoded)
+		}
+	}
+}
+
+func TestCommandGroupErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		group string
+		err   string
+	}{
+		{"unknown group", `{"command_type":"robot","payload":[]}`, `unknown command_type "robot"`},
+		{"unknown command", `{"command_type":"opentrons","payload":[{"type":"home"},{"type":"shake"}]}`, `unknown opentrons command type "shake" at payload 1`},
+		{"command in the wrong group", `{"command_type":"opentrons","payload":[{"type":"quantify","payload":{}}]}`, `unknown opentrons command type "quantify"`},
+		{"unknown field", `{"command_type":"opentrons","payload":[{"type":"tc_set_lid_temp","payload":{"temperature":100,"ramp":1}}]}`, `unknown field "ramp"`},
+		{"unknown group field", `{"command_type":"human","payload":[],"priority":1}`, `unknown field "priority"`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var group CommandGroup
+			err := json.Unmarshal([]byte(tt.group), &group)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected an error mentioning %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// Commands which couldn't be decoded again can't be encoded either.
+	group := CommandGroup{CommandType: "human", Payload: []Command{HomeCommand{Type: "home"}}}
+	if _, err := json.Marshal(group); err == nil || !strings.Contains(err.Error(), `unknown human command type "home" at payload 0`) {
+		t.Errorf("Expected encoding a home command as human to fail, got %v", err)
+	}
+}
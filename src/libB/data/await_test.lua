@@ -0,0 +1,16 @@
+function main()
+	local plate = "nest_96_wellplate_100ul_pcr_full_skirt"
+
+	local first = libB.Script.new("first")
+	first:add_commands(libB.HumanCommands.new():quantify("dna", plate, "7", "A1"))
+	local dna = libB.json.decode(libB.await(first, "Quantify DNA")["dna"])
+	if dna.ng_per_ul < 25 then
+		return 1, "Low DNA concentration", "", "", ""
+	end
+
+	local second = libB.Script.new("second")
+	second:add_commands(libB.HumanCommands.new():quantify("diluted", plate, "7", "A2"))
+	local diluted = libB.json.decode(libB.await(second)["diluted"])
+
+	return 0, string.format("%d ng/uL, diluted to %d ng/uL", dna.ng_per_ul, diluted.ng_per_ul), "", "", ""
+end
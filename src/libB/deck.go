@@ -0,0 +1,424 @@
+package libb
+
+import (
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/******************************************************************************
+
+Deck validation.
+
+The script schema only checks that a script is well formed. A well formed
+script can still ask for things the robot cannot do: aspirate without a tip,
+dispense through a closed thermocycler lid, or put two plates in one slot. The
+robot finds these out halfway through a run, with reagents already spent, so
+ValidateDeck finds them first by simulating the deck command by command.
+
+The simulation only knows what the script tells it. Nothing says whether the
+thermocycler lid starts open or closed, for instance, so touching the plate
+before the script opens the lid is a warning rather than an error. Errors are
+things that are wrong whatever the deck looked like beforehand.
+
+******************************************************************************/
+
+// Severities of a DeckIssue.
+const (
+	DeckError   = "error"
+	DeckWarning = "warning"
+)
+
+// DeckIssue is a problem ValidateDeck found with a script, located at the
+// command that caused it.
+type DeckIssue struct {
+	Severity string `json:"severity"` // DeckError or DeckWarning
+	Group    int    `json:"group"`    // index into the script's commands
+	Command  int    `json:"command"`  // index into the group's payload
+	Kind     string `json:"kind"`     // the command's type
+	Message  string `json:"message"`
+}
+
+func (i DeckIssue) String() string {
+	return fmt.Sprintf("%s: commands.%d.payload.%d (%s): %s", i.Severity, i.Group, i.Command, i.Kind, i.Message)
+}
+
+// DeckErrors returns an error listing the errors among issues, or nil if
+// there are only warnings.
+func DeckErrors(issues []DeckIssue) error {
+	var messages []string
+	for _, issue := range issues {
+		if issue.Severity == DeckError {
+			messages = append(messages, issue.String())
+		}
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%s", strings.Join(messages, "; "))
+}
+
+// pipetteVolume is the range of volumes, in uL, a pipette can move at once.
+type pipetteVolume struct {
+	min, max float64
+}
+
+// pipetteVolumes holds the volume range of each pipette model.
+var pipetteVolumes = map[string]pipetteVolume{
+	"p20_single_gen2":   {1, 20},
+	"p20_multi_gen2":    {1, 20},
+	"p300_single_gen2":  {20, 300},
+	"p300_multi_gen2":   {20, 300},
+	"p1000_single_gen2": {100, 1000},
+}
+
+// thermocyclerSlot is the slot labware on the thermocycler is addressed by.
+// The thermocycler covers the slots in thermocyclerCovers as well.
+const thermocyclerSlot = "7"
+
+var thermocyclerCovers = []string{"8", "10", "11"}
+
+// mountSides are the OT-2's pipette mounts.
+var mountSides = map[string]bool{"left": true, "right": true}
+
+// deckSlots are the OT-2's deck slots. Slot 12 is the fixed trash.
+var deckSlots = map[string]bool{
+	"1": true, "2": true, "3": true, "4": true, "5": true, "6": true,
+	"7": true, "8": true, "9": true, "10": true, "11": true,
+}
+
+// Thermocycler lid states.
+const (
+	lidUnknown = iota
+	lidOpen
+	lidClosed
+)
+
+// deckLocation is a well of a labware on the deck.
+type deckLocation struct {
+	labware  string
+	slot     string
+	address  string
+	onModule string
+}
+
+func (l deckLocation) String() string {
+	return fmt.Sprintf("%s of %s in slot %s", l.address, l.labware, l.slot)
+}
+
+// pipetteState is what the simulation knows about the pipette on a mount.
+type pipetteState struct {
+	name     string
+	hasTip   bool
+	volume   float64
+	location *deckLocation // where the pipette last moved to
+}
+
+// deckState is the state of the deck part way through a script.
+type deckState struct {
+	pipettes     map[string]*pipetteState // by mount side
+	slots        map[string]string        // labware by deck slot
+	usedTips     map[deckLocation]bool
+	thermocycler bool
+	lid          int
+	lidWarned    bool
+	issueList
+}
+
+// issueList collects the issues found simulating a script, located at the
+// command being simulated.
+type issueList struct {
+	issues  []DeckIssue
+	group   int
+	command int
+	kind    string
+}
+
+// at moves on to the command at payload command of group.
+func (l *issueList) at(group, command int, kind string) {
+	l.group, l.command, l.kind = group, command, kind
+}
+
+func (l *issueList) errorf(format string, args ...interface{}) {
+	l.issues = append(l.issues, DeckIssue{DeckError, l.group, l.command, l.kind, fmt.Sprintf(format, args...)})
+}
+
+func (l *issueList) warnf(format string, args ...interface{}) {
+	l.issues = append(l.issues, DeckIssue{DeckWarning, l.group, l.command, l.kind, fmt.Sprintf(format, args...)})
+}
+
+// ValidateDeck simulates a script's tips, pipette volumes, thermocycler lid
+// and deck slots command by command, and returns the problems it finds in
+// order.
+func ValidateDeck(script *Script) []DeckIssue {
+	state := &deckState{
+		pipettes:     make(map[string]*pipetteState),
+		slots:        make(map[string]string),
+		usedTips:     make(map[deckLocation]bool),
+		thermocycler: usesThermocycler(script),
+	}
+	for i, group := range script.Commands {
+		for j, command := range group.Payload {
+			state.at(i, j, command.Kind())
+			state.apply(command)
+		}
+	}
+	return state.issues
+}
+
+// usesThermocycler reports whether any command of a script needs the
+// thermocycler, which means it takes up its slots for the whole script.
+func usesThermocycler(script *Script) bool {
+	for _, group := range script.Commands {
+		for _, command := range group.Payload {
+			if strings.HasPrefix(command.Kind(), "tc_") {
+				return true
+			}
+			if move, ok := command.(MoveToCommand); ok && move.Payload.Module != nil && *move.Payload.Module == "thermocycler" {
+				return true
+			}
+			if move, ok := command.(AspirateDispenseCommand); ok && move.Payload.MoveTo != nil && move.Payload.MoveTo.Module != nil && *move.Payload.MoveTo.Module == "thermocycler" {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// apply simulates a single command.
+func (s *deckState) apply(command Command) {
+	switch c := command.(type) {
+	case MoveToCommand:
+		pipette := s.pipette(c.Payload.Pipette)
+		location := moveToLocation(c.Payload)
+		s.touch(location, false)
+		pipette.location = &location
+	case PickUpTipCommand:
+		pipette := s.pipette(c.Payload.Pipette)
+		location := deckLocation{labware: c.Payload.Labware, slot: c.Payload.DeckSlot, address: c.Payload.Address}
+		s.touch(location, false)
+		pipette.location = &location
+		if pipette.hasTip {
+			s.errorf("the %s pipette already has a tip", c.Payload.Pipette.Side)
+			return
+		}
+		if s.usedTips[location] {
+			s.warnf("the tip at %s has already been used", location)
+		}
+		s.usedTips[location] = true
+		pipette.hasTip, pipette.volume = true, 0
+	case DropTipCommand:
+		pipette := s.pipette(c.Payload.Pipette)
+		if location, ok := dropTipLocation(c.Payload); ok {
+			s.touch(location, false)
+			pipette.location = &location
+		} else if !c.Payload.Trash {
+			// /api/plr drops into the labware given, so it needs all of it.
+			s.errorf("drop_tip needs a labware, deck_slot and address unless it drops into the trash")
+		}
+		if !pipette.hasTip {
+			s.errorf("the %s pipette has no tip to drop", c.Payload.Pipette.Side)
+			return
+		}
+		if pipette.volume > 0 {
+			s.warnf("dropping a tip still holding %g uL", pipette.volume)
+		}
+		pipette.hasTip, pipette.volume = false, 0
+	case AspirateDispenseCommand:
+		s.moveLiquid(c)
+	case HomeCommand:
+		for _, pipette := range s.pipettes {
+			pipette.location = nil
+		}
+	case TCSetLidTempCommand:
+		if c.Payload.Temperature < 37 || c.Payload.Temperature > 110 {
+			s.errorf("lid temperature %g C is outside the thermocycler's range of 37-110 C", c.Payload.Temperature)
+		}
+	case TCSetBlockTempCommand:
+		s.checkBlockTemperature(c.Payload.Temperature)
+	case TCExecuteProfileCommand:
+		if len(c.Payload.Steps) == 0 {
+			s.errorf("the profile has no steps")
+		}
+		if c.Payload.Repetitions < 1 {
+			s.errorf("the profile must run at least once, not %d times", c.Payload.Repetitions)
+		}
+		for _, step := range c.Payload.Steps {
+			s.checkBlockTemperature(step.Temperature)
+			if step.HoldTimeSeconds < 0 {
+				s.errorf("negative hold time of %d seconds", step.HoldTimeSeconds)
+			}
+		}
+		if s.lid == lidOpen {
+			s.warnf("running a profile with the thermocycler lid open")
+		}
+	case TCSimpleCommand:
+		switch c.Type {
+		case "tc_open_lid":
+			s.lid = lidOpen
+		case "tc_close_lid":
+			s.lid = lidClosed
+		}
+	case QuantifyCommand:
+		// A person can take the plate out wherever it is; only where it is
+		// matters.
+		s.touch(deckLocation{labware: c.Payload.Labware, slot: c.Payload.DeckSlot, address: c.Payload.Address}, false)
+	}
+}
+
+// pipette returns the state of the pipette on a mount, checking the script
+// uses the same pipette there throughout.
+func (s *deckState) pipette(p Pipette) *pipetteState {
+	if !mountSides[p.Side] {
+		s.errorf("%q is not a mount", p.Side)
+	}
+	pipette, ok := s.pipettes[p.Side]
+	if !ok {
+		if _, known := pipetteVolumes[p.Name]; !known {
+			s.warnf("unknown pipette %s; its volumes can't be checked", p.Name)
+		}
+		pipette = &pipetteState{name: p.Name}
+		s.pipettes[p.Side] = pipette
+	}
+	if pipette.name != p.Name {
+		s.errorf("the %s mount holds a %s, not a %s", p.Side, pipette.name, p.Name)
+	}
+	return pipette
+}
+
+// moveLiquid simulates an aspirate or a dispense.
+func (s *deckState) moveLiquid(c AspirateDispenseCommand) {
+	pipette := s.pipette(c.Payload.Pipette)
+	// The robot server won't take an aspirate or dispense without move_to,
+	// even to stay where the pipette is.
+	if c.Payload.MoveTo == nil {
+		s.errorf("%s has no move_to, which the robot requires", c.Type)
+	} else {
+		location := moveToLocation(*c.Payload.MoveTo)
+		pipette.location = &location
+		s.touch(location, true)
+	}
+	if !pipette.hasTip {
+		s.errorf("%s without a tip on the %s pipette", c.Type, c.Payload.Pipette.Side)
+		return
+	}
+	volume := c.Payload.Volume
+	if volume <= 0 {
+		s.errorf("volume must be positive, not %g uL", volume)
+		return
+	}
+
+	limits, known := pipetteVolumes[pipette.name]
+	if c.Type == "dispense" {
+		if volume > pipette.volume {
+			s.errorf("dispensing %g uL but the pipette holds %g uL", volume, pipette.volume)
+			volume = pipette.volume
+		}
+		pipette.volume -= volume
+		return
+	}
+	if known && volume < limits.min {
+		s.errorf("aspirating %g uL is below the %s's minimum of %g uL", volume, pipette.name, limits.min)
+	}
+	if known && pipette.volume+volume > limits.max {
+		s.errorf("aspirating %g uL to hold %g uL exceeds the %s's maximum of %g uL", volume, pipette.volume+volume, pipette.name, limits.max)
+	}
+	pipette.volume += volume
+}
+
+// checkBlockTemperature checks a thermocycler block temperature.
+func (s *deckState) checkBlockTemperature(temperature float64) {
+	if temperature < 4 || temperature > 99 {
+		s.errorf("block temperature %g C is outside the thermocycler's range of 4-99 C", temperature)
+	}
+}
+
+// touch checks a location the script reaches into and records the labware
+// in its slot. liquid is whether liquid goes in or out there.
+func (s *deckState) touch(location deckLocation, liquid bool) {
+	if !deckSlots[location.slot] {
+		s.errorf("%q is not a deck slot", location.slot)
+		return
+	}
+	if s.thermocycler {
+		for _, covered := range thermocyclerCovers {
+			if location.slot == covered {
+				s.errorf("slot %s is covered by the thermocycler", location.slot)
+				return
+			}
+		}
+	}
+	if labware, ok := s.slots[location.slot]; ok && labware != location.labware {
+		s.errorf("slot %s already holds %s, not %s", location.slot, labware, location.labware)
+	} else {
+		s.slots[location.slot] = location.labware
+	}
+
+	onThermocycler := location.onModule == "thermocycler" || (s.thermocycler && location.slot == thermocyclerSlot)
+	if !liquid || !onThermocycler {
+		return
+	}
+	switch s.lid {
+	case lidClosed:
+		s.errorf("the thermocycler lid is closed")
+	case lidUnknown:
+		if !s.lidWarned {
+			s.warnf("the thermocycler lid may be closed; open it with tc_open_lid first")
+			s.lidWarned = true
+		}
+	}
+}
+
+// dropTipLocation returns where a drop_tip drops its tip. Without a full
+// location it drops it in the trash, and ok is false.
+func dropTipLocation(payload DropTipPayload) (location deckLocation, ok bool) {
+	if payload.Trash || payload.Labware == nil || payload.DeckSlot == nil || payload.Address == nil {
+		return deckLocation{}, false
+	}
+	return deckLocation{labware: *payload.Labware, slot: *payload.DeckSlot, address: *payload.Address}, true
+}
+
+// moveToLocation returns the location a MoveTo moves to.
+func moveToLocation(move MoveTo) deckLocation {
+	location := deckLocation{labware: move.Labware, slot: move.DeckSlot, address: move.Address}
+	if move.Module != nil {
+		location.onModule = *move.Module
+	}
+	return location
+}
+
+// installValidate replaces the libB.validate stub with ValidateDeck.
+func installValidate(L *lua.LState) {
+	if libB, ok := L.GetGlobal("libB").(*lua.LTable); ok {
+		libB.RawSetString("validate", L.NewFunction(luaValidate))
+	}
+}
+
+// luaValidate is libB.validate(script). It returns the script's issues as a
+// list of DeckIssue tables.
+func luaValidate(L *lua.LState) int {
+	script, err := scriptFromLua(L, L.CheckTable(1))
+	if err != nil {
+		L.RaiseError("libB.validate: %v", err)
+		return 0
+	}
+	L.Push(deckIssuesToLua(L, ValidateDeck(script)))
+	return 1
+}
+
+// deckIssuesToLua converts issues to a list of DeckIssue tables, with group
+// and command indexed from 1 as in Lua.
+func deckIssuesToLua(L *lua.LState, issues []DeckIssue) *lua.LTable {
+	list := L.NewTable()
+	for _, issue := range issues {
+		table := L.NewTable()
+		table.RawSetString("severity", lua.LString(issue.Severity))
+		table.RawSetString("group", lua.LNumber(issue.Group+1))
+		table.RawSetString("command", lua.LNumber(issue.Command+1))
+		table.RawSetString("kind", lua.LString(issue.Kind))
+		table.RawSetString("message", lua.LString(issue.Message))
+		list.Append(table)
+	}
+	return list
+}
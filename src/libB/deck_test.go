@@ -0,0 +1,161 @@
+package libb
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+// deckScript builds a script from Lua commands run against the OpentronsCommands
+// c, with pipette p, tips in slot 1, tubes in slot 2 and a PCR plate on the
+// thermocycler.
+func deckScript(t *testing.T, commands string) *Script {
+	t.Helper()
+	output, err := ExecuteLua(context.Background(), `
+local p = { pipette = "p20_single_gen2", side = "right" }
+local tips = libB.Labware.new("opentrons_96_tiprack_20ul", "1")
+local tubes = libB.Labware.new("opentrons_24_tuberack_nest_1.5ml_snapcap", "2")
+local plate = libB.Labware.new("nest_96_wellplate_100ul_pcr_full_skirt", "7", "thermocycler")
+local c = libB.OpentronsCommands.new()
+`+commands+`
+print(libB.Script.new("s"):add_commands(c):to_json())`)
+	if err != nil {
+		t.Fatalf("Failed to build script: %v", err)
+	}
+	script, err := ParseScript([]byte(output))
+	if err != nil {
+		t.Fatalf("Failed to parse script: %v", err)
+	}
+	return script
+}
+
+func TestValidateDeck(t *testing.T) {
+	tests := []struct {
+		name     string
+		commands string
+		want     []string // issue strings, in order
+	}{
+		{
+			name: "safe transfer",
+			commands: `c:tc_open_lid():pick_up_tip(p, tips:well("A1")):aspirate(p, 10, tubes:well("A1"))
+				:dispense(p, 10, plate:well("A1")):drop_tip(p)`,
+		},
+		{
+			name:     "aspirate without a tip",
+			commands: `c:aspirate(p, 10, tubes:well("A1"))`,
+			want:     []string{"error: commands.0.payload.0 (aspirate): aspirate without a tip on the right pipette"},
+		},
+		{
+			name: "dispense with the lid closed",
+			commands: `c:tc_close_lid():pick_up_tip(p, tips:well("A1")):aspirate(p, 10, tubes:well("A1"))
+				:dispense(p, 10, plate:well("A1"))`,
+			want: []string{"error: commands.0.payload.3 (dispense): the thermocycler lid is closed"},
+		},
+		{
+			name:     "lid never opened",
+			commands: `c:pick_up_tip(p, tips:well("A1")):aspirate(p, 10, tubes:well("A1")):dispense(p, 5, plate:well("A1")):dispense(p, 5, plate:well("A1"))`,
+			want:     []string{"warning: commands.0.payload.2 (dispense): the thermocycler lid may be closed; open it with tc_open_lid first"},
+		},
+		{
+			name:     "over the p20's maximum",
+			commands: `c:pick_up_tip(p, tips:well("A1")):aspirate(p, 15, tubes:well("A1")):aspirate(p, 10, tubes:well("A1"))`,
+			want:     []string{"error: commands.0.payload.2 (aspirate): aspirating 10 uL to hold 25 uL exceeds the p20_single_gen2's maximum of 20 uL"},
+		},
+		{
+			name:     "under the p20's minimum",
+			commands: `c:pick_up_tip(p, tips:well("A1")):aspirate(p, 0.5, tubes:well("A1"))`,
+			want:     []string{"error: commands.0.payload.1 (aspirate): aspirating 0.5 uL is below the p20_single_gen2's minimum of 1 uL"},
+		},
+		{
+			name:     "dispensing more than held",
+			commands: `c:pick_up_tip(p, tips:well("A1")):aspirate(p, 5, tubes:well("A1")):dispense(p, 8, tubes:well("A2"))`,
+			want:     []string{"error: commands.0.payload.2 (dispense): dispensing 8 uL but the pipette holds 5 uL"},
+		},
+		{
+			name:     "dispense without move_to",
+			commands: `c:pick_up_tip(p, tips:well("A1")):aspirate(p, 5, tubes:well("A1")):dispense(p, 5)`,
+			want:     []string{"error: commands.0.payload.2 (dispense): dispense has no move_to, which the robot requires"},
+		},
+		{
+			name:     "two labware in one slot",
+			commands: `c:pick_up_tip(p, tips:well("A1")):aspirate(p, 5, libB.Labware.new("nest_12_reservoir_15ml", "1"):well("A1"))`,
+			want:     []string{"error: commands.0.payload.1 (aspirate): slot 1 already holds opentrons_96_tiprack_20ul, not nest_12_reservoir_15ml"},
+		},
+		{
+			name:     "slot under the thermocycler",
+			commands: `c:tc_open_lid():move_to(p, libB.Labware.new("nest_12_reservoir_15ml", "10"):well("A1"))`,
+			want:     []string{"error: commands.0.payload.1 (move_to): slot 10 is covered by the thermocycler"},
+		},
+		{
+			name:     "tips",
+			commands: `c:pick_up_tip(p, tips:well("A1")):pick_up_tip(p, tips:well("B1")):aspirate(p, 5, tubes:well("A1")):drop_tip(p):drop_tip(p):pick_up_tip(p, tips:well("A1"))`,
+			want: []string{
+				"error: commands.0.payload.1 (pick_up_tip): the right pipette already has a tip",
+				"warning: commands.0.payload.3 (drop_tip): dropping a tip still holding 5 uL",
+				"error: commands.0.payload.4 (drop_tip): the right pipette has no tip to drop",
+				"warning: commands.0.payload.5 (pick_up_tip): the tip at A1 of opentrons_96_tiprack_20ul in slot 1 has already been used",
+			},
+		},
+		{
+			name:     "thermocycler temperatures",
+			commands: `c:tc_set_lid_temp(120):tc_open_lid():tc_execute_profile({ { temperature = 100, hold_time_seconds = 30 } }, 0)`,
+			want: []string{
+				"error: commands.0.payload.0 (tc_set_lid_temp): lid temperature 120 C is outside the thermocycler's range of 37-110 C",
+				"error: commands.0.payload.2 (tc_execute_profile): the profile must run at least once, not 0 times",
+				"error: commands.0.payload.2 (tc_execute_profile): block temperature 100 C is outside the thermocycler's range of 4-99 C",
+				"warning: commands.0.payload.2 (tc_execute_profile): running a profile with the thermocycler lid open",
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, issue := range ValidateDeck(deckScript(t, tt.commands)) {
+				got = append(got, issue.String())
+			}
+			if strings.Join(got, "\n") != strings.Join(tt.want, "\n") {
+				t.Errorf("Unexpected issues:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(tt.want, "\n"))
+			}
+		})
+	}
+}
+
+func TestValidateDeckExample(t *testing.T) {
+	output, err := ExecuteLua(context.Background(), "print(libB.generate_protocol())")
+	if err != nil {
+		t.Fatalf("Failed to execute Lua code: %v", err)
+	}
+	script, err := ParseScript([]byte(output))
+	if err != nil {
+		t.Fatalf("Failed to parse script: %v", err)
+	}
+	issues := ValidateDeck(script)
+	if err := DeckErrors(issues); err != nil {
+		t.Errorf("Expected the example protocol to be safe, got %v", err)
+	}
+	// It fills the plate before opening the lid, then runs the profile with the
+	// lid still open.
+	if len(issues) != 2 || issues[0].Kind != "dispense" || issues[1].Kind != "tc_execute_profile" {
+		t.Errorf("Expected two lid warnings, got %v", issues)
+	}
+}
+
+func TestLuaValidate(t *testing.T) {
+	output, err := ExecuteLua(context.Background(), `
+local p = { pipette = "p20_single_gen2", side = "left" }
+local c = libB.OpentronsCommands.new():aspirate(p, 5, libB.Labware.new("nest_12_reservoir_15ml", "2"):well("A1"))
+for _, issue in ipairs(libB.validate(libB.Script.new("s"):add_commands(c))) do
+	print(issue.severity, issue.group, issue.command, issue.kind, issue.message)
+end`)
+	if err != nil {
+		t.Fatalf("Failed to execute Lua code: %v", err)
+	}
+	want := "error\t1\t1\taspirate\taspirate without a tip on the left pipette\n"
+	if output != want {
+		t.Errorf("Unexpected output %q, want %q", output, want)
+	}
+
+	if _, err := ExecuteLua(context.Background(), `libB.validate({})`); err == nil || !strings.Contains(err.Error(), "libB.validate: expected a libB.Script") {
+		t.Errorf("Expected an error for a table which isn't a script, got %v", err)
+	}
+}
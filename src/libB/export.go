@@ -0,0 +1,297 @@
+package libb
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/******************************************************************************
+
+Opentrons export.
+
+Scripts are normally run by posting their opentrons command groups to the
+/api/plr endpoint in ot2/app.py. Labs without that server can still run them
+by exporting a script as a standalone Opentrons Protocol API v2 protocol, to be
+uploaded through the Opentrons App like any other.
+
+The exported protocol loads everything up front, in run() order: the
+thermocycler, then each slot's labware, then each mount's pipette with the tip
+racks it picks tips from. Commands then follow one for one, with the same
+meaning /api/plr gives them, and each human command becomes a protocol.pause()
+telling the operator what to do before resuming. Scripts that fail
+ValidateDeck are refused, since loading two labware into one slot, say, would
+fail on the robot anyway. Slots and mounts become Python identifiers, so the
+exporter checks them itself too, rather than trusting ValidateDeck to have
+seen every one.
+
+******************************************************************************/
+
+// opentronsAPILevel is the Protocol API version of exported protocols. It
+// matches the version ot2/app.py runs scripts with.
+const opentronsAPILevel = "2.8"
+
+// ExportOpentrons returns a script as an Opentrons Protocol API v2 Python
+// protocol.
+func ExportOpentrons(script *Script) ([]byte, error) {
+	if err := DeckErrors(ValidateDeck(script)); err != nil {
+		return nil, fmt.Errorf("script %s can't be exported: %v", script.ID, err)
+	}
+	e, err := newExporter(script)
+	if err != nil {
+		return nil, fmt.Errorf("script %s can't be exported: %v", script.ID, err)
+	}
+
+	e.line(0, "# Exported from autodemo script %q.", script.ID)
+	e.line(0, "from opentrons import protocol_api")
+	if e.usesOffsets {
+		e.line(0, "from opentrons.types import Point")
+	}
+	e.line(0, "")
+	e.line(0, "metadata = {")
+	e.line(1, "%q: %s,", "protocolName", pyString(script.ID))
+	e.line(1, "%q: %s,", "description", pyString("Exported from autodemo script "+script.ID))
+	e.line(1, "%q: %s,", "apiLevel", pyString(opentronsAPILevel))
+	e.line(0, "}")
+	e.line(0, "")
+	e.line(0, "")
+	e.line(0, "def run(protocol: protocol_api.ProtocolContext):")
+	e.loads()
+	if len(script.Commands) == 0 {
+		e.line(1, "pass")
+	}
+	for i, group := range script.Commands {
+		e.line(1, "")
+		e.line(1, "# commands[%d]: %q", i, group.CommandType)
+		if len(group.Payload) == 0 {
+			e.line(1, "pass")
+		}
+		for _, command := range group.Payload {
+			if err := e.command(command); err != nil {
+				return nil, fmt.Errorf("script %s can't be exported: %v", script.ID, err)
+			}
+		}
+	}
+	return e.buf.Bytes(), nil
+}
+
+// exporter writes a single exported protocol.
+type exporter struct {
+	buf          bytes.Buffer
+	thermocycler bool
+	usesOffsets  bool
+	labware      map[string]string   // labware by slot
+	pipettes     map[string]string   // pipette by mount side
+	tipRacks     map[string][]string // tip rack slots by mount side
+}
+
+// newExporter collects what a script's protocol has to load. It fails if any
+// command uses a slot or mount the robot doesn't have.
+func newExporter(script *Script) (*exporter, error) {
+	e := &exporter{
+		thermocycler: usesThermocycler(script),
+		labware:      make(map[string]string),
+		pipettes:     make(map[string]string),
+		tipRacks:     make(map[string][]string),
+	}
+	var err error
+	addLabware := func(labware, slot string) {
+		if !deckSlots[slot] {
+			err = fmt.Errorf("%q is not a deck slot", slot)
+			return
+		}
+		if _, ok := e.labware[slot]; !ok {
+			e.labware[slot] = labware
+		}
+	}
+	addPipette := func(pipette Pipette) {
+		if !mountSides[pipette.Side] {
+			err = fmt.Errorf("%q is not a mount", pipette.Side)
+			return
+		}
+		e.pipettes[pipette.Side] = pipette.Name
+	}
+	addMoveTo := func(move MoveTo) {
+		addLabware(move.Labware, move.DeckSlot)
+		if move.X != nil || move.Y != nil || move.Z != nil {
+			e.usesOffsets = true
+		}
+	}
+	for _, group := range script.Commands {
+		for _, command := range group.Payload {
+			switch c := command.(type) {
+			case MoveToCommand:
+				addPipette(c.Payload.Pipette)
+				addMoveTo(c.Payload)
+			case AspirateDispenseCommand:
+				addPipette(c.Payload.Pipette)
+				if c.Payload.MoveTo != nil {
+					addMoveTo(*c.Payload.MoveTo)
+				}
+			case PickUpTipCommand:
+				side := c.Payload.Pipette.Side
+				addPipette(c.Payload.Pipette)
+				addLabware(c.Payload.Labware, c.Payload.DeckSlot)
+				if !containsString(e.tipRacks[side], c.Payload.DeckSlot) {
+					e.tipRacks[side] = append(e.tipRacks[side], c.Payload.DeckSlot)
+				}
+			case DropTipCommand:
+				addPipette(c.Payload.Pipette)
+				if location, ok := dropTipLocation(c.Payload); ok {
+					addLabware(location.labware, location.slot)
+				}
+			case QuantifyCommand:
+				addLabware(c.Payload.Labware, c.Payload.DeckSlot)
+			}
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return e, nil
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// line writes a line of Python, indented by depth levels.
+func (e *exporter) line(depth int, format string, args ...interface{}) {
+	line := fmt.Sprintf(format, args...)
+	if line != "" {
+		e.buf.WriteString(strings.Repeat("    ", depth))
+		e.buf.WriteString(line)
+	}
+	e.buf.WriteString("\n")
+}
+
+// loads writes the module, labware and pipette loads at the start of run.
+func (e *exporter) loads() {
+	if e.thermocycler {
+		e.line(1, "thermocycler = protocol.load_module(%s, %s)", pyString("thermocycler module"), thermocyclerSlot)
+	}
+	slots := make([]string, 0, len(e.labware))
+	for slot := range e.labware {
+		slots = append(slots, slot)
+	}
+	sort.Slice(slots, func(i, j int) bool { return naturalLess(slots[i], slots[j]) })
+	for _, slot := range slots {
+		if e.thermocycler && slot == thermocyclerSlot {
+			e.line(1, "%s = thermocycler.load_labware(%s)", slotVariable(slot), pyString(e.labware[slot]))
+			continue
+		}
+		e.line(1, "%s = protocol.load_labware(%s, %s)", slotVariable(slot), pyString(e.labware[slot]), pyString(slot))
+	}
+	for _, side := range []string{"left", "right"} {
+		name, ok := e.pipettes[side]
+		if !ok {
+			continue
+		}
+		racks := make([]string, len(e.tipRacks[side]))
+		for i, slot := range e.tipRacks[side] {
+			racks[i] = slotVariable(slot)
+		}
+		e.line(1, "%s = protocol.load_instrument(%s, %s, tip_racks=[%s])", side, pyString(name), pyString(side), strings.Join(racks, ", "))
+	}
+}
+
+// command writes a single command.
+func (e *exporter) command(command Command) error {
+	switch c := command.(type) {
+	case HomeCommand:
+		e.line(1, "protocol.home()")
+	case MoveToCommand:
+		e.line(1, "%s.move_to(%s)", c.Payload.Pipette.Side, moveToExpression(c.Payload))
+	case AspirateDispenseCommand:
+		if c.Payload.MoveTo != nil {
+			e.line(1, "%s.%s(%s, %s)", c.Payload.Pipette.Side, c.Type, pyNumber(c.Payload.Volume), moveToExpression(*c.Payload.MoveTo))
+		} else {
+			e.line(1, "%s.%s(%s)", c.Payload.Pipette.Side, c.Type, pyNumber(c.Payload.Volume))
+		}
+	case PickUpTipCommand:
+		e.line(1, "%s.pick_up_tip(%s[%s])", c.Payload.Pipette.Side, slotVariable(c.Payload.DeckSlot), pyString(c.Payload.Address))
+	case DropTipCommand:
+		if location, ok := dropTipLocation(c.Payload); ok {
+			e.line(1, "%s.drop_tip(%s[%s])", c.Payload.Pipette.Side, slotVariable(location.slot), pyString(location.address))
+		} else {
+			e.line(1, "%s.drop_tip()", c.Payload.Pipette.Side)
+		}
+	case TCSimpleCommand:
+		e.line(1, "thermocycler.%s()", strings.TrimPrefix(c.Type, "tc_"))
+	case TCSetLidTempCommand:
+		e.line(1, "thermocycler.set_lid_temperature(temperature=%s)", pyNumber(c.Payload.Temperature))
+	case TCSetBlockTempCommand:
+		args := []string{"temperature=" + pyNumber(c.Payload.Temperature)}
+		for _, arg := range []struct {
+			name  string
+			value *float64
+		}{
+			{"hold_time_minutes", c.Payload.HoldTimeMinutes},
+			{"hold_time_seconds", c.Payload.HoldTimeSeconds},
+			{"block_max_volume", c.Payload.BlockMaxVolume},
+		} {
+			if arg.value != nil {
+				args = append(args, arg.name+"="+pyNumber(*arg.value))
+			}
+		}
+		e.line(1, "thermocycler.set_block_temperature(%s)", strings.Join(args, ", "))
+	case TCExecuteProfileCommand:
+		e.line(1, "thermocycler.execute_profile(")
+		e.line(2, "steps=[")
+		for _, step := range c.Payload.Steps {
+			e.line(3, "{%q: %s, %q: %d},", "temperature", pyNumber(step.Temperature), "hold_time_seconds", step.HoldTimeSeconds)
+		}
+		e.line(2, "],")
+		e.line(2, "repetitions=%d,", c.Payload.Repetitions)
+		if c.Payload.BlockMaxVolume != nil {
+			e.line(2, "block_max_volume=%s,", pyNumber(*c.Payload.BlockMaxVolume))
+		}
+		e.line(1, ")")
+	case QuantifyCommand:
+		e.line(1, "protocol.pause(%s)", pyString(fmt.Sprintf("Quantify the DNA in %s of %s in slot %s, upload the result as %s, then resume.",
+			c.Payload.Address, c.Payload.Labware, c.Payload.DeckSlot, c.Payload.ReturnKey)))
+	default:
+		return fmt.Errorf("no export for %s commands", command.Kind())
+	}
+	return nil
+}
+
+// moveToExpression returns the Python location of a MoveTo: the bottom of its
+// well, offset by any of x, y and z, as /api/plr moves to.
+func moveToExpression(move MoveTo) string {
+	location := fmt.Sprintf("%s[%s].bottom()", slotVariable(move.DeckSlot), pyString(move.Address))
+	if move.X == nil && move.Y == nil && move.Z == nil {
+		return location
+	}
+	offset := func(value *float64) string {
+		if value == nil {
+			return "0"
+		}
+		return pyNumber(*value)
+	}
+	return fmt.Sprintf("%s.move(Point(x=%s, y=%s, z=%s))", location, offset(move.X), offset(move.Y), offset(move.Z))
+}
+
+// slotVariable returns the name of the variable holding a slot's labware. The
+// slot must be one of deckSlots, as checked by newExporter.
+func slotVariable(slot string) string {
+	return "slot_" + slot
+}
+
+// pyString returns s as a Python string literal. Go's escapes are all valid in
+// Python.
+func pyString(s string) string {
+	return strconv.Quote(s)
+}
+
+// pyNumber returns a number as a Python literal.
+func pyNumber(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
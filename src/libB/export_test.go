@@ -0,0 +1,104 @@
+package libb
+
+import (
+	"context"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite golden files with the current output")
+
+// checkGolden compares got with the golden file at path, or rewrites the file
+// if -update is set.
+func checkGolden(t *testing.T, path string, got []byte) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatalf("Failed to update %s: %v", path, err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("Failed to read %s: %v", path, err)
+	}
+	if string(got) != string(want) {
+		t.Errorf("Output doesn't match %s (rerun with -update to accept it):\n%s", path, got)
+	}
+}
+
+func TestExportOpentrons(t *testing.T) {
+	// The example protocol, exported straight from libB so it stays in step
+	// with it.
+	output, err := ExecuteLua(context.Background(), "print(libB.generate_protocol())")
+	if err != nil {
+		t.Fatalf("Failed to execute Lua code: %v", err)
+	}
+	scripts := map[string][]byte{"testdata/export/example.py": []byte(output)}
+
+	inputs, err := filepath.Glob("testdata/export/*.json")
+	if err != nil || len(inputs) == 0 {
+		t.Fatalf("Failed to find export inputs: %v", err)
+	}
+	for _, input := range inputs {
+		data, err := os.ReadFile(input)
+		if err != nil {
+			t.Fatalf("Failed to read %s: %v", input, err)
+		}
+		scripts[strings.TrimSuffix(input, ".json")+".py"] = data
+	}
+
+	for golden, data := range scripts {
+		t.Run(filepath.Base(golden), func(t *testing.T) {
+			script, err := ParseScript(data)
+			if err != nil {
+				t.Fatalf("Failed to parse script: %v", err)
+			}
+			exported, err := ExportOpentrons(script)
+			if err != nil {
+				t.Fatalf("Failed to export script: %v", err)
+			}
+			checkGolden(t, golden, exported)
+		})
+	}
+}
+
+func TestExportOpentronsUnsafe(t *testing.T) {
+	script := deckScript(t, `c:aspirate(p, 10, tubes:well("A1"))`)
+	if _, err := ExportOpentrons(script); err == nil || !strings.Contains(err.Error(), "aspirate without a tip") {
+		t.Errorf("Expected the deck error, got %v", err)
+	}
+}
+
+func TestExportOpentronsSlots(t *testing.T) {
+	// A drop_tip into labware without an address used to load the labware
+	// into its slot unchecked.
+	script, err := ParseScript([]byte(`{"id": "drop", "commands": [{"command_type": "opentrons", "payload": [
+		{"type": "pick_up_tip", "payload": {"pipette": {"pipette": "p300_single_gen2", "side": "left"}, "labware": "opentrons_96_tiprack_300ul", "deck_slot": "4", "address": "A1"}},
+		{"type": "drop_tip", "payload": {"pipette": {"pipette": "p300_single_gen2", "side": "left"}, "labware": "opentrons_96_tiprack_300ul", "deck_slot": "4 = __import__('os')", "trash": false}}
+	]}]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse script: %v", err)
+	}
+	if _, err := ExportOpentrons(script); err == nil || !strings.Contains(err.Error(), "drop_tip needs a labware, deck_slot and address") {
+		t.Errorf("Expected the drop_tip to be refused, got %v", err)
+	}
+
+	// The exporter checks slots and mounts itself, whatever ValidateDeck saw.
+	for _, test := range []struct {
+		command Command
+		want    string
+	}{
+		{QuantifyCommand{Type: "quantify", Payload: QuantifyPayload{Labware: "nest_96_wellplate_100ul_pcr_full_skirt", DeckSlot: "7 = None", Address: "A1"}}, `"7 = None" is not a deck slot`},
+		{HomeCommand{Type: "home"}, ""},
+		{MoveToCommand{Type: "move_to", Payload: MoveTo{Pipette: Pipette{Name: "p300_single_gen2", Side: "left.home()"}, Labware: "nest_12_reservoir_15ml", DeckSlot: "5", Address: "A1"}}, `"left.home()" is not a mount`},
+	} {
+		_, err := newExporter(&Script{ID: "unsafe", Commands: []CommandGroup{{CommandType: "opentrons", Payload: []Command{test.command}}}})
+		if test.want == "" && err != nil || test.want != "" && (err == nil || err.Error() != test.want) {
+			t.Errorf("Expected %s to give %q, got %v", test.command.Kind(), test.want, err)
+		}
+	}
+}
@@ -1,15 +1,19 @@
 package libb
 
 import (
+	"context"
 	_ "embed"
-	"encoding/json"
 	"fmt"
 	"io"
 	"log"
+	"maps"
+	"slices"
 	"strings"
 	"sync"
+	"time"
 
 	lua "github.com/yuin/gopher-lua"
+	"github.com/yuin/gopher-lua/parse"
 )
 
 //go:embed tl.lua
@@ -46,12 +50,39 @@ func CompileTealToLua() (string, error) {
 	return compiledLua, nil
 }
 
+var (
+	libBProtoOnce sync.Once
+	libBProto     *lua.FunctionProto
+	libBProtoErr  error
+)
+
+// CompiledLibB returns libB compiled to a gopher-lua function prototype. The
+// Teal compile only ever happens once per process: every Lua state after the
+// first one just runs the cached prototype. Its concatenations are guarded
+// like a protocol's, so it must be loaded with newSandboxedFunction.
+func CompiledLibB() (*lua.FunctionProto, error) {
+	libBProtoOnce.Do(func() {
+		compiledLua, err := CompileTealToLua()
+		if err != nil {
+			libBProtoErr = fmt.Errorf("failed to compile libB: %v", err)
+			return
+		}
+		chunk, err := parse.Parse(strings.NewReader(compiledLua), "libB")
+		if err != nil {
+			libBProtoErr = fmt.Errorf("failed to parse compiled libB: %v", err)
+			return
+		}
+		libBProto, libBProtoErr = lua.Compile(guardConcat(chunk), "libB")
+	})
+	return libBProto, libBProtoErr
+}
+
 // customPrint is a function that mimics Lua's print function but writes to an io.Writer
 func customPrint(writer io.Writer) func(L *lua.LState) int {
 	return func(L *lua.LState) int {
 		top := L.GetTop()
 		for i := 1; i <= top; i++ {
-			str := L.ToString(i)
+			str := L.ToStringMeta(L.Get(i)).String()
 			if i > 1 {
 				io.WriteString(writer, "\t")
 			}
@@ -62,36 +93,19 @@ func customPrint(writer io.Writer) func(L *lua.LState) int {
 	}
 }
 
-// ExecuteLua executes the provided Lua code with the compiled libB available
-func ExecuteLua(code string) (string, error) {
-	// First, compile the Teal code to Lua
-	compiledLibB, err := CompileTealToLua()
-	if err != nil {
-		return "", fmt.Errorf("failed to compile libB: %v", err)
-	}
-
-	L := lua.NewState()
-	defer L.Close()
-
-	// Add stdout
-	var buffer strings.Builder
-	L.SetGlobal("print", L.NewFunction(customPrint(&buffer)))
-
-	// Load the compiled library content
-	if err := L.DoString(compiledLibB); err != nil {
-		return "", fmt.Errorf("failed to load compiled libB: %v", err)
-	}
-
-	// Store returned table as global
-	L.SetGlobal("libB", L.Get(-1))
-	L.Pop(1)
-
-	// Execute the user's code
-	if err := L.DoString(code); err != nil {
-		return "", err
-	}
+// ExecuteLua executes the provided Lua code with the compiled libB available,
+// bounded by ctx and DefaultLimits.
+func ExecuteLua(ctx context.Context, code string) (string, error) {
+	return ExecuteLuaWithLimits(ctx, code, DefaultLimits)
+}
 
-	return buffer.String(), nil
+// ExecuteLuaWithLimits executes the provided Lua code with the compiled libB
+// available and returns what it printed. If the code runs past ctx or limits,
+// a *LimitError is returned. Use CaptureLuaWithLimits to also get logs, return
+// values and tracebacks.
+func ExecuteLuaWithLimits(ctx context.Context, code string, limits Limits) (string, error) {
+	capture := CaptureLuaWithLimits(ctx, code, limits)
+	return capture.Output(), capture.Err
 }
 
 /*
@@ -126,86 +140,165 @@ func NewMockDB() *MockDB {
 	}
 }
 
-// ExecuteLuaStep executes a single step of the protocol
-func ExecuteLuaStep(code string, funcName string, inputData string, data map[string]map[string]string) (*ProtocolState, error) {
-	compiledLibB, err := CompileTealToLua()
+// StepInput is everything a single protocol step runs with.
+type StepInput struct {
+	Function    string                       // the function to call, or AwaitFunction to replay main
+	Passthrough string                       // data_passthrough from the previous step
+	Data        map[string]map[string]string // script_id -> data_id -> json, exposed as DATA
+	Replay      []AwaitResult                // results of earlier libB.await calls, oldest first
+	Seed        int64                        // seed for math.random and libB.uuid.generate
+}
+
+// ExecuteLuaStep executes a single step of the protocol, bounded by ctx and
+// DefaultLimits.
+func ExecuteLuaStep(ctx context.Context, code string, input StepInput) (*ProtocolState, error) {
+	state, capture := CaptureLuaStep(ctx, code, input)
+	return state, capture.Err
+}
+
+// CaptureLuaStep executes a single step of the protocol, bounded by ctx and
+// DefaultLimits, and captures everything it outputs. If the step fails, the
+// state is nil and Capture.Err holds the error.
+func CaptureLuaStep(ctx context.Context, code string, input StepInput) (*ProtocolState, *Capture) {
+	capture := newCapture(DefaultLimits.MaxOutputBytes)
+	pool, err := defaultStatePool()
 	if err != nil {
-		return nil, fmt.Errorf("failed to compile libB: %v", err)
+		capture.setError(err)
+		return nil, capture
+	}
+	L, err := pool.Get()
+	if err != nil {
+		capture.setError(err)
+		return nil, capture
 	}
 
-	L := lua.NewState()
-	defer L.Close()
+	start := time.Now()
+	var state *ProtocolState
+	err = runWithLimits(ctx, L, DefaultLimits, func() error {
+		state, err = executeLuaStep(L, code, input, capture)
+		return err
+	})
+	capture.WallTime = time.Since(start)
+	capture.flush()
+	if err != nil {
+		traceback := capture.Traceback
+		capture.setError(err)
+		if capture.Traceback == "" {
+			capture.Traceback = traceback
+		}
+		pool.Close(L)
+		return nil, capture
+	}
+	pool.Put(L)
+	return state, capture
+}
 
-	// Set up DATA table
+// startSuspended wraps a protocol function so that its coroutine yields
+// before running any of it, giving us a chance to install an error handler
+// on the coroutine first.
+const startSuspended = `return function(yield, fn, ...) yield() return fn(...) end`
+
+// executeLuaStep runs a protocol function on a state that already has libB
+// loaded. The function runs inside a coroutine so that libB.await can yield.
+func executeLuaStep(L *lua.LState, code string, input StepInput, capture *Capture) (*ProtocolState, error) {
+	seedRandom(L, input.Seed)
+	capture.install(L)
+
+	// Set up DATA table. pairs follows the order keys are inserted in, so
+	// they are inserted sorted for the step to replay the same.
 	dataTable := L.NewTable()
-	for scriptID, innerMap := range data {
+	for _, scriptID := range slices.Sorted(maps.Keys(input.Data)) {
+		innerMap := input.Data[scriptID]
 		scriptTable := L.NewTable()
-		for dataID, jsonStr := range innerMap {
-			L.SetField(scriptTable, dataID, lua.LString(jsonStr))
+		for _, dataID := range slices.Sorted(maps.Keys(innerMap)) {
+			L.SetField(scriptTable, dataID, lua.LString(innerMap[dataID]))
 		}
 		L.SetField(dataTable, scriptID, scriptTable)
 	}
 	L.SetGlobal("DATA", dataTable)
 
-	// Load libB
-	if err := L.DoString(compiledLibB); err != nil {
-		return nil, fmt.Errorf("failed to load compiled libB: %v", err)
+	// Set up libB.await
+	funcName := input.Function
+	awaits := &awaitState{enabled: funcName == "main" || funcName == AwaitFunction, replay: input.Replay}
+	if funcName == AwaitFunction {
+		funcName = "main"
+	}
+	if libB, ok := L.GetGlobal("libB").(*lua.LTable); ok {
+		libB.RawSetString("await", L.NewFunction(awaits.await))
 	}
-	L.SetGlobal("libB", L.Get(-1))
-	L.Pop(1)
 
 	// Load protocol code
-	if err := L.DoString(code); err != nil {
+	load, err := loadSandboxed(L, strings.NewReader(code))
+	if err == nil {
+		L.Push(load)
+		err = L.PCall(0, lua.MultRet, nil)
+	}
+	if err != nil {
 		return nil, fmt.Errorf("failed to load protocol code: %v", err)
 	}
 
 	// Execute function
-	fn := L.GetGlobal(funcName)
-	if fn.Type() != lua.LTFunction {
+	fn, ok := L.GetGlobal(funcName).(*lua.LFunction)
+	if !ok {
 		return nil, fmt.Errorf("function %s not found", funcName)
 	}
 
-	L.Push(fn)
-	if inputData != "" {
-		L.Push(lua.LString(inputData))
+	var args []lua.LValue
+	if input.Passthrough != "" {
+		args = append(args, lua.LString(input.Passthrough))
 	}
 
-	numArgs := 0
-	if inputData != "" {
-		numArgs = 1
+	if err := L.DoString(startSuspended); err != nil {
+		return nil, fmt.Errorf("failed to load protocol wrapper: %v", err)
 	}
+	wrapper := L.Get(-1).(*lua.LFunction)
+	L.Pop(1)
+	yield := L.NewFunction(func(L *lua.LState) int { return L.Yield() })
 
-	if err := L.PCall(numArgs, 5, nil); err != nil {
-		return nil, fmt.Errorf("error calling %s: %v", funcName, err)
+	co, cancel := L.NewThread()
+	if cancel != nil {
+		defer cancel()
+		co.SetContext(L.Context())
 	}
+	defer co.Close()
 
-	// Parse return values
-	state := &ProtocolState{
-		Status:          int(L.CheckNumber(-5)),
-		Comments:        L.CheckString(-4),
-		DataPassthrough: L.CheckString(-1),
+	// Errors inside a coroutine lose their traceback, so record it when the
+	// error is raised, before the coroutine's stack unwinds.
+	if result, err, _ := L.Resume(co, wrapper, append([]lua.LValue{yield, fn}, args...)...); result != lua.ResumeYield {
+		return nil, fmt.Errorf("failed to start %s: %v", funcName, err)
 	}
-
-	if nextFunc := L.Get(-3); nextFunc.Type() != lua.LTNil {
-		state.NextFunc = nextFunc.String()
+	panicHandler := co.Panic
+	co.Panic = func(co *lua.LState) {
+		capture.Traceback = traceback(co)
+		panicHandler(co)
 	}
 
-	scriptJSON := L.CheckString(-2)
-	if scriptJSON != "" {
-		var script Script
-		if err := json.Unmarshal([]byte(scriptJSON), &script); err != nil {
-			return nil, fmt.Errorf("failed to parse script JSON: %v", err)
+	result, err, values := L.Resume(co, wrapper)
+	if result != lua.ResumeError {
+		// Errors caught by pcall are not the step's problem.
+		capture.Traceback = ""
+	}
+	switch result {
+	case lua.ResumeError:
+		return nil, fmt.Errorf("error calling %s: %v", funcName, err)
+	case lua.ResumeYield:
+		if awaits.pending == nil {
+			return nil, fmt.Errorf("%s yielded outside of libB.await", funcName)
+		}
+		if err := awaits.finish(); err != nil {
+			return nil, err
 		}
-		state.Script = &script
+		return awaits.pending, nil
 	}
-
-	L.Pop(5)
-	return state, nil
+	if err := awaits.finish(); err != nil {
+		return nil, err
+	}
+	return parseStepResult(L, funcName, values)
 }
 
 // MockDB methods
 func (db *MockDB) StartProtocol(code string) error {
-	state, err := ExecuteLuaStep(code, "main", "", make(map[string]map[string]string))
+	state, err := ExecuteLuaStep(context.Background(), code, StepInput{Function: "main"})
 	if err != nil {
 		return err
 	}
@@ -245,13 +338,17 @@ func (db *MockDB) watchScriptCompletion(code string, initialState *ProtocolState
 
 		// If we have a script object, check if we have all required data
 		if state.Script != nil {
-			hasAllData := state.Script.HasAllData(db.data)
-			log.Printf("Checking data completion for script %s: %v", state.Script.ID, hasAllData)
+			hasAllData, missing := state.Script.HasAllData(db.data)
+			log.Printf("Checking data completion for script %s: %v (missing %v)", state.Script.ID, hasAllData, missing)
 
 			if hasAllData {
 				log.Printf("All required data present, continuing execution")
 				// Continue execution
-				newState, err := ExecuteLuaStep(code, state.NextFunc, state.DataPassthrough, db.data)
+				newState, err := ExecuteLuaStep(context.Background(), code, StepInput{
+					Function:    state.NextFunc,
+					Passthrough: state.DataPassthrough,
+					Data:        db.data,
+				})
 				if err != nil {
 					log.Printf("Error continuing execution: %v", err)
 					db.mu.Unlock()
@@ -1,9 +1,12 @@
 package libb
 
 import (
+	"context"
 	_ "embed"
 	"encoding/json"
+	"errors"
 	"reflect"
+	"runtime"
 	"strings"
 	"testing"
 	"time"
@@ -71,7 +74,7 @@ func TestExecuteLua(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := ExecuteLua(tt.luaCode)
+			got, err := ExecuteLua(context.Background(), tt.luaCode)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ExecuteLua() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -149,7 +152,7 @@ func TestLibBIntegration(t *testing.T) {
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			got, err := ExecuteLua(tt.luaCode)
+			got, err := ExecuteLua(context.Background(), tt.luaCode)
 			if (err != nil) != tt.wantErr {
 				t.Errorf("ExecuteLua() error = %v, wantErr %v", err, tt.wantErr)
 				return
@@ -178,6 +181,33 @@ func TestLibBIntegration(t *testing.T) {
 	}
 }
 
+func TestDataGet(t *testing.T) {
+	code := `
+function main()
+	local reading = libB.data.get("script1", "data1")
+	local missing = libB.data.get("script1", "data2")
+	local unknown = libB.data.get("script2", "data1")
+	return 0, string.format("%d %s %s", reading.ng_per_ul, tostring(missing), tostring(unknown)), "", "", ""
+end
+`
+	state, err := ExecuteLuaStep(context.Background(), code, StepInput{
+		Function: "main",
+		Data:     map[string]map[string]string{"script1": {"data1": `{"ng_per_ul": 42}`}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if state.Comments != "42 nil nil" {
+		t.Errorf("Expected decoded reading and nils, got %q", state.Comments)
+	}
+
+	// Outside of a protocol there is no DATA at all.
+	output, err := ExecuteLua(context.Background(), `print(libB.data.get("script1", "data1"))`)
+	if err != nil || output != "nil\n" {
+		t.Errorf("Expected nil outside of a protocol, got %q, %v", output, err)
+	}
+}
+
 //go:embed data/simple_test.lua
 var simple_test string
 
@@ -204,3 +234,252 @@ func TestExampleDB(t *testing.T) {
 		t.Error("Script should have completed")
 	}
 }
+
+func TestStatePoolReset(t *testing.T) {
+	// The first run mutates everything it can reach: globals, libB and the
+	// standard library. None of it should survive into the next run.
+	_, err := ExecuteLua(context.Background(), `
+		leaked = "leaked"
+		libB.primers = nil
+		libB.json.encode = function() return "hijacked" end
+		string.upper = nil
+		setmetatable(libB, { __index = function() return "ghost" end })
+		getmetatable("").__index = {}
+	`)
+	if err != nil {
+		t.Fatalf("ExecuteLua() error = %v", err)
+	}
+
+	for i := 0; i < 2*runtime.GOMAXPROCS(0); i++ {
+		got, err := ExecuteLua(context.Background(), `print(tostring(leaked), tostring(libB.primers ~= nil), libB.json.encode({1}), ("a"):upper(), tostring(libB.missing))`)
+		if err != nil {
+			t.Fatalf("ExecuteLua() error = %v", err)
+		}
+		if want := "nil\ttrue\t[1]\tA\tnil\n"; got != want {
+			t.Fatalf("ExecuteLua() = %q, want %q", got, want)
+		}
+	}
+}
+
+func BenchmarkCompileTealToLua(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		if _, err := CompileTealToLua(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkExecuteLuaUncached is what every ExecuteLua call used to cost:
+// compiling libB from Teal and loading it into a fresh state.
+func BenchmarkExecuteLuaUncached(b *testing.B) {
+	for i := 0; i < b.N; i++ {
+		compiledLibB, err := CompileTealToLua()
+		if err != nil {
+			b.Fatal(err)
+		}
+		L := lua.NewState()
+		if err := L.DoString(compiledLibB); err != nil {
+			b.Fatal(err)
+		}
+		L.SetGlobal("libB", L.Get(-1))
+		L.Pop(1)
+		if err := L.DoString("local x = libB.primers.melting_temp('GTAAAACGACGGCCAGT')"); err != nil {
+			b.Fatal(err)
+		}
+		L.Close()
+	}
+}
+
+func BenchmarkExecuteLua(b *testing.B) {
+	if err := Warm(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ExecuteLua(context.Background(), "local x = libB.primers.melting_temp('GTAAAACGACGGCCAGT')"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkExecuteLuaStep(b *testing.B) {
+	if err := Warm(); err != nil {
+		b.Fatal(err)
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := ExecuteLuaStep(context.Background(), simple_test, StepInput{Function: "main"}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func TestSandboxLimits(t *testing.T) {
+	tests := []struct {
+		name    string
+		luaCode string
+		limits  Limits
+		wantErr error
+	}{
+		{
+			name:    "Infinite loop hits instruction budget",
+			luaCode: "while true do end",
+			limits:  Limits{MaxInstructions: 100_000},
+			wantErr: ErrInstructionLimit,
+		},
+		{
+			name:    "Infinite loop hits deadline",
+			luaCode: "while true do end",
+			limits:  Limits{Timeout: 50 * time.Millisecond},
+			wantErr: ErrTimeout,
+		},
+		{
+			name:    "pcall cannot swallow the budget",
+			luaCode: "while true do pcall(function() while true do end end) end",
+			limits:  Limits{MaxInstructions: 100_000},
+			wantErr: ErrInstructionLimit,
+		},
+		{
+			name:    "Growing table hits instruction budget",
+			luaCode: "local t = {} while true do t[#t+1] = {} end",
+			limits:  Limits{MaxInstructions: 1_000_000, MaxAllocBytes: 16 << 20},
+			wantErr: ErrInstructionLimit,
+		},
+		{
+			name:    "string.rep hits allocation cap",
+			luaCode: "local s = string.rep('x', 1e9)",
+			limits:  Limits{MaxAllocBytes: 16 << 20},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "Doubling a string hits allocation cap",
+			luaCode: "local s = 'x' for i = 1, 28 do s = s .. s end",
+			limits:  Limits{MaxAllocBytes: 16 << 20},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "pcall cannot swallow the allocation cap",
+			luaCode: "local s = 'x' for i = 1, 28 do pcall(function() s = s .. s end) end",
+			limits:  Limits{MaxAllocBytes: 16 << 20},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "Doubling a string with gsub hits allocation cap",
+			luaCode: "local s = 'xx' for i = 1, 28 do s = s:gsub('.+', '%0%0') end",
+			limits:  Limits{MaxAllocBytes: 16 << 20},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "table.concat hits allocation cap",
+			luaCode: "local t = {} local s = string.rep('x', 2^20) for i = 1, 64 do t[i] = s end s = table.concat(t)",
+			limits:  Limits{MaxAllocBytes: 16 << 20},
+			wantErr: ErrMemoryLimit,
+		},
+		{
+			name:    "string.format hits allocation cap",
+			luaCode: "local t = {} local s = string.rep('x', 2^20) for i = 1, 64 do t[i] = s end s = string.format(string.rep('%s', 64), unpack(t))",
+			limits:  Limits{MaxAllocBytes: 16 << 20},
+			wantErr: ErrMemoryLimit,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ExecuteLuaWithLimits(context.Background(), tt.luaCode, tt.limits)
+			var limitErr *LimitError
+			if !errors.As(err, &limitErr) {
+				t.Fatalf("ExecuteLuaWithLimits() error = %v, want *LimitError", err)
+			}
+			if !errors.Is(err, tt.wantErr) {
+				t.Errorf("ExecuteLuaWithLimits() error = %v, want %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSandboxAllocCapPerExecution(t *testing.T) {
+	// Allocations made alongside an execution aren't charged to it.
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		var sink []byte
+		for {
+			select {
+			case <-stop:
+				_ = sink
+				return
+			default:
+				sink = make([]byte, 1<<20)
+			}
+		}
+	}()
+	_, err := ExecuteLuaWithLimits(context.Background(), "local t = {} for i = 1, 1000000 do t[i % 100] = string.rep('x', 8) end", Limits{MaxAllocBytes: 16 << 20})
+	close(stop)
+	<-done
+	if err != nil {
+		t.Errorf("ExecuteLuaWithLimits() error = %v, want nil", err)
+	}
+}
+
+func TestSandboxStringRepHardCap(t *testing.T) {
+	// Without an allocation cap, string.rep still refuses huge strings rather
+	// than overflowing or panicking.
+	got, err := ExecuteLuaWithLimits(context.Background(), "print(pcall(string.rep, 'xx', 2^62))", Limits{})
+	if err != nil {
+		t.Fatalf("ExecuteLuaWithLimits() error = %v", err)
+	}
+	if !strings.HasPrefix(got, "false\t") || !strings.Contains(got, "resulting string too large") {
+		t.Errorf("ExecuteLuaWithLimits() = %q, want string.rep to fail", got)
+	}
+}
+
+func TestSandboxConcat(t *testing.T) {
+	// .. is compiled into a guarded call, which behaves like the operator.
+	got, err := ExecuteLua(context.Background(), `
+local mt = {__concat = function(a, b) return "meta" end}
+print("a" .. 1 .. 2.5, setmetatable({}, mt) .. "b", "b" .. setmetatable({}, mt))
+print(pcall(function() return "a" .. nil end))`)
+	if err != nil {
+		t.Fatalf("ExecuteLua() error = %v", err)
+	}
+	want := "a12.5\tmeta\tmeta\nfalse\t<string>:4: cannot perform concat operation between string and nil\n"
+	if got != want {
+		t.Errorf("ExecuteLua() = %q, want %q", got, want)
+	}
+}
+
+func TestSandboxCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+	_, err := ExecuteLua(ctx, "while true do end")
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("ExecuteLua() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestSandboxWhitelist(t *testing.T) {
+	for _, name := range []string{"os.execute", "os.exit", "os.getenv", "os.time", "os.clock", "os.date", "io", "load", "loadstring", "dofile", "loadfile", "require", "debug", "package", "setfenv", "getfenv", "coroutine", "channel", "collectgarbage"} {
+		t.Run(name, func(t *testing.T) {
+			got, err := ExecuteLua(context.Background(), "print(type("+name+"))")
+			if err != nil {
+				t.Fatalf("ExecuteLua() error = %v", err)
+			}
+			if got != "nil\n" {
+				t.Errorf("%s is reachable from the sandbox: type = %q", name, got)
+			}
+		})
+	}
+
+	// libB keeps working without the functions it used while loading.
+	got, err := ExecuteLua(context.Background(), "print(libB.json.decode('[1,2]')[2], tostring(os.difftime(2, 1) > 0))")
+	if err != nil {
+		t.Fatalf("ExecuteLua() error = %v", err)
+	}
+	if got != "2\ttrue\n" {
+		t.Errorf("ExecuteLua() = %q, want %q", got, "2\ttrue\n")
+	}
+}
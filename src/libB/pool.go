@@ -0,0 +1,204 @@
+package libb
+
+import (
+	"fmt"
+	"runtime"
+	"sync"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/******************************************************************************
+
+Lua state pool.
+
+Loading libB into a fresh Lua state is cheap once the Teal has been compiled,
+but it still isn't free, and the chat loop runs sandbox snippets constantly.
+Instead, we keep a pool of pre-warmed states that already have libB loaded.
+
+A pooled state is only useful if user code from the previous run can't leak
+into the next one. When a state is first warmed we take a snapshot of every
+table reachable from its globals (and the string metatable), including the
+tables' metatables. Before a state goes back into the pool, every one of those
+tables is restored to its snapshot: new keys are deleted, overwritten keys are
+reset, and metatables are put back. New globals disappear along with any other
+state the user attached to a reachable table.
+
+States which errored are never returned to the pool: they are closed, and a
+fresh state is warmed when the pool next runs dry.
+
+******************************************************************************/
+
+// tableSnapshot is the contents of a single Lua table at warm-up time.
+type tableSnapshot struct {
+	table     *lua.LTable
+	keys      []lua.LValue
+	values    []lua.LValue
+	metatable lua.LValue
+}
+
+// stateSnapshot is the reachable contents of a freshly warmed Lua state.
+type stateSnapshot struct {
+	tables []tableSnapshot
+}
+
+// takeSnapshot records every table reachable from the state's globals.
+func takeSnapshot(L *lua.LState) *stateSnapshot {
+	snapshot := &stateSnapshot{}
+	visited := make(map[*lua.LTable]bool)
+	var walk func(value lua.LValue)
+	walk = func(value lua.LValue) {
+		table, ok := value.(*lua.LTable)
+		if !ok || visited[table] {
+			return
+		}
+		visited[table] = true
+
+		ts := tableSnapshot{table: table, metatable: L.GetMetatable(table)}
+		table.ForEach(func(key, value lua.LValue) {
+			ts.keys = append(ts.keys, key)
+			ts.values = append(ts.values, value)
+		})
+		snapshot.tables = append(snapshot.tables, ts)
+
+		for i := range ts.keys {
+			walk(ts.keys[i])
+			walk(ts.values[i])
+		}
+		walk(ts.metatable)
+	}
+	walk(L.G.Global)
+	walk(L.GetMetatable(lua.LString("")))
+	return snapshot
+}
+
+// restore resets every snapshotted table to its warm-up contents.
+func (s *stateSnapshot) restore(L *lua.LState) {
+	for _, ts := range s.tables {
+		var current []lua.LValue
+		ts.table.ForEach(func(key, _ lua.LValue) {
+			current = append(current, key)
+		})
+		for _, key := range current {
+			ts.table.RawSet(key, lua.LNil)
+		}
+		for i, key := range ts.keys {
+			ts.table.RawSet(key, ts.values[i])
+		}
+		L.SetMetatable(ts.table, ts.metatable)
+	}
+	L.SetTop(0)
+}
+
+// statePool hands out Lua states which already have libB loaded.
+type statePool struct {
+	proto     *lua.FunctionProto
+	states    chan *lua.LState
+	snapshots sync.Map // *lua.LState -> *stateSnapshot
+}
+
+// newStatePool creates a pool holding up to size idle states, all of which
+// are warmed up front.
+func newStatePool(proto *lua.FunctionProto, size int) (*statePool, error) {
+	pool := &statePool{
+		proto:  proto,
+		states: make(chan *lua.LState, size),
+	}
+	for i := 0; i < size; i++ {
+		L, err := pool.warm()
+		if err != nil {
+			return nil, err
+		}
+		pool.states <- L
+	}
+	return pool, nil
+}
+
+// warm creates a new sandboxed Lua state with libB loaded as the global libB.
+func (p *statePool) warm() (*lua.LState, error) {
+	L := newSandboxState()
+	fn, err := newSandboxedFunction(L, p.proto)
+	if err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to load compiled libB: %v", err)
+	}
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		L.Close()
+		return nil, fmt.Errorf("failed to load compiled libB: %v", err)
+	}
+	L.SetGlobal("libB", L.Get(-1))
+	L.Pop(1)
+	installValidate(L)
+	installSimulate(L)
+	lockDownState(L)
+
+	p.snapshots.Store(L, takeSnapshot(L))
+	return L, nil
+}
+
+// Get returns an idle state from the pool, warming a new one if none are
+// available.
+func (p *statePool) Get() (*lua.LState, error) {
+	select {
+	case L := <-p.states:
+		return L, nil
+	default:
+		return p.warm()
+	}
+}
+
+// Put resets a state and returns it to the pool. Only states which finished
+// without error should be put back; anything else should just be closed.
+func (p *statePool) Put(L *lua.LState) {
+	snapshot, ok := p.snapshots.Load(L)
+	if !ok {
+		L.Close()
+		return
+	}
+	snapshot.(*stateSnapshot).restore(L)
+
+	select {
+	case p.states <- L:
+	default:
+		p.snapshots.Delete(L)
+		L.Close()
+	}
+}
+
+// Close discards a state that will not be returned to the pool.
+func (p *statePool) Close(L *lua.LState) {
+	p.snapshots.Delete(L)
+	L.Close()
+}
+
+var (
+	statePoolOnce sync.Once
+	sharedPool    *statePool
+	sharedPoolErr error
+)
+
+// defaultStatePool returns the process-wide state pool, creating it on first
+// use. It holds one idle state per available CPU.
+func defaultStatePool() (*statePool, error) {
+	statePoolOnce.Do(func() {
+		proto, err := CompiledLibB()
+		if err != nil {
+			sharedPoolErr = err
+			return
+		}
+		sharedPool, sharedPoolErr = newStatePool(proto, runtime.GOMAXPROCS(0))
+	})
+	return sharedPool, sharedPoolErr
+}
+
+// Warm compiles libB, fills the state pool and loads the type checker, so
+// that the first script run doesn't pay for it. It is safe to call more than
+// once.
+func Warm() error {
+	if _, err := defaultStatePool(); err != nil {
+		return err
+	}
+	_, err := defaultChecker()
+	return err
+}
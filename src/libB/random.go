@@ -0,0 +1,97 @@
+package libb
+
+import (
+	"math/rand"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/******************************************************************************
+
+Seeded randomness.
+
+gopher-lua's math.random draws from Go's global random source, so a script
+can't be re-run and produce the same values, and every Lua state shares (and
+reseeds) the same generator. libB.uuid.generate is built on math.random, so
+a re-executed step would produce different script and data ids, breaking any
+DATA[script_id][data_id] lookups against ids that were already handed out.
+
+Instead, every sandboxed state gets its own generator, stored in the state's
+registry where user code can't reach it. Protocol steps seed it from
+StepInput.Seed, which the host persists with each code_step, so re-running a
+step with the same inputs yields byte-identical results. Sandbox snippets
+are seeded from the clock.
+
+******************************************************************************/
+
+// randomRegistryKey is where a state's generator is kept in its registry.
+const randomRegistryKey = "libB.random"
+
+// NewSeed returns a fresh seed for a protocol step.
+func NewSeed() int64 {
+	return rand.Int63()
+}
+
+// installRandom replaces math.random and math.randomseed with functions
+// backed by a generator private to the state.
+func installRandom(L *lua.LState) {
+	generator := L.NewUserData()
+	generator.Value = rand.New(rand.NewSource(time.Now().UnixNano()))
+	L.G.Registry.RawSetString(randomRegistryKey, generator)
+
+	if math, ok := L.GetGlobal("math").(*lua.LTable); ok {
+		math.RawSetString("random", L.NewFunction(sandboxedRandom))
+		math.RawSetString("randomseed", L.NewFunction(sandboxedRandomseed))
+	}
+}
+
+// stateRandom returns the state's generator.
+func stateRandom(L *lua.LState) *rand.Rand {
+	if ud, ok := L.G.Registry.RawGetString(randomRegistryKey).(*lua.LUserData); ok {
+		if generator, ok := ud.Value.(*rand.Rand); ok {
+			return generator
+		}
+	}
+	L.RaiseError("random generator not initialized")
+	return nil
+}
+
+// seedRandom reseeds the state's generator.
+func seedRandom(L *lua.LState, seed int64) {
+	stateRandom(L).Seed(seed)
+}
+
+// sandboxedRandom is math.random, using the state's generator.
+func sandboxedRandom(L *lua.LState) int {
+	generator := stateRandom(L)
+	switch L.GetTop() {
+	case 0:
+		L.Push(lua.LNumber(generator.Float64()))
+	case 1:
+		n := L.CheckInt(1)
+		if n < 1 {
+			L.ArgError(1, "interval is empty")
+		}
+		L.Push(lua.LNumber(generator.Intn(n) + 1))
+	default:
+		min := L.CheckInt(1)
+		max := L.CheckInt(2)
+		if max < min {
+			L.ArgError(2, "interval is empty")
+		}
+		// The size of the interval wraps around past math.MaxInt.
+		n := max - min + 1
+		if n <= 0 {
+			L.ArgError(2, "interval is too large")
+		}
+		L.Push(lua.LNumber(generator.Intn(n) + min))
+	}
+	return 1
+}
+
+// sandboxedRandomseed is math.randomseed, using the state's generator.
+func sandboxedRandomseed(L *lua.LState) int {
+	seedRandom(L, L.CheckInt64(1))
+	return 0
+}
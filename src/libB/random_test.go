@@ -0,0 +1,141 @@
+package libb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+const uuidProtocol = `
+function main()
+	local script = libB.Script.new(libB.uuid.generate())
+	local human_commands = libB.HumanCommands.new()
+	human_commands:quantify(libB.uuid.generate(), "nest_96_wellplate_100ul_pcr_full_skirt", "7", "A1")
+	script:add_commands(human_commands)
+	return 2, tostring(math.random(1, 1000000)), "next", script:to_json(), ""
+end
+`
+
+func TestSeededRandom(t *testing.T) {
+	run := func(seed int64) string {
+		t.Helper()
+		state, err := ExecuteLuaStep(context.Background(), uuidProtocol, StepInput{Function: "main", Seed: seed})
+		if err != nil {
+			t.Fatalf("Failed to execute step: %v", err)
+		}
+		if id := state.Script.ID; state.Script.GetReturnKeys()[id][id] {
+			t.Errorf("Script id and data id are both %s", id)
+		}
+		scriptJSON, err := json.Marshal(state.Script)
+		if err != nil {
+			t.Fatalf("Failed to marshal script: %v", err)
+		}
+		return state.Comments + string(scriptJSON)
+	}
+
+	first := run(42)
+	if again := run(42); again != first {
+		t.Errorf("Same seed gave different results:\n%s\n%s", first, again)
+	}
+	if other := run(43); other == first {
+		t.Errorf("Different seeds gave the same result: %s", first)
+	}
+}
+
+func TestSandboxedRandom(t *testing.T) {
+	output, err := ExecuteLua(context.Background(), `
+math.randomseed(7)
+local a = math.random(10)
+math.randomseed(7)
+print(tostring(a == math.random(10)), tostring(math.random() < 1), math.random(3, 3))
+`)
+	if err != nil {
+		t.Fatalf("Failed to execute: %v", err)
+	}
+	if output != "true\ttrue\t3\n" {
+		t.Errorf("Unexpected output: %q", output)
+	}
+
+	_, err = ExecuteLua(context.Background(), `math.random(5, 1)`)
+	if err == nil || !strings.Contains(err.Error(), "interval is empty") {
+		t.Errorf("Expected an empty interval error, got %v", err)
+	}
+	_, err = ExecuteLua(context.Background(), `math.random(-2^62, 2^62)`)
+	if err == nil || !strings.Contains(err.Error(), "bad argument #2 to random (interval is too large)") {
+		t.Errorf("Expected an interval too large error, got %v", err)
+	}
+}
+
+// clockProtocol reaches for the clock, which would make replays differ.
+const clockProtocol = `
+function main()
+	local clocks = {}
+	for _, name in ipairs({"time", "clock", "date"}) do
+		local ok, err = pcall(function() return os[name]() end)
+		table.insert(clocks, name .. "=" .. tostring(ok))
+	end
+	return 0, table.concat(clocks, " ") .. " " .. os.difftime(60, 0) .. " " .. math.random(1, 1000000), "", nil, ""
+end
+`
+
+func TestClockReplay(t *testing.T) {
+	run := func() string {
+		t.Helper()
+		state, err := ExecuteLuaStep(context.Background(), clockProtocol, StepInput{Function: "main", Seed: 42})
+		if err != nil {
+			t.Fatalf("Failed to execute step: %v", err)
+		}
+		return state.Comments
+	}
+
+	first := run()
+	if !strings.HasPrefix(first, "time=false clock=false date=false 60 ") {
+		t.Errorf("Expected the clock to be out of reach, got %s", first)
+	}
+	if again := run(); again != first {
+		t.Errorf("Replaying the step gave a different result:\n%s\n%s", first, again)
+	}
+}
+
+// dataLoopProtocol draws a uuid for every upload, in the order pairs visits
+// DATA.
+const dataLoopProtocol = `
+function main()
+	local script = libB.Script.new(libB.uuid.generate())
+	local human_commands = libB.HumanCommands.new()
+	for script_id, results in pairs(DATA) do
+		for data_id in pairs(results) do
+			human_commands:quantify(script_id .. "/" .. data_id .. "/" .. libB.uuid.generate(), "nest_96_wellplate_100ul_pcr_full_skirt", "7", "A1")
+		end
+	end
+	script:add_commands(human_commands)
+	return 2, "Quantify again", "next", script:to_json(), ""
+end
+`
+
+func TestDataOrderReplay(t *testing.T) {
+	data := make(map[string]map[string]string)
+	for _, scriptID := range []string{"a", "b", "c", "d"} {
+		data[scriptID] = map[string]string{}
+		for _, dataID := range []string{"w", "x", "y", "z"} {
+			data[scriptID][dataID] = `{"ng_per_ul": 1}`
+		}
+	}
+	var first string
+	for i := 0; i < 20; i++ {
+		state, err := ExecuteLuaStep(context.Background(), dataLoopProtocol, StepInput{Function: "main", Seed: 42, Data: data})
+		if err != nil {
+			t.Fatalf("Failed to execute step: %v", err)
+		}
+		scriptJSON, err := json.Marshal(state.Script)
+		if err != nil {
+			t.Fatalf("Failed to marshal script: %v", err)
+		}
+		if i == 0 {
+			first = string(scriptJSON)
+		} else if string(scriptJSON) != first {
+			t.Fatalf("Run %d looped over DATA in a different order:\n%s\n%s", i, first, scriptJSON)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package libb
+
+import (
+	"fmt"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/******************************************************************************
+
+Step results.
+
+Every protocol function ends a step by describing what should happen next. It
+can do that in two ways. The original form is 5 positional values:
+
+	return 2, "Quantify DNA", "process_dna", script:to_json(), passthrough
+
+The same result can also be returned as a single table, using the named
+statuses in libB.status:
+
+	return {
+		status = libB.status.CONTINUE,
+		comment = "Quantify DNA",
+		next = "process_dna",
+		script = script,
+		passthrough = passthrough,
+	}
+
+In the table form only status is required, and script may be either a
+libB.Script or its JSON. Both forms are validated the same way, and any
+problem is reported as a *StepResultError naming the offending field.
+
+******************************************************************************/
+
+// Step statuses, as stored in code_step.status and exposed to Lua as
+// libB.status.
+const (
+	StatusSuccess        = 0 // the protocol finished successfully
+	StatusFailure        = 1 // the protocol finished unsuccessfully
+	StatusContinue       = 2 // run next once the script's data is uploaded
+	StatusContinueNoData = 3 // run next once the script has been run
+)
+
+// statusNames are the libB.status names of each status.
+var statusNames = map[int]string{
+	StatusSuccess:        "SUCCESS",
+	StatusFailure:        "FAILURE",
+	StatusContinue:       "CONTINUE",
+	StatusContinueNoData: "CONTINUE_NO_DATA",
+}
+
+// stepResultFields are the fields of a step result, in positional order.
+var stepResultFields = []string{"status", "comment", "next", "script", "passthrough"}
+
+// StepResultError is returned when a protocol function returns something
+// which isn't a valid step result.
+type StepResultError struct {
+	Function string // the protocol function which returned the result
+	Field    string // the invalid field, or empty if the result as a whole is invalid
+	Position int    // the field's return value position for positional results, 0 for tables
+	Message  string
+}
+
+func (e *StepResultError) Error() string {
+	switch {
+	case e.Field == "":
+		return fmt.Sprintf("%s returned an invalid step result: %s", e.Function, e.Message)
+	case e.Position > 0:
+		return fmt.Sprintf("%s returned an invalid %s (return value %d): %s", e.Function, e.Field, e.Position, e.Message)
+	}
+	return fmt.Sprintf("%s returned an invalid step result: field %s: %s", e.Function, e.Field, e.Message)
+}
+
+// parseStepResult parses the values returned by a protocol function, in
+// either the positional or the table form.
+func parseStepResult(L *lua.LState, funcName string, values []lua.LValue) (*ProtocolState, error) {
+	fields := make(map[string]lua.LValue, len(stepResultFields))
+	positional := true
+	switch {
+	case len(values) == len(stepResultFields):
+		for i, field := range stepResultFields {
+			fields[field] = values[i]
+		}
+	case len(values) == 1 && values[0].Type() == lua.LTTable:
+		positional = false
+		var unknown []string
+		values[0].(*lua.LTable).ForEach(func(key, value lua.LValue) {
+			name, ok := key.(lua.LString)
+			if !ok || !isStepResultField(string(name)) {
+				unknown = append(unknown, key.String())
+				return
+			}
+			fields[string(name)] = value
+		})
+		if len(unknown) > 0 {
+			return nil, &StepResultError{
+				Function: funcName,
+				Message:  fmt.Sprintf("unknown field %s; expected %s", strings.Join(unknown, ", "), strings.Join(stepResultFields, ", ")),
+			}
+		}
+	default:
+		got := fmt.Sprintf("%d values", len(values))
+		if len(values) == 1 {
+			got = fmt.Sprintf("a single %s", values[0].Type())
+		}
+		return nil, &StepResultError{
+			Function: funcName,
+			Message:  fmt.Sprintf("got %s; return either a table {status = ..., comment = ..., next = ..., script = ..., passthrough = ...} or 5 values: status, comment, next, script, passthrough", got),
+		}
+	}
+
+	fieldError := func(field string, format string, args ...interface{}) error {
+		err := &StepResultError{Function: funcName, Field: field, Message: fmt.Sprintf(format, args...)}
+		if positional {
+			for i, name := range stepResultFields {
+				if name == field {
+					err.Position = i + 1
+				}
+			}
+		}
+		return err
+	}
+	getString := func(field string) (string, error) {
+		value, ok := fields[field]
+		if !ok || value == lua.LNil {
+			return "", nil
+		}
+		if !lua.LVCanConvToString(value) {
+			return "", fieldError(field, "expected string, got %s", value.Type())
+		}
+		return lua.LVAsString(value), nil
+	}
+
+	// status
+	status, ok := fields["status"].(lua.LNumber)
+	if !ok {
+		got := lua.LNil.Type()
+		if value, exists := fields["status"]; exists {
+			got = value.Type()
+		}
+		return nil, fieldError("status", "expected one of libB.status, got %s", got)
+	}
+	if _, known := statusNames[int(status)]; !known || lua.LNumber(int(status)) != status {
+		return nil, fieldError("status", "%v is not a status; expected one of %s", status, statusList())
+	}
+	state := &ProtocolState{Status: int(status)}
+
+	// comment and passthrough
+	var err error
+	if state.Comments, err = getString("comment"); err != nil {
+		return nil, err
+	}
+	if state.DataPassthrough, err = getString("passthrough"); err != nil {
+		return nil, err
+	}
+
+	// next
+	if state.NextFunc, err = getString("next"); err != nil {
+		return nil, err
+	}
+	if state.NextFunc == "" && (state.Status == StatusContinue || state.Status == StatusContinueNoData) {
+		return nil, fieldError("next", "required when status is %s", statusNames[state.Status])
+	}
+	if state.NextFunc != "" && state.NextFunc != AwaitFunction {
+		if _, ok := L.GetGlobal(state.NextFunc).(*lua.LFunction); !ok {
+			return nil, fieldError("next", "%q is not a global function", state.NextFunc)
+		}
+	}
+
+	// script
+	switch script := fields["script"].(type) {
+	case nil, *lua.LNilType:
+	case *lua.LTable:
+		state.Script, err = scriptFromLua(L, script)
+		if err != nil {
+			return nil, fieldError("script", "%v", err)
+		}
+	default:
+		scriptJSON, err := getString("script")
+		if err != nil {
+			return nil, fieldError("script", "expected libB.Script or its JSON, got %s", script.Type())
+		}
+		if scriptJSON != "" {
+			state.Script, err = ParseScript([]byte(scriptJSON))
+			if err != nil {
+				return nil, fieldError("script", "%v", err)
+			}
+		}
+	}
+
+	return state, nil
+}
+
+func isStepResultField(name string) bool {
+	for _, field := range stepResultFields {
+		if field == name {
+			return true
+		}
+	}
+	return false
+}
+
+// statusList describes every libB.status, in order.
+func statusList() string {
+	names := make([]string, 0, len(statusNames))
+	for status := 0; status < len(statusNames); status++ {
+		names = append(names, fmt.Sprintf("libB.status.%s (%d)", statusNames[status], status))
+	}
+	return strings.Join(names, ", ")
+}
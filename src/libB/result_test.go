@@ -0,0 +1,84 @@
+package libb
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestStepResultTable(t *testing.T) {
+	code := `
+function main()
+	local script = libB.Script.new("script1")
+	return {
+		status = libB.status.CONTINUE,
+		comment = "Quantify DNA",
+		next = "process",
+		script = script,
+		passthrough = "{}",
+	}
+end
+
+function process(input)
+	return { status = libB.status.SUCCESS, comment = "Done", script = '{"id":"script2","commands":[]}' }
+end
+`
+	state, err := ExecuteLuaStep(context.Background(), code, StepInput{Function: "main"})
+	if err != nil {
+		t.Fatalf("Failed to execute main: %v", err)
+	}
+	if state.Status != StatusContinue || state.Comments != "Quantify DNA" || state.NextFunc != "process" || state.DataPassthrough != "{}" {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+	if state.Script == nil || state.Script.ID != "script1" {
+		t.Errorf("Expected script1, got %+v", state.Script)
+	}
+
+	state, err = ExecuteLuaStep(context.Background(), code, StepInput{Function: "process", Passthrough: "{}"})
+	if err != nil {
+		t.Fatalf("Failed to execute process: %v", err)
+	}
+	if state.Status != StatusSuccess || state.Comments != "Done" || state.NextFunc != "" || state.Script == nil || state.Script.ID != "script2" {
+		t.Errorf("Unexpected state: %+v", state)
+	}
+}
+
+func TestStepResultErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		result   string
+		field    string
+		position int
+		want     string
+	}{
+		{"four values", `2, "comment", "main", ""`, "", 0, "got 4 values"},
+		{"nothing", ``, "", 0, "got a single nil"},
+		{"missing status", `{ comment = "hi" }`, "status", 0, "got nil"},
+		{"unknown status", `{ status = 7 }`, "status", 0, "7 is not a status"},
+		{"fractional status", `1.5, "", "", "", ""`, "status", 1, "1.5 is not a status"},
+		{"unknown field", `{ status = libB.status.SUCCESS, coment = "typo" }`, "", 0, "unknown field coment"},
+		{"comment type", `{ status = libB.status.SUCCESS, comment = {} }`, "comment", 0, "expected string, got table"},
+		{"positional comment type", `0, true, "", "", ""`, "comment", 2, "expected string, got boolean"},
+		{"missing next", `{ status = libB.status.CONTINUE }`, "next", 0, "required when status is CONTINUE"},
+		{"undefined next", `{ status = libB.status.CONTINUE, next = "nope" }`, "next", 0, `"nope" is not a global function`},
+		{"bad script JSON", `0, "", "", "{", ""`, "script", 4, "failed to parse script JSON"},
+		{"script type", `{ status = libB.status.SUCCESS, script = true }`, "script", 0, "expected libB.Script or its JSON"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code := "function main()\n\treturn " + tt.result + "\nend"
+			_, err := ExecuteLuaStep(context.Background(), code, StepInput{Function: "main"})
+			var resultErr *StepResultError
+			if !errors.As(err, &resultErr) {
+				t.Fatalf("Expected a StepResultError, got %v", err)
+			}
+			if resultErr.Field != tt.field || resultErr.Position != tt.position {
+				t.Errorf("Expected field %q at position %d, got %q at %d", tt.field, tt.position, resultErr.Field, resultErr.Position)
+			}
+			if !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Expected error containing %q, got %q", tt.want, err.Error())
+			}
+		})
+	}
+}
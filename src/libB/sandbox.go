@@ -0,0 +1,241 @@
+package libb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/******************************************************************************
+
+Sandbox.
+
+Everything run through ExecuteLua or ExecuteLuaStep is written by a language
+model, so it has to be treated as hostile. Lua states only get a whitelist of
+the standard library: the base functions minus anything that loads code or
+touches the filesystem, plus table, string, math and os.difftime. The rest of
+os is gone, clock included: a step must replay to the same result, and the
+time it is replayed at is never the time it first ran. io, debug, package,
+coroutine and channel are never opened.
+
+Every execution is also bounded by Limits:
+
+- A deadline, taken from the context (or Limits.Timeout if it is sooner).
+- An instruction budget. gopher-lua checks its context once per VM
+  instruction, so the budget is counted in the context's Done method.
+- An allocation cap. Go has no per-goroutine allocation counter, and the
+  process-wide one counts every other execution and request too, so this is
+  the bytes the execution's own strings are built from, reserved before
+  anything builds them (see alloc.go). Tables and other small allocations
+  aren't counted; a script can only make so many of them within its
+  instruction budget.
+
+When a limit is hit the execution fails with a *LimitError.
+
+******************************************************************************/
+
+// Limits bounds the resources a single Lua execution may use. Zero values
+// disable the corresponding limit.
+type Limits struct {
+	Timeout         time.Duration
+	MaxInstructions int64
+	MaxAllocBytes   uint64
+	MaxOutputBytes  int // output kept by a Capture; anything past it is dropped
+}
+
+// DefaultLimits are the limits used for every execution unless otherwise
+// specified.
+var DefaultLimits = Limits{
+	Timeout:         10 * time.Second,
+	MaxInstructions: 100_000_000,
+	MaxAllocBytes:   512 << 20, // 512 MiB
+	MaxOutputBytes:  16 << 10,  // 16 KiB
+}
+
+var (
+	ErrTimeout          = errors.New("execution timed out")
+	ErrInstructionLimit = errors.New("instruction budget exceeded")
+	ErrMemoryLimit      = errors.New("allocation limit exceeded")
+)
+
+// LimitError is returned when a Lua execution is stopped for exceeding one of
+// its Limits. Err is one of ErrTimeout, ErrInstructionLimit or ErrMemoryLimit.
+type LimitError struct {
+	Err    error
+	Limits Limits
+}
+
+func (e *LimitError) Error() string {
+	switch e.Err {
+	case ErrTimeout:
+		return fmt.Sprintf("%v (limit %s)", e.Err, e.Limits.Timeout)
+	case ErrInstructionLimit:
+		return fmt.Sprintf("%v (limit %d instructions)", e.Err, e.Limits.MaxInstructions)
+	case ErrMemoryLimit:
+		return fmt.Sprintf("%v (limit %d bytes)", e.Err, e.Limits.MaxAllocBytes)
+	}
+	return e.Err.Error()
+}
+
+func (e *LimitError) Unwrap() error { return e.Err }
+
+// budgetContext is the context given to a Lua state while it runs. Its Done
+// method is called by the VM before every instruction, which is where the
+// instruction budget is enforced.
+type budgetContext struct {
+	context.Context
+	limits   Limits
+	steps    atomic.Int64
+	reserved uint64 // bytes reserved by guarded operations, see reserve
+	done     chan struct{}
+	once     sync.Once
+	err      atomic.Value // error
+	stop     func() bool
+}
+
+// newBudgetContext creates a context enforcing limits on top of ctx. The
+// returned function must be called once the execution finishes.
+func newBudgetContext(ctx context.Context, limits Limits) (*budgetContext, context.CancelFunc) {
+	var cancel context.CancelFunc = func() {}
+	if limits.Timeout > 0 {
+		ctx, cancel = context.WithTimeout(ctx, limits.Timeout)
+	}
+	c := &budgetContext{
+		Context: ctx,
+		limits:  limits,
+		done:    make(chan struct{}),
+	}
+	c.stop = context.AfterFunc(ctx, func() {
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			c.exceed(ErrTimeout)
+		} else {
+			c.exceed(ctx.Err())
+		}
+	})
+	return c, func() {
+		c.stop()
+		cancel()
+	}
+}
+
+func (c *budgetContext) exceed(err error) {
+	c.once.Do(func() {
+		c.err.Store(err)
+		close(c.done)
+	})
+}
+
+func (c *budgetContext) Done() <-chan struct{} {
+	steps := c.steps.Add(1)
+	if c.limits.MaxInstructions > 0 && steps > c.limits.MaxInstructions {
+		c.exceed(ErrInstructionLimit)
+	}
+	return c.done
+}
+
+func (c *budgetContext) Err() error {
+	if err, ok := c.err.Load().(error); ok {
+		return err
+	}
+	return nil
+}
+
+// limitError converts an error from a Lua call into a *LimitError if the
+// execution was stopped by its budget.
+func (c *budgetContext) limitError(err error) error {
+	switch budgetErr := c.Err(); budgetErr {
+	case nil:
+		return err
+	case ErrTimeout, ErrInstructionLimit, ErrMemoryLimit:
+		return &LimitError{Err: budgetErr, Limits: c.limits}
+	default:
+		return fmt.Errorf("execution cancelled: %w", budgetErr)
+	}
+}
+
+// runWithLimits runs fn with the state bound to ctx and limits. Any error fn
+// returns after a limit was hit is replaced with a *LimitError.
+func runWithLimits(ctx context.Context, L *lua.LState, limits Limits, fn func() error) error {
+	budget, release := newBudgetContext(ctx, limits)
+	defer release()
+
+	L.SetContext(budget)
+	defer L.RemoveContext()
+
+	if err := fn(); err != nil {
+		return budget.limitError(err)
+	}
+	return nil
+}
+
+// sandboxedBaseFunctions are the only base library functions left after
+// libB has loaded.
+var sandboxedBaseFunctions = map[string]bool{
+	"_G": true, "_VERSION": true,
+	"assert": true, "error": true, "getmetatable": true, "ipairs": true,
+	"next": true, "pairs": true, "pcall": true, "print": true,
+	"rawequal": true, "rawget": true, "rawset": true, "select": true,
+	"setmetatable": true, "tonumber": true, "tostring": true, "type": true,
+	"unpack": true, "xpcall": true,
+	"table": true, "string": true, "math": true, "os": true,
+}
+
+// sandboxedOsFunctions are the functions left in os.
+var sandboxedOsFunctions = map[string]bool{
+	"difftime": true,
+}
+
+// newSandboxState creates a Lua state with only the whitelisted libraries
+// open. libB needs loadstring while it loads, so the base library is pruned
+// by lockDownState once it has.
+func newSandboxState() *lua.LState {
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	for _, lib := range []struct {
+		name string
+		fn   lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+		{lua.OsLibName, lua.OpenOs},
+	} {
+		L.Push(L.NewFunction(lib.fn))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	return L
+}
+
+// lockDownState removes everything outside the whitelist from the state's
+// globals, guards functions which can allocate a lot in a single call and
+// gives the state its own random generator.
+func lockDownState(L *lua.LState) {
+	prune := func(table *lua.LTable, keep map[string]bool) {
+		var remove []lua.LValue
+		table.ForEach(func(key, _ lua.LValue) {
+			if name, ok := key.(lua.LString); !ok || !keep[string(name)] {
+				remove = append(remove, key)
+			}
+		})
+		for _, key := range remove {
+			table.RawSet(key, lua.LNil)
+		}
+	}
+	keep := make(map[string]bool, len(sandboxedBaseFunctions)+1)
+	for name := range sandboxedBaseFunctions {
+		keep[name] = true
+	}
+	keep["libB"] = true
+	prune(L.G.Global, keep)
+	if os, ok := L.GetGlobal("os").(*lua.LTable); ok {
+		prune(os, sandboxedOsFunctions)
+	}
+	guardLibraries(L)
+	installRandom(L)
+}
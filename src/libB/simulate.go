@@ -0,0 +1,407 @@
+package libb
+
+import (
+	"fmt"
+	"maps"
+	"math"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+/******************************************************************************
+
+Liquid simulation.
+
+ValidateDeck checks a script can run; Simulate checks it makes the reactions
+it was written for. It follows every aspirate and dispense, moving liquid
+between wells and tips, and keeps track of what each well is made of, so that
+at the end it can say "A1 contains 10 uL mastermix + 2 uL primers".
+
+Wells start empty unless they are given an InitialVolume. A well nobody
+declared which is aspirated from before anything was put into it is assumed to
+hold as much as needed of a liquid named after the well, such as "slot 2 A1",
+with a warning, so that a script can be simulated without declaring anything.
+Aspirating from a well which has run dry, or filling a well past its capacity,
+is an error.
+
+Well capacities come from labware names, which by Opentrons convention include
+the capacity of their wells or tips, as in
+nest_96_wellplate_100ul_pcr_full_skirt.
+
+******************************************************************************/
+
+// InitialVolume declares the liquid in a well before a script starts.
+type InitialVolume struct {
+	DeckSlot string  `json:"deck_slot"`
+	Address  string  `json:"address"`
+	Liquid   string  `json:"liquid"`
+	Volume   float64 `json:"volume"`
+}
+
+// WellVolume is what a well holds at the end of a simulation.
+type WellVolume struct {
+	Labware  string             `json:"labware"`
+	DeckSlot string             `json:"deck_slot"`
+	Address  string             `json:"address"`
+	Volume   float64            `json:"volume"`
+	Contents map[string]float64 `json:"contents"` // volume by liquid
+}
+
+// String describes the well's composition, largest volume first.
+func (w WellVolume) String() string {
+	well := fmt.Sprintf("%s of %s in slot %s", w.Address, w.Labware, w.DeckSlot)
+	if w.Labware == "" {
+		// Declared, but never used by the script.
+		well = fmt.Sprintf("%s in slot %s", w.Address, w.DeckSlot)
+	}
+	if len(w.Contents) == 0 {
+		return well + " is empty"
+	}
+	liquids := make([]string, 0, len(w.Contents))
+	for liquid := range w.Contents {
+		liquids = append(liquids, liquid)
+	}
+	sort.Slice(liquids, func(i, j int) bool {
+		if w.Contents[liquids[i]] != w.Contents[liquids[j]] {
+			return w.Contents[liquids[i]] > w.Contents[liquids[j]]
+		}
+		return liquids[i] < liquids[j]
+	})
+	parts := make([]string, len(liquids))
+	for i, liquid := range liquids {
+		parts[i] = fmt.Sprintf("%s uL %s", formatVolume(w.Contents[liquid]), liquid)
+	}
+	return fmt.Sprintf("%s contains %s", well, strings.Join(parts, " + "))
+}
+
+// Simulation is the result of simulating a script's liquid handling.
+type Simulation struct {
+	Wells  []WellVolume `json:"wells"` // every well used or declared, by slot then address
+	Issues []DeckIssue  `json:"issues"`
+}
+
+// formatVolume formats a volume in uL, hiding floating point noise from
+// splitting mixtures.
+func formatVolume(volume float64) string {
+	return strconv.FormatFloat(math.Round(volume*1000)/1000, 'f', -1, 64)
+}
+
+// volumeEpsilon absorbs floating point noise when comparing volumes.
+const volumeEpsilon = 1e-9
+
+// mixture is liquid by volume.
+type mixture map[string]float64
+
+// volume is the total volume of the mixture, added up in order of liquid so
+// that floating point rounding is the same every time.
+func (m mixture) volume() float64 {
+	var total float64
+	for _, liquid := range slices.Sorted(maps.Keys(m)) {
+		total += m[liquid]
+	}
+	return total
+}
+
+// take removes volume from the mixture, in proportion to what it is made of,
+// and returns what was removed.
+func (m mixture) take(volume float64) mixture {
+	total := m.volume()
+	taken := make(mixture)
+	if total <= 0 {
+		return taken
+	}
+	for liquid, amount := range m {
+		part := amount * volume / total
+		taken[liquid] = part
+		m[liquid] = amount - part
+		if m[liquid] <= volumeEpsilon {
+			delete(m, liquid)
+		}
+	}
+	return taken
+}
+
+func (m mixture) add(other mixture) {
+	for liquid, amount := range other {
+		m[liquid] += amount
+	}
+}
+
+// wellKey identifies a well. Labware is recorded separately, since only one
+// labware fits in a slot.
+type wellKey struct {
+	slot    string
+	address string
+}
+
+// simulatedWell is a well part way through a simulation.
+type simulatedWell struct {
+	labware  string
+	contents mixture
+	declared bool // given an InitialVolume
+	assumed  bool // undeclared, but aspirated from before it was filled
+}
+
+// simulatedTip is the tip on a pipette part way through a simulation.
+type simulatedTip struct {
+	capacity float64 // 0 if unknown
+	contents mixture
+}
+
+// simulation is the state of a Simulate call.
+type simulation struct {
+	wells     map[wellKey]*simulatedWell
+	tips      map[string]*simulatedTip // by mount side; nil without a tip
+	locations map[string]*deckLocation // where each mount last moved to
+	warned    map[string]bool          // labware already warned about
+	issueList
+}
+
+// Simulate follows the liquid moved by a script, starting from initial, and
+// returns what every well holds at the end along with the problems found.
+func Simulate(script *Script, initial []InitialVolume) Simulation {
+	s := &simulation{
+		wells:     make(map[wellKey]*simulatedWell),
+		tips:      make(map[string]*simulatedTip),
+		locations: make(map[string]*deckLocation),
+		warned:    make(map[string]bool),
+	}
+	for _, declared := range initial {
+		well := s.well(wellKey{declared.DeckSlot, declared.Address}, "")
+		well.declared = true
+		if declared.Volume > 0 {
+			well.contents[declared.Liquid] += declared.Volume
+		}
+	}
+	for i, group := range script.Commands {
+		for j, command := range group.Payload {
+			s.at(i, j, command.Kind())
+			s.apply(command)
+		}
+	}
+	return Simulation{Wells: s.results(), Issues: s.issues}
+}
+
+// well returns the simulated well at key, recording its labware if known.
+func (s *simulation) well(key wellKey, labware string) *simulatedWell {
+	well, ok := s.wells[key]
+	if !ok {
+		well = &simulatedWell{contents: make(mixture)}
+		s.wells[key] = well
+	}
+	if well.labware == "" {
+		well.labware = labware
+	}
+	return well
+}
+
+// apply simulates a single command.
+func (s *simulation) apply(command Command) {
+	switch c := command.(type) {
+	case MoveToCommand:
+		location := moveToLocation(c.Payload)
+		s.locations[c.Payload.Pipette.Side] = &location
+	case PickUpTipCommand:
+		location := deckLocation{labware: c.Payload.Labware, slot: c.Payload.DeckSlot, address: c.Payload.Address}
+		s.locations[c.Payload.Pipette.Side] = &location
+		capacity, _ := labwareCapacity(c.Payload.Labware)
+		s.tips[c.Payload.Pipette.Side] = &simulatedTip{capacity: capacity, contents: make(mixture)}
+	case DropTipCommand:
+		delete(s.tips, c.Payload.Pipette.Side)
+	case HomeCommand:
+		s.locations = make(map[string]*deckLocation)
+	case AspirateDispenseCommand:
+		if c.Payload.MoveTo != nil {
+			location := moveToLocation(*c.Payload.MoveTo)
+			s.locations[c.Payload.Pipette.Side] = &location
+		}
+		location := s.locations[c.Payload.Pipette.Side]
+		tip := s.tips[c.Payload.Pipette.Side]
+		if location == nil || tip == nil || c.Payload.Volume <= 0 {
+			// ValidateDeck reports these; there is no liquid to follow.
+			return
+		}
+		key := wellKey{location.slot, location.address}
+		well := s.well(key, location.labware)
+		if c.Type == "aspirate" {
+			s.aspirate(tip, well, *location, c.Payload.Volume)
+		} else {
+			s.dispense(tip, well, *location, c.Payload.Volume)
+		}
+	}
+}
+
+// aspirate moves volume from well into tip.
+func (s *simulation) aspirate(tip *simulatedTip, well *simulatedWell, location deckLocation, volume float64) {
+	held := well.contents.volume()
+	if !well.declared && !well.assumed && held <= volumeEpsilon {
+		s.warnf("no initial volume declared for %s; assuming it holds enough", location)
+		well.assumed = true
+	}
+	if well.assumed {
+		tip.contents[fmt.Sprintf("slot %s %s", location.slot, location.address)] += volume
+	} else {
+		if volume > held+volumeEpsilon {
+			s.errorf("aspirating %s uL from %s, which holds %s uL", formatVolume(volume), location, formatVolume(held))
+			volume = held
+		}
+		tip.contents.add(well.contents.take(volume))
+	}
+	if tipVolume := tip.contents.volume(); tip.capacity > 0 && tipVolume > tip.capacity+volumeEpsilon {
+		s.errorf("the tip holds %s uL, more than its capacity of %s uL", formatVolume(tipVolume), formatVolume(tip.capacity))
+	}
+}
+
+// dispense moves volume from tip into well. Overdrawing the tip is left to
+// ValidateDeck; whatever the tip holds is dispensed.
+func (s *simulation) dispense(tip *simulatedTip, well *simulatedWell, location deckLocation, volume float64) {
+	well.contents.add(tip.contents.take(math.Min(volume, tip.contents.volume())))
+	capacity, ok := labwareCapacity(location.labware)
+	if !ok {
+		if !s.warned[location.labware] {
+			s.warnf("unknown well capacity of %s; its wells can't be checked for overfilling", location.labware)
+			s.warned[location.labware] = true
+		}
+		return
+	}
+	if held := well.contents.volume(); held > capacity+volumeEpsilon {
+		s.errorf("%s holds %s uL, more than its capacity of %s uL", location, formatVolume(held), formatVolume(capacity))
+	}
+}
+
+// results returns the wells sorted by slot then address.
+func (s *simulation) results() []WellVolume {
+	wells := make([]WellVolume, 0, len(s.wells))
+	for key, well := range s.wells {
+		contents := make(map[string]float64, len(well.contents))
+		for liquid, volume := range well.contents {
+			contents[liquid] = volume
+		}
+		wells = append(wells, WellVolume{
+			Labware:  well.labware,
+			DeckSlot: key.slot,
+			Address:  key.address,
+			Volume:   well.contents.volume(),
+			Contents: contents,
+		})
+	}
+	sort.Slice(wells, func(i, j int) bool {
+		if wells[i].DeckSlot != wells[j].DeckSlot {
+			return naturalLess(wells[i].DeckSlot, wells[j].DeckSlot)
+		}
+		return addressLess(wells[i].Address, wells[j].Address)
+	})
+	return wells
+}
+
+// naturalLess orders numbers numerically and anything else as strings.
+func naturalLess(a, b string) bool {
+	x, errA := strconv.Atoi(a)
+	y, errB := strconv.Atoi(b)
+	if errA == nil && errB == nil {
+		return x < y
+	}
+	return a < b
+}
+
+// addressLess orders well addresses by row, then column, so A2 comes before
+// A10.
+func addressLess(a, b string) bool {
+	rowA := strings.TrimRight(a, "0123456789")
+	rowB := strings.TrimRight(b, "0123456789")
+	if rowA != rowB {
+		return rowA < rowB
+	}
+	return naturalLess(a[len(rowA):], b[len(rowB):])
+}
+
+// capacityPattern matches the well capacity in a labware name.
+var capacityPattern = regexp.MustCompile(`_(\d+(?:\.\d+)?)(ul|ml)(?:_|$)`)
+
+// labwareCapacity returns the capacity in uL of each well, or tip, of a
+// labware, read from its name.
+func labwareCapacity(labware string) (float64, bool) {
+	match := capacityPattern.FindStringSubmatch(strings.ToLower(labware))
+	if match == nil {
+		return 0, false
+	}
+	capacity, err := strconv.ParseFloat(match[1], 64)
+	if err != nil {
+		return 0, false
+	}
+	if match[2] == "ml" {
+		capacity *= 1000
+	}
+	return capacity, true
+}
+
+// installSimulate replaces the libB.simulate stub with Simulate.
+func installSimulate(L *lua.LState) {
+	if libB, ok := L.GetGlobal("libB").(*lua.LTable); ok {
+		libB.RawSetString("simulate", L.NewFunction(luaSimulate))
+	}
+}
+
+// luaSimulate is libB.simulate(script, initial). initial is an optional list
+// of InitialVolume tables. It returns a Simulation table, whose wells each
+// also have a description of their composition.
+func luaSimulate(L *lua.LState) int {
+	script, err := scriptFromLua(L, L.CheckTable(1))
+	if err != nil {
+		L.RaiseError("libB.simulate: %v", err)
+		return 0
+	}
+	var initial []InitialVolume
+	if table, ok := L.Get(2).(*lua.LTable); ok {
+		for i := 1; i <= table.Len(); i++ {
+			entry, ok := table.RawGetInt(i).(*lua.LTable)
+			if !ok {
+				L.RaiseError("libB.simulate: initial volume %d is not a table", i)
+				return 0
+			}
+			volume, ok := entry.RawGetString("volume").(lua.LNumber)
+			if !ok {
+				L.RaiseError("libB.simulate: initial volume %d has no volume", i)
+				return 0
+			}
+			initial = append(initial, InitialVolume{
+				DeckSlot: lua.LVAsString(entry.RawGetString("deck_slot")),
+				Address:  lua.LVAsString(entry.RawGetString("address")),
+				Liquid:   lua.LVAsString(entry.RawGetString("liquid")),
+				Volume:   float64(volume),
+			})
+		}
+	} else if L.Get(2) != lua.LNil {
+		L.ArgError(2, "expected a list of initial volumes")
+		return 0
+	}
+
+	simulation := Simulate(script, initial)
+	wells := L.NewTable()
+	for _, well := range simulation.Wells {
+		// pairs follows the order keys are inserted in, so they are
+		// inserted sorted for replays to loop over them the same.
+		contents := L.NewTable()
+		for _, liquid := range slices.Sorted(maps.Keys(well.Contents)) {
+			contents.RawSetString(liquid, lua.LNumber(well.Contents[liquid]))
+		}
+		table := L.NewTable()
+		table.RawSetString("labware", lua.LString(well.Labware))
+		table.RawSetString("deck_slot", lua.LString(well.DeckSlot))
+		table.RawSetString("address", lua.LString(well.Address))
+		table.RawSetString("volume", lua.LNumber(well.Volume))
+		table.RawSetString("contents", contents)
+		table.RawSetString("description", lua.LString(well.String()))
+		wells.Append(table)
+	}
+	result := L.NewTable()
+	result.RawSetString("wells", wells)
+	result.RawSetString("issues", deckIssuesToLua(L, simulation.Issues))
+	L.Push(result)
+	return 1
+}
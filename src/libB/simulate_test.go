@@ -0,0 +1,184 @@
+package libb
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestSimulateExample(t *testing.T) {
+	output, err := ExecuteLua(context.Background(), "print(libB.generate_protocol())")
+	if err != nil {
+		t.Fatalf("Failed to execute Lua code: %v", err)
+	}
+	script, err := ParseScript([]byte(output))
+	if err != nil {
+		t.Fatalf("Failed to parse script: %v", err)
+	}
+	simulation := Simulate(script, []InitialVolume{
+		{DeckSlot: "2", Address: "A1", Liquid: "mastermix", Volume: 500},
+		{DeckSlot: "2", Address: "B1", Liquid: "primers", Volume: 100},
+		{DeckSlot: "2", Address: "C1", Liquid: "template", Volume: 50},
+		{DeckSlot: "2", Address: "D1", Liquid: "water", Volume: 500},
+	})
+	if len(simulation.Issues) != 0 {
+		t.Errorf("Expected no issues, got %v", simulation.Issues)
+	}
+	var got []string
+	for _, well := range simulation.Wells {
+		got = append(got, well.String())
+	}
+	want := []string{
+		"A1 of opentrons_24_tuberack_nest_1.5ml_snapcap in slot 2 contains 490 uL mastermix",
+		"B1 of opentrons_24_tuberack_nest_1.5ml_snapcap in slot 2 contains 98 uL primers",
+		"C1 of opentrons_24_tuberack_nest_1.5ml_snapcap in slot 2 contains 49 uL template",
+		"D1 of opentrons_24_tuberack_nest_1.5ml_snapcap in slot 2 contains 493 uL water",
+		"A1 of nest_96_wellplate_100ul_pcr_full_skirt in slot 7 contains 10 uL mastermix + 7 uL water + 2 uL primers + 1 uL template",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("Unexpected wells:\n%s\nwant:\n%s", strings.Join(got, "\n"), strings.Join(want, "\n"))
+	}
+	if plate := simulation.Wells[4]; plate.Volume != 20 || plate.Contents["mastermix"] != 10 {
+		t.Errorf("Unexpected plate well: %+v", plate)
+	}
+}
+
+func TestSimulate(t *testing.T) {
+	initial := []InitialVolume{
+		{DeckSlot: "2", Address: "A1", Liquid: "mastermix", Volume: 100},
+		{DeckSlot: "2", Address: "B1", Liquid: "water", Volume: 5},
+	}
+	tests := []struct {
+		name     string
+		commands string
+		wells    []string // descriptions of the wells on the plate
+		issues   []string
+	}{
+		{
+			name: "mixtures split in proportion",
+			commands: `c:tc_open_lid():pick_up_tip(p, tips:well("A1")):aspirate(p, 10, tubes:well("A1")):dispense(p, 10, plate:well("A1"))
+				:aspirate(p, 4, tubes:well("B1")):dispense(p, 4, plate:well("A1")):aspirate(p, 7, plate:well("A1")):dispense(p, 7, plate:well("B1"))`,
+			wells: []string{
+				"A1 of nest_96_wellplate_100ul_pcr_full_skirt in slot 7 contains 5 uL mastermix + 2 uL water",
+				"B1 of nest_96_wellplate_100ul_pcr_full_skirt in slot 7 contains 5 uL mastermix + 2 uL water",
+			},
+		},
+		{
+			name:     "aspirating more than a well holds",
+			commands: `c:tc_open_lid():pick_up_tip(p, tips:well("A1")):aspirate(p, 8, tubes:well("B1")):dispense(p, 8, plate:well("A1"))`,
+			wells:    []string{"A1 of nest_96_wellplate_100ul_pcr_full_skirt in slot 7 contains 5 uL water"},
+			issues:   []string{"error: commands.0.payload.2 (aspirate): aspirating 8 uL from B1 of opentrons_24_tuberack_nest_1.5ml_snapcap in slot 2, which holds 5 uL"},
+		},
+		{
+			name: "overfilling a well",
+			commands: `c:tc_open_lid():pick_up_tip(p, tips:well("A1"))
+				for _ = 1, 5 do c:aspirate(p, 20, tubes:well("A1")):dispense(p, 20, plate:well("A1")) end
+				c:aspirate(p, 1, tubes:well("B1")):dispense(p, 1, plate:well("A1"))`,
+			wells:  []string{"A1 of nest_96_wellplate_100ul_pcr_full_skirt in slot 7 contains 100 uL mastermix + 1 uL water"},
+			issues: []string{"error: commands.0.payload.13 (dispense): A1 of nest_96_wellplate_100ul_pcr_full_skirt in slot 7 holds 101 uL, more than its capacity of 100 uL"},
+		},
+		{
+			name:     "undeclared source",
+			commands: `c:tc_open_lid():pick_up_tip(p, tips:well("A1")):aspirate(p, 3, tubes:well("C1")):dispense(p, 3, plate:well("A1")):aspirate(p, 3, tubes:well("C1"))`,
+			wells:    []string{"A1 of nest_96_wellplate_100ul_pcr_full_skirt in slot 7 contains 3 uL slot 2 C1"},
+			issues:   []string{"warning: commands.0.payload.2 (aspirate): no initial volume declared for C1 of opentrons_24_tuberack_nest_1.5ml_snapcap in slot 2; assuming it holds enough"},
+		},
+		{
+			name: "overfilling a tip",
+			commands: `c:tc_open_lid():pick_up_tip(p, tips:well("A1")):aspirate(p, 15, tubes:well("A1")):aspirate(p, 10, tubes:well("A1"))
+				:dispense(p, 25, plate:well("A1"))`,
+			wells:  []string{"A1 of nest_96_wellplate_100ul_pcr_full_skirt in slot 7 contains 25 uL mastermix"},
+			issues: []string{"error: commands.0.payload.3 (aspirate): the tip holds 25 uL, more than its capacity of 20 uL"},
+		},
+		{
+			name:     "unknown capacity",
+			commands: `c:pick_up_tip(p, tips:well("A1")):aspirate(p, 10, tubes:well("A1")):dispense(p, 10, libB.Labware.new("custom_plate", "3"):well("A1"))`,
+			issues:   []string{"warning: commands.0.payload.2 (dispense): unknown well capacity of custom_plate; its wells can't be checked for overfilling"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			simulation := Simulate(deckScript(t, tt.commands), initial)
+			var wells, issues []string
+			for _, well := range simulation.Wells {
+				if well.DeckSlot == "7" {
+					wells = append(wells, well.String())
+				}
+			}
+			for _, issue := range simulation.Issues {
+				issues = append(issues, issue.String())
+			}
+			if strings.Join(wells, "\n") != strings.Join(tt.wells, "\n") {
+				t.Errorf("Unexpected wells:\n%s\nwant:\n%s", strings.Join(wells, "\n"), strings.Join(tt.wells, "\n"))
+			}
+			if strings.Join(issues, "\n") != strings.Join(tt.issues, "\n") {
+				t.Errorf("Unexpected issues:\n%s\nwant:\n%s", strings.Join(issues, "\n"), strings.Join(tt.issues, "\n"))
+			}
+		})
+	}
+}
+
+func TestLabwareCapacity(t *testing.T) {
+	tests := map[string]float64{
+		"nest_96_wellplate_100ul_pcr_full_skirt":     100,
+		"opentrons_24_tuberack_nest_1.5ml_snapcap":   1500,
+		"opentrons_24_tuberack_generic_2ml_screwcap": 2000,
+		"nest_12_reservoir_15ml":                     15000,
+		"opentrons_96_tiprack_20ul":                  20,
+	}
+	for labware, want := range tests {
+		if got, ok := labwareCapacity(labware); !ok || got != want {
+			t.Errorf("labwareCapacity(%q) = %v, %v, want %v", labware, got, ok, want)
+		}
+	}
+	if _, ok := labwareCapacity("custom_plate"); ok {
+		t.Error("Expected no capacity for a name without one")
+	}
+}
+
+func TestLuaSimulate(t *testing.T) {
+	output, err := ExecuteLua(context.Background(), `
+local p = { pipette = "p20_single_gen2", side = "left" }
+local tubes = libB.Labware.new("opentrons_24_tuberack_nest_1.5ml_snapcap", "2")
+local c = libB.OpentronsCommands.new()
+	:pick_up_tip(p, libB.Labware.new("opentrons_96_tiprack_20ul", "1"):well("A1"))
+	:aspirate(p, 12, tubes:well("A1"))
+	:dispense(p, 12, tubes:well("A2"))
+local simulation = libB.simulate(libB.Script.new("s"):add_commands(c), {
+	{ deck_slot = "2", address = "A1", liquid = "buffer", volume = 10 },
+})
+for _, well in ipairs(simulation.wells) do
+	print(well.description, well.volume, well.contents.buffer)
+end
+for _, issue in ipairs(simulation.issues) do
+	print(issue.severity, issue.command, issue.message)
+end`)
+	if err != nil {
+		t.Fatalf("Failed to execute Lua code: %v", err)
+	}
+	want := "A1 of opentrons_24_tuberack_nest_1.5ml_snapcap in slot 2 is empty\t0\tnil\n" +
+		"A2 of opentrons_24_tuberack_nest_1.5ml_snapcap in slot 2 contains 10 uL buffer\t10\t10\n" +
+		"error\t2\taspirating 12 uL from A1 of opentrons_24_tuberack_nest_1.5ml_snapcap in slot 2, which holds 10 uL\n"
+	if output != want {
+		t.Errorf("Unexpected output:\n%s\nwant:\n%s", output, want)
+	}
+
+	// Contents are looped over in the same order on every run.
+	output, err = ExecuteLua(context.Background(), `
+local initial = {}
+for _, liquid in ipairs({ "water", "primers", "buffer", "enzyme", "template", "dntps" }) do
+	table.insert(initial, { deck_slot = "2", address = "A1", liquid = liquid, volume = 1 })
+end
+local simulation = libB.simulate(libB.Script.new("s"), initial)
+local liquids = {}
+for liquid in pairs(simulation.wells[1].contents) do
+	table.insert(liquids, liquid)
+end
+print(table.concat(liquids, " "))`)
+	if err != nil {
+		t.Fatalf("Failed to execute Lua code: %v", err)
+	}
+	if want := "buffer dntps enzyme primers template water\n"; output != want {
+		t.Errorf("Expected contents in sorted order, got %q", output)
+	}
+}
@@ -0,0 +1,52 @@
+# Exported from autodemo script "da50bbdd-e80c-4fd7-a27b-f0c2275e3f07".
+from opentrons import protocol_api
+
+metadata = {
+    "protocolName": "da50bbdd-e80c-4fd7-a27b-f0c2275e3f07",
+    "description": "Exported from autodemo script da50bbdd-e80c-4fd7-a27b-f0c2275e3f07",
+    "apiLevel": "2.8",
+}
+
+
+def run(protocol: protocol_api.ProtocolContext):
+    thermocycler = protocol.load_module("thermocycler module", 7)
+    slot_1 = protocol.load_labware("opentrons_96_tiprack_20ul", "1")
+    slot_2 = protocol.load_labware("opentrons_24_tuberack_nest_1.5ml_snapcap", "2")
+    slot_7 = thermocycler.load_labware("nest_96_wellplate_100ul_pcr_full_skirt")
+    right = protocol.load_instrument("p20_single_gen2", "right", tip_racks=[slot_1])
+
+    # commands[0]: "opentrons"
+    protocol.home()
+    right.pick_up_tip(slot_1["A1"])
+    right.aspirate(10, slot_2["A1"].bottom())
+    right.dispense(10, slot_7["A1"].bottom())
+    right.drop_tip()
+    right.pick_up_tip(slot_1["B1"])
+    right.aspirate(2, slot_2["B1"].bottom())
+    right.dispense(2, slot_7["A1"].bottom())
+    right.drop_tip()
+    right.pick_up_tip(slot_1["C1"])
+    right.aspirate(1, slot_2["C1"].bottom())
+    right.dispense(1, slot_7["A1"].bottom())
+    right.drop_tip()
+    right.pick_up_tip(slot_1["D1"])
+    right.aspirate(7, slot_2["D1"].bottom())
+    right.dispense(7, slot_7["A1"].bottom())
+    right.drop_tip()
+    protocol.home()
+    thermocycler.open_lid()
+    thermocycler.set_lid_temperature(temperature=100)
+    thermocycler.execute_profile(
+        steps=[
+            {"temperature": 95, "hold_time_seconds": 30},
+            {"temperature": 57, "hold_time_seconds": 30},
+            {"temperature": 72, "hold_time_seconds": 60},
+        ],
+        repetitions=30,
+        block_max_volume=50,
+    )
+    thermocycler.deactivate_block()
+    thermocycler.deactivate_lid()
+
+    # commands[1]: "human"
+    protocol.pause("Quantify the DNA in A1 of nest_96_wellplate_100ul_pcr_full_skirt in slot 7, upload the result as b6885800-f454-4f19-9c60-ff725aa2d51a, then resume.")
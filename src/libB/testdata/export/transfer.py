@@ -0,0 +1,30 @@
+# Exported from autodemo script "transfer".
+from opentrons import protocol_api
+from opentrons.types import Point
+
+metadata = {
+    "protocolName": "transfer",
+    "description": "Exported from autodemo script transfer",
+    "apiLevel": "2.8",
+}
+
+
+def run(protocol: protocol_api.ProtocolContext):
+    thermocycler = protocol.load_module("thermocycler module", 7)
+    slot_4 = protocol.load_labware("opentrons_96_tiprack_300ul", "4")
+    slot_5 = protocol.load_labware("nest_12_reservoir_15ml", "5")
+    slot_6 = protocol.load_labware("corning_96_wellplate_360ul_flat", "6")
+    left = protocol.load_instrument("p300_single_gen2", "left", tip_racks=[slot_4])
+
+    # commands[0]: "opentrons"
+    protocol.home()
+    left.pick_up_tip(slot_4["A1"])
+    left.move_to(slot_5["A1"].bottom().move(Point(x=0, y=0, z=2.5)))
+    left.aspirate(150, slot_5["A1"].bottom().move(Point(x=0, y=0, z=2.5)))
+    left.dispense(150, slot_6["H12"].bottom().move(Point(x=-1, y=0.5, z=0)))
+    left.drop_tip(slot_4["A1"])
+    thermocycler.close_lid()
+    thermocycler.set_block_temperature(temperature=4, hold_time_minutes=5, block_max_volume=150)
+
+    # commands[1]: "human"
+    pass
@@ -1,5 +1,15 @@
 package libb
 
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/xeipuuv/gojsonschema"
+)
+
 type Script struct {
 	ID       string         `json:"id"`
 	Commands []CommandGroup `json:"commands"`
@@ -128,59 +138,262 @@ type QuantifyCommand struct {
 	Payload QuantifyPayload `json:"payload"`
 }
 
-// Command groups
-type OpentronsCommand struct {
-	Type    string      `json:"type"`
-	Payload interface{} `json:"payload,omitempty"`
+// QuantifyResult is the result uploaded for a quantify command.
+type QuantifyResult struct {
+	NgPerUl float64 `json:"ng_per_ul"`
 }
 
+// CommandGroup is a group of commands for one kind of executor. Its commands
+// are decoded into their concrete types; see command.go.
 type CommandGroup struct {
-	CommandType string        `json:"command_type"` // "opentrons" or "human"
-	Payload     []interface{} `json:"payload"`
-}
-
-
-// GetReturnKeys extracts all return keys from a Script's commands
-func (s *Script) GetReturnKeys() map[string]string {
-    returnKeys := make(map[string]string) // scriptID -> returnKey
-
-    for _, commandGroup := range s.Commands {
-        if commandGroup.CommandType == "human" {
-            for _, payloadInterface := range commandGroup.Payload {
-                // Convert the interface{} to a map to check command type
-                if payloadMap, ok := payloadInterface.(map[string]interface{}); ok {
-                    if cmdType, ok := payloadMap["type"].(string); ok {
-                        switch cmdType {
-                        case "quantify":
-                            // Extract return key from quantify command
-                            if payload, ok := payloadMap["payload"].(map[string]interface{}); ok {
-                                if returnKey, ok := payload["return_key"].(string); ok {
-                                    returnKeys[s.ID] = returnKey
-                                }
-                            }
-                        // Add other human command types that have return keys here
-                        }
-                    }
-                }
-            }
-        }
-    }
-
-    return returnKeys
-}
-
-// HasAllData checks if all required return data is present in the provided data map
-func (s *Script) HasAllData(data map[string]map[string]string) bool {
-    returnKeys := s.GetReturnKeys()
-    
-    for scriptID, returnKey := range returnKeys {
-        if _, ok := data[scriptID]; !ok {
-            return false
-        }
-        if _, ok := data[scriptID][returnKey]; !ok {
-            return false
-        }
-    }
-    
-    return true
-}
\ No newline at end of file
+	CommandType string    `json:"command_type"` // "opentrons" or "human"
+	Payload     []Command `json:"payload"`
+}
+
+// ScriptSchema is the JSON schema every Script must match. It describes the
+// same commands as the types above; a test checks that the two agree.
+//
+//go:embed schema.json
+var ScriptSchema string
+
+var scriptSchema = func() *gojsonschema.Schema {
+	schema, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(ScriptSchema))
+	if err != nil {
+		panic(fmt.Sprintf("invalid script schema: %v", err))
+	}
+	return schema
+}()
+
+// Validate checks a Script against ScriptSchema, returning an error listing
+// every violation. Scripts decoded from JSON should be checked by ParseScript
+// instead, since decoding fills in missing fields.
+func (s *Script) Validate() error {
+	scriptJSON, err := json.Marshal(s)
+	if err != nil {
+		return fmt.Errorf("failed to marshal script: %v", err)
+	}
+	validation, err := scriptSchema.Validate(gojsonschema.NewBytesLoader(scriptJSON))
+	if err != nil {
+		return fmt.Errorf("failed to validate script: %v", err)
+	}
+	if validation.Valid() {
+		return nil
+	}
+	return schemaError(s.ID, validation)
+}
+
+// ParseScript decodes a Script from JSON, after checking the JSON against
+// ScriptSchema. Checking the JSON itself, rather than the decoded Script,
+// catches missing fields which would otherwise decode as zero values.
+func ParseScript(scriptJSON []byte) (*Script, error) {
+	validation, err := scriptSchema.Validate(gojsonschema.NewBytesLoader(scriptJSON))
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse script JSON: %v", err)
+	}
+	if !validation.Valid() {
+		var script struct {
+			ID string `json:"id"`
+		}
+		_ = json.Unmarshal(scriptJSON, &script)
+		return nil, schemaError(script.ID, validation)
+	}
+	var script Script
+	if err := json.Unmarshal(scriptJSON, &script); err != nil {
+		return nil, fmt.Errorf("failed to parse script JSON: %v", err)
+	}
+	return &script, nil
+}
+
+// schemaError lists every violation of ScriptSchema by the script with id.
+func schemaError(id string, validation *gojsonschema.Result) error {
+	violations := make([]string, len(validation.Errors()))
+	for i, resultErr := range validation.Errors() {
+		violations[i] = resultErr.String()
+	}
+	return fmt.Errorf("script %s does not match the script schema: %s", id, strings.Join(violations, "; "))
+}
+
+// resultCommands lists the commands of a Script which declare a return key,
+// in the order the commands were added.
+func (s *Script) resultCommands() []ResultCommand {
+	var commands []ResultCommand
+	for _, commandGroup := range s.Commands {
+		for _, command := range commandGroup.Payload {
+			if command, ok := command.(ResultCommand); ok {
+				commands = append(commands, command)
+			}
+		}
+	}
+	return commands
+}
+
+// returnKeys lists the return keys of a Script's human commands, in the order
+// the commands were added.
+func (s *Script) returnKeys() []string {
+	var keys []string
+	for _, command := range s.resultCommands() {
+		keys = append(keys, command.ResultKey())
+	}
+	return keys
+}
+
+// GetReturnKeys extracts the set of return keys from a Script's commands,
+// keyed by script ID. A script with no human commands returning data has no
+// entry.
+func (s *Script) GetReturnKeys() map[string]map[string]bool {
+	returnKeys := make(map[string]map[string]bool) // scriptID -> set of returnKeys
+	for _, key := range s.returnKeys() {
+		if returnKeys[s.ID] == nil {
+			returnKeys[s.ID] = make(map[string]bool)
+		}
+		returnKeys[s.ID][key] = true
+	}
+	return returnKeys
+}
+
+// HasAllData checks if all required return data is present in the provided
+// data map. If it isn't, missing holds the sorted return keys which have no
+// data yet, keyed by script ID.
+func (s *Script) HasAllData(data map[string]map[string]string) (bool, map[string][]string) {
+	missing := make(map[string][]string)
+	for scriptID, returnKeys := range s.GetReturnKeys() {
+		for returnKey := range returnKeys {
+			if _, ok := data[scriptID][returnKey]; !ok {
+				missing[scriptID] = append(missing[scriptID], returnKey)
+			}
+		}
+		sort.Strings(missing[scriptID])
+	}
+	return len(missing) == 0, missing
+}
+
+// HumanResultSchemas holds the JSON schema of the result of each human command
+// type, keyed by command type. Results uploaded for a command are validated
+// against its schema before they are stored. These match
+// HumanCommands.result_schemas in libB.tl. Results of commands without a
+// schema can be any JSON.
+var HumanResultSchemas = map[string]string{
+	"quantify": `{
+	"type": "object",
+	"properties": {
+		"ng_per_ul": {"type": "number", "minimum": 0, "description": "DNA concentration in ng/uL"}
+	},
+	"required": ["ng_per_ul"],
+	"additionalProperties": false
+}`,
+}
+
+// humanResultSchemas holds HumanResultSchemas compiled.
+var humanResultSchemas = func() map[string]*gojsonschema.Schema {
+	schemas := make(map[string]*gojsonschema.Schema, len(HumanResultSchemas))
+	for commandType, schema := range HumanResultSchemas {
+		compiled, err := gojsonschema.NewSchema(gojsonschema.NewStringLoader(schema))
+		if err != nil {
+			panic(fmt.Sprintf("invalid result schema for %s: %v", commandType, err))
+		}
+		schemas[commandType] = compiled
+	}
+	return schemas
+}()
+
+// FieldError is a problem with one field of an uploaded result.
+type FieldError struct {
+	ReturnKey string `json:"return_key"`
+	Field     string `json:"field"` // "(root)" for the result as a whole
+	Message   string `json:"message"`
+}
+
+func (e FieldError) String() string {
+	return fmt.Sprintf("%s: %s: %s", e.ReturnKey, e.Field, e.Message)
+}
+
+// ValidateResult checks a JSON result uploaded for a return key against the
+// result schema of the command declaring the key, and returns every problem
+// found. Return keys the Script doesn't declare aren't checked.
+func (s *Script) ValidateResult(returnKey string, result string) []FieldError {
+	for _, command := range s.resultCommands() {
+		if command.ResultKey() != returnKey {
+			continue
+		}
+		schema, ok := humanResultSchemas[command.Kind()]
+		if !ok {
+			return nil
+		}
+		validation, err := schema.Validate(gojsonschema.NewStringLoader(result))
+		if err != nil {
+			return []FieldError{{ReturnKey: returnKey, Field: "(root)", Message: fmt.Sprintf("invalid JSON: %v", err)}}
+		}
+		var errs []FieldError
+		for _, resultErr := range validation.Errors() {
+			errs = append(errs, FieldError{ReturnKey: returnKey, Field: resultErr.Field(), Message: resultErr.Description()})
+		}
+		return errs
+	}
+	return nil
+}
+
+// ValidateData checks every result uploaded for the Script in data, keyed by
+// script ID then return key, with ValidateResult. Problems are sorted by
+// return key.
+func (s *Script) ValidateData(data map[string]map[string]string) []FieldError {
+	returnKeys := make([]string, 0, len(data[s.ID]))
+	for returnKey := range data[s.ID] {
+		returnKeys = append(returnKeys, returnKey)
+	}
+	sort.Strings(returnKeys)
+	var errs []FieldError
+	for _, returnKey := range returnKeys {
+		errs = append(errs, s.ValidateResult(returnKey, data[s.ID][returnKey])...)
+	}
+	return errs
+}
+
+// ResultField is a field of a human command's result, for building forms to
+// upload results with.
+type ResultField struct {
+	Name        string
+	Type        string // the field's JSON schema type, such as "number"
+	Description string
+	Required    bool
+}
+
+// ResultFields returns the fields of the result expected for a return key:
+// required fields first, in the order of the schema's required list, then the
+// rest sorted by name, since decoding the schema's properties loses their
+// order. It returns nil if the command declaring the key has no result schema.
+func (s *Script) ResultFields(returnKey string) []ResultField {
+	for _, command := range s.resultCommands() {
+		if command.ResultKey() != returnKey {
+			continue
+		}
+		var schema struct {
+			Properties map[string]struct {
+				Type        string `json:"type"`
+				Description string `json:"description"`
+			} `json:"properties"`
+			Required []string `json:"required"`
+		}
+		if err := json.Unmarshal([]byte(HumanResultSchemas[command.Kind()]), &schema); err != nil {
+			return nil
+		}
+		required := make(map[string]bool, len(schema.Required))
+		names := append([]string{}, schema.Required...)
+		for _, name := range schema.Required {
+			required[name] = true
+		}
+		var optional []string
+		for name := range schema.Properties {
+			if !required[name] {
+				optional = append(optional, name)
+			}
+		}
+		sort.Strings(optional)
+		var fields []ResultField
+		for _, name := range append(names, optional...) {
+			property := schema.Properties[name]
+			fields = append(fields, ResultField{Name: name, Type: property.Type, Description: property.Description, Required: required[name]})
+		}
+		return fields
+	}
+	return nil
+}
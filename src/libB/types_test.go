@@ -1,7 +1,7 @@
 package libb
 
 import (
-	_ "embed"
+	"context"
 	"encoding/json"
 	"reflect"
 	"strings"
@@ -10,12 +10,9 @@ import (
 	"github.com/xeipuuv/gojsonschema"
 )
 
-//go:embed schema.json
-var protocolSchema string
-
 func TestProtocolSerialization(t *testing.T) {
 	// Execute the Lua code to get the protocol JSON
-	result, err := ExecuteLua("local result = libB.generate_protocol() print(result)")
+	result, err := ExecuteLua(context.Background(), "local result = libB.generate_protocol() print(result)")
 	if err != nil {
 		t.Fatalf("Failed to execute Lua code: %v", err)
 	}
@@ -24,7 +21,7 @@ func TestProtocolSerialization(t *testing.T) {
 	result = strings.TrimSpace(result)
 
 	// Step 1: Validate against JSON schema
-	schemaLoader := gojsonschema.NewStringLoader(protocolSchema)
+	schemaLoader := gojsonschema.NewStringLoader(ScriptSchema)
 	documentLoader := gojsonschema.NewStringLoader(result)
 
 	validation, err := gojsonschema.Validate(schemaLoader, documentLoader)
@@ -152,3 +149,296 @@ func TestCommandSerialization(t *testing.T) {
 		})
 	}
 }
+
+func TestReturnKeys(t *testing.T) {
+	state, err := ExecuteLuaStep(context.Background(), `
+function main()
+	local script = libB.Script.new("plate")
+	local human_commands = libB.HumanCommands.new()
+	for _, address in ipairs({"A1", "A2", "A3"}) do
+		human_commands:quantify("dna_" .. address, "nest_96_wellplate_100ul_pcr_full_skirt", "7", address)
+	end
+	script:add_commands(human_commands)
+	return 2, "Quantify the plate", "next", script:to_json(), ""
+end
+`, StepInput{Function: "main"})
+	if err != nil {
+		t.Fatalf("Failed to execute step: %v", err)
+	}
+	script := state.Script
+	// Return keys come from every command group, whether it was decoded or
+	// built in Go.
+	script.Commands = append(script.Commands, CommandGroup{
+		CommandType: "human",
+		Payload:     []Command{QuantifyCommand{Type: "quantify", Payload: QuantifyPayload{ReturnKey: "dna_B1"}}},
+	})
+
+	expected := map[string]map[string]bool{"plate": {"dna_A1": true, "dna_A2": true, "dna_A3": true, "dna_B1": true}}
+	if keys := script.GetReturnKeys(); !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected return keys: %v", keys)
+	}
+
+	data := map[string]map[string]string{"plate": {"dna_A2": `{"ng_per_ul": 10}`, "od": "0.5"}}
+	hasAll, missing := script.HasAllData(data)
+	if hasAll || !reflect.DeepEqual(missing, map[string][]string{"plate": {"dna_A1", "dna_A3", "dna_B1"}}) {
+		t.Errorf("Expected dna_A1, dna_A3 and dna_B1 to be missing, got %v %v", hasAll, missing)
+	}
+	for _, key := range missing["plate"] {
+		data["plate"][key] = `{"ng_per_ul": 10}`
+	}
+	if hasAll, missing := script.HasAllData(data); !hasAll || len(missing) != 0 {
+		t.Errorf("Expected all data to be present, missing %v", missing)
+	}
+}
+
+func TestValidateResult(t *testing.T) {
+	script := &Script{ID: "plate", Commands: []CommandGroup{{
+		CommandType: "human",
+		Payload:     []Command{QuantifyCommand{Type: "quantify", Payload: QuantifyPayload{ReturnKey: "dna"}}},
+	}}}
+
+	tests := []struct {
+		result string
+		fields []string
+	}{
+		{`{"ng_per_ul": 12.5}`, nil},
+		{`{}`, []string{"(root)"}},
+		{`{"ng_per_ul": "high"}`, []string{"ng_per_ul"}},
+		{`{"ng_per_ul": -1}`, []string{"ng_per_ul"}},
+		{`{"ng_per_ul": 1, "ng_per_ml": 1000}`, []string{"(root)"}},
+		{`not json`, []string{"(root)"}},
+	}
+	for _, tt := range tests {
+		var fields []string
+		for _, err := range script.ValidateResult("dna", tt.result) {
+			if err.ReturnKey != "dna" || err.Message == "" {
+				t.Errorf("Unexpected error for %s: %+v", tt.result, err)
+			}
+			fields = append(fields, err.Field)
+		}
+		if !reflect.DeepEqual(fields, tt.fields) {
+			t.Errorf("Expected errors for %v validating %s, got %v", tt.fields, tt.result, fields)
+		}
+	}
+
+	// Return keys the script doesn't declare aren't checked.
+	if errs := script.ValidateResult("od", `0.5`); len(errs) != 0 {
+		t.Errorf("Expected any result for od, got %v", errs)
+	}
+	errs := script.ValidateData(map[string]map[string]string{"plate": {"od": `0.5`, "dna": `{"ng_per_ul": "high"}`}})
+	if len(errs) != 1 || errs[0].String() != "dna: ng_per_ul: Invalid type. Expected: number, given: string" {
+		t.Errorf("Unexpected errors: %v", errs)
+	}
+
+	fields := script.ResultFields("dna")
+	if len(fields) != 1 || fields[0] != (ResultField{Name: "ng_per_ul", Type: "number", Description: "DNA concentration in ng/uL", Required: true}) {
+		t.Errorf("Unexpected fields: %+v", fields)
+	}
+	if fields := script.ResultFields("od"); fields != nil {
+		t.Errorf("Expected no fields for od, got %+v", fields)
+	}
+}
+
+func TestResultSchemasMatchLibB(t *testing.T) {
+	output, err := ExecuteLua(context.Background(), `print(libB.json.encode(libB.HumanCommands.result_schemas))`)
+	if err != nil {
+		t.Fatalf("Failed to read result schemas: %v", err)
+	}
+	var luaSchemas map[string]string
+	if err := json.Unmarshal([]byte(output), &luaSchemas); err != nil {
+		t.Fatalf("Failed to parse result schemas: %v", err)
+	}
+	if len(luaSchemas) != len(HumanResultSchemas) {
+		t.Errorf("libB.tl declares result schemas for %d commands, types.go for %d", len(luaSchemas), len(HumanResultSchemas))
+	}
+	for commandType, schema := range HumanResultSchemas {
+		var goSchema, luaSchema interface{}
+		if err := json.Unmarshal([]byte(schema), &goSchema); err != nil {
+			t.Fatalf("Failed to parse Go schema for %s: %v", commandType, err)
+		}
+		if err := json.Unmarshal([]byte(luaSchemas[commandType]), &luaSchema); err != nil {
+			t.Fatalf("Failed to parse libB.tl schema for %s: %v", commandType, err)
+		}
+		if !reflect.DeepEqual(goSchema, luaSchema) {
+			t.Errorf("Result schemas for %s differ:\nGo: %s\nlibB.tl: %s", commandType, schema, luaSchemas[commandType])
+		}
+	}
+}
+
+// goCommands holds the Go type of every command type in schema.json.
+var goCommands = map[string]interface{}{
+	"home":                HomeCommand{},
+	"move_to":             MoveToCommand{},
+	"aspirate":            AspirateDispenseCommand{},
+	"dispense":            AspirateDispenseCommand{},
+	"pick_up_tip":         PickUpTipCommand{},
+	"drop_tip":            DropTipCommand{},
+	"tc_set_lid_temp":     TCSetLidTempCommand{},
+	"tc_set_block_temp":   TCSetBlockTempCommand{},
+	"tc_execute_profile":  TCExecuteProfileCommand{},
+	"tc_open_lid":         TCSimpleCommand{},
+	"tc_close_lid":        TCSimpleCommand{},
+	"tc_deactivate_lid":   TCSimpleCommand{},
+	"tc_deactivate_block": TCSimpleCommand{},
+	"quantify":            QuantifyCommand{},
+}
+
+// schemaNode is the part of a JSON schema the agreement test reads.
+type schemaNode struct {
+	Ref        string                 `json:"$ref"`
+	Type       string                 `json:"type"`
+	Enum       []string               `json:"enum"`
+	Properties map[string]*schemaNode `json:"properties"`
+	Required   []string               `json:"required"`
+	Items      *schemaNode            `json:"items"`
+	OneOf      []*schemaNode          `json:"oneOf"`
+	AllOf      []*schemaNode          `json:"allOf"`
+	Defs       map[string]*schemaNode `json:"$defs"`
+}
+
+func TestSchemaMatchesTypes(t *testing.T) {
+	var root schemaNode
+	if err := json.Unmarshal([]byte(ScriptSchema), &root); err != nil {
+		t.Fatalf("Failed to parse schema: %v", err)
+	}
+	// resolve follows $refs and merges allOf into a single object schema.
+	var resolve func(node *schemaNode) *schemaNode
+	resolve = func(node *schemaNode) *schemaNode {
+		if node.Ref != "" {
+			return resolve(root.Defs[strings.TrimPrefix(node.Ref, "#/$defs/")])
+		}
+		if len(node.AllOf) == 0 {
+			return node
+		}
+		merged := &schemaNode{Type: "object", Properties: map[string]*schemaNode{}}
+		for _, part := range append([]*schemaNode{node}, node.AllOf...) {
+			if part != node {
+				part = resolve(part)
+			}
+			for name, property := range part.Properties {
+				merged.Properties[name] = property
+			}
+			merged.Required = append(merged.Required, part.Required...)
+		}
+		return merged
+	}
+	// compare checks that a Go type marshals to what a schema describes.
+	var compare func(path string, goType reflect.Type, node *schemaNode)
+	compare = func(path string, goType reflect.Type, node *schemaNode) {
+		node = resolve(node)
+		if goType.Kind() == reflect.Pointer {
+			goType = goType.Elem()
+		}
+		switch goType.Kind() {
+		case reflect.Struct:
+			required := make(map[string]bool)
+			for _, name := range node.Required {
+				required[name] = true
+			}
+			fields := make(map[string]bool)
+			for i := 0; i < goType.NumField(); i++ {
+				name, options, _ := strings.Cut(goType.Field(i).Tag.Get("json"), ",")
+				fields[name] = true
+				property, ok := node.Properties[name]
+				if !ok {
+					t.Errorf("%s.%s is in types.go but not schema.json", path, name)
+					continue
+				}
+				if omitempty := options == "omitempty"; omitempty == required[name] {
+					t.Errorf("%s.%s: omitempty is %v in types.go, but required is %v in schema.json", path, name, omitempty, required[name])
+				}
+				compare(path+"."+name, goType.Field(i).Type, property)
+			}
+			for name := range node.Properties {
+				if !fields[name] {
+					t.Errorf("%s.%s is in schema.json but not types.go", path, name)
+				}
+			}
+		case reflect.Slice:
+			if node.Type != "array" || node.Items == nil {
+				t.Errorf("%s is a slice in types.go but %q in schema.json", path, node.Type)
+				return
+			}
+			compare(path+"[]", goType.Elem(), node.Items)
+		case reflect.String:
+			if node.Type != "string" {
+				t.Errorf("%s is a string in types.go but %q in schema.json", path, node.Type)
+			}
+		case reflect.Float64, reflect.Int:
+			if node.Type != "number" && node.Type != "integer" {
+				t.Errorf("%s is a number in types.go but %q in schema.json", path, node.Type)
+			}
+		case reflect.Bool:
+			if node.Type != "boolean" {
+				t.Errorf("%s is a bool in types.go but %q in schema.json", path, node.Type)
+			}
+		default:
+			t.Errorf("%s has unexpected kind %s in types.go", path, goType.Kind())
+		}
+	}
+
+	seen := make(map[string]bool)
+	for _, group := range root.Properties["commands"].Items.OneOf {
+		commands := group.Properties["payload"].Items
+		branches := commands.OneOf
+		if len(branches) == 0 {
+			branches = []*schemaNode{commands}
+		}
+		for _, branch := range branches {
+			for _, commandType := range branch.Properties["type"].Enum {
+				seen[commandType] = true
+				command, ok := goCommands[commandType]
+				if !ok {
+					t.Errorf("schema.json has command %s, which has no type in types.go", commandType)
+					continue
+				}
+				compare(commandType, reflect.TypeOf(command), branch)
+			}
+		}
+	}
+	for commandType := range goCommands {
+		if !seen[commandType] {
+			t.Errorf("types.go has command %s, which isn't in schema.json", commandType)
+		}
+	}
+	for groupType, decoders := range commandTypes {
+		for commandType := range decoders {
+			if !seen[commandType] {
+				t.Errorf("%s command %s is decoded, but isn't in schema.json", groupType, commandType)
+			}
+		}
+	}
+}
+
+func TestParseScript(t *testing.T) {
+	tests := []struct {
+		name   string
+		script string
+		err    string
+	}{
+		{"valid", `{"id": "s", "commands": [{"command_type": "opentrons", "payload": [{"type": "home"}]}]}`, ""},
+		{"no commands", `{"id": "s"}`, "commands is required"},
+		{"unknown command type", `{"id": "s", "commands": [{"command_type": "robot", "payload": []}]}`, "commands.0"},
+		{"missing field", `{"id": "s", "commands": [{"command_type": "human", "payload": [{"type": "quantify", "payload": {"return_key": "k"}}]}]}`, "labware is required"},
+		{"wrong type", `{"id": "s", "commands": [{"command_type": "opentrons", "payload": [{"type": "tc_set_lid_temp", "payload": {"temperature": "hot"}}]}]}`, "commands.0"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := ParseScript([]byte(tt.script))
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("Expected script to be valid, got %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), "script s does not match the script schema") || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("Expected an error mentioning %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	// Scripts built in Go are checked after the fact.
+	if err := (&Script{ID: "s"}).Validate(); err == nil || !strings.Contains(err.Error(), "commands: Invalid type") {
+		t.Errorf("Expected a script without commands to be invalid, got %v", err)
+	}
+}
@@ -0,0 +1,151 @@
+/*
+Package ot2 runs scripts on an OT-2 through the FastAPI server in app.py.
+
+The server runs one opentrons command group at a time: posting a group to
+/api/plr simulates it, then starts it on the robot and returns the id of the
+run in the server's activity log. The run is RUNNING until it either FAILED or
+COMPLETED, which /status/{run_id} reports. Only one run can hold the robot at
+a time; posting while it is busy is refused rather than queued.
+
+FakeRobot implements the same endpoints in Go, so that everything talking to a
+robot can be tested without one.
+*/
+package ot2
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+// RunStatus is the status of a run in the server's activity log.
+type RunStatus string
+
+const (
+	StatusRunning   RunStatus = "RUNNING"
+	StatusFailed    RunStatus = "FAILED"
+	StatusCompleted RunStatus = "COMPLETED"
+)
+
+// lockedMessage is the message the server refuses runs with while the robot
+// is busy.
+const lockedMessage = "App currently locked"
+
+// ErrLocked is returned when submitting a run while another one holds the
+// robot.
+var ErrLocked = errors.New("robot is busy with another run")
+
+// SubmitResponse is the server's response to posting a group to /api/plr.
+// ID is nil if no run was started.
+type SubmitResponse struct {
+	Message string `json:"Message"`
+	ID      *int64 `json:"id,omitempty"`
+	Version string `json:"ver,omitempty"`
+}
+
+// Status is a run's entry in the server's activity log, from /status/{run_id}.
+type Status struct {
+	Status        RunStatus `json:"status"`
+	StatusMessage string    `json:"status_message"`
+	Started       string    `json:"started"`
+	ExecutionTime *int64    `json:"execution_time"` // seconds, once the run has finished
+}
+
+// Client talks to the server at BaseURL.
+type Client struct {
+	BaseURL      string
+	HTTPClient   *http.Client
+	PollInterval time.Duration // how often Wait checks a run's status
+}
+
+// NewClient returns a client for the server at baseURL, such as
+// "http://ot2.local:8000".
+func NewClient(baseURL string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimRight(baseURL, "/"),
+		HTTPClient:   http.DefaultClient,
+		PollInterval: 5 * time.Second,
+	}
+}
+
+// Submit posts an opentrons command group to /api/plr and returns the id of
+// the run it started. It returns ErrLocked if the robot is busy.
+func (c *Client) Submit(ctx context.Context, group libb.CommandGroup) (int64, error) {
+	body, err := json.Marshal(group)
+	if err != nil {
+		return 0, fmt.Errorf("failed to encode command group: %v", err)
+	}
+	var response SubmitResponse
+	if err := c.do(ctx, "POST", "/api/plr", body, &response); err != nil {
+		return 0, err
+	}
+	if response.ID == nil {
+		if response.Message == lockedMessage {
+			return 0, ErrLocked
+		}
+		return 0, fmt.Errorf("robot started no run: %s", response.Message)
+	}
+	return *response.ID, nil
+}
+
+// Status returns the status of a run.
+func (c *Client) Status(ctx context.Context, runID int64) (Status, error) {
+	var status Status
+	err := c.do(ctx, "GET", fmt.Sprintf("/status/%d", runID), nil, &status)
+	return status, err
+}
+
+// Wait polls a run's status until it is no longer RUNNING, and returns it.
+func (c *Client) Wait(ctx context.Context, runID int64) (Status, error) {
+	for {
+		status, err := c.Status(ctx, runID)
+		if err != nil || status.Status != StatusRunning {
+			return status, err
+		}
+		select {
+		case <-ctx.Done():
+			return status, ctx.Err()
+		case <-time.After(c.PollInterval):
+		}
+	}
+}
+
+// do sends a request with an optional JSON body and decodes the JSON
+// response into v.
+func (c *Client) do(ctx context.Context, method, path string, body []byte, v interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, reader)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %v", err)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to reach robot: %v", err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("failed to read robot response: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("robot returned %s for %s %s: %s", resp.Status, method, path, strings.TrimSpace(string(data)))
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("failed to parse robot response: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package ot2
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+// exampleGroup returns the opentrons group of libB's example protocol.
+func exampleGroup(t *testing.T) libb.CommandGroup {
+	t.Helper()
+	output, err := libb.ExecuteLua(context.Background(), "print(libB.generate_protocol())")
+	if err != nil {
+		t.Fatalf("Failed to execute Lua code: %v", err)
+	}
+	script, err := libb.ParseScript([]byte(output))
+	if err != nil {
+		t.Fatalf("Failed to parse script: %v", err)
+	}
+	return script.Commands[0]
+}
+
+func testClient(robot *FakeRobot) *Client {
+	client := NewClient(robot.URL)
+	client.PollInterval = time.Millisecond
+	return client
+}
+
+func TestClientRun(t *testing.T) {
+	robot := NewFakeRobot()
+	defer robot.Close()
+	robot.PollsToComplete = 2
+	client := testClient(robot)
+	ctx := context.Background()
+	group := exampleGroup(t)
+
+	id, err := client.Submit(ctx, group)
+	if err != nil || id != 1 {
+		t.Fatalf("Expected run 1, got %d: %v", id, err)
+	}
+	if status, err := client.Status(ctx, id); err != nil || status.Status != StatusRunning || status.ExecutionTime != nil {
+		t.Errorf("Expected a RUNNING run, got %+v: %v", status, err)
+	}
+	// The robot only runs one group at a time.
+	if _, err := client.Submit(ctx, group); !errors.Is(err, ErrLocked) {
+		t.Errorf("Expected ErrLocked, got %v", err)
+	}
+	status, err := client.Wait(ctx, id)
+	if err != nil || status.Status != StatusCompleted || status.StatusMessage != "Completed protocol successfully." || status.ExecutionTime == nil {
+		t.Errorf("Expected a COMPLETED run, got %+v: %v", status, err)
+	}
+	if groups := robot.Groups(); len(groups) != 1 || !reflect.DeepEqual(groups[0], group) {
+		t.Errorf("Expected the robot to receive the group, got %+v", groups)
+	}
+
+	// Once it's done, the robot takes the next run.
+	if id, err := client.Submit(ctx, group); err != nil || id != 2 {
+		t.Errorf("Expected run 2, got %d: %v", id, err)
+	}
+	if _, err := client.Status(ctx, 3); err == nil || !strings.Contains(err.Error(), "500") {
+		t.Errorf("Expected an error for an unknown run, got %v", err)
+	}
+}
+
+func TestClientFailures(t *testing.T) {
+	robot := NewFakeRobot()
+	defer robot.Close()
+	client := testClient(robot)
+	ctx := context.Background()
+
+	// Groups failing simulation start a run which has already failed.
+	var unsafe libb.CommandGroup
+	if err := json.Unmarshal([]byte(`{"command_type":"opentrons","payload":[
+		{"type":"aspirate","payload":{"pipette":{"pipette":"p20_single_gen2","side":"left"},"vol":5,
+			"move_to":{"pipette":{"pipette":"p20_single_gen2","side":"left"},"labware":"nest_12_reservoir_15ml","deck_slot":"2","address":"A1"}}}]}`), &unsafe); err != nil {
+		t.Fatalf("Failed to decode group: %v", err)
+	}
+	id, err := client.Submit(ctx, unsafe)
+	if err != nil {
+		t.Fatalf("Failed to submit: %v", err)
+	}
+	if status, err := client.Wait(ctx, id); err != nil || status.Status != StatusFailed || status.StatusMessage != "Failed on simulation." {
+		t.Errorf("Expected a run failed on simulation, got %+v: %v", status, err)
+	}
+
+	// Errors on the robot fail the run with their message.
+	robot.Fail = func(libb.CommandGroup) error { return errors.New("tip not found") }
+	id, err = client.Submit(ctx, exampleGroup(t))
+	if err != nil {
+		t.Fatalf("Failed to submit: %v", err)
+	}
+	if status, err := client.Wait(ctx, id); err != nil || status.Status != StatusFailed || status.StatusMessage != "tip not found" {
+		t.Errorf("Expected a failed run, got %+v: %v", status, err)
+	}
+
+	// Requests not matching app.py's models are rejected, as FastAPI does.
+	var noMoveTo libb.CommandGroup
+	if err := json.Unmarshal([]byte(`{"command_type":"opentrons","payload":[
+		{"type":"aspirate","payload":{"pipette":{"pipette":"p20_single_gen2","side":"left"},"vol":5}}]}`), &noMoveTo); err != nil {
+		t.Fatalf("Failed to decode group: %v", err)
+	}
+	if _, err := client.Submit(ctx, noMoveTo); err == nil || !strings.Contains(err.Error(), "422") || !strings.Contains(err.Error(), "move_to") {
+		t.Errorf("Expected a validation error, got %v", err)
+	}
+	var human libb.CommandGroup
+	if err := json.Unmarshal([]byte(`{"command_type":"human","payload":[
+		{"type":"quantify","payload":{"labware":"plate","deck_slot":"1","address":"A1","return_key":"k"}}]}`), &human); err != nil {
+		t.Fatalf("Failed to decode group: %v", err)
+	}
+	if _, err := client.Submit(ctx, human); err == nil || !strings.Contains(err.Error(), "not a valid enumeration member") {
+		t.Errorf("Expected a validation error, got %v", err)
+	}
+
+	// A robot which can't be reached is an error too.
+	robot.Close()
+	if _, err := client.Status(ctx, 1); err == nil || !strings.Contains(err.Error(), "failed to reach robot") {
+		t.Errorf("Expected a connection error, got %v", err)
+	}
+}
@@ -0,0 +1,218 @@
+package ot2
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+// FakeRobot is an httptest server implementing the /api/plr and
+// /status/{run_id} endpoints of app.py, with the same request models. It
+// simulates each group with libb.ValidateDeck, as app.py simulates runs
+// before starting them, and "runs" groups instantly.
+type FakeRobot struct {
+	*httptest.Server
+
+	// PollsToComplete is how many status requests a run answers RUNNING to
+	// before it finishes. Until then it holds the robot.
+	PollsToComplete int
+	// Fail, if set, is called with each group when its run finishes. An error
+	// fails the run with the error as its status message, as an exception
+	// raised on the robot does.
+	Fail func(group libb.CommandGroup) error
+
+	mu   sync.Mutex
+	runs []*fakeRun
+}
+
+type fakeRun struct {
+	group   libb.CommandGroup
+	started time.Time
+	status  RunStatus
+	message string
+	polls   int
+}
+
+// NewFakeRobot starts a fake robot. Close it when done.
+func NewFakeRobot() *FakeRobot {
+	robot := &FakeRobot{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /api/plr", robot.handlePLR)
+	mux.HandleFunc("GET /status/{run_id}", robot.handleStatus)
+	robot.Server = httptest.NewServer(mux)
+	return robot
+}
+
+// Groups returns the command groups of every run started, in order.
+func (f *FakeRobot) Groups() []libb.CommandGroup {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	groups := make([]libb.CommandGroup, len(f.runs))
+	for i, run := range f.runs {
+		groups[i] = run.group
+	}
+	return groups
+}
+
+// plrCommandTypes are the command types of app.py's CommandType enum. The
+// ones mapped to true need no payload.
+var plrCommandTypes = map[string]bool{
+	"move_to":             false,
+	"aspirate":            false,
+	"dispense":            false,
+	"pick_up_tip":         false,
+	"drop_tip":            false,
+	"home":                true,
+	"tc_open_lid":         true,
+	"tc_close_lid":        true,
+	"tc_set_lid_temp":     false,
+	"tc_deactivate_lid":   true,
+	"tc_set_block_temp":   false,
+	"tc_deactivate_block": true,
+	"tc_execute_profile":  false,
+}
+
+// validationError writes a FastAPI style request validation error.
+func validationError(w http.ResponseWriter, loc []interface{}, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"detail": []map[string]interface{}{{"loc": loc, "msg": msg, "type": "value_error"}},
+	})
+}
+
+// parsePLRRequest checks a request against app.py's PLRRequest model, and
+// decodes it. It writes a validation error and returns false if it doesn't
+// match.
+func parsePLRRequest(w http.ResponseWriter, r *http.Request) (libb.CommandGroup, bool) {
+	var request struct {
+		CommandType *string `json:"command_type"`
+		Payload     []struct {
+			Type    string          `json:"type"`
+			Payload json.RawMessage `json:"payload,omitempty"`
+		} `json:"payload"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		validationError(w, []interface{}{"body"}, err.Error())
+		return libb.CommandGroup{}, false
+	}
+	if request.CommandType == nil {
+		validationError(w, []interface{}{"body", "command_type"}, "field required")
+		return libb.CommandGroup{}, false
+	}
+	if request.Payload == nil {
+		validationError(w, []interface{}{"body", "payload"}, "field required")
+		return libb.CommandGroup{}, false
+	}
+	for i, command := range request.Payload {
+		noPayload, ok := plrCommandTypes[command.Type]
+		if !ok {
+			validationError(w, []interface{}{"body", "payload", i, "type"}, "value is not a valid enumeration member")
+			return libb.CommandGroup{}, false
+		}
+		if string(command.Payload) == "null" {
+			request.Payload[i].Payload = nil
+		}
+		if !noPayload && request.Payload[i].Payload == nil {
+			validationError(w, []interface{}{"body", "payload", i, "payload"}, "Payload required for command type: "+command.Type)
+			return libb.CommandGroup{}, false
+		}
+		if command.Type == "aspirate" || command.Type == "dispense" {
+			// app.py's Aspirate and Dispense models require move_to.
+			var payload struct {
+				MoveTo json.RawMessage `json:"move_to"`
+			}
+			if json.Unmarshal(command.Payload, &payload) != nil || payload.MoveTo == nil || string(payload.MoveTo) == "null" {
+				validationError(w, []interface{}{"body", "payload", i, "payload", "move_to"}, "field required")
+				return libb.CommandGroup{}, false
+			}
+		}
+	}
+
+	// The command types are all opentrons ones, whatever command_type says.
+	raw, _ := json.Marshal(map[string]interface{}{"command_type": "opentrons", "payload": request.Payload})
+	var group libb.CommandGroup
+	if err := json.Unmarshal(raw, &group); err != nil {
+		validationError(w, []interface{}{"body", "payload"}, err.Error())
+		return libb.CommandGroup{}, false
+	}
+	group.CommandType = *request.CommandType
+	return group, true
+}
+
+func (f *FakeRobot) handlePLR(w http.ResponseWriter, r *http.Request) {
+	group, ok := parsePLRRequest(w, r)
+	if !ok {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, run := range f.runs {
+		if run.status == StatusRunning {
+			writeJSON(w, SubmitResponse{Message: lockedMessage})
+			return
+		}
+	}
+	run := &fakeRun{group: group, started: time.Now(), status: StatusRunning, message: "Executed"}
+	f.runs = append(f.runs, run)
+	id := int64(len(f.runs))
+
+	script := &libb.Script{ID: "plr", Commands: []libb.CommandGroup{group}}
+	if err := libb.DeckErrors(libb.ValidateDeck(script)); err != nil {
+		run.status, run.message = StatusFailed, "Failed on simulation."
+		writeJSON(w, SubmitResponse{Message: fmt.Sprintf("Failed on simulation. Got error message: %v", err), ID: &id, Version: "fake"})
+		return
+	}
+	writeJSON(w, SubmitResponse{Message: "Execution initiated", ID: &id, Version: "fake"})
+}
+
+func (f *FakeRobot) handleStatus(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("run_id"))
+	if err != nil {
+		validationError(w, []interface{}{"path", "run_id"}, "value is not a valid integer")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if id < 1 || id > len(f.runs) {
+		// app.py has no row to report, and fails.
+		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+		return
+	}
+	run := f.runs[id-1]
+	if run.status == StatusRunning {
+		run.polls++
+		if run.polls > f.PollsToComplete {
+			run.status, run.message = StatusCompleted, "Completed protocol successfully."
+			if f.Fail != nil {
+				if err := f.Fail(run.group); err != nil {
+					run.status, run.message = StatusFailed, err.Error()
+				}
+			}
+		}
+	}
+
+	status := Status{
+		Status:        run.status,
+		StatusMessage: run.message,
+		Started:       run.started.Format("15:04:05. Monday 02. January 2006"),
+	}
+	if run.status != StatusRunning {
+		executionTime := int64(time.Since(run.started).Seconds())
+		status.ExecutionTime = &executionTime
+	}
+	writeJSON(w, status)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
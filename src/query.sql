@@ -20,19 +20,22 @@ ORDER BY pmh.created_at DESC
 LIMIT 1;
 
 -- name: CreateCode :one
-INSERT INTO code(project_message_history_id, code) VALUES (?, ?) RETURNING id;
+INSERT INTO code(project_message_history_id, code, language) VALUES (?, ?, ?) RETURNING id;
 
 -- name: GetCode :one
 SELECT * FROM code WHERE id = ?;
 
 -- name: CreateCodeStep :one
-INSERT INTO code_step(code, status, step_comment, next_function, script, data_passthrough) VALUES (?, ?, ?, ?, ?, ?) RETURNING id;
+INSERT INTO code_step(code, status, step_comment, next_function, script, data_passthrough, seed) VALUES (?, ?, ?, ?, ?, ?, ?) RETURNING id;
 
 -- name: GetCodeStep :one
 SELECT * FROM code_step WHERE id = ?;
 
+-- name: GetStepsForCode :many
+SELECT * FROM code_step WHERE code = ? ORDER BY id;
+
 -- name: GetAllStepsForCodeFromProjectHistoryID :many
-SELECT cs.id, cs.code, cs.status, cs.step_comment, cs.next_function, cs.script, cs.data_passthrough, cs.data
+SELECT cs.id, cs.code, cs.status, cs.step_comment, cs.next_function, cs.script, cs.data_passthrough, cs.data, cs.seed
 FROM code_step AS cs
 JOIN code AS c ON c.id = cs.code
 WHERE c.project_message_history_id = ?;
@@ -43,6 +46,19 @@ SELECT data FROM code_step WHERE id = ?;
 -- name: UpdateStepData :exec
 UPDATE code_step SET data = ? WHERE id = ?;
 
+-- name: UpdatePendingStepData :execrows
+UPDATE code_step SET data = ? WHERE id = ? AND status = 2 AND data IS NULL;
+
+-- name: GetReadySteps :many
+SELECT cs.* FROM code_step cs
+WHERE cs.status = 2 AND cs.data IS NOT NULL
+AND NOT EXISTS (SELECT 1 FROM code_step later WHERE later.code = cs.code AND later.id > cs.id)
+AND (SELECT COUNT(*) FROM code_step_run run WHERE run.code_step = cs.id AND run.status = 'COMPLETED') >= COALESCE(json_array_length(cs.script, '$.commands'), 0)
+ORDER BY cs.id;
+
+-- name: CountStepsAfter :one
+SELECT COUNT(*) FROM code_step WHERE code = ? AND id > ?;
+
 -- name: UpdateStepStatus :exec
 UPDATE code_step SET status = ? WHERE id = ?;
 
@@ -52,3 +68,135 @@ JOIN code c ON cs.code = c.id
 JOIN project_message_history pmh ON c.project_message_history_id = pmh.id
 WHERE pmh.project_id = ? 
 ORDER BY cs.id DESC;
+
+-- name: CreateCodeStepLog :exec
+INSERT INTO code_step_log(code_step, function_name, stdout, logs, wall_time_ms, error, traceback, truncated) VALUES (?, ?, ?, ?, ?, ?, ?, ?);
+
+-- name: GetCodeStepLog :one
+SELECT * FROM code_step_log WHERE code_step = ?;
+
+-- name: GetLatestStepLogsForProject :many
+SELECT csl.* FROM code_step_log csl
+JOIN code_step cs ON csl.code_step = cs.id
+JOIN code c ON cs.code = c.id
+JOIN project_message_history pmh ON c.project_message_history_id = pmh.id
+WHERE pmh.project_id = ?
+ORDER BY csl.code_step DESC;
+
+-- name: GetStepsToDispatch :many
+SELECT cs.* FROM code_step cs
+WHERE (NOT EXISTS (SELECT 1 FROM code_step later WHERE later.code = cs.code AND later.id > cs.id) AND (
+	cs.status IN (2, 3)
+	OR (cs.script NOT IN ('', 'null')
+		AND NOT EXISTS (SELECT 1 FROM code_step_run run WHERE run.code_step = cs.id AND run.status = 'FAILED')
+		AND (SELECT COUNT(*) FROM code_step_run run WHERE run.code_step = cs.id AND run.status = 'COMPLETED') < COALESCE(json_array_length(cs.script, '$.commands'), 0))))
+OR EXISTS (SELECT 1 FROM code_step_run run WHERE run.code_step = cs.id AND run.status = 'RUNNING')
+ORDER BY cs.id;
+
+-- name: CreateCodeStepRun :one
+INSERT INTO code_step_run(code_step, command_group, run_id, status, status_message) VALUES (?, ?, ?, ?, ?) RETURNING id;
+
+-- name: UpdateCodeStepRun :exec
+UPDATE code_step_run SET status = ?, status_message = ?, updated_at = unixepoch() WHERE id = ?;
+
+-- name: GetCodeStepRuns :many
+SELECT * FROM code_step_run WHERE code_step = ? ORDER BY command_group;
+
+-- name: GetCodeStepRun :one
+SELECT * FROM code_step_run WHERE id = ?;
+
+-- name: DeleteCodeStepRun :exec
+DELETE FROM code_step_run WHERE id = ?;
+
+-- name: CreateWorkItem :exec
+INSERT INTO work_item(code_step, command_group, command_index, command_type, command, return_key) VALUES (?, ?, ?, ?, ?, ?)
+ON CONFLICT (code_step, command_group, command_index) DO NOTHING;
+
+-- name: GetWorkItem :one
+SELECT wi.*, pmh.project_id
+FROM work_item wi
+JOIN code_step cs ON cs.id = wi.code_step
+JOIN code c ON c.id = cs.code
+JOIN project_message_history pmh ON pmh.id = c.project_message_history_id
+WHERE wi.id = ?;
+
+-- name: GetOpenWorkItems :many
+SELECT wi.*, pmh.project_id
+FROM work_item wi
+JOIN code_step cs ON cs.id = wi.code_step
+JOIN code c ON c.id = cs.code
+JOIN project_message_history pmh ON pmh.id = c.project_message_history_id
+WHERE wi.completed_at IS NULL
+AND NOT EXISTS (SELECT 1 FROM code_step later WHERE later.code = cs.code AND later.id > cs.id)
+ORDER BY wi.due_at IS NULL, wi.due_at, wi.id;
+
+-- name: GetWorkItemsForGroup :many
+SELECT * FROM work_item WHERE code_step = ? AND command_group = ? ORDER BY command_index;
+
+-- name: ClaimWorkItem :exec
+UPDATE work_item SET claimed_by = ?, claimed_at = unixepoch() WHERE id = ?;
+
+-- name: UnclaimWorkItem :exec
+UPDATE work_item SET claimed_by = NULL, claimed_at = NULL WHERE id = ?;
+
+-- name: SetWorkItemAssignee :exec
+UPDATE work_item SET assignee = ? WHERE id = ?;
+
+-- name: SetWorkItemDue :exec
+UPDATE work_item SET due_at = ? WHERE id = ?;
+
+-- name: CompleteWorkItem :exec
+UPDATE work_item SET result = ?, completed_at = unixepoch() WHERE id = ? AND completed_at IS NULL;
+
+-- name: CompleteWorkItemsForKey :exec
+UPDATE work_item SET result = ?, completed_at = unixepoch() WHERE code_step = ? AND return_key = ? AND completed_at IS NULL;
+
+-- name: CreateProjectWebhook :one
+INSERT INTO project_webhook(project_id, url, secret) VALUES (?, ?, ?) RETURNING *;
+
+-- name: GetProjectWebhooks :many
+SELECT * FROM project_webhook WHERE project_id = ? AND active ORDER BY id;
+
+-- name: GetProjectWebhook :one
+SELECT * FROM project_webhook WHERE id = ? AND project_id = ?;
+
+-- name: RemoveProjectWebhook :execrows
+UPDATE project_webhook SET active = FALSE WHERE id = ? AND project_id = ? AND active;
+
+-- name: GetWebhooksForCode :many
+SELECT pw.*
+FROM project_webhook pw
+JOIN project_message_history pmh ON pmh.project_id = pw.project_id
+JOIN code c ON c.project_message_history_id = pmh.id
+WHERE c.id = ? AND pw.active
+ORDER BY pw.id;
+
+-- name: CreateWebhookDelivery :exec
+INSERT INTO webhook_delivery(webhook, event, payload) VALUES (?, ?, ?);
+
+-- name: GetDueWebhookDeliveries :many
+SELECT wd.*, pw.url, pw.secret
+FROM webhook_delivery wd
+JOIN project_webhook pw ON pw.id = wd.webhook
+WHERE wd.status = 'PENDING' AND wd.next_attempt_at <= ? AND pw.active
+ORDER BY wd.id;
+
+-- name: GetNextWebhookAttempt :one
+SELECT wd.next_attempt_at
+FROM webhook_delivery wd
+JOIN project_webhook pw ON pw.id = wd.webhook
+WHERE wd.status = 'PENDING' AND pw.active
+ORDER BY wd.next_attempt_at
+LIMIT 1;
+
+-- name: UpdateWebhookDelivery :exec
+UPDATE webhook_delivery SET status = ?, attempts = ?, next_attempt_at = ?, delivered_at = ? WHERE id = ?;
+
+-- name: CreateWebhookDeliveryAttempt :exec
+INSERT INTO webhook_delivery_attempt(delivery, response_code, error, duration_ms) VALUES (?, ?, ?, ?);
+
+-- name: GetWebhookDeliveries :many
+SELECT * FROM webhook_delivery WHERE webhook = ? ORDER BY id DESC;
+
+-- name: GetWebhookDeliveryAttempts :many
+SELECT * FROM webhook_delivery_attempt WHERE delivery = ? ORDER BY id;
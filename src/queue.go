@@ -0,0 +1,439 @@
+package autodemo
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"text/template"
+	"time"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+/******************************************************************************
+
+Work queue
+
+Human commands are done by technicians working across every project at once,
+so each one becomes a work item when the dispatcher hands its group to the
+HumanExecutor. The queue lists every item which isn't done yet, most urgent
+first. Technicians claim items while they work on them, items can be assigned
+to someone ahead of time and given a due time, and completing an item uploads
+its result to its step exactly like /upload/{stepID}/{returnKey} does. Any
+upload of a result completes the items waiting on it, however it arrives.
+
+******************************************************************************/
+
+// ErrWorkItemCompleted is returned when changing a work item which is done.
+var ErrWorkItemCompleted = errors.New("work item has already been completed")
+
+// ErrWorkItemClaimed is returned when claiming a work item which someone else
+// has claimed.
+var ErrWorkItemClaimed = errors.New("work item is claimed by someone else")
+
+// WorkItem is a human command in the work queue.
+type WorkItem struct {
+	ID           int64           `json:"id"`
+	ProjectID    string          `json:"project_id"`
+	StepID       int64           `json:"step_id"`
+	CommandGroup int64           `json:"command_group"`
+	CommandIndex int64           `json:"command_index"`
+	CommandType  string          `json:"command_type"`
+	Command      json.RawMessage `json:"command"`
+	ReturnKey    string          `json:"return_key,omitempty"`
+	Assignee     string          `json:"assignee,omitempty"`
+	ClaimedBy    string          `json:"claimed_by,omitempty"`
+	ClaimedAt    *int64          `json:"claimed_at,omitempty"`
+	DueAt        *int64          `json:"due_at,omitempty"` // unix time
+	CompletedAt  *int64          `json:"completed_at,omitempty"`
+	CreatedAt    int64           `json:"created_at"`
+}
+
+func nullInt64(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// newWorkItem converts a work_item row, joined with its project.
+func newWorkItem(row autodemosql.GetWorkItemRow) WorkItem {
+	return WorkItem{
+		ID:           row.ID,
+		ProjectID:    row.ProjectID,
+		StepID:       row.CodeStep,
+		CommandGroup: row.CommandGroup,
+		CommandIndex: row.CommandIndex,
+		CommandType:  row.CommandType,
+		Command:      json.RawMessage(row.Command),
+		ReturnKey:    row.ReturnKey,
+		Assignee:     row.Assignee.String,
+		ClaimedBy:    row.ClaimedBy.String,
+		ClaimedAt:    nullInt64(row.ClaimedAt),
+		DueAt:        nullInt64(row.DueAt),
+		CompletedAt:  nullInt64(row.CompletedAt),
+		CreatedAt:    row.CreatedAt,
+	}
+}
+
+// createWorkItems adds a work item for every command of a job's group. Items
+// already added, before a restart, are left as they are. Results can be
+// uploaded before the group is started, so items whose results are already in
+// the step's data are completed straight away.
+func createWorkItems(queries *autodemosql.Queries, ctx context.Context, job Job) error {
+	for i, command := range job.Group.Payload {
+		commandJSON, err := json.Marshal(command)
+		if err != nil {
+			return fmt.Errorf("failed to marshal command %d: %v", i, err)
+		}
+		var returnKey string
+		if result, ok := command.(libb.ResultCommand); ok {
+			returnKey = result.ResultKey()
+		}
+		err = queries.CreateWorkItem(ctx, autodemosql.CreateWorkItemParams{
+			CodeStep:     job.Step.ID,
+			CommandGroup: int64(job.Index),
+			CommandIndex: int64(i),
+			CommandType:  command.Kind(),
+			Command:      string(commandJSON),
+			ReturnKey:    returnKey,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create work item: %v", err)
+		}
+	}
+	step, err := queries.GetCodeStep(ctx, job.Step.ID)
+	if err != nil {
+		return fmt.Errorf("failed to get step: %v", err)
+	}
+	uploaded, err := parseStepData(step.Data.String)
+	if err != nil {
+		return err
+	}
+	return completeWorkItems(queries, ctx, job.Step.ID, uploaded)
+}
+
+// completeWorkItems completes the work items of a step waiting on the results
+// in data, keyed by script ID then return key.
+func completeWorkItems(queries *autodemosql.Queries, ctx context.Context, stepID int64, data map[string]map[string]string) error {
+	for _, results := range data {
+		for returnKey, result := range results {
+			err := queries.CompleteWorkItemsForKey(ctx, autodemosql.CompleteWorkItemsForKeyParams{
+				Result:    sql.NullString{String: result, Valid: true},
+				CodeStep:  stepID,
+				ReturnKey: returnKey,
+			})
+			if err != nil {
+				return fmt.Errorf("failed to complete work items: %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// updateWorkItem applies update to a work item which isn't done yet.
+func (w *WriteDB) updateWorkItem(ctx context.Context, id int64, update func(queries *autodemosql.Queries, ctx context.Context, item autodemosql.GetWorkItemRow) error) error {
+	return w.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		item, err := queries.GetWorkItem(ctx, id)
+		if err != nil {
+			return err
+		}
+		if item.CompletedAt.Valid {
+			return ErrWorkItemCompleted
+		}
+		return update(queries, ctx, item)
+	})
+}
+
+// ClaimWorkItem claims a work item for technician. Claiming an item twice is
+// fine, but claiming someone else's item is not.
+func (w *WriteDB) ClaimWorkItem(ctx context.Context, id int64, technician string) error {
+	return w.updateWorkItem(ctx, id, func(queries *autodemosql.Queries, ctx context.Context, item autodemosql.GetWorkItemRow) error {
+		if item.ClaimedBy.Valid && item.ClaimedBy.String != technician {
+			return fmt.Errorf("%w: %s", ErrWorkItemClaimed, item.ClaimedBy.String)
+		}
+		return queries.ClaimWorkItem(ctx, autodemosql.ClaimWorkItemParams{
+			ClaimedBy: sql.NullString{String: technician, Valid: true},
+			ID:        id,
+		})
+	})
+}
+
+// UnclaimWorkItem puts a claimed work item back in the queue.
+func (w *WriteDB) UnclaimWorkItem(ctx context.Context, id int64) error {
+	return w.updateWorkItem(ctx, id, func(queries *autodemosql.Queries, ctx context.Context, item autodemosql.GetWorkItemRow) error {
+		return queries.UnclaimWorkItem(ctx, id)
+	})
+}
+
+// SetWorkItemAssignee assigns a work item to someone, or to no one if
+// assignee is empty.
+func (w *WriteDB) SetWorkItemAssignee(ctx context.Context, id int64, assignee string) error {
+	return w.updateWorkItem(ctx, id, func(queries *autodemosql.Queries, ctx context.Context, item autodemosql.GetWorkItemRow) error {
+		return queries.SetWorkItemAssignee(ctx, autodemosql.SetWorkItemAssigneeParams{
+			Assignee: sql.NullString{String: assignee, Valid: assignee != ""},
+			ID:       id,
+		})
+	})
+}
+
+// SetWorkItemDue sets when a work item should be done by, or clears it if
+// dueAt is nil.
+func (w *WriteDB) SetWorkItemDue(ctx context.Context, id int64, dueAt *int64) error {
+	return w.updateWorkItem(ctx, id, func(queries *autodemosql.Queries, ctx context.Context, item autodemosql.GetWorkItemRow) error {
+		due := sql.NullInt64{Valid: dueAt != nil}
+		if dueAt != nil {
+			due.Int64 = *dueAt
+		}
+		return queries.SetWorkItemDue(ctx, autodemosql.SetWorkItemDueParams{DueAt: due, ID: id})
+	})
+}
+
+// CompleteWorkItem completes a work item whose command has no result. Items
+// with results are completed by uploading the result, with MergeData.
+func (w *WriteDB) CompleteWorkItem(ctx context.Context, id int64, result string) error {
+	return w.updateWorkItem(ctx, id, func(queries *autodemosql.Queries, ctx context.Context, item autodemosql.GetWorkItemRow) error {
+		return queries.CompleteWorkItem(ctx, autodemosql.CompleteWorkItemParams{
+			Result: sql.NullString{String: result, Valid: true},
+			ID:     id,
+		})
+	})
+}
+
+/******************************************************************************
+
+Work queue endpoints
+
+******************************************************************************/
+
+// QueueHandler lists every work item which isn't done yet, as JSON, most
+// urgent first. With ?assignee=, only items assigned to someone are listed.
+func (app *App) QueueHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := app.openWorkItems(r.Context(), r.URL.Query().Get("assignee"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(items)
+}
+
+// openWorkItems returns the work items which aren't done yet, only those
+// assigned to assignee unless it is empty.
+func (app *App) openWorkItems(ctx context.Context, assignee string) ([]WorkItem, error) {
+	rows, err := autodemosql.New(app.DB).GetOpenWorkItems(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get work items: %v", err)
+	}
+	items := []WorkItem{}
+	for _, row := range rows {
+		item := newWorkItem(autodemosql.GetWorkItemRow(row))
+		if assignee == "" || item.Assignee == assignee {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// workItemRequest reads the ID of the work item a POST request is for, and
+// decodes its JSON body into v unless v is nil. It writes an error and returns
+// false if either is invalid.
+func workItemRequest(w http.ResponseWriter, r *http.Request, v interface{}) (int64, bool) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return 0, false
+	}
+	id, err := strconv.ParseInt(r.PathValue("itemID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid work item ID", http.StatusBadRequest)
+		return 0, false
+	}
+	if v != nil {
+		if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return 0, false
+		}
+	}
+	return id, true
+}
+
+// writeWorkItem responds to a request changing a work item with the item, or
+// with the error changing it.
+func (app *App) writeWorkItem(w http.ResponseWriter, r *http.Request, id int64, err error) {
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		http.Error(w, "Work item not found", http.StatusNotFound)
+		return
+	case errors.Is(err, ErrWorkItemCompleted), errors.Is(err, ErrWorkItemClaimed),
+		errors.Is(err, ErrStepNotPending), errors.Is(err, ErrResultUploaded):
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	row, err := autodemosql.New(app.DB).GetWorkItem(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newWorkItem(row))
+}
+
+// ClaimWorkItemHandler claims a work item for the technician in the request,
+// {"technician": "..."}.
+func (app *App) ClaimWorkItemHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Technician string `json:"technician"`
+	}
+	id, ok := workItemRequest(w, r, &request)
+	if !ok {
+		return
+	}
+	if request.Technician == "" {
+		http.Error(w, "Technician required", http.StatusBadRequest)
+		return
+	}
+	app.writeWorkItem(w, r, id, app.WDB.ClaimWorkItem(r.Context(), id, request.Technician))
+}
+
+// UnclaimWorkItemHandler puts a claimed work item back in the queue.
+func (app *App) UnclaimWorkItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := workItemRequest(w, r, nil)
+	if !ok {
+		return
+	}
+	app.writeWorkItem(w, r, id, app.WDB.UnclaimWorkItem(r.Context(), id))
+}
+
+// AssignWorkItemHandler assigns a work item to the assignee in the request,
+// {"assignee": "..."}, or to no one if it is empty.
+func (app *App) AssignWorkItemHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Assignee string `json:"assignee"`
+	}
+	id, ok := workItemRequest(w, r, &request)
+	if !ok {
+		return
+	}
+	app.writeWorkItem(w, r, id, app.WDB.SetWorkItemAssignee(r.Context(), id, request.Assignee))
+}
+
+// DueWorkItemHandler sets when a work item is due from the request,
+// {"due_at": <unix time>}, or clears it if due_at is null.
+func (app *App) DueWorkItemHandler(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		DueAt *int64 `json:"due_at"`
+	}
+	id, ok := workItemRequest(w, r, &request)
+	if !ok {
+		return
+	}
+	app.writeWorkItem(w, r, id, app.WDB.SetWorkItemDue(r.Context(), id, request.DueAt))
+}
+
+// CompleteWorkItemHandler completes a work item with the result in the
+// request body. Results are checked against the command's result schema, and
+// uploaded to the item's step.
+func (app *App) CompleteWorkItemHandler(w http.ResponseWriter, r *http.Request) {
+	id, ok := workItemRequest(w, r, nil)
+	if !ok {
+		return
+	}
+	buf := new(bytes.Buffer)
+	_, _ = buf.ReadFrom(r.Body)
+	if !json.Valid(buf.Bytes()) {
+		http.Error(w, "Invalid data: result must be JSON", http.StatusBadRequest)
+		return
+	}
+	item, err := autodemosql.New(app.DB).GetWorkItem(r.Context(), id)
+	if err != nil {
+		app.writeWorkItem(w, r, id, err)
+		return
+	}
+	if item.CompletedAt.Valid {
+		app.writeWorkItem(w, r, id, ErrWorkItemCompleted)
+		return
+	}
+	if item.ReturnKey == "" {
+		app.writeWorkItem(w, r, id, app.WDB.CompleteWorkItem(r.Context(), id, buf.String()))
+		return
+	}
+
+	script, err := app.stepScript(r.Context(), item.CodeStep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if script != nil {
+		if errs := script.ValidateResult(item.ReturnKey, buf.String()); len(errs) > 0 {
+			writeFieldErrors(w, errs)
+			return
+		}
+	}
+	err = app.WDB.MergeData(r.Context(), item.CodeStep, item.ReturnKey, buf.String())
+	if err == nil {
+		app.dataUploaded()
+	}
+	app.writeWorkItem(w, r, id, err)
+}
+
+// WorkItemDisplay is a work item along with what the queue page shows of it.
+type WorkItemDisplay struct {
+	WorkItem
+	CommandJSON string
+	Due         string // DueAt formatted, in UTC
+	Fields      []libb.ResultField
+}
+
+//go:embed queue.html
+var queueHtml string
+var queueTemplate = template.Must(template.New("queue").Parse(queueHtml))
+
+// QueuePageHandler shows the work queue, for technicians to work through.
+func (app *App) QueuePageHandler(w http.ResponseWriter, r *http.Request) {
+	items, err := app.openWorkItems(r.Context(), r.URL.Query().Get("assignee"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	scripts := make(map[int64]*libb.Script)
+	displays := make([]WorkItemDisplay, len(items))
+	for i, item := range items {
+		script, ok := scripts[item.StepID]
+		if !ok {
+			script, err = app.stepScript(r.Context(), item.StepID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			scripts[item.StepID] = script
+		}
+		commandJSON, err := json.MarshalIndent(item.Command, "", "    ")
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error encoding command: %v", err), http.StatusInternalServerError)
+			return
+		}
+		displays[i] = WorkItemDisplay{WorkItem: item, CommandJSON: string(commandJSON)}
+		if item.DueAt != nil {
+			displays[i].Due = time.Unix(*item.DueAt, 0).UTC().Format("2006-01-02 15:04 UTC")
+		}
+		if script != nil && item.ReturnKey != "" {
+			displays[i].Fields = script.ResultFields(item.ReturnKey)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	if err := queueTemplate.Execute(w, displays); err != nil {
+		http.Error(w, fmt.Sprintf("Error executing template: %v", err), http.StatusInternalServerError)
+		return
+	}
+}
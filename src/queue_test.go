@@ -0,0 +1,157 @@
+package autodemo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+)
+
+func TestWorkQueue(t *testing.T) {
+	dbPath := "test_queue.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+
+	runner := NewProtocolRunner(wdb)
+	app := &App{DB: db, WDB: wdb, Runner: runner, Engine: NewEngine(runner, db), Dispatcher: NewDispatcher(runner, db)}
+	app.Dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = app.Dispatcher.Notify
+	app.Dispatcher.Start(ctx)
+	defer app.Dispatcher.Stop()
+	app.Engine.Start(ctx)
+	defer app.Engine.Stop()
+	if err := runner.StartProtocol(ctx, historyID, plateProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	queries := autodemosql.New(db)
+	step := waitForSteps(t, queries, historyID, 1)[0]
+
+	list := func(query string) []WorkItem {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/queue/items"+query, nil)
+		rec := httptest.NewRecorder()
+		app.QueueHandler(rec, req)
+		var items []WorkItem
+		if err := json.Unmarshal(rec.Body.Bytes(), &items); err != nil {
+			t.Fatalf("Failed to parse work items: %v", err)
+		}
+		return items
+	}
+	var lastBody string
+	post := func(handler http.HandlerFunc, id int64, body string) int {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/queue/items/%d", id), strings.NewReader(body))
+		req.SetPathValue("itemID", fmt.Sprint(id))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		lastBody = rec.Body.String()
+		return rec.Code
+	}
+
+	// The dispatcher adds a work item for each human command.
+	var items []WorkItem
+	deadline := time.Now().Add(10 * time.Second)
+	for len(items) < 3 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for work items, got %+v", items)
+		}
+		time.Sleep(10 * time.Millisecond)
+		items = list("")
+	}
+	for i, item := range items {
+		if item.ProjectID != "test-project-1" || item.StepID != step.ID || item.CommandType != "quantify" || item.ReturnKey != fmt.Sprintf("dna_A%d", i+1) {
+			t.Errorf("Unexpected work item %d: %+v", i, item)
+		}
+	}
+
+	// Items can only be claimed by one technician at a time.
+	if code := post(app.ClaimWorkItemHandler, items[0].ID, `{"technician": "alice"}`); code != http.StatusOK || !strings.Contains(lastBody, `"claimed_by":"alice"`) {
+		t.Errorf("Expected alice to claim the item, got %d: %s", code, lastBody)
+	}
+	if code := post(app.ClaimWorkItemHandler, items[0].ID, `{"technician": "bob"}`); code != http.StatusConflict {
+		t.Errorf("Expected bob's claim to conflict, got %d", code)
+	}
+	if code := post(app.UnclaimWorkItemHandler, items[0].ID, ""); code != http.StatusOK {
+		t.Errorf("Expected the item to be unclaimed, got %d: %s", code, lastBody)
+	}
+	if code := post(app.ClaimWorkItemHandler, items[0].ID, `{"technician": "bob"}`); code != http.StatusOK {
+		t.Errorf("Expected bob to claim the item, got %d: %s", code, lastBody)
+	}
+	if code := post(app.ClaimWorkItemHandler, 1000, `{"technician": "bob"}`); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown item not to be found, got %d", code)
+	}
+
+	// Items assigned to someone can be listed on their own, and items due
+	// soonest come first.
+	if code := post(app.AssignWorkItemHandler, items[1].ID, `{"assignee": "alice"}`); code != http.StatusOK {
+		t.Errorf("Expected the item to be assigned, got %d: %s", code, lastBody)
+	}
+	if mine := list("?assignee=alice"); len(mine) != 1 || mine[0].ID != items[1].ID {
+		t.Errorf("Expected alice to have one item, got %+v", mine)
+	}
+	if code := post(app.DueWorkItemHandler, items[2].ID, `{"due_at": 1700000000}`); code != http.StatusOK {
+		t.Errorf("Expected the due time to be set, got %d: %s", code, lastBody)
+	}
+	if got := list(""); got[0].ID != items[2].ID || got[0].DueAt == nil || *got[0].DueAt != 1700000000 {
+		t.Errorf("Expected the item due to come first, got %+v", got)
+	}
+
+	// Completing an item uploads its result, which is checked first.
+	if code := post(app.CompleteWorkItemHandler, items[0].ID, `{"ng_per_ul": "high"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a malformed result to be rejected, got %d", code)
+	}
+	if code := post(app.CompleteWorkItemHandler, items[0].ID, `{"ng_per_ul": 10}`); code != http.StatusOK || !strings.Contains(lastBody, `"completed_at"`) {
+		t.Errorf("Expected the item to be completed, got %d: %s", code, lastBody)
+	}
+	if code := post(app.CompleteWorkItemHandler, items[0].ID, `{"ng_per_ul": 10}`); code != http.StatusConflict {
+		t.Errorf("Expected completing the item again to conflict, got %d", code)
+	}
+	if code := post(app.ClaimWorkItemHandler, items[0].ID, `{"technician": "alice"}`); code != http.StatusConflict {
+		t.Errorf("Expected claiming a completed item to conflict, got %d", code)
+	}
+
+	// Results uploaded to the step complete their items too.
+	if err := wdb.MergeData(ctx, step.ID, "dna_A2", `{"ng_per_ul": 20}`); err != nil {
+		t.Fatalf("Failed to upload result: %v", err)
+	}
+	if got := list(""); len(got) != 1 || got[0].ID != items[2].ID {
+		t.Errorf("Expected one item left, got %+v", got)
+	}
+
+	req := httptest.NewRequest("GET", "/queue", nil)
+	rec := httptest.NewRecorder()
+	app.QueuePageHandler(rec, req)
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), "dna_A3") || !strings.Contains(rec.Body.String(), "2023-11-14 22:13 UTC") {
+		t.Errorf("Expected the queue page to show the last item, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// Once every item is done, the protocol continues.
+	if code := post(app.CompleteWorkItemHandler, items[2].ID, `{"ng_per_ul": 30}`); code != http.StatusOK {
+		t.Errorf("Expected the item to be completed, got %d: %s", code, lastBody)
+	}
+	steps := waitForSteps(t, queries, historyID, 2)
+	if steps[1].StepComment != "total 60" {
+		t.Errorf("Expected the protocol to continue, got %s", steps[1].StepComment)
+	}
+	if got := list(""); len(got) != 0 {
+		t.Errorf("Expected the queue to be empty, got %+v", got)
+	}
+}
@@ -0,0 +1,50 @@
+package autodemo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/koeng101/autodemo/src/ot2"
+)
+
+// RobotExecutor executes opentrons groups on an OT-2, through the ot2 server.
+// The ID of a run is its id in the server's activity log.
+type RobotExecutor struct {
+	client *ot2.Client
+}
+
+// NewRobotExecutor creates an executor running groups with client.
+func NewRobotExecutor(client *ot2.Client) *RobotExecutor {
+	return &RobotExecutor{client: client}
+}
+
+// Start submits the group to the robot. It returns ErrExecutorBusy while the
+// robot is running another group.
+func (r *RobotExecutor) Start(ctx context.Context, job Job) (int64, error) {
+	runID, err := r.client.Submit(ctx, job.Group)
+	if errors.Is(err, ot2.ErrLocked) {
+		return 0, ErrExecutorBusy
+	}
+	return runID, err
+}
+
+// Progress reports the run's status in the server's activity log.
+func (r *RobotExecutor) Progress(ctx context.Context, job Job, runID int64) (Progress, error) {
+	status, err := r.client.Status(ctx, runID)
+	if err != nil {
+		return Progress{}, err
+	}
+	var runStatus string
+	switch status.Status {
+	case ot2.StatusRunning:
+		runStatus = RunRunning
+	case ot2.StatusFailed:
+		runStatus = RunFailed
+	case ot2.StatusCompleted:
+		runStatus = RunCompleted
+	default:
+		return Progress{}, fmt.Errorf("unknown run status %q", status.Status)
+	}
+	return Progress{Status: runStatus, Message: status.StatusMessage}, nil
+}
@@ -24,8 +24,9 @@ CREATE TABLE project_message_history (
 CREATE TABLE code (
 	id INTEGER PRIMARY KEY AUTOINCREMENT,
 	project_message_history_id INTEGER NOT NULL REFERENCES project_message_history(id), -- the thread the code was created from
-	code TEXT NOT NULL, -- lua code
-	complete INTEGER NOT NULL DEFAULT FALSE -- bool
+	code TEXT NOT NULL, -- lua code, or a JSON array of scripts
+	complete INTEGER NOT NULL DEFAULT FALSE, -- bool
+	language TEXT NOT NULL DEFAULT 'lua' CHECK (language IN ('lua', 'json')) -- json for scripts submitted directly, which run one after another without lua
 ) STRICT;
 
 CREATE TABLE code_step (
@@ -36,5 +37,85 @@ CREATE TABLE code_step (
 	next_function TEXT NOT NULL,  -- next function to run
 	script TEXT NOT NULL, -- the script to execute, JSON
 	data_passthrough TEXT NOT NULL, -- passthrough data from lua
-	data TEXT -- the data to insert into this function, JSON
+	data TEXT, -- the data to insert into this function, JSON
+	seed INTEGER NOT NULL DEFAULT 0 -- the random seed used by the lua execution that created this step
+) STRICT;
+
+-- code_step_log records the lua execution which created a code step
+CREATE TABLE code_step_log (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code_step INTEGER NOT NULL UNIQUE REFERENCES code_step(id),
+	function_name TEXT NOT NULL, -- the lua function that was run
+	stdout TEXT NOT NULL, -- everything printed, one line per print
+	logs TEXT NOT NULL, -- libB.log entries, JSON
+	wall_time_ms INTEGER NOT NULL, -- how long the execution took
+	error TEXT, -- the lua error, if the execution failed
+	traceback TEXT, -- the lua traceback of the error
+	truncated INTEGER NOT NULL DEFAULT FALSE, -- bool, whether output was cut off at the output limit
+	created_at INTEGER NOT NULL DEFAULT (unixepoch())
+) STRICT;
+
+-- code_step_run records the runs of a code step's command groups by their executors
+CREATE TABLE code_step_run (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code_step INTEGER NOT NULL REFERENCES code_step(id),
+	command_group INTEGER NOT NULL, -- index of the group in the step's script
+	run_id INTEGER NOT NULL, -- id of the run given by its executor, such as the robot server's activity log id
+	status TEXT NOT NULL CHECK (status IN ('RUNNING', 'FAILED', 'COMPLETED')),
+	status_message TEXT NOT NULL, -- the executor's message for the run
+	created_at INTEGER NOT NULL DEFAULT (unixepoch()),
+	updated_at INTEGER NOT NULL DEFAULT (unixepoch()),
+	UNIQUE (code_step, command_group)
+) STRICT;
+
+-- work_item is a human command waiting on a technician. Items are listed across every project.
+CREATE TABLE work_item (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	code_step INTEGER NOT NULL REFERENCES code_step(id),
+	command_group INTEGER NOT NULL, -- index of the group in the step's script
+	command_index INTEGER NOT NULL, -- index of the command in the group
+	command_type TEXT NOT NULL, -- the command's type, such as quantify
+	command TEXT NOT NULL, -- the command, JSON
+	return_key TEXT NOT NULL, -- the key the command's result is uploaded under, or '' if it has none
+	assignee TEXT, -- who the item is planned for
+	claimed_by TEXT, -- the technician working on the item
+	claimed_at INTEGER,
+	due_at INTEGER, -- unix time the item should be done by
+	result TEXT, -- the result uploaded, JSON
+	completed_at INTEGER,
+	created_at INTEGER NOT NULL DEFAULT (unixepoch()),
+	UNIQUE (code_step, command_group, command_index)
+) STRICT;
+
+-- project_webhook is a URL sent the project's step events. Removed webhooks are kept for their delivery log.
+CREATE TABLE project_webhook (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	project_id TEXT NOT NULL REFERENCES project(id),
+	url TEXT NOT NULL,
+	secret TEXT NOT NULL, -- key each delivery's body is signed with, HMAC-SHA256
+	active INTEGER NOT NULL DEFAULT TRUE, -- bool, false once the webhook is removed
+	created_at INTEGER NOT NULL DEFAULT (unixepoch())
+) STRICT;
+
+-- webhook_delivery is an event to send to a webhook, retried with backoff until it is delivered or given up on
+CREATE TABLE webhook_delivery (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	webhook INTEGER NOT NULL REFERENCES project_webhook(id),
+	event TEXT NOT NULL, -- such as step.created
+	payload TEXT NOT NULL, -- the body to send, JSON
+	status TEXT NOT NULL DEFAULT 'PENDING' CHECK (status IN ('PENDING', 'DELIVERED', 'FAILED')),
+	attempts INTEGER NOT NULL DEFAULT 0,
+	next_attempt_at INTEGER NOT NULL DEFAULT (unixepoch()), -- unix time of the next attempt, while PENDING
+	delivered_at INTEGER,
+	created_at INTEGER NOT NULL DEFAULT (unixepoch())
+) STRICT;
+
+-- webhook_delivery_attempt logs each attempt to send a delivery
+CREATE TABLE webhook_delivery_attempt (
+	id INTEGER PRIMARY KEY AUTOINCREMENT,
+	delivery INTEGER NOT NULL REFERENCES webhook_delivery(id),
+	response_code INTEGER, -- the HTTP status of the response, if there was one
+	error TEXT, -- why the attempt failed, if it did
+	duration_ms INTEGER NOT NULL,
+	created_at INTEGER NOT NULL DEFAULT (unixepoch())
 ) STRICT;
@@ -4,8 +4,12 @@ import (
 	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
+	"runtime"
 	"sync"
+	"time"
 
 	"github.com/koeng101/autodemo/src/autodemosql"
 	libb "github.com/koeng101/autodemo/src/libB"
@@ -14,11 +18,19 @@ import (
 // ProtocolRunner manages the execution of protocol steps in the database
 type ProtocolRunner struct {
 	db *WriteDB
+
+	// Executors execute the command groups of scripts. Steps whose scripts
+	// have groups without an executor are failed.
+	Executors Executors
+	// OnStep, if set, is called after each new step is recorded, such as to
+	// nudge the dispatcher. Set it before running any protocol.
+	OnStep func()
 }
 
 func NewProtocolRunner(db *WriteDB) *ProtocolRunner {
 	return &ProtocolRunner{
-		db: db,
+		db:        db,
+		Executors: DefaultExecutors(db),
 	}
 }
 
@@ -30,114 +42,438 @@ type ProtocolState struct {
 	DataPassthrough string
 }
 
-// StartProtocol begins execution of a new protocol
+// ErrStepAdvanced is returned when a step was continued, or had its data
+// changed, while it was being continued. The execution is thrown away.
+var ErrStepAdvanced = errors.New("step has already been continued")
+
+// ErrStepIncomplete is returned when continuing a step which is still waiting
+// for data for some of its script's return keys.
+var ErrStepIncomplete = errors.New("step is still waiting for data")
+
+/******************************************************************************
+
+Step execution
+
+Executing a step runs arbitrary Lua, which can take seconds, while every write
+in the service goes through a single writer (see WriteDB). So Lua never runs
+inside RunTx. Instead, a protocol moves forward in three phases:
+
+ 1. Read: a short transaction reads the step and everything it needs to run.
+ 2. Execute: the Lua runs outside of the writer, while other writes go on.
+ 3. Commit: a second short transaction records the new step, unless the step
+    was continued, or its data changed, in the meantime.
+
+Since nothing holds the step while its Lua is running, two continuations of
+the same step can race. The commit check lets exactly one of them win.
+
+******************************************************************************/
+
+// StartProtocol begins execution of a new protocol. If main fails, the
+// protocol's first step is a failed step recording the error.
 func (r *ProtocolRunner) StartProtocol(ctx context.Context, messageHistoryID int64, code string) error {
-	return r.db.RunTx(func(db *sql.DB, ctx context.Context) error {
-		queries := autodemosql.New(db)
+	seed := libb.NewSeed()
+	state, capture := libb.CaptureLuaStep(ctx, code, libb.StepInput{Function: "main", Seed: seed})
+	if err := interrupted(ctx, "main", capture); err != nil {
+		return err
+	}
 
+	err := r.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
 		codeID, err := queries.CreateCode(ctx, autodemosql.CreateCodeParams{
 			ProjectMessageHistoryID: messageHistoryID,
 			Code:                    code,
+			Language:                LanguageLua,
 		})
 		if err != nil {
 			return fmt.Errorf("failed to create code entry: %v", err)
 		}
 
-		state, err := r.executeLuaStep(code, "main", "", "")
-		if err != nil {
-			return fmt.Errorf("failed to execute initial step: %v", err)
-		}
+		_, err = recordStep(queries, ctx, r.Executors, codeID, "main", seed, state, capture)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	r.stepRecorded()
+	return nil
+}
 
-		scriptJSONbytes, err := json.Marshal(state.Script)
+// ContinueStep continues the protocol from a step whose data has already
+// been uploaded.
+func (r *ProtocolRunner) ContinueStep(ctx context.Context, stepID int64) error {
+	var execution *stepExecution
+	err := r.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		var err error
+		execution, err = prepareStep(queries, ctx, stepID)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return r.execute(ctx, execution)
+}
+
+// FailStep fails the protocol from a step which can't be continued, recording
+// a failed step with err as its comment. It returns ErrStepAdvanced if the
+// step has been continued in the meantime.
+func (r *ProtocolRunner) FailStep(ctx context.Context, stepID int64, cause error) error {
+	err := r.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		step, err := queries.GetCodeStep(ctx, stepID)
 		if err != nil {
-			return fmt.Errorf("failed to marshal script")
+			return fmt.Errorf("failed to query step: %v", err)
 		}
-
-		_, err = queries.CreateCodeStep(ctx, autodemosql.CreateCodeStepParams{
-			Code:            codeID,
-			Status:          int64(state.Status),
-			StepComment:     state.Comments,
-			NextFunction:    state.NextFunc,
-			Script:          string(scriptJSONbytes),
-			DataPassthrough: state.DataPassthrough,
-		})
+		later, err := queries.CountStepsAfter(ctx, autodemosql.CountStepsAfterParams{Code: step.Code, ID: step.ID})
 		if err != nil {
-			return fmt.Errorf("failed to create code step: %v", err)
+			return fmt.Errorf("failed to count later steps: %v", err)
 		}
-
-		return nil
+		if later > 0 {
+			return ErrStepAdvanced
+		}
+		state := &libb.ProtocolState{
+			Status:   libb.StatusFailure,
+			Comments: fmt.Sprintf("Failed to continue: %v", cause),
+		}
+		_, err = recordStep(queries, ctx, r.Executors, step.Code, step.NextFunction, libb.NewSeed(), state, &libb.Capture{})
+		return err
 	})
+	if err != nil {
+		return err
+	}
+	r.stepRecorded()
+	return nil
 }
 
-// executeStep executes a step and returns the new state - separated from transaction handling
-func (r *ProtocolRunner) executeStep(db *sql.DB, ctx context.Context, stepID int64) (*libb.ProtocolState, error) {
-	queries := autodemosql.New(db)
+// stepExecution is everything needed to continue a protocol from a step,
+// read from the database so that it can be executed outside of the writer.
+type stepExecution struct {
+	step  autodemosql.CodeStep // the step being continued, as it was read
+	code  autodemosql.Code
+	input libb.StepInput
+}
 
+// prepareStep reads everything needed to continue the protocol from a step.
+func prepareStep(queries *autodemosql.Queries, ctx context.Context, stepID int64) (*stepExecution, error) {
 	step, err := queries.GetCodeStep(ctx, stepID)
 	if err != nil {
-		return nil, fmt.Errorf("failed to get code step: %v", err)
+		return nil, fmt.Errorf("failed to query step: %v", err)
+	}
+	outstanding, err := outstandingKeys(step)
+	if err != nil {
+		return nil, err
+	}
+	if len(outstanding) > 0 {
+		return nil, fmt.Errorf("%w: missing %v", ErrStepIncomplete, outstanding)
 	}
+	seed, err := nextSeed(queries, ctx, step)
+	if err != nil {
+		return nil, err
+	}
+	code, input, err := stepInput(queries, ctx, step, seed)
+	if err != nil {
+		return nil, err
+	}
+	return &stepExecution{step: step, code: code, input: input}, nil
+}
 
-	code, err := queries.GetCode(ctx, step.Code)
+// execute runs a prepared execution's Lua outside of the writer, then
+// commits its result. A new step is always created, even if the execution
+// failed, unless it was interrupted by ctx.
+func (r *ProtocolRunner) execute(ctx context.Context, execution *stepExecution) error {
+	state, capture := runStep(ctx, execution.code, execution.input)
+	if err := interrupted(ctx, execution.step.NextFunction, capture); err != nil {
+		return err
+	}
+	err := r.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		return execution.commit(queries, ctx, r.Executors, state, capture)
+	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to get code: %v", err)
+		return err
 	}
+	r.stepRecorded()
+	return nil
+}
 
-	if !step.Data.Valid {
-		return nil, fmt.Errorf("no data available for step")
+// stepRecorded calls OnStep, if set.
+func (r *ProtocolRunner) stepRecorded() {
+	if r.OnStep != nil {
+		r.OnStep()
+	}
+}
+
+// commit records the result of an execution as the step after the one it
+// continued, unless that step has advanced since the execution was prepared.
+func (e *stepExecution) commit(queries *autodemosql.Queries, ctx context.Context, executors Executors, state *libb.ProtocolState, capture *libb.Capture) error {
+	current, err := queries.GetCodeStep(ctx, e.step.ID)
+	if err != nil {
+		return fmt.Errorf("failed to query step: %v", err)
+	}
+	if current.Data != e.step.Data {
+		return ErrStepAdvanced
+	}
+	later, err := queries.CountStepsAfter(ctx, autodemosql.CountStepsAfterParams{Code: e.step.Code, ID: e.step.ID})
+	if err != nil {
+		return fmt.Errorf("failed to count later steps: %v", err)
+	}
+	if later > 0 {
+		return ErrStepAdvanced
 	}
 
-	return r.executeLuaStep(code.Code, step.NextFunction, step.DataPassthrough, step.Data.String)
+	_, err = recordStep(queries, ctx, executors, e.step.Code, e.step.NextFunction, e.input.Seed, state, capture)
+	return err
 }
 
-func (r *ProtocolRunner) UpdateStepAndContinue(ctx context.Context, stepID int64, data string) error {
-	return r.db.RunTx(func(db *sql.DB, ctx context.Context) error {
-		queries := autodemosql.New(db)
+// interrupted returns an error if an execution of function failed because
+// ctx was cancelled, such as by shutdown. That says nothing about the
+// protocol, so the protocol isn't failed over it.
+func interrupted(ctx context.Context, function string, capture *libb.Capture) error {
+	if capture.Err != nil && ctx.Err() != nil {
+		return fmt.Errorf("execution of %s interrupted: %v", function, capture.Err)
+	}
+	return nil
+}
 
-		// Update the step with the new data
-		err := queries.UpdateStepData(ctx, autodemosql.UpdateStepDataParams{
-			ID:   stepID,
-			Data: sql.NullString{String: data, Valid: true},
-		})
+// runStep runs the function of input in code: Lua code with libB, or the next
+// of a sequence of scripts submitted directly.
+func runStep(ctx context.Context, code autodemosql.Code, input libb.StepInput) (*libb.ProtocolState, *libb.Capture) {
+	if code.Language == LanguageJSON {
+		return runScripts(code.Code, input)
+	}
+	return libb.CaptureLuaStep(ctx, code.Code, input)
+}
+
+// stepInput reads the code and inputs for continuing a protocol from step,
+// seeding its randomness with seed.
+func stepInput(queries *autodemosql.Queries, ctx context.Context, step autodemosql.CodeStep, seed int64) (autodemosql.Code, libb.StepInput, error) {
+	code, err := queries.GetCode(ctx, step.Code)
+	if err != nil {
+		return code, libb.StepInput{}, fmt.Errorf("failed to get code: %v", err)
+	}
+
+	// Steps with status 3 continue once their script has run, without data.
+	if !step.Data.Valid && step.Status != int64(libb.StatusContinueNoData) {
+		return code, libb.StepInput{}, fmt.Errorf("no data available for step")
+	}
+
+	steps, err := queries.GetStepsForCode(ctx, step.Code)
+	if err != nil {
+		return code, libb.StepInput{}, fmt.Errorf("failed to get steps for code: %v", err)
+	}
+
+	// DATA holds the results uploaded to this step and every step before it,
+	// so functions can read earlier results without threading their ids
+	// through data_passthrough.
+	data := make(map[string]map[string]string)
+	for _, s := range steps {
+		if s.ID > step.ID || !s.Data.Valid {
+			continue
+		}
+		stepData, err := parseStepData(s.Data.String)
 		if err != nil {
-			return fmt.Errorf("failed to update step data: %v", err)
+			return code, libb.StepInput{}, err
+		}
+		for scriptID, results := range stepData {
+			if data[scriptID] == nil {
+				data[scriptID] = make(map[string]string)
+			}
+			for dataID, result := range results {
+				data[scriptID][dataID] = result
+			}
+		}
+	}
+	input := libb.StepInput{
+		Function:    step.NextFunction,
+		Passthrough: step.DataPassthrough,
+		Data:        data,
+		Seed:        seed,
+	}
+
+	// Protocols using libB.await are replayed from main with the results of
+	// every step they have awaited so far.
+	if step.NextFunction == libb.AwaitFunction {
+		for _, s := range steps {
+			if s.ID > step.ID || s.NextFunction != libb.AwaitFunction {
+				continue
+			}
+			result, err := awaitResult(s)
+			if err != nil {
+				return code, libb.StepInput{}, err
+			}
+			input.Replay = append(input.Replay, result)
 		}
+	}
+
+	return code, input, nil
+}
 
+// nextSeed picks the seed for continuing a protocol from step. Protocols
+// using libB.await replay main, so they reuse the seed main first ran with
+// and every replay generates the same ids. Anything else gets a fresh seed.
+func nextSeed(queries *autodemosql.Queries, ctx context.Context, step autodemosql.CodeStep) (int64, error) {
+	if step.NextFunction != libb.AwaitFunction {
+		return libb.NewSeed(), nil
+	}
+	steps, err := queries.GetStepsForCode(ctx, step.Code)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get steps for code: %v", err)
+	}
+	return steps[0].Seed, nil
+}
+
+// ReplayStep re-runs the Lua execution which created a step, with the same
+// inputs and seed, and returns the state it produces. Since executions are
+// deterministic, this matches the stored step; it is used to recover steps and
+// to check that protocols replay cleanly.
+func (r *ProtocolRunner) ReplayStep(ctx context.Context, stepID int64) (*libb.ProtocolState, error) {
+	var code autodemosql.Code
+	var input libb.StepInput
+	err := r.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
 		step, err := queries.GetCodeStep(ctx, stepID)
 		if err != nil {
-			return fmt.Errorf("failed to query step: %v", err)
+			return fmt.Errorf("failed to get code step: %v", err)
 		}
-
-		// Execute the step within the same transaction
-		state, err := r.executeStep(db, ctx, stepID)
+		steps, err := queries.GetStepsForCode(ctx, step.Code)
 		if err != nil {
-			return err
+			return fmt.Errorf("failed to get steps for code: %v", err)
 		}
 
-		scriptJSONbytes, err := json.Marshal(state.Script)
-		if err != nil {
-			return fmt.Errorf("failed to marshal script")
+		// The first step was created by main, every other step by continuing
+		// from the step before it.
+		var previous *autodemosql.CodeStep
+		for i := range steps {
+			if steps[i].ID == step.ID {
+				break
+			}
+			previous = &steps[i]
 		}
+		if previous == nil {
+			c, err := queries.GetCode(ctx, step.Code)
+			if err != nil {
+				return fmt.Errorf("failed to get code: %v", err)
+			}
+			code, input = c, libb.StepInput{Function: "main", Seed: step.Seed}
+			return nil
+		}
+		code, input, err = stepInput(queries, ctx, *previous, step.Seed)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	if code.Language == LanguageJSON {
+		state, capture := runScripts(code.Code, input)
+		return state, capture.Err
+	}
+	return libb.ExecuteLuaStep(ctx, code.Code, input)
+}
 
-		// Always create a new step when processing data
-		_, err = queries.CreateCodeStep(ctx, autodemosql.CreateCodeStepParams{
-			Code:            step.Code,
-			Status:          int64(state.Status),
-			StepComment:     state.Comments,
-			NextFunction:    state.NextFunc,
-			Script:          string(scriptJSONbytes),
-			DataPassthrough: state.DataPassthrough,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to create new step: %v", err)
+// awaitResult converts a step which waited on libB.await into the result the
+// call returns when the protocol is replayed. Steps with status 3 awaited a
+// script returning nothing, so their result is empty.
+func awaitResult(step autodemosql.CodeStep) (libb.AwaitResult, error) {
+	var script libb.Script
+	if err := json.Unmarshal([]byte(step.Script), &script); err != nil {
+		return libb.AwaitResult{}, fmt.Errorf("failed to parse script of step %d: %v", step.ID, err)
+	}
+	if !step.Data.Valid && step.Status == int64(libb.StatusContinueNoData) {
+		return libb.AwaitResult{Script: &script}, nil
+	}
+	if !step.Data.Valid {
+		return libb.AwaitResult{}, fmt.Errorf("no data available for step %d", step.ID)
+	}
+	data, err := parseStepData(step.Data.String)
+	if err != nil {
+		return libb.AwaitResult{}, err
+	}
+	return libb.AwaitResult{Script: &script, Data: data[script.ID]}, nil
+}
+
+// recordStep stores the state an execution of function produced as a new step
+// of code, along with a log of the execution, and returns the new step's ID.
+// If the execution failed, or returned a script which doesn't match the script
+// schema, has groups none of executors can execute or fails deck validation,
+// the step is stored as failed, with the error as its comment. Deck validation
+// warnings are added to the log, and the step's webhook events are queued.
+func recordStep(queries *autodemosql.Queries, ctx context.Context, executors Executors, codeID int64, function string, seed int64, state *libb.ProtocolState, capture *libb.Capture) (int64, error) {
+	if capture.Err != nil {
+		state = &libb.ProtocolState{
+			Status:   libb.StatusFailure,
+			Comments: fmt.Sprintf("Lua error: %v", capture.Err),
+		}
+	}
+	// Scripts are handed to robots and people, so one which doesn't match the
+	// schema fails the protocol here rather than on the lab bench.
+	if state.Script != nil {
+		if err := state.Script.Validate(); err != nil {
+			state = &libb.ProtocolState{
+				Status:   libb.StatusFailure,
+				Comments: fmt.Sprintf("Invalid script: %v", err),
+			}
+		}
+	}
+	if state.Script != nil {
+		if err := executors.Check(state.Script); err != nil {
+			state = &libb.ProtocolState{
+				Status:   libb.StatusFailure,
+				Comments: fmt.Sprintf("Unexecutable script: %v", err),
+			}
+		}
+	}
+	if state.Script != nil {
+		issues := libb.ValidateDeck(state.Script)
+		for _, issue := range issues {
+			if issue.Severity == libb.DeckWarning {
+				capture.Logs = append(capture.Logs, libb.LogEntry{Level: libb.LogWarn, Message: "Deck " + issue.String(), After: len(capture.Stdout)})
+			}
+		}
+		if err := libb.DeckErrors(issues); err != nil {
+			state = &libb.ProtocolState{
+				Status:   libb.StatusFailure,
+				Comments: fmt.Sprintf("Unsafe script: %v", err),
+			}
 		}
+	}
 
-		return nil
+	scriptJSONbytes, err := json.Marshal(state.Script)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal script")
+	}
+	stepID, err := queries.CreateCodeStep(ctx, autodemosql.CreateCodeStepParams{
+		Code:            codeID,
+		Status:          int64(state.Status),
+		StepComment:     state.Comments,
+		NextFunction:    state.NextFunc,
+		Script:          string(scriptJSONbytes),
+		DataPassthrough: state.DataPassthrough,
+		Seed:            seed,
 	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create code step: %v", err)
+	}
+
+	logsJSONbytes, err := json.Marshal(capture.Logs)
+	if err != nil {
+		return 0, fmt.Errorf("failed to marshal logs")
+	}
+	err = queries.CreateCodeStepLog(ctx, autodemosql.CreateCodeStepLogParams{
+		CodeStep:     stepID,
+		FunctionName: function,
+		Stdout:       capture.Output(),
+		Logs:         string(logsJSONbytes),
+		WallTimeMs:   capture.WallTime.Milliseconds(),
+		Error:        sql.NullString{String: capture.Error, Valid: capture.Error != ""},
+		Traceback:    sql.NullString{String: capture.Traceback, Valid: capture.Traceback != ""},
+		Truncated:    capture.Truncated,
+	})
+	if err != nil {
+		return 0, fmt.Errorf("failed to create code step log: %v", err)
+	}
+	if err := queueStepEvents(queries, ctx, codeID, stepID); err != nil {
+		return 0, err
+	}
+	return stepID, nil
 }
 
-func (r *ProtocolRunner) executeLuaStep(code string, funcName string, dataPassthrough string, dataString string) (*libb.ProtocolState, error) {
-	fmt.Println(dataString)
+// parseStepData parses the data uploaded for a step.
+func parseStepData(dataString string) (map[string]map[string]string, error) {
 	var data map[string]map[string]string
 	if dataString != "" {
 		err := json.Unmarshal([]byte(dataString), &data)
@@ -145,64 +481,272 @@ func (r *ProtocolRunner) executeLuaStep(code string, funcName string, dataPassth
 			return nil, fmt.Errorf("failed to parse json: %v", err)
 		}
 	}
-	fmt.Println(data)
+	return data, nil
+}
 
-	return libb.ExecuteLuaStep(code, funcName, dataPassthrough, data)
+// outstandingKeys returns the return keys of a step's script which have no
+// data uploaded yet, keyed by script ID. Steps which aren't waiting on a
+// script have none.
+func outstandingKeys(step autodemosql.CodeStep) (map[string][]string, error) {
+	if step.Status != int64(libb.StatusContinue) || step.Script == "" {
+		return nil, nil
+	}
+	var script libb.Script
+	if err := json.Unmarshal([]byte(step.Script), &script); err != nil {
+		return nil, fmt.Errorf("failed to parse script: %v", err)
+	}
+	data, err := parseStepData(step.Data.String)
+	if err != nil {
+		return nil, err
+	}
+	if hasAll, missing := script.HasAllData(data); !hasAll {
+		return missing, nil
+	}
+	return nil, nil
 }
 
-// StepWatcher remains unchanged
-type StepWatcher struct {
-	runner   *ProtocolRunner
-	watchers map[int64]chan string
-	mu       sync.RWMutex
+/******************************************************************************
+
+Engine
+
+Protocols wait on people and robots for hours or days, far longer than any
+websocket or server process lives, so the engine keeps no state of its own.
+Everything it needs is in code_step: a step with status 2 and no data is
+waiting for an upload, and a step with status 2 whose data has been uploaded
+for every return key of its script, but which has no step after it, is ready
+to continue once the dispatcher has recorded every command group of its
+script as COMPLETED in code_step_run. Results for a script can be uploaded one
+return key at a time, so a step may have data and still be waiting on the
+rest of it, and a step whose robot run is still going, or has failed, waits
+however much of its data is in.
+
+Uploads only write their data to the database and then nudge the engine. On
+startup, the engine continues anything that was uploaded while it was down,
+so a restart never loses a protocol.
+
+Ready steps are continued by up to Workers at once, so a slow step only holds
+up its own protocol. A step which fails to continue, such as when the database
+is busy, is retried with exponential backoff, and once it has failed
+MaxAttempts times its protocol is failed with the error, since the step will
+never continue by itself.
+
+******************************************************************************/
+
+// Engine continues protocols as data is uploaded for their steps.
+type Engine struct {
+	runner *ProtocolRunner
+	db     *sql.DB
+	wake   chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	mu       sync.Mutex
+	running  map[int64]bool         // steps being continued
+	failures map[int64]*stepFailure // steps which failed to continue
+
+	// Workers is how many steps are continued at once.
+	Workers int
+	// Backoff is how long to wait before retrying a step which failed to
+	// continue, doubling after each further failure up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is how many times a step is tried before its protocol is
+	// failed.
+	MaxAttempts int
 }
 
-func NewStepWatcher(runner *ProtocolRunner) *StepWatcher {
-	return &StepWatcher{
-		runner:   runner,
-		watchers: make(map[int64]chan string),
-	}
+// stepFailure is how often a step has failed to continue, and when it is
+// retried.
+type stepFailure struct {
+	attempts int
+	retryAt  time.Time
 }
 
-func (w *StepWatcher) WatchStep(ctx context.Context, stepID int64) {
-	w.mu.Lock()
-	dataChan := make(chan string, 1)
-	w.watchers[stepID] = dataChan
-	w.mu.Unlock()
+// NewEngine creates an engine continuing protocols with runner, reading
+// steps from db.
+func NewEngine(runner *ProtocolRunner, db *sql.DB) *Engine {
+	return &Engine{
+		runner:      runner,
+		db:          db,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		running:     make(map[int64]bool),
+		failures:    make(map[int64]*stepFailure),
+		Workers:     runtime.GOMAXPROCS(0),
+		Backoff:     time.Second,
+		MaxBackoff:  5 * time.Minute,
+		MaxAttempts: 10,
+	}
+}
 
+// Start continues every step which is ready, then does so again whenever
+// Notify is called or a retry is due, until ctx is cancelled or Stop is
+// called.
+func (e *Engine) Start(ctx context.Context) {
+	ctx, e.cancel = context.WithCancel(ctx)
 	go func() {
+		var wg sync.WaitGroup
+		workers := make(chan struct{}, max(e.Workers, 1))
+		defer close(e.done)
+		defer wg.Wait()
+		for {
+			var next <-chan time.Time
+			if at, ok := e.continueReady(ctx, &wg, workers); ok {
+				next = time.After(time.Until(at))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-e.wake:
+			case <-next:
+			}
+		}
+	}()
+}
+
+// Notify tells the engine that data has been uploaded.
+func (e *Engine) Notify() {
+	select {
+	case e.wake <- struct{}{}:
+	default:
+		// A wake up is already pending, which will see this data too.
+	}
+}
+
+// Stop stops the engine, waiting for the steps being continued to finish.
+func (e *Engine) Stop() {
+	if e.cancel == nil {
+		return
+	}
+	e.cancel()
+	<-e.done
+}
+
+// continueReady starts continuing every step which is ready, oldest first,
+// apart from those already being continued or waiting to be retried. Each
+// takes one of workers until it is done. It returns when the next retry is
+// due, if any is.
+func (e *Engine) continueReady(ctx context.Context, wg *sync.WaitGroup, workers chan struct{}) (time.Time, bool) {
+	steps, err := autodemosql.New(e.db).GetReadySteps(ctx)
+	if err != nil {
+		log.Printf("Failed to get ready steps: %v", err)
+		return time.Now().Add(e.Backoff), true
+	}
+	// Steps which have stopped being ready, such as by being continued
+	// elsewhere, are forgotten.
+	ready := make(map[int64]bool, len(steps))
+	for _, step := range steps {
+		ready[step.ID] = true
+	}
+	e.mu.Lock()
+	for stepID := range e.failures {
+		if !ready[stepID] && !e.running[stepID] {
+			delete(e.failures, stepID)
+		}
+	}
+	e.mu.Unlock()
+
+	var next time.Time
+	now := time.Now()
+	for _, step := range steps {
+		e.mu.Lock()
+		failure := e.failures[step.ID]
+		skip := e.running[step.ID] || (failure != nil && now.Before(failure.retryAt))
+		if !skip {
+			e.running[step.ID] = true
+		}
+		e.mu.Unlock()
+		if skip {
+			if failure != nil && (next.IsZero() || failure.retryAt.Before(next)) {
+				next = failure.retryAt
+			}
+			continue
+		}
+
 		select {
-		case data := <-dataChan:
-			err := w.runner.UpdateStepAndContinue(ctx, stepID, data)
+		case <-ctx.Done():
+			return next, !next.IsZero()
+		case workers <- struct{}{}:
+		}
+		wg.Add(1)
+		go func(stepID int64) {
+			defer wg.Done()
+			defer func() { <-workers }()
+			e.continueStep(ctx, stepID)
+		}(step.ID)
+	}
+	return next, !next.IsZero()
+}
+
+// continueStep continues a step, scheduling a retry if it fails, or failing
+// its protocol once it has failed too often.
+func (e *Engine) continueStep(ctx context.Context, stepID int64) {
+	// A step which advanced while it was being continued was continued by
+	// someone else, which is what we were trying to do anyway. A step with
+	// only part of its data is continued once the rest is uploaded.
+	err := e.runner.ContinueStep(ctx, stepID)
+	if err != nil && (errors.Is(err, ErrStepAdvanced) || errors.Is(err, ErrStepIncomplete)) {
+		err = nil
+	}
+	if err != nil && ctx.Err() != nil {
+		// Interrupted by shutdown, and continued again on the next start.
+		e.finish(stepID, nil)
+		return
+	}
+	if err != nil {
+		attempts := e.attempts(stepID) + 1
+		log.Printf("Error continuing step %d (attempt %d of %d): %v", stepID, attempts, e.MaxAttempts, err)
+		if attempts >= e.MaxAttempts {
+			err = e.runner.FailStep(ctx, stepID, err)
+			if errors.Is(err, ErrStepAdvanced) {
+				err = nil
+			}
 			if err != nil {
-				fmt.Printf("Error executing step %d: %v\n", stepID, err)
+				log.Printf("Failed to fail step %d: %v", stepID, err)
 			}
-			w.mu.Lock()
-			delete(w.watchers, stepID)
-			close(dataChan)
-			w.mu.Unlock()
-		case <-ctx.Done():
-			w.mu.Lock()
-			delete(w.watchers, stepID)
-			close(dataChan)
-			w.mu.Unlock()
 		}
-	}()
+	}
+	e.finish(stepID, err)
+	if err != nil {
+		// Wake up to schedule the retry.
+		e.Notify()
+	}
 }
 
-func (w *StepWatcher) UpdateStep(stepID int64, data string) error {
-	w.mu.RLock()
-	dataChan, exists := w.watchers[stepID]
-	w.mu.RUnlock()
+// attempts returns how often a step has failed to continue.
+func (e *Engine) attempts(stepID int64) int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if failure := e.failures[stepID]; failure != nil {
+		return failure.attempts
+	}
+	return 0
+}
 
-	if !exists {
-		return fmt.Errorf("no watcher found for step %d", stepID)
+// finish records that a step is no longer being continued, and schedules a
+// retry if it failed with err.
+func (e *Engine) finish(stepID int64, err error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	delete(e.running, stepID)
+	if err == nil {
+		delete(e.failures, stepID)
+		return
+	}
+	failure := e.failures[stepID]
+	if failure == nil {
+		failure = &stepFailure{}
+		e.failures[stepID] = failure
 	}
+	failure.attempts++
+	failure.retryAt = time.Now().Add(e.backoff(failure.attempts))
+}
 
-	select {
-	case dataChan <- data:
-		return nil
-	default:
-		return fmt.Errorf("watcher for step %d is not ready", stepID)
+// backoff returns how long to wait after a step's attempts have failed.
+func (e *Engine) backoff(attempts int) time.Duration {
+	backoff := e.Backoff
+	for i := 1; i < attempts && backoff < e.MaxBackoff; i++ {
+		backoff *= 2
 	}
+	return min(backoff, e.MaxBackoff)
 }
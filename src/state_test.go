@@ -2,11 +2,21 @@ package autodemo
 
 import (
 	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"strings"
 	"testing"
 	"time"
 
 	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
 )
 
 const testProtocol = `
@@ -15,7 +25,7 @@ function main()
     local data_id = "data1"
     
     -- Return format: status, comment, next_func, script, data_passthrough
-    return 2, "Starting DNA test", "process_dna", '{"id":"script1"}', '{"script_id":"script1","data_id":"data1"}'
+    return 2, "Starting DNA test", "process_dna", '{"id":"script1","commands":[]}', '{"script_id":"script1","data_id":"data1"}'
 end
 
 function process_dna(data_passthrough)
@@ -60,9 +70,11 @@ func TestProtocolExecution(t *testing.T) {
 	}
 	historyID = result
 
-	// Create protocol runner and watcher
+	// Create protocol runner and engine
 	runner := NewProtocolRunner(wdb)
-	watcher := NewStepWatcher(runner)
+	engine := NewEngine(runner, db)
+	engine.Start(ctx)
+	defer engine.Stop()
 
 	// Start protocol
 	err = runner.StartProtocol(ctx, historyID, testProtocol)
@@ -84,9 +96,6 @@ func TestProtocolExecution(t *testing.T) {
 		t.Errorf("Expected status 2 (continuation), got %d", initialStep.Status)
 	}
 
-	// Start watching the step
-	watcher.WatchStep(ctx, initialStep.ID)
-
 	// Simulate external system providing data
 	testData := `{
 		"script1": {
@@ -95,19 +104,14 @@ func TestProtocolExecution(t *testing.T) {
 	}`
 
 	// Update the step with new data
-	err = watcher.UpdateStep(initialStep.ID, testData)
+	err = wdb.CreateData(ctx, initialStep.ID, testData)
 	if err != nil {
 		t.Fatalf("Failed to update step: %v", err)
 	}
-
-	// Give the watcher time to process
-	time.Sleep(500 * time.Millisecond)
+	engine.Notify()
 
 	// Read final state
-	allSteps, err = queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
-	if err != nil {
-		t.Fatalf("Failed to get final steps: %v", err)
-	}
+	allSteps = waitForSteps(t, queries, historyID, 2)
 
 	if len(allSteps) < 2 {
 		t.Fatal("Expected at least 2 steps")
@@ -122,3 +126,1097 @@ func TestProtocolExecution(t *testing.T) {
 		t.Errorf("Expected comment 'High DNA concentration', got %s", finalStep.StepComment)
 	}
 }
+
+// waitForSteps waits for the engine to create count steps from a message
+// history, and returns them.
+func waitForSteps(t *testing.T, queries *autodemosql.Queries, historyID int64, count int) []autodemosql.CodeStep {
+	t.Helper()
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		steps, err := queries.GetAllStepsForCodeFromProjectHistoryID(context.Background(), historyID)
+		if err != nil {
+			t.Fatalf("Failed to get steps: %v", err)
+		}
+		if len(steps) >= count {
+			return steps
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for %d steps, got %d", count, len(steps))
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+const awaitTestProtocol = `
+function main()
+    local first = libB.Script.new("script1")
+    first:add_commands(libB.HumanCommands.new():quantify("data1", "nest_96_wellplate_100ul_pcr_full_skirt", "7", "A1"))
+    local reading = libB.json.decode(libB.await(first, "Quantify DNA")["data1"])
+
+    local second = libB.Script.new("script2")
+    second:add_commands(libB.HumanCommands.new():quantify("data2", "nest_96_wellplate_100ul_pcr_full_skirt", "7", "A2"))
+    local diluted = libB.json.decode(libB.await(second, "Quantify diluted DNA")["data2"])
+
+    if reading.ng_per_ul > 25 and diluted.ng_per_ul < 25 then
+        return 0, "Dilution worked", "", "", ""
+    end
+    return 1, "Dilution failed", "", "", ""
+end
+`
+
+func TestAwaitProtocolExecution(t *testing.T) {
+	dbPath := "test_await.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	projectID := "test-project-1"
+	if err := wdb.CreateProject(ctx, projectID); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, projectID, "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+
+	runner := NewProtocolRunner(wdb)
+	engine := NewEngine(runner, db)
+	engine.Start(ctx)
+	defer engine.Stop()
+	dispatcher := NewDispatcher(runner, db)
+	dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = dispatcher.Notify
+	dispatcher.Start(ctx)
+	defer dispatcher.Stop()
+	queries := autodemosql.New(db)
+
+	if err := runner.StartProtocol(ctx, historyID, awaitTestProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+
+	// Each upload replays main one libB.await further.
+	for i, upload := range []struct {
+		comment string
+		data    string
+	}{
+		{"Quantify DNA", `{"script1": {"data1": "{\"ng_per_ul\": 30}"}}`},
+		{"Quantify diluted DNA", `{"script2": {"data2": "{\"ng_per_ul\": 12}"}}`},
+	} {
+		steps := waitForSteps(t, queries, historyID, i+1)
+		step := steps[len(steps)-1]
+		if step.Status != 2 || step.NextFunction != libb.AwaitFunction || step.StepComment != upload.comment {
+			t.Fatalf("Expected step waiting on %q, got %+v", upload.comment, step)
+		}
+
+		if err := wdb.CreateData(ctx, step.ID, upload.data); err != nil {
+			t.Fatalf("Failed to update step: %v", err)
+		}
+		engine.Notify()
+	}
+
+	steps := waitForSteps(t, queries, historyID, 3)
+	if len(steps) != 3 {
+		t.Fatalf("Expected 3 steps, got %d", len(steps))
+	}
+	finalStep := steps[len(steps)-1]
+	if finalStep.Status != 0 || finalStep.StepComment != "Dilution worked" {
+		t.Errorf("Expected successful final step, got status %d: %s", finalStep.Status, finalStep.StepComment)
+	}
+}
+
+const replayHandoffProtocol = `
+function quantify(well)
+    local script = libB.Script.new(libB.uuid.generate())
+    local data_id = libB.uuid.generate()
+    script:add_commands(libB.HumanCommands.new():quantify(data_id, "nest_96_wellplate_100ul_pcr_full_skirt", "7", well))
+    return script, libB.json.encode({ script_id = script.id, data_id = data_id })
+end
+
+function main()
+    local script, passthrough = quantify("A1")
+    return 2, "Quantify DNA", "dilute", script:to_json(), passthrough
+end
+
+function dilute(input)
+    local ids = libB.json.decode(input)
+    local reading = libB.json.decode(DATA[ids.script_id][ids.data_id])
+    local script, passthrough = quantify("A2")
+    return 2, string.format("Diluting %d ng/uL", reading.ng_per_ul), "finish", script:to_json(), passthrough
+end
+
+function finish(input)
+    return 0, "Done", "", "", ""
+end
+`
+
+const replayAwaitProtocol = `
+function main()
+    local readings = {}
+    for _, well in ipairs({ "A1", "A2", "A3" }) do
+        local script = libB.Script.new(libB.uuid.generate())
+        local data_id = libB.uuid.generate()
+        script:add_commands(libB.HumanCommands.new():quantify(data_id, "nest_96_wellplate_100ul_pcr_full_skirt", "7", well))
+        local results = libB.await(script, "Quantify " .. well)
+        table.insert(readings, libB.json.decode(results[data_id]).ng_per_ul)
+    end
+    return 0, table.concat(readings, ","), "", "", ""
+end
+`
+
+// TestReplayProtocol runs protocols to completion, then re-runs the execution
+// behind every step and checks it produces exactly what was stored.
+func TestReplayProtocol(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		code  string
+		steps int
+	}{
+		{"hand-off", replayHandoffProtocol, 3},
+		{"await", replayAwaitProtocol, 4},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dbPath := "test_replay.db"
+			db, wdb := MakeTestDatabase(dbPath)
+			defer db.Close()
+			defer os.Remove(dbPath)
+			defer os.Remove(dbPath + "-wal")
+			defer os.Remove(dbPath + "-shm")
+
+			ctx := context.Background()
+			if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+				t.Fatalf("Failed to create project: %v", err)
+			}
+			historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+			if err != nil {
+				t.Fatalf("Failed to create message history: %v", err)
+			}
+			runner := NewProtocolRunner(wdb)
+			queries := autodemosql.New(db)
+
+			if err := runner.StartProtocol(ctx, historyID, tt.code); err != nil {
+				t.Fatalf("Failed to start protocol: %v", err)
+			}
+
+			// Upload a reading for every step until the protocol finishes.
+			var steps []autodemosql.CodeStep
+			for reading := 30; ; reading++ {
+				steps, err = queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+				if err != nil {
+					t.Fatalf("Failed to get steps: %v", err)
+				}
+				step := steps[len(steps)-1]
+				if step.Status != 2 {
+					break
+				}
+				var script libb.Script
+				if err := json.Unmarshal([]byte(step.Script), &script); err != nil {
+					t.Fatalf("Failed to parse script: %v", err)
+				}
+				results := make(map[string]string)
+				for returnKey := range script.GetReturnKeys()[script.ID] {
+					results[returnKey] = fmt.Sprintf(`{"ng_per_ul": %d}`, reading)
+				}
+				data, _ := json.Marshal(map[string]map[string]string{script.ID: results})
+				if err := uploadAndContinue(ctx, wdb, runner, step.ID, string(data)); err != nil {
+					t.Fatalf("Failed to continue step %d: %v", step.ID, err)
+				}
+			}
+			if len(steps) != tt.steps {
+				t.Fatalf("Expected %d steps, got %d", tt.steps, len(steps))
+			}
+			if final := steps[len(steps)-1]; final.Status != 0 {
+				t.Fatalf("Expected protocol to succeed, got status %d: %s", final.Status, final.StepComment)
+			}
+
+			for _, step := range steps {
+				state, err := runner.ReplayStep(ctx, step.ID)
+				if err != nil {
+					t.Fatalf("Failed to replay step %d: %v", step.ID, err)
+				}
+				scriptJSON, err := json.Marshal(state.Script)
+				if err != nil {
+					t.Fatalf("Failed to marshal script: %v", err)
+				}
+				replayed := autodemosql.CodeStep{
+					ID:              step.ID,
+					Code:            step.Code,
+					Status:          int64(state.Status),
+					StepComment:     state.Comments,
+					NextFunction:    state.NextFunc,
+					Script:          string(scriptJSON),
+					DataPassthrough: state.DataPassthrough,
+					Data:            step.Data,
+					Seed:            step.Seed,
+				}
+				if replayed != step {
+					t.Errorf("Replaying step %d differs:\nstored:   %+v\nreplayed: %+v", step.ID, step, replayed)
+				}
+			}
+		})
+	}
+}
+
+const loggedProtocol = `
+function main()
+    print("reading plate")
+    libB.log.info("threshold", 25)
+    return 2, "Quantify DNA", "check", '{"id":"script1","commands":[]}', '{"script_id":"script1","data_id":"data1"}'
+end
+
+local function require_reading(reading)
+    if reading.ng_per_ul < 25 then
+        error("reading too low")
+    end
+end
+
+function check(data_passthrough)
+    local ids = libB.json.decode(data_passthrough)
+    local reading = libB.json.decode(DATA[ids.script_id][ids.data_id])
+    libB.log.warn("got", reading.ng_per_ul)
+    require_reading(reading)
+    return 0, "Done", "", "", ""
+end
+`
+
+func TestStepLogs(t *testing.T) {
+	dbPath := "test_logs.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	projectID := "test-project-1"
+	if err := wdb.CreateProject(ctx, projectID); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, projectID, "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	runner := NewProtocolRunner(wdb)
+	queries := autodemosql.New(db)
+
+	if err := runner.StartProtocol(ctx, historyID, loggedProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	steps, err := queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	first := steps[0]
+	row, err := queries.GetCodeStepLog(ctx, first.ID)
+	if err != nil {
+		t.Fatalf("Failed to get log: %v", err)
+	}
+	if row.FunctionName != "main" || row.Stdout != "reading plate\n" || row.Error.Valid {
+		t.Errorf("Unexpected log for main: %+v", row)
+	}
+
+	// A failing continuation is recorded as a failed step, with its error.
+	if err := uploadAndContinue(ctx, wdb, runner, first.ID, `{"script1": {"data1": "{\"ng_per_ul\": 10}"}}`); err != nil {
+		t.Fatalf("Failed to continue step: %v", err)
+	}
+	steps, err = queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	if len(steps) != 2 {
+		t.Fatalf("Expected 2 steps, got %d", len(steps))
+	}
+	failed := steps[1]
+	if failed.Status != libb.StatusFailure || !strings.Contains(failed.StepComment, "reading too low") {
+		t.Errorf("Expected a failed step, got status %d: %s", failed.Status, failed.StepComment)
+	}
+
+	// Both steps and their logs are shown on the status endpoint.
+	app := &App{DB: db, WDB: wdb, Runner: runner}
+	req := httptest.NewRequest("GET", "/status/"+projectID, nil)
+	req.SetPathValue("projectID", projectID)
+	rec := httptest.NewRecorder()
+	app.StatusHandler(rec, req)
+	var statuses []StepStatus
+	if err := json.NewDecoder(rec.Body).Decode(&statuses); err != nil {
+		t.Fatalf("Failed to decode status: %v", err)
+	}
+	if len(statuses) != 2 || statuses[0].ID != failed.ID || statuses[0].Log == nil || statuses[1].Log == nil {
+		t.Fatalf("Expected both steps with logs, got %+v", statuses)
+	}
+	failedLog := statuses[0].Log
+	if failedLog.Function != "check" || len(failedLog.Logs) != 1 || failedLog.Logs[0].Message != "got\t10" {
+		t.Errorf("Unexpected log for check: %+v", failedLog)
+	}
+	if !strings.Contains(failedLog.Error, "reading too low") || !strings.Contains(failedLog.Traceback, "in function 'require_reading'") {
+		t.Errorf("Expected error with traceback, got %q\n%s", failedLog.Error, failedLog.Traceback)
+	}
+	if mainLog := statuses[1].Log; len(mainLog.Stdout) != 1 || mainLog.Logs[0].Level != libb.LogInfo {
+		t.Errorf("Unexpected log for main: %+v", mainLog)
+	}
+
+	// And on the technician page.
+	req = httptest.NewRequest("GET", fmt.Sprintf("/backend/%d", failed.ID), nil)
+	req.SetPathValue("codestep", fmt.Sprint(failed.ID))
+	rec = httptest.NewRecorder()
+	app.CodeStepHandler(rec, req)
+	if page := rec.Body.String(); !strings.Contains(page, "Execution Log") || !strings.Contains(page, "[warn] got\t10") || !strings.Contains(page, "require_reading") {
+		t.Errorf("Expected the log on the code step page, got:\n%s", page)
+	}
+}
+
+const dataHistoryProtocol = `
+function main()
+    local script = libB.Script.new("script1")
+    script:add_commands(libB.HumanCommands.new():quantify("data1", "nest_96_wellplate_100ul_pcr_full_skirt", "7", "A1"))
+    return 2, "Quantify DNA", "dilute", script:to_json(), ""
+end
+
+function dilute()
+    local script = libB.Script.new("script2")
+    script:add_commands(libB.HumanCommands.new():quantify("data2", "nest_96_wellplate_100ul_pcr_full_skirt", "7", "A2"))
+    return 2, "Quantify diluted DNA", "compare", script:to_json(), ""
+end
+
+function compare()
+    -- Results from every earlier step are available, not just the last one.
+    local before = libB.data.get("script1", "data1")
+    local after = libB.data.get("script2", "data2")
+    return 0, string.format("%d -> %d", before.ng_per_ul, after.ng_per_ul), "", "", ""
+end
+`
+
+func TestProtocolDataHistory(t *testing.T) {
+	dbPath := "test_data_history.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	runner := NewProtocolRunner(wdb)
+	queries := autodemosql.New(db)
+
+	if err := runner.StartProtocol(ctx, historyID, dataHistoryProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	for _, upload := range []string{
+		`{"script1": {"data1": "{\"ng_per_ul\": 40}"}}`,
+		`{"script2": {"data2": "{\"ng_per_ul\": 20}"}}`,
+	} {
+		steps, err := queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+		if err != nil {
+			t.Fatalf("Failed to get steps: %v", err)
+		}
+		if err := uploadAndContinue(ctx, wdb, runner, steps[len(steps)-1].ID, upload); err != nil {
+			t.Fatalf("Failed to continue step: %v", err)
+		}
+	}
+
+	steps, err := queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	if final := steps[len(steps)-1]; final.Status != 0 || final.StepComment != "40 -> 20" {
+		t.Errorf("Expected both readings in the final step, got status %d: %s", final.Status, final.StepComment)
+	}
+}
+
+// reopenTestDatabase opens an existing test database, as a restarted server
+// would.
+func reopenTestDatabase(dbLocation string) (*sql.DB, *WriteDB) {
+	readDB, err := sql.Open("sqlite3", fmt.Sprintf("file:%s?mode=ro", dbLocation))
+	if err != nil {
+		panic(err)
+	}
+	writeDB, err := sql.Open("sqlite3", dbLocation)
+	if err != nil {
+		panic(err)
+	}
+	writeDB.SetMaxOpenConns(1)
+	return readDB, InitWriteDB(writeDB, context.Background())
+}
+
+func TestEngineRestart(t *testing.T) {
+	dbPath := "test_restart.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+
+	runner := NewProtocolRunner(wdb)
+	app := &App{DB: db, WDB: wdb, Runner: runner, Engine: NewEngine(runner, db), Dispatcher: NewDispatcher(runner, db)}
+	app.Dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = app.Dispatcher.Notify
+	app.Dispatcher.Start(ctx)
+	app.Engine.Start(ctx)
+	if err := runner.StartProtocol(ctx, historyID, dataHistoryProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	upload := func(stepID int64, data string) int {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/upload/%d", stepID), strings.NewReader(data))
+		req.SetPathValue("stepID", fmt.Sprint(stepID))
+		rec := httptest.NewRecorder()
+		app.UploadHandler(rec, req)
+		return rec.Code
+	}
+
+	// The first upload is continued by the running engine.
+	steps := waitForSteps(t, autodemosql.New(db), historyID, 1)
+	first := steps[0].ID
+	if code := upload(first, `{"script1": {"data1": "{\"ng_per_ul\": 40}"}}`); code != http.StatusOK {
+		t.Fatalf("Expected upload to succeed, got %d", code)
+	}
+	steps = waitForSteps(t, autodemosql.New(db), historyID, 2)
+	second := steps[1].ID
+
+	// Uploads are rejected unless the step is waiting for data.
+	if code := upload(first, `{"script1": {"data1": "{\"ng_per_ul\": 41}"}}`); code != http.StatusConflict {
+		t.Errorf("Expected a second upload to conflict, got %d", code)
+	}
+	if code := upload(second, `not json`); code != http.StatusBadRequest {
+		t.Errorf("Expected invalid data to be rejected, got %d", code)
+	}
+
+	// The server goes down right after the second upload is stored.
+	app.Engine.Stop()
+	app.Dispatcher.Stop()
+	if code := upload(second, `{"script2": {"data2": "{\"ng_per_ul\": 20}"}}`); code != http.StatusOK {
+		t.Fatalf("Expected upload to succeed, got %d", code)
+	}
+	steps, err = autodemosql.New(db).GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil || len(steps) != 2 {
+		t.Fatalf("Expected the protocol to be paused at 2 steps, got %d: %v", len(steps), err)
+	}
+	db.Close()
+	wdb.Close()
+
+	// After a restart, the dispatcher and engine pick up where the protocol
+	// left off.
+	db, wdb = reopenTestDatabase(dbPath)
+	defer db.Close()
+	runner = NewProtocolRunner(wdb)
+	dispatcher := NewDispatcher(runner, db)
+	dispatcher.PollInterval = time.Millisecond
+	dispatcher.Start(ctx)
+	defer dispatcher.Stop()
+	engine := NewEngine(runner, db)
+	engine.Start(ctx)
+	defer engine.Stop()
+
+	steps = waitForSteps(t, autodemosql.New(db), historyID, 3)
+	if final := steps[2]; final.Status != 0 || final.StepComment != "40 -> 20" {
+		t.Errorf("Expected protocol to finish after restart, got status %d: %s", final.Status, final.StepComment)
+	}
+}
+
+// TestEngineRetries checks that a step which fails to continue is retried
+// without another upload, and fails its protocol once it has failed too often.
+func TestEngineRetries(t *testing.T) {
+	dbPath := "test_engine_retries.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	runner := NewProtocolRunner(wdb)
+	queries := autodemosql.New(db)
+	setData := func(stepID int64, data string) {
+		t.Helper()
+		err := wdb.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+			return queries.UpdateStepData(ctx, autodemosql.UpdateStepDataParams{Data: sql.NullString{String: data, Valid: true}, ID: stepID})
+		})
+		if err != nil {
+			t.Fatalf("Failed to set data: %v", err)
+		}
+	}
+	// Both protocols have data stored which can't be read.
+	var historyIDs, stepIDs []int64
+	for i := 0; i < 2; i++ {
+		historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+		if err != nil {
+			t.Fatalf("Failed to create message history: %v", err)
+		}
+		if err := runner.StartProtocol(ctx, historyID, testProtocol); err != nil {
+			t.Fatalf("Failed to start protocol: %v", err)
+		}
+		steps := waitForSteps(t, queries, historyID, 1)
+		setData(steps[0].ID, `{"script1": {"data1": 30}}`)
+		historyIDs, stepIDs = append(historyIDs, historyID), append(stepIDs, steps[0].ID)
+	}
+
+	engine := NewEngine(runner, db)
+	engine.Backoff = 20 * time.Millisecond
+	engine.MaxAttempts = 4
+	engine.Start(ctx)
+	defer engine.Stop()
+
+	// The first is fixed after it has failed, and is continued by a retry.
+	time.Sleep(10 * time.Millisecond)
+	setData(stepIDs[0], `{"script1": {"data1": "{\"ng_per_ul\": 30}"}}`)
+	steps := waitForSteps(t, queries, historyIDs[0], 2)
+	if steps[1].Status != 0 || steps[1].StepComment != "High DNA concentration" {
+		t.Errorf("Expected the retried step to continue, got status %d: %s", steps[1].Status, steps[1].StepComment)
+	}
+
+	// The second never can be, so its protocol is failed.
+	steps = waitForSteps(t, queries, historyIDs[1], 2)
+	if steps[1].Status != 1 || !strings.HasPrefix(steps[1].StepComment, "Failed to continue: ") {
+		t.Errorf("Expected the protocol to fail, got status %d: %s", steps[1].Status, steps[1].StepComment)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if steps := waitForSteps(t, queries, historyIDs[1], 2); len(steps) != 2 {
+		t.Errorf("Expected the protocol to be failed once, got %d steps", len(steps))
+	}
+}
+
+// slowProtocol takes a while to continue.
+const slowProtocol = `
+function main()
+    return 2, "Waiting", "spin", '{"id":"script1","commands":[]}', ""
+end
+
+function spin()
+    for i = 1, 1e7 do end
+    return 0, "Done spinning", "", "", ""
+end
+`
+
+// TestEngineWorkers checks that a slow step doesn't hold up other protocols.
+func TestEngineWorkers(t *testing.T) {
+	dbPath := "test_engine_workers.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	runner := NewProtocolRunner(wdb)
+	queries := autodemosql.New(db)
+	var historyIDs []int64
+	for _, code := range []string{slowProtocol, testProtocol} {
+		historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+		if err != nil {
+			t.Fatalf("Failed to create message history: %v", err)
+		}
+		if err := runner.StartProtocol(ctx, historyID, code); err != nil {
+			t.Fatalf("Failed to start protocol: %v", err)
+		}
+		steps := waitForSteps(t, queries, historyID, 1)
+		if err := wdb.CreateData(ctx, steps[0].ID, `{"script1": {"data1": "{\"ng_per_ul\": 30}"}}`); err != nil {
+			t.Fatalf("Failed to upload data: %v", err)
+		}
+		historyIDs = append(historyIDs, historyID)
+	}
+
+	engine := NewEngine(runner, db)
+	engine.Workers = 2
+	engine.Start(ctx)
+	defer engine.Stop()
+
+	waitForSteps(t, queries, historyIDs[1], 2)
+	if steps := waitForSteps(t, queries, historyIDs[0], 1); len(steps) != 1 {
+		t.Errorf("Expected the fast protocol to finish before the slow one")
+	}
+	if steps := waitForSteps(t, queries, historyIDs[0], 2); steps[1].StepComment != "Done spinning" {
+		t.Errorf("Expected the slow protocol to finish, got %s", steps[1].StepComment)
+	}
+}
+
+// uploadAndContinue stores data for a step and continues the protocol from
+// it, as an upload and the engine would.
+func uploadAndContinue(ctx context.Context, wdb *WriteDB, runner *ProtocolRunner, stepID int64, data string) error {
+	if err := wdb.CreateData(ctx, stepID, data); err != nil {
+		return err
+	}
+	return runner.ContinueStep(ctx, stepID)
+}
+
+// TestStepTransitionAtomicity checks that a data upload or step transition
+// which fails part way through leaves the protocol exactly where it was.
+func TestStepTransitionAtomicity(t *testing.T) {
+	dbPath := "test_atomicity.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	runner := NewProtocolRunner(wdb)
+	queries := autodemosql.New(db)
+	registerWebhook(t, &App{DB: db, WDB: wdb}, "test-project-1", `{"url": "http://localhost/hook", "secret": "shh"}`)
+
+	if err := runner.StartProtocol(ctx, historyID, testProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	steps, err := queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	step := steps[0]
+	rows := func() map[string]int {
+		counts := make(map[string]int)
+		for _, table := range []string{"code_step", "code_step_log", "work_item", "webhook_delivery"} {
+			var count int
+			if err := db.QueryRow("SELECT COUNT(*) FROM " + table).Scan(&count); err != nil {
+				t.Fatalf("Failed to count %s: %v", table, err)
+			}
+			counts[table] = count
+		}
+		return counts
+	}
+
+	// The data is written before it fails to parse, so the write must be
+	// rolled back along with everything else.
+	if err := wdb.CreateData(ctx, step.ID, "not json"); err == nil {
+		t.Fatal("Expected uploading invalid data to fail")
+	}
+	data, err := queries.GetDataForStep(ctx, step.ID)
+	if err != nil {
+		t.Fatalf("Failed to get data: %v", err)
+	}
+	if data.Valid {
+		t.Errorf("Expected data to be rolled back, got %q", data.String)
+	}
+	steps, err = queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	if len(steps) != 1 {
+		t.Fatalf("Expected no new step, got %d steps", len(steps))
+	}
+
+	// The transition itself fails inside the commit transaction: the script
+	// passes the executor check at prepare, and the new step and its log are
+	// inserted before queueing its webhook deliveries fails.
+	if err := wdb.CreateData(ctx, step.ID, `{"script1": {"data1": "{\"ng_per_ul\": 30}"}}`); err != nil {
+		t.Fatalf("Failed to upload data: %v", err)
+	}
+	before := rows()
+	if _, err := wdb.DB.Exec("CREATE TRIGGER fail_delivery BEFORE INSERT ON webhook_delivery BEGIN SELECT RAISE(ABORT, 'no delivery'); END"); err != nil {
+		t.Fatalf("Failed to create trigger: %v", err)
+	}
+	if err := runner.ContinueStep(ctx, step.ID); err == nil || !strings.Contains(err.Error(), "no delivery") {
+		t.Fatalf("Expected the transition to fail to commit, got %v", err)
+	}
+	if after := rows(); !maps.Equal(after, before) {
+		t.Errorf("Expected a failed transition to leave no new rows, got %v rather than %v", after, before)
+	}
+	if _, err := wdb.DB.Exec("DROP TRIGGER fail_delivery"); err != nil {
+		t.Fatalf("Failed to drop trigger: %v", err)
+	}
+
+	// The step can still be continued once the fault is gone.
+	if err := runner.ContinueStep(ctx, step.ID); err != nil {
+		t.Fatalf("Failed to continue step: %v", err)
+	}
+	steps, err = queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	if len(steps) != 2 || steps[1].Status != 0 {
+		t.Fatalf("Expected the protocol to finish, got %+v", steps)
+	}
+	if _, err := queries.GetCodeStepLog(ctx, steps[1].ID); err != nil {
+		t.Errorf("Expected the new step's log to be committed with it: %v", err)
+	}
+	if after := rows(); after["webhook_delivery"] <= before["webhook_delivery"] {
+		t.Errorf("Expected the new step's deliveries to be committed with it, got %v", after)
+	}
+}
+
+func TestConcurrentContinue(t *testing.T) {
+	dbPath := "test_concurrent.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	runner := NewProtocolRunner(wdb)
+	queries := autodemosql.New(db)
+
+	if err := runner.StartProtocol(ctx, historyID, testProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	steps := waitForSteps(t, queries, historyID, 1)
+	if err := wdb.CreateData(ctx, steps[0].ID, `{"script1": {"data1": "{\"ng_per_ul\": 30}"}}`); err != nil {
+		t.Fatalf("Failed to upload data: %v", err)
+	}
+
+	// Two continuations of the same step both read it before either commits.
+	var executions []*stepExecution
+	for range 2 {
+		err := wdb.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+			execution, err := prepareStep(queries, ctx, steps[0].ID)
+			executions = append(executions, execution)
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Failed to prepare step: %v", err)
+		}
+	}
+	if err := runner.execute(ctx, executions[0]); err != nil {
+		t.Fatalf("Failed to execute step: %v", err)
+	}
+	if err := runner.execute(ctx, executions[1]); !errors.Is(err, ErrStepAdvanced) {
+		t.Errorf("Expected the second continuation to lose, got %v", err)
+	}
+	steps, err = queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	if len(steps) != 2 {
+		t.Errorf("Expected exactly one new step, got %d steps", len(steps))
+	}
+}
+
+func TestLongStepDoesNotBlockWrites(t *testing.T) {
+	dbPath := "test_long_step.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	runner := NewProtocolRunner(wdb)
+
+	done := make(chan error, 1)
+	go func() {
+		done <- runner.StartProtocol(ctx, historyID, `
+function main()
+	while true do end
+end
+`)
+	}()
+
+	// Other writes go on while main is spinning.
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err := wdb.CreateProject(ctx, "test-project-2"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Write took %v while Lua was running", elapsed)
+	}
+	select {
+	case err := <-done:
+		t.Fatalf("Expected main to still be running, it returned %v", err)
+	default:
+	}
+
+	// Interrupting main records nothing.
+	cancel()
+	if err := <-done; err == nil || !strings.Contains(err.Error(), "interrupted") {
+		t.Errorf("Expected main to be interrupted, got %v", err)
+	}
+	steps, err := autodemosql.New(db).GetAllStepsForCodeFromProjectHistoryID(context.Background(), historyID)
+	if err != nil {
+		t.Fatalf("Failed to get steps: %v", err)
+	}
+	if len(steps) != 0 {
+		t.Errorf("Expected no steps, got %+v", steps)
+	}
+}
+
+const plateProtocol = `
+function main()
+	local script = libB.Script.new("plate")
+	local human_commands = libB.HumanCommands.new()
+	for _, address in ipairs({"A1", "A2", "A3"}) do
+		human_commands:quantify("dna_" .. address, "nest_96_wellplate_100ul_pcr_full_skirt", "7", address)
+	end
+	script:add_commands(human_commands)
+	return libB.status.CONTINUE, "Quantify the plate", "total", script:to_json(), ""
+end
+
+function total()
+	local sum = 0
+	for _, address in ipairs({"A1", "A2", "A3"}) do
+		sum = sum + libB.data.get("plate", "dna_" .. address).ng_per_ul
+	end
+	return libB.status.SUCCESS, "total " .. sum, "", "", ""
+end
+`
+
+func TestPartialUploads(t *testing.T) {
+	dbPath := "test_partial.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+
+	runner := NewProtocolRunner(wdb)
+	queries := autodemosql.New(db)
+	app := &App{DB: db, WDB: wdb, Runner: runner, Engine: NewEngine(runner, db), Dispatcher: NewDispatcher(runner, db)}
+	app.Dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = app.Dispatcher.Notify
+	app.Dispatcher.Start(ctx)
+	defer app.Dispatcher.Stop()
+	app.Engine.Start(ctx)
+	defer app.Engine.Stop()
+	if err := runner.StartProtocol(ctx, historyID, plateProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	step := waitForSteps(t, queries, historyID, 1)[0]
+
+	var lastBody []byte
+	upload := func(returnKey string, result string) int {
+		req := httptest.NewRequest("POST", fmt.Sprintf("/upload/%d/%s", step.ID, returnKey), strings.NewReader(result))
+		req.SetPathValue("stepID", fmt.Sprint(step.ID))
+		req.SetPathValue("returnKey", returnKey)
+		rec := httptest.NewRecorder()
+		app.UploadResultHandler(rec, req)
+		lastBody = rec.Body.Bytes()
+		return rec.Code
+	}
+	outstanding := func() map[string][]string {
+		req := httptest.NewRequest("GET", "/status/test-project-1", nil)
+		req.SetPathValue("projectID", "test-project-1")
+		rec := httptest.NewRecorder()
+		app.StatusHandler(rec, req)
+		var statuses []StepStatus
+		if err := json.Unmarshal(rec.Body.Bytes(), &statuses); err != nil {
+			t.Fatalf("Failed to parse status: %v", err)
+		}
+		return statuses[len(statuses)-1].Outstanding
+	}
+
+	if got := outstanding(); !reflect.DeepEqual(got, map[string][]string{"plate": {"dna_A1", "dna_A2", "dna_A3"}}) {
+		t.Errorf("Expected every key to be outstanding, got %v", got)
+	}
+	if code := upload("dna_A1", `{"ng_per_ul": 10}`); code != http.StatusOK {
+		t.Fatalf("Expected upload to succeed, got %d", code)
+	}
+	if code := upload("dna_A3", `{"ng_per_ul": 30}`); code != http.StatusOK {
+		t.Fatalf("Expected upload to succeed, got %d", code)
+	}
+
+	// Uploads are rejected for unknown keys, keys which already have a result
+	// and results which aren't JSON.
+	if code := upload("dna_B1", `{"ng_per_ul": 10}`); code != http.StatusBadRequest {
+		t.Errorf("Expected an unknown key to be rejected, got %d", code)
+	}
+	if code := upload("dna_A1", `{"ng_per_ul": 11}`); code != http.StatusConflict {
+		t.Errorf("Expected a second result for a key to conflict, got %d", code)
+	}
+	if code := upload("dna_A2", `not json`); code != http.StatusBadRequest {
+		t.Errorf("Expected invalid data to be rejected, got %d", code)
+	}
+
+	// Results which don't match their command's result schema are rejected
+	// field by field, whichever endpoint they are uploaded to.
+	if code := upload("dna_A2", `{"ng_per_ul": "high"}`); code != http.StatusBadRequest {
+		t.Errorf("Expected a malformed result to be rejected, got %d", code)
+	}
+	var uploadErrors UploadErrors
+	if err := json.Unmarshal(lastBody, &uploadErrors); err != nil {
+		t.Fatalf("Failed to parse upload errors: %v", err)
+	}
+	if len(uploadErrors.Errors) != 1 || uploadErrors.Errors[0].ReturnKey != "dna_A2" || uploadErrors.Errors[0].Field != "ng_per_ul" {
+		t.Errorf("Expected an error for ng_per_ul of dna_A2, got %+v", uploadErrors.Errors)
+	}
+	req := httptest.NewRequest("POST", fmt.Sprintf("/upload/%d", step.ID), strings.NewReader(`{"plate": {"dna_A2": "{\"ng_per_ml\": 20}"}}`))
+	req.SetPathValue("stepID", fmt.Sprint(step.ID))
+	rec := httptest.NewRecorder()
+	app.UploadHandler(rec, req)
+	if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), `"return_key":"dna_A2"`) {
+		t.Errorf("Expected a malformed upload to be rejected, got %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The protocol waits for the last key.
+	if got := outstanding(); !reflect.DeepEqual(got, map[string][]string{"plate": {"dna_A2"}}) {
+		t.Errorf("Expected dna_A2 to be outstanding, got %v", got)
+	}
+	req = httptest.NewRequest("GET", fmt.Sprintf("/backend/%d", step.ID), nil)
+	req.SetPathValue("codestep", fmt.Sprint(step.ID))
+	rec = httptest.NewRecorder()
+	app.CodeStepHandler(rec, req)
+	page := rec.Body.String()
+	if !strings.Contains(page, `data-return-key="dna_A2"`) || strings.Contains(page, `data-return-key="dna_A1"`) {
+		t.Errorf("Expected an upload form for dna_A2 only, got:\n%s", page)
+	}
+	if !strings.Contains(page, `<input type="number" step="any" name="ng_per_ul" data-type="number" required>`) {
+		t.Errorf("Expected an input for ng_per_ul, got:\n%s", page)
+	}
+	app.Engine.Notify()
+	if err := runner.ContinueStep(ctx, step.ID); !errors.Is(err, ErrStepIncomplete) {
+		t.Errorf("Expected continuing an incomplete step to fail, got %v", err)
+	}
+	steps, err := queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil || len(steps) != 1 {
+		t.Fatalf("Expected the protocol to wait at 1 step, got %d: %v", len(steps), err)
+	}
+
+	if code := upload("dna_A2", `{"ng_per_ul": 20}`); code != http.StatusOK {
+		t.Fatalf("Expected upload to succeed, got %d", code)
+	}
+	steps = waitForSteps(t, queries, historyID, 2)
+	if final := steps[1]; final.Status != 0 || final.StepComment != "total 60" {
+		t.Errorf("Expected protocol to finish, got status %d: %s", final.Status, final.StepComment)
+	}
+	if code := upload("dna_A2", `{"ng_per_ul": 20}`); code != http.StatusConflict {
+		t.Errorf("Expected uploads after the step advanced to conflict, got %d", code)
+	}
+}
+
+func TestInvalidScriptFailsStep(t *testing.T) {
+	dbPath := "test_invalid_script.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+
+	// The quantify command is missing its location.
+	err = NewProtocolRunner(wdb).StartProtocol(ctx, historyID, `
+function main()
+	local script = '{"id":"s","commands":[{"command_type":"human","payload":[{"type":"quantify","payload":{"return_key":"k"}}]}]}'
+	return libB.status.CONTINUE, "Quantify", "next", script, ""
+end
+`)
+	if err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	steps, err := autodemosql.New(db).GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+	if err != nil || len(steps) != 1 {
+		t.Fatalf("Expected 1 step, got %d: %v", len(steps), err)
+	}
+	if steps[0].Status != 1 || !strings.Contains(steps[0].StepComment, "script s does not match the script schema") || !strings.Contains(steps[0].StepComment, "labware is required") {
+		t.Errorf("Expected a failed step explaining the violation, got status %d: %s", steps[0].Status, steps[0].StepComment)
+	}
+}
+
+func TestUnsafeScriptFailsStep(t *testing.T) {
+	dbPath := "test_unsafe_script.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	queries := autodemosql.New(db)
+	start := func(commands string) autodemosql.CodeStep {
+		t.Helper()
+		historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+		if err != nil {
+			t.Fatalf("Failed to create message history: %v", err)
+		}
+		err = NewProtocolRunner(wdb).StartProtocol(ctx, historyID, `
+function main()
+	local p = { pipette = "p20_single_gen2", side = "right" }
+	local plate = libB.Labware.new("nest_96_wellplate_100ul_pcr_full_skirt", "7", "thermocycler")
+	local c = libB.OpentronsCommands.new()
+	`+commands+`
+	return libB.status.CONTINUE_NO_DATA, "Fill the plate", "next", libB.Script.new("s"):add_commands(c):to_json(), ""
+end
+`)
+		if err != nil {
+			t.Fatalf("Failed to start protocol: %v", err)
+		}
+		steps, err := queries.GetAllStepsForCodeFromProjectHistoryID(ctx, historyID)
+		if err != nil || len(steps) != 1 {
+			t.Fatalf("Expected 1 step, got %d: %v", len(steps), err)
+		}
+		return steps[0]
+	}
+
+	// Dispensing through a closed lid fails the step.
+	step := start(`c:tc_close_lid():dispense(p, 10, plate:well("A1"))`)
+	if step.Status != 1 || !strings.HasPrefix(step.StepComment, "Unsafe script: ") || !strings.Contains(step.StepComment, "(dispense): the thermocycler lid is closed") {
+		t.Errorf("Expected a failed step explaining the problem, got status %d: %s", step.Status, step.StepComment)
+	}
+
+	// Warnings only go to the log.
+	step = start(`c:pick_up_tip(p, libB.Labware.new("opentrons_96_tiprack_20ul", "1"):well("A1")):aspirate(p, 10, plate:well("A1")):drop_tip(p)`)
+	if step.Status != 3 {
+		t.Errorf("Expected the step to continue, got status %d: %s", step.Status, step.StepComment)
+	}
+	row, err := queries.GetCodeStepLog(ctx, step.ID)
+	if err != nil {
+		t.Fatalf("Failed to get log: %v", err)
+	}
+	var logs []libb.LogEntry
+	if err := json.Unmarshal([]byte(row.Logs), &logs); err != nil {
+		t.Fatalf("Failed to parse logs: %v", err)
+	}
+	if len(logs) != 2 || logs[0].Level != libb.LogWarn || !strings.Contains(logs[0].Message, "lid may be closed") || !strings.Contains(logs[1].Message, "still holding 10 uL") {
+		t.Errorf("Expected deck warnings in the log, got %+v", logs)
+	}
+}
@@ -0,0 +1,317 @@
+package autodemo
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+/******************************************************************************
+
+Script submission
+
+Not everyone wants a protocol written for them in Lua: some clients just want
+to run scripts they have built themselves on the lab. POST /scripts takes a
+script, or a sequence of them, as JSON, and runs them one after another just
+as if a Lua protocol had returned each in turn, with no LLM or Lua involved.
+
+A submission is stored as code with language json, whose code is the array of
+scripts. Its first step holds the first script, and each step after holds the
+next, until a final step with status 0. A script with human commands waits
+for their results (status 2), and any other continues once it has been run
+(status 3), so executors, uploads, the work queue and webhooks all work the
+same as for Lua protocols.
+
+******************************************************************************/
+
+// Code languages, as stored in code.language.
+const (
+	LanguageLua  = "lua"
+	LanguageJSON = "json"
+)
+
+// ScriptFunction is the next function of the steps of submitted scripts. The
+// step's data passthrough is the index of the script to run next.
+const ScriptFunction = "next_script"
+
+// runScripts runs the next of the scripts in code, a JSON array, as given by
+// input's passthrough.
+func runScripts(code string, input libb.StepInput) (*libb.ProtocolState, *libb.Capture) {
+	capture := &libb.Capture{}
+	var scripts []libb.Script
+	if err := json.Unmarshal([]byte(code), &scripts); err != nil {
+		capture.Err = fmt.Errorf("failed to parse scripts: %v", err)
+		return &libb.ProtocolState{}, capture
+	}
+	var next int
+	if input.Passthrough != "" {
+		var err error
+		next, err = strconv.Atoi(input.Passthrough)
+		if err != nil {
+			capture.Err = fmt.Errorf("invalid script index %q: %v", input.Passthrough, err)
+			return &libb.ProtocolState{}, capture
+		}
+	}
+	return scriptState(scripts, next), capture
+}
+
+// scriptState returns the step which runs scripts[next], or finishes the
+// protocol once every script has run.
+func scriptState(scripts []libb.Script, next int) *libb.ProtocolState {
+	if next >= len(scripts) {
+		return &libb.ProtocolState{
+			Status:   libb.StatusSuccess,
+			Comments: fmt.Sprintf("Ran %d of %d scripts", len(scripts), len(scripts)),
+		}
+	}
+	script := scripts[next]
+	status := libb.StatusContinueNoData
+	if len(script.GetReturnKeys()[script.ID]) > 0 {
+		status = libb.StatusContinue
+	}
+	return &libb.ProtocolState{
+		Status:          status,
+		Comments:        fmt.Sprintf("Script %d of %d: %s", next+1, len(scripts), script.ID),
+		NextFunc:        ScriptFunction,
+		Script:          &script,
+		DataPassthrough: strconv.Itoa(next + 1),
+	}
+}
+
+// StartScripts begins running submitted scripts, one after another, in the
+// project with projectID, which is created first if create is set. It returns
+// the IDs of their code and its first step. Nothing is recorded unless all of
+// it is, so a failed submission leaves no project or message behind.
+func (r *ProtocolRunner) StartScripts(ctx context.Context, projectID string, create bool, scripts []libb.Script) (int64, int64, error) {
+	code, err := json.Marshal(scripts)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to marshal scripts: %v", err)
+	}
+	state, capture := runScripts(string(code), libb.StepInput{Function: "main"})
+	ids := make([]string, len(scripts))
+	for i, script := range scripts {
+		ids[i] = script.ID
+	}
+
+	var codeID, stepID int64
+	err = r.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		if create {
+			if err := queries.CreateProject(ctx, projectID); err != nil {
+				return fmt.Errorf("failed to create project: %v", err)
+			}
+		}
+		history, err := queries.AddMessageHistory(ctx, autodemosql.AddMessageHistoryParams{
+			ProjectID: projectID,
+			Content:   "Submitted scripts: " + strings.Join(ids, ", "),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add message history: %v", err)
+		}
+		codeID, err = queries.CreateCode(ctx, autodemosql.CreateCodeParams{
+			ProjectMessageHistoryID: history.ID,
+			Code:                    string(code),
+			Language:                LanguageJSON,
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create code entry: %v", err)
+		}
+		stepID, err = recordStep(queries, ctx, r.Executors, codeID, "main", 0, state, capture)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	r.stepRecorded()
+	return codeID, stepID, nil
+}
+
+/******************************************************************************
+
+Script submission endpoints
+
+******************************************************************************/
+
+// ScriptError is a problem with one of the scripts of a submission.
+type ScriptError struct {
+	Index    int    `json:"index"` // the script's index in the submission
+	ScriptID string `json:"script_id,omitempty"`
+	Message  string `json:"message"`
+}
+
+// ScriptErrors is the body of a submission rejected for invalid scripts.
+type ScriptErrors struct {
+	Errors []ScriptError `json:"errors"`
+}
+
+// ScriptSubmission is where a submission has got to.
+type ScriptSubmission struct {
+	ProjectID   string              `json:"project_id"`
+	CodeID      int64               `json:"code_id"`
+	StepID      int64               `json:"step_id"` // the latest step
+	Status      int64               `json:"status"`  // the latest step's status
+	Comment     string              `json:"comment"`
+	Outstanding map[string][]string `json:"outstanding,omitempty"` // script ID -> return keys waiting for results
+	StatusURL   string              `json:"status_url"`
+	UploadURL   string              `json:"upload_url,omitempty"` // while results are outstanding
+}
+
+// parseScripts decodes a submission, a script or an array of scripts, and
+// checks that every script is valid, safe and executable.
+func parseScripts(body []byte, executors Executors) ([]libb.Script, []ScriptError) {
+	var raws []json.RawMessage
+	if trimmed := bytes.TrimSpace(body); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &raws); err != nil {
+			return nil, []ScriptError{{Message: fmt.Sprintf("invalid JSON: %v", err)}}
+		}
+		if len(raws) == 0 {
+			return nil, []ScriptError{{Message: "no scripts submitted"}}
+		}
+	} else {
+		raws = []json.RawMessage{body}
+	}
+
+	var errs []ScriptError
+	scripts := make([]libb.Script, len(raws))
+	seen := make(map[string]bool)
+	for i, raw := range raws {
+		script, err := libb.ParseScript(raw)
+		if err != nil {
+			errs = append(errs, ScriptError{Index: i, Message: err.Error()})
+			continue
+		}
+		scripts[i] = *script
+		fail := func(err error) {
+			errs = append(errs, ScriptError{Index: i, ScriptID: script.ID, Message: err.Error()})
+		}
+		if seen[script.ID] {
+			fail(fmt.Errorf("duplicate script id %q", script.ID))
+		}
+		seen[script.ID] = true
+		if err := executors.Check(script); err != nil {
+			fail(err)
+		}
+		if err := libb.DeckErrors(libb.ValidateDeck(script)); err != nil {
+			fail(err)
+		}
+	}
+	return scripts, errs
+}
+
+// SubmitScriptsHandler runs the scripts in the request body, a script or an
+// array of scripts, one after another. They are added to the project given by
+// ?project_id=, or to a new project. It responds with the submission, whose
+// status can be polled at its status_url.
+func (app *App) SubmitScriptsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Only POST allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	buf := new(bytes.Buffer)
+	_, _ = buf.ReadFrom(r.Body)
+	scripts, errs := parseScripts(buf.Bytes(), app.Runner.Executors)
+	if len(errs) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(ScriptErrors{Errors: errs})
+		return
+	}
+
+	projectID := r.URL.Query().Get("project_id")
+	create := projectID == ""
+	if create {
+		projectID = uuid.New().String()
+	} else if _, err := autodemosql.New(app.DB).GetProjectByID(r.Context(), projectID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	codeID, _, err := app.Runner.StartScripts(r.Context(), projectID, create, scripts)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	submission, err := app.scriptSubmission(r.Context(), codeID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(submission)
+}
+
+// ScriptSubmissionHandler reports where a submission has got to.
+func (app *App) ScriptSubmissionHandler(w http.ResponseWriter, r *http.Request) {
+	codeID, err := strconv.ParseInt(r.PathValue("codeID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid code ID", http.StatusBadRequest)
+		return
+	}
+	submission, err := app.scriptSubmission(r.Context(), codeID)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Submission not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(submission)
+}
+
+// scriptSubmission reads where the code with codeID has got to. It returns
+// sql.ErrNoRows if there is no such code, or it is not a submission.
+func (app *App) scriptSubmission(ctx context.Context, codeID int64) (ScriptSubmission, error) {
+	queries := autodemosql.New(app.DB)
+	code, err := queries.GetCode(ctx, codeID)
+	if err != nil {
+		return ScriptSubmission{}, err
+	}
+	if code.Language != LanguageJSON {
+		return ScriptSubmission{}, sql.ErrNoRows
+	}
+	history, err := queries.GetMessageHistoryByID(ctx, code.ProjectMessageHistoryID)
+	if err != nil {
+		return ScriptSubmission{}, fmt.Errorf("failed to get message history: %v", err)
+	}
+	steps, err := queries.GetStepsForCode(ctx, codeID)
+	if err != nil {
+		return ScriptSubmission{}, fmt.Errorf("failed to get steps for code: %v", err)
+	}
+	if len(steps) == 0 {
+		return ScriptSubmission{}, fmt.Errorf("code %d has no steps", codeID)
+	}
+	step := steps[len(steps)-1]
+	outstanding, err := outstandingKeys(step)
+	if err != nil {
+		return ScriptSubmission{}, err
+	}
+	submission := ScriptSubmission{
+		ProjectID:   history.ProjectID,
+		CodeID:      codeID,
+		StepID:      step.ID,
+		Status:      step.Status,
+		Comment:     step.StepComment,
+		Outstanding: outstanding,
+		StatusURL:   fmt.Sprintf("/scripts/%d", codeID),
+	}
+	if len(outstanding) > 0 {
+		submission.UploadURL = fmt.Sprintf("/upload/%d", step.ID)
+	}
+	return submission, nil
+}
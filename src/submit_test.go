@@ -0,0 +1,185 @@
+package autodemo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+// pcrScript homes the robot, and quantScript has the DNA quantified.
+const (
+	pcrScript   = `{"id": "pcr", "commands": [{"command_type": "opentrons", "payload": [{"type": "home"}]}]}`
+	quantScript = `{"id": "quant", "commands": [{"command_type": "human", "payload": [{"type": "quantify", "payload": {"return_key": "dna", "labware": "nest_96_wellplate_100ul_pcr_full_skirt", "deck_slot": "7", "address": "A1"}}]}]}`
+)
+
+func TestSubmitScripts(t *testing.T) {
+	dbPath := "test_submit.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	runner := NewProtocolRunner(wdb)
+	app := &App{DB: db, WDB: wdb, Runner: runner, Engine: NewEngine(runner, db), Dispatcher: NewDispatcher(runner, db)}
+	app.Dispatcher.PollInterval = time.Millisecond
+	runner.OnStep = app.Dispatcher.Notify
+	app.Dispatcher.Start(ctx)
+	defer app.Dispatcher.Stop()
+	app.Engine.Start(ctx)
+	defer app.Engine.Stop()
+
+	var lastBody string
+	submit := func(query, body string) int {
+		req := httptest.NewRequest("POST", "/scripts"+query, strings.NewReader(body))
+		rec := httptest.NewRecorder()
+		app.SubmitScriptsHandler(rec, req)
+		lastBody = rec.Body.String()
+		return rec.Code
+	}
+	get := func(codeID int64) (ScriptSubmission, int) {
+		req := httptest.NewRequest("GET", fmt.Sprintf("/scripts/%d", codeID), nil)
+		req.SetPathValue("codeID", fmt.Sprint(codeID))
+		rec := httptest.NewRecorder()
+		app.ScriptSubmissionHandler(rec, req)
+		var submission ScriptSubmission
+		if rec.Code == http.StatusOK {
+			if err := json.Unmarshal(rec.Body.Bytes(), &submission); err != nil {
+				t.Fatalf("Failed to parse submission: %v", err)
+			}
+		}
+		return submission, rec.Code
+	}
+	waitForStatus := func(codeID int64, status int64) ScriptSubmission {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			submission, _ := get(codeID)
+			if submission.Status == status {
+				return submission
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for status %d, got %+v", status, submission)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+
+	// A sequence of scripts runs one after another in a new project.
+	if code := submit("", "["+pcrScript+", "+quantScript+"]"); code != http.StatusCreated {
+		t.Fatalf("Expected the scripts to be submitted, got %d: %s", code, lastBody)
+	}
+	var submission ScriptSubmission
+	if err := json.Unmarshal([]byte(lastBody), &submission); err != nil {
+		t.Fatalf("Failed to parse submission: %v", err)
+	}
+	if submission.ProjectID == "" || submission.Status != libb.StatusContinueNoData || submission.Comment != "Script 1 of 2: pcr" || submission.StatusURL != fmt.Sprintf("/scripts/%d", submission.CodeID) {
+		t.Errorf("Expected the first script to run, got %+v", submission)
+	}
+
+	// The opentrons script is simulated, then the human script waits for its
+	// result.
+	submission = waitForStatus(submission.CodeID, libb.StatusContinue)
+	if !reflect.DeepEqual(submission.Outstanding, map[string][]string{"quant": {"dna"}}) || submission.UploadURL != fmt.Sprintf("/upload/%d", submission.StepID) {
+		t.Errorf("Expected the second script to wait for its result, got %+v", submission)
+	}
+	if err := wdb.MergeData(ctx, submission.StepID, "dna", `{"ng_per_ul": 30}`); err != nil {
+		t.Fatalf("Failed to upload result: %v", err)
+	}
+	app.Engine.Notify()
+	submission = waitForStatus(submission.CodeID, libb.StatusSuccess)
+	if submission.Comment != "Ran 2 of 2 scripts" || submission.UploadURL != "" {
+		t.Errorf("Expected the submission to finish, got %+v", submission)
+	}
+
+	// Steps of submitted scripts replay like any other.
+	state, err := runner.ReplayStep(ctx, submission.StepID)
+	if err != nil {
+		t.Fatalf("Failed to replay step: %v", err)
+	}
+	if state.Status != libb.StatusSuccess || state.Comments != submission.Comment {
+		t.Errorf("Expected the replay to match the step, got %+v", state)
+	}
+
+	// A single script can be added to an existing project.
+	if code := submit("?project_id="+submission.ProjectID, pcrScript); code != http.StatusCreated || !strings.Contains(lastBody, submission.ProjectID) {
+		t.Errorf("Expected the script to be added to the project, got %d: %s", code, lastBody)
+	}
+
+	// Invalid submissions are rejected, script by script, without creating a
+	// project.
+	projects := func() int {
+		t.Helper()
+		var count int
+		if err := db.QueryRow("SELECT COUNT(*) FROM project").Scan(&count); err != nil {
+			t.Fatalf("Failed to count projects: %v", err)
+		}
+		return count
+	}
+	before := projects()
+	for _, test := range []struct {
+		body string
+		want string
+	}{
+		{`not json`, "failed to parse script JSON"},
+		{`[]`, "no scripts submitted"},
+		{`[` + pcrScript + `, {"id": "empty"}]`, `"index":1,"message":"script empty does not match the script schema`},
+		{`[` + pcrScript + `, ` + pcrScript + `]`, `duplicate script id \"pcr\"`},
+	} {
+		if code := submit("", test.body); code != http.StatusBadRequest || !strings.Contains(lastBody, test.want) {
+			t.Errorf("Expected %s to be rejected with %s, got %d: %s", test.body, test.want, code, lastBody)
+		}
+	}
+	if count := projects(); count != before {
+		t.Errorf("Expected rejected submissions to leave no project, got %d projects rather than %d", count, before)
+	}
+	// A submission which fails to be recorded leaves nothing behind either.
+	if _, err := wdb.DB.Exec("CREATE TRIGGER fail_code BEFORE INSERT ON code BEGIN SELECT RAISE(ABORT, 'no code'); END"); err != nil {
+		t.Fatalf("Failed to create trigger: %v", err)
+	}
+	if code := submit("", "["+pcrScript+", "+quantScript+"]"); code != http.StatusInternalServerError || !strings.Contains(lastBody, "no code") {
+		t.Errorf("Expected the submission to fail to be recorded, got %d: %s", code, lastBody)
+	}
+	if count := projects(); count != before {
+		t.Errorf("Expected a failed submission to leave no project, got %d projects rather than %d", count, before)
+	}
+	if _, err := wdb.DB.Exec("DROP TRIGGER fail_code"); err != nil {
+		t.Fatalf("Failed to drop trigger: %v", err)
+	}
+	if _, errs := parseScripts([]byte(quantScript), Executors{"opentrons": SimulatorExecutor{}}); len(errs) != 1 || errs[0].Message != `no executor for command_type "human"` {
+		t.Errorf("Expected a script nothing can execute to be rejected, got %+v", errs)
+	}
+	if code := submit("?project_id=test-project-2", pcrScript); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown project not to be found, got %d", code)
+	}
+
+	// Only submissions can be polled.
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	if err := runner.StartProtocol(ctx, historyID, `function main() return libB.status.SUCCESS, "Done", "", nil, "" end`); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	steps := waitForSteps(t, autodemosql.New(db), historyID, 1)
+	if _, code := get(steps[0].Code); code != http.StatusNotFound {
+		t.Errorf("Expected a Lua protocol not to be found, got %d", code)
+	}
+	if _, code := get(1000); code != http.StatusNotFound {
+		t.Errorf("Expected an unknown submission not to be found, got %d", code)
+	}
+}
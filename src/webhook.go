@@ -0,0 +1,578 @@
+package autodemo
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+	libb "github.com/koeng101/autodemo/src/libB"
+)
+
+/******************************************************************************
+
+Webhooks
+
+Projects can register webhooks to follow their protocols from outside, such as
+to run their own execution environment on just the scripting layer. Each
+webhook is sent a JSON POST for every event of the project's steps:
+
+  - step.created: a step was recorded.
+  - step.needs_data: a step is waiting for results to be uploaded.
+  - step.completed: a step was continued, or finished its protocol.
+  - step.failed: a step failed its protocol, or a run of one of its command
+    groups failed, holding the step.
+  - protocol.completed and protocol.failed: a protocol reached either end.
+
+Events are queued in webhook_delivery in the same transaction that records
+their step or run, so none are lost to a crash, and the WebhookSender sends them
+outside of the writer. A delivery which doesn't get a 2xx response is retried
+with exponential backoff until it is given up on, and every attempt is logged
+in webhook_delivery_attempt.
+
+Each body is signed with the webhook's secret: the X-Autodemo-Signature header
+is "sha256=" followed by the hex HMAC-SHA256 of the body.
+
+******************************************************************************/
+
+// Webhook events.
+const (
+	EventStepCreated       = "step.created"
+	EventStepNeedsData     = "step.needs_data"
+	EventStepCompleted     = "step.completed"
+	EventStepFailed        = "step.failed"
+	EventProtocolCompleted = "protocol.completed"
+	EventProtocolFailed    = "protocol.failed"
+)
+
+// Delivery statuses, as recorded in webhook_delivery.
+const (
+	DeliveryPending   = "PENDING"
+	DeliveryDelivered = "DELIVERED"
+	DeliveryFailed    = "FAILED"
+)
+
+// WebhookEvent is the body of a webhook delivery.
+type WebhookEvent struct {
+	Event       string                   `json:"event"`
+	ProjectID   string                   `json:"project_id"`
+	Step        autodemosql.CodeStep     `json:"step"`                  // as in /status/{projectID}
+	Outstanding map[string][]string      `json:"outstanding,omitempty"` // for step.needs_data, script ID -> return keys
+	Run         *autodemosql.CodeStepRun `json:"run,omitempty"`         // for step.failed by a failed run
+	CreatedAt   int64                    `json:"created_at"`
+}
+
+// stepEvents returns the events of recording step, which continued previous
+// unless it is the first step of its protocol.
+func stepEvents(previous *autodemosql.CodeStep, step autodemosql.CodeStep) ([]WebhookEvent, error) {
+	var events []WebhookEvent
+	add := func(event string, step autodemosql.CodeStep) {
+		events = append(events, WebhookEvent{Event: event, Step: step})
+	}
+	if previous != nil {
+		add(EventStepCompleted, *previous)
+	}
+	add(EventStepCreated, step)
+	switch step.Status {
+	case libb.StatusContinue:
+		outstanding, err := outstandingKeys(step)
+		if err != nil {
+			return nil, err
+		}
+		events = append(events, WebhookEvent{Event: EventStepNeedsData, Step: step, Outstanding: outstanding})
+	case libb.StatusSuccess:
+		add(EventStepCompleted, step)
+		add(EventProtocolCompleted, step)
+	case libb.StatusFailure:
+		add(EventStepFailed, step)
+		add(EventProtocolFailed, step)
+	}
+	return events, nil
+}
+
+// queueStepEvents queues a delivery of each event of recording a step of code
+// to each of its project's webhooks.
+func queueStepEvents(queries *autodemosql.Queries, ctx context.Context, codeID, stepID int64) error {
+	webhooks, err := queries.GetWebhooksForCode(ctx, codeID)
+	if err != nil {
+		return fmt.Errorf("failed to get webhooks: %v", err)
+	}
+	if len(webhooks) == 0 {
+		return nil
+	}
+	steps, err := queries.GetStepsForCode(ctx, codeID)
+	if err != nil {
+		return fmt.Errorf("failed to get steps for code: %v", err)
+	}
+	var previous *autodemosql.CodeStep
+	for i := range steps {
+		if steps[i].ID != stepID {
+			previous = &steps[i]
+			continue
+		}
+		events, err := stepEvents(previous, steps[i])
+		if err != nil {
+			return err
+		}
+		return queueEvents(queries, ctx, webhooks, events)
+	}
+	return fmt.Errorf("step %d not found", stepID)
+}
+
+// queueRunFailedEvent queues a step.failed delivery of a failed run of one of
+// a step's command groups to each of its project's webhooks.
+func queueRunFailedEvent(queries *autodemosql.Queries, ctx context.Context, stepID int64, run autodemosql.CodeStepRun) error {
+	step, err := queries.GetCodeStep(ctx, stepID)
+	if err != nil {
+		return fmt.Errorf("failed to get step: %v", err)
+	}
+	webhooks, err := queries.GetWebhooksForCode(ctx, step.Code)
+	if err != nil {
+		return fmt.Errorf("failed to get webhooks: %v", err)
+	}
+	return queueEvents(queries, ctx, webhooks, []WebhookEvent{{Event: EventStepFailed, Step: step, Run: &run}})
+}
+
+// queueEvents queues a delivery of each event to each webhook.
+func queueEvents(queries *autodemosql.Queries, ctx context.Context, webhooks []autodemosql.ProjectWebhook, events []WebhookEvent) error {
+	now := time.Now().Unix()
+	for _, webhook := range webhooks {
+		for _, event := range events {
+			event.ProjectID = webhook.ProjectID
+			event.CreatedAt = now
+			payload, err := json.Marshal(event)
+			if err != nil {
+				return fmt.Errorf("failed to marshal %s event: %v", event.Event, err)
+			}
+			err = queries.CreateWebhookDelivery(ctx, autodemosql.CreateWebhookDeliveryParams{
+				Webhook: webhook.ID,
+				Event:   event.Event,
+				Payload: string(payload),
+			})
+			if err != nil {
+				return fmt.Errorf("failed to queue %s event: %v", event.Event, err)
+			}
+		}
+	}
+	return nil
+}
+
+// SignWebhook returns the hex HMAC-SHA256 of a delivery's body with its
+// webhook's secret, which receivers compare to X-Autodemo-Signature.
+func SignWebhook(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+/******************************************************************************
+
+Webhook sender
+
+******************************************************************************/
+
+// WebhookSender sends queued webhook deliveries.
+type WebhookSender struct {
+	db     *WriteDB
+	readDB *sql.DB
+	wake   chan struct{}
+	done   chan struct{}
+	cancel context.CancelFunc
+
+	// Client sends deliveries.
+	Client *http.Client
+	// Backoff is how long to wait before retrying a failed delivery, doubling
+	// after each further failure up to MaxBackoff.
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// MaxAttempts is how many times a delivery is tried before it is failed.
+	MaxAttempts int64
+	// Now tells the time, for scheduling retries.
+	Now func() time.Time
+}
+
+// NewWebhookSender creates a sender recording deliveries with db, and reading
+// them from readDB.
+func NewWebhookSender(db *WriteDB, readDB *sql.DB) *WebhookSender {
+	return &WebhookSender{
+		db:          db,
+		readDB:      readDB,
+		wake:        make(chan struct{}, 1),
+		done:        make(chan struct{}),
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		Backoff:     10 * time.Second,
+		MaxBackoff:  time.Hour,
+		MaxAttempts: 10,
+		Now:         time.Now,
+	}
+}
+
+// Start sends every due delivery, then does so again whenever Notify is
+// called or the next retry is due, until ctx is cancelled or Stop is called.
+func (s *WebhookSender) Start(ctx context.Context) {
+	ctx, s.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(s.done)
+		for {
+			var next <-chan time.Time
+			if err := s.deliverDue(ctx); err != nil {
+				log.Printf("Error sending webhooks: %v", err)
+				next = time.After(s.Backoff)
+			} else if at, ok := s.nextAttempt(ctx); ok {
+				next = time.After(at.Sub(s.Now()))
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-s.wake:
+			case <-next:
+			}
+		}
+	}()
+}
+
+// Notify tells the sender that deliveries have been queued.
+func (s *WebhookSender) Notify() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+		// A wake up is already pending, which will see these deliveries too.
+	}
+}
+
+// Stop stops the sender, waiting for the delivery being sent to finish.
+func (s *WebhookSender) Stop() {
+	if s.cancel == nil {
+		return
+	}
+	s.cancel()
+	<-s.done
+}
+
+// nextAttempt returns when the next pending delivery is due, if there is one.
+func (s *WebhookSender) nextAttempt(ctx context.Context) (time.Time, bool) {
+	at, err := autodemosql.New(s.readDB).GetNextWebhookAttempt(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return time.Time{}, false
+	}
+	if err != nil {
+		log.Printf("Failed to get next webhook delivery: %v", err)
+		return s.Now().Add(s.Backoff), true
+	}
+	return time.Unix(at, 0), true
+}
+
+// deliverDue sends every pending delivery which is due, oldest first.
+func (s *WebhookSender) deliverDue(ctx context.Context) error {
+	deliveries, err := autodemosql.New(s.readDB).GetDueWebhookDeliveries(ctx, s.Now().Unix())
+	if err != nil {
+		return fmt.Errorf("failed to get due deliveries: %v", err)
+	}
+	for _, delivery := range deliveries {
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err := s.deliver(ctx, delivery); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deliver makes one attempt at sending a delivery, and records how it went.
+// Attempts interrupted by ctx are made again after a restart.
+func (s *WebhookSender) deliver(ctx context.Context, delivery autodemosql.GetDueWebhookDeliveriesRow) error {
+	start := time.Now()
+	code, err := s.post(ctx, delivery)
+	if ctx.Err() != nil {
+		return nil
+	}
+	attempt := autodemosql.CreateWebhookDeliveryAttemptParams{
+		Delivery:     delivery.ID,
+		ResponseCode: sql.NullInt64{Int64: int64(code), Valid: code != 0},
+		DurationMs:   time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		attempt.Error = sql.NullString{String: err.Error(), Valid: true}
+	}
+
+	now := s.Now()
+	update := autodemosql.UpdateWebhookDeliveryParams{
+		Status:        DeliveryPending,
+		Attempts:      delivery.Attempts + 1,
+		NextAttemptAt: delivery.NextAttemptAt,
+		ID:            delivery.ID,
+	}
+	switch {
+	case err == nil:
+		update.Status = DeliveryDelivered
+		update.DeliveredAt = sql.NullInt64{Int64: now.Unix(), Valid: true}
+	case update.Attempts >= s.MaxAttempts:
+		update.Status = DeliveryFailed
+	default:
+		update.NextAttemptAt = now.Add(s.backoff(update.Attempts)).Unix()
+	}
+	err = s.db.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		if err := queries.CreateWebhookDeliveryAttempt(ctx, attempt); err != nil {
+			return err
+		}
+		return queries.UpdateWebhookDelivery(ctx, update)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record delivery %d: %v", delivery.ID, err)
+	}
+	return nil
+}
+
+// backoff returns how long to wait after a delivery's attempts have failed.
+func (s *WebhookSender) backoff(attempts int64) time.Duration {
+	backoff := s.Backoff
+	for i := int64(1); i < attempts && backoff < s.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	return min(backoff, s.MaxBackoff)
+}
+
+// post sends a delivery, and returns the status code of the response, if
+// there was one. Responses other than 2xx are errors.
+func (s *WebhookSender) post(ctx context.Context, delivery autodemosql.GetDueWebhookDeliveriesRow) (int, error) {
+	body := []byte(delivery.Payload)
+	req, err := http.NewRequestWithContext(ctx, "POST", delivery.Url, strings.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Autodemo-Event", delivery.Event)
+	req.Header.Set("X-Autodemo-Delivery", strconv.FormatInt(delivery.ID, 10))
+	req.Header.Set("X-Autodemo-Signature", "sha256="+SignWebhook(delivery.Secret, body))
+	resp, err := s.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<16))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, fmt.Errorf("unexpected response: %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+/******************************************************************************
+
+Webhook endpoints
+
+******************************************************************************/
+
+// Webhook is a webhook of a project. Its secret is only given when it is
+// created.
+type Webhook struct {
+	ID        int64  `json:"id"`
+	ProjectID string `json:"project_id"`
+	URL       string `json:"url"`
+	Secret    string `json:"secret,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+// WebhookDelivery is a delivery to a webhook, with the log of its attempts.
+type WebhookDelivery struct {
+	ID            int64            `json:"id"`
+	Event         string           `json:"event"`
+	Payload       json.RawMessage  `json:"payload"`
+	Status        string           `json:"status"`
+	Attempts      int64            `json:"attempts"`
+	NextAttemptAt int64            `json:"next_attempt_at"`
+	DeliveredAt   *int64           `json:"delivered_at,omitempty"`
+	CreatedAt     int64            `json:"created_at"`
+	Log           []WebhookAttempt `json:"log"`
+}
+
+// WebhookAttempt is one attempt at sending a delivery.
+type WebhookAttempt struct {
+	ResponseCode *int64 `json:"response_code,omitempty"`
+	Error        string `json:"error,omitempty"`
+	DurationMs   int64  `json:"duration_ms"`
+	CreatedAt    int64  `json:"created_at"`
+}
+
+// CreateWebhook registers a webhook for a project.
+func (w *WriteDB) CreateWebhook(ctx context.Context, projectID, url, secret string) (autodemosql.ProjectWebhook, error) {
+	var webhook autodemosql.ProjectWebhook
+	err := w.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		var err error
+		webhook, err = queries.CreateProjectWebhook(ctx, autodemosql.CreateProjectWebhookParams{
+			ProjectID: projectID,
+			Url:       url,
+			Secret:    secret,
+		})
+		return err
+	})
+	return webhook, err
+}
+
+// RemoveWebhook stops a project's webhook being sent events. Its deliveries
+// are kept. It returns sql.ErrNoRows if the project has no such webhook.
+func (w *WriteDB) RemoveWebhook(ctx context.Context, projectID string, id int64) error {
+	return w.RunTx(func(queries *autodemosql.Queries, ctx context.Context) error {
+		removed, err := queries.RemoveProjectWebhook(ctx, autodemosql.RemoveProjectWebhookParams{ID: id, ProjectID: projectID})
+		if err != nil {
+			return err
+		}
+		if removed == 0 {
+			return sql.ErrNoRows
+		}
+		return nil
+	})
+}
+
+// WebhooksHandler lists a project's webhooks on GET, and registers one on
+// POST from {"url": "...", "secret": "..."}. A secret is generated if none is
+// given.
+func (app *App) WebhooksHandler(w http.ResponseWriter, r *http.Request) {
+	projectID := r.PathValue("projectID")
+	queries := autodemosql.New(app.DB)
+	if _, err := queries.GetProjectByID(r.Context(), projectID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			http.Error(w, "Project not found", http.StatusNotFound)
+			return
+		}
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		rows, err := queries.GetProjectWebhooks(r.Context(), projectID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		webhooks := make([]Webhook, len(rows))
+		for i, row := range rows {
+			webhooks[i] = Webhook{ID: row.ID, ProjectID: row.ProjectID, URL: row.Url, CreatedAt: row.CreatedAt}
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(webhooks)
+	case "POST":
+		var request struct {
+			URL    string `json:"url"`
+			Secret string `json:"secret"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			http.Error(w, fmt.Sprintf("Invalid request: %v", err), http.StatusBadRequest)
+			return
+		}
+		u, err := url.Parse(request.URL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			http.Error(w, "Invalid URL: must be an absolute http or https URL", http.StatusBadRequest)
+			return
+		}
+		if request.Secret == "" {
+			secret := make([]byte, 32)
+			if _, err := rand.Read(secret); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			request.Secret = hex.EncodeToString(secret)
+		}
+		row, err := app.WDB.CreateWebhook(r.Context(), projectID, request.URL, request.Secret)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(Webhook{ID: row.ID, ProjectID: row.ProjectID, URL: row.Url, Secret: row.Secret, CreatedAt: row.CreatedAt})
+	default:
+		http.Error(w, "Only GET and POST allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// WebhookHandler removes a project's webhook on DELETE.
+func (app *App) WebhookHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		http.Error(w, "Only DELETE allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseInt(r.PathValue("webhookID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	err = app.WDB.RemoveWebhook(r.Context(), r.PathValue("projectID"), id)
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// WebhookDeliveriesHandler lists the deliveries to a project's webhook, newest
+// first, each with the log of its attempts.
+func (app *App) WebhookDeliveriesHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.ParseInt(r.PathValue("webhookID"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid webhook ID", http.StatusBadRequest)
+		return
+	}
+	queries := autodemosql.New(app.DB)
+	_, err = queries.GetProjectWebhook(r.Context(), autodemosql.GetProjectWebhookParams{ID: id, ProjectID: r.PathValue("projectID")})
+	if errors.Is(err, sql.ErrNoRows) {
+		http.Error(w, "Webhook not found", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows, err := queries.GetWebhookDeliveries(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	deliveries := make([]WebhookDelivery, len(rows))
+	for i, row := range rows {
+		attempts, err := queries.GetWebhookDeliveryAttempts(r.Context(), row.ID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		deliveries[i] = WebhookDelivery{
+			ID:            row.ID,
+			Event:         row.Event,
+			Payload:       json.RawMessage(row.Payload),
+			Status:        row.Status,
+			Attempts:      row.Attempts,
+			NextAttemptAt: row.NextAttemptAt,
+			DeliveredAt:   nullInt64(row.DeliveredAt),
+			CreatedAt:     row.CreatedAt,
+			Log:           make([]WebhookAttempt, len(attempts)),
+		}
+		for j, attempt := range attempts {
+			deliveries[i].Log[j] = WebhookAttempt{
+				ResponseCode: nullInt64(attempt.ResponseCode),
+				Error:        attempt.Error.String,
+				DurationMs:   attempt.DurationMs,
+				CreatedAt:    attempt.CreatedAt,
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(deliveries)
+}
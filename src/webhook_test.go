@@ -0,0 +1,334 @@
+package autodemo
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/koeng101/autodemo/src/autodemosql"
+)
+
+// webhookReceiver records the deliveries it is sent, failing the first fails
+// attempts at each, or every attempt if fails is negative.
+type webhookReceiver struct {
+	*httptest.Server
+	t      *testing.T
+	secret string
+	fails  int
+
+	mu       sync.Mutex
+	attempts map[string]int
+	events   []WebhookEvent
+}
+
+func newWebhookReceiver(t *testing.T, secret string, fails int) *webhookReceiver {
+	r := &webhookReceiver{t: t, secret: secret, fails: fails, attempts: make(map[string]int)}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := io.ReadAll(req.Body)
+		if got, want := req.Header.Get("X-Autodemo-Signature"), "sha256="+SignWebhook(r.secret, body); got != want {
+			r.t.Errorf("Expected signature %s, got %s", want, got)
+		}
+		var event WebhookEvent
+		if err := json.Unmarshal(body, &event); err != nil {
+			r.t.Errorf("Failed to parse delivery: %v", err)
+		}
+		if req.Header.Get("X-Autodemo-Event") != event.Event {
+			r.t.Errorf("Expected event header %s, got %s", event.Event, req.Header.Get("X-Autodemo-Event"))
+		}
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		delivery := req.Header.Get("X-Autodemo-Delivery")
+		r.attempts[delivery]++
+		if r.fails < 0 || r.attempts[delivery] <= r.fails {
+			http.Error(w, "try again", http.StatusInternalServerError)
+			return
+		}
+		r.events = append(r.events, event)
+	}))
+	return r
+}
+
+// received returns the events delivered so far.
+func (r *webhookReceiver) received() []WebhookEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]WebhookEvent(nil), r.events...)
+}
+
+// registerWebhook registers a webhook for a project through the API.
+func registerWebhook(t *testing.T, app *App, projectID, body string) Webhook {
+	t.Helper()
+	req := httptest.NewRequest("POST", "/webhooks/"+projectID, strings.NewReader(body))
+	req.SetPathValue("projectID", projectID)
+	rec := httptest.NewRecorder()
+	app.WebhooksHandler(rec, req)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("Failed to register webhook: %d %s", rec.Code, rec.Body.String())
+	}
+	var webhook Webhook
+	if err := json.Unmarshal(rec.Body.Bytes(), &webhook); err != nil {
+		t.Fatalf("Failed to parse webhook: %v", err)
+	}
+	return webhook
+}
+
+// webhookDeliveries lists the deliveries to a webhook through the API.
+func webhookDeliveries(t *testing.T, app *App, webhook Webhook) []WebhookDelivery {
+	t.Helper()
+	req := httptest.NewRequest("GET", fmt.Sprintf("/webhooks/%s/%d/deliveries", webhook.ProjectID, webhook.ID), nil)
+	req.SetPathValue("projectID", webhook.ProjectID)
+	req.SetPathValue("webhookID", fmt.Sprint(webhook.ID))
+	rec := httptest.NewRecorder()
+	app.WebhookDeliveriesHandler(rec, req)
+	var deliveries []WebhookDelivery
+	if err := json.Unmarshal(rec.Body.Bytes(), &deliveries); err != nil {
+		t.Fatalf("Failed to parse deliveries: %d %s", rec.Code, rec.Body.String())
+	}
+	return deliveries
+}
+
+func TestWebhooks(t *testing.T) {
+	dbPath := "test_webhooks.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	runner := NewProtocolRunner(wdb)
+	app := &App{DB: db, WDB: wdb, Runner: runner, Webhooks: NewWebhookSender(wdb, db)}
+	runner.OnStep = app.Webhooks.Notify
+	app.Webhooks.Start(ctx)
+	defer app.Webhooks.Stop()
+	queries := autodemosql.New(db)
+
+	receiver := newWebhookReceiver(t, "shh", 0)
+	defer receiver.Close()
+	webhook := registerWebhook(t, app, "test-project-1", fmt.Sprintf(`{"url": %q, "secret": "shh"}`, receiver.URL))
+	if webhook.Secret != "shh" {
+		t.Errorf("Expected the webhook's secret, got %q", webhook.Secret)
+	}
+	waitForEvents := func(count int) []WebhookEvent {
+		t.Helper()
+		deadline := time.Now().Add(10 * time.Second)
+		for {
+			events := receiver.received()
+			if len(events) >= count {
+				return events
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("Timed out waiting for %d events, got %+v", count, events)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	eventNames := func(events []WebhookEvent) []string {
+		var names []string
+		for _, event := range events {
+			names = append(names, event.Event)
+		}
+		return names
+	}
+
+	// A protocol waiting on data, then finishing once it is uploaded.
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	if err := runner.StartProtocol(ctx, historyID, quantifyProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	events := waitForEvents(2)
+	step := waitForSteps(t, queries, historyID, 1)[0]
+	if events[0].ProjectID != "test-project-1" || events[0].Step.ID != step.ID {
+		t.Errorf("Expected an event for step %d, got %+v", step.ID, events[0])
+	}
+	if !reflect.DeepEqual(events[1].Outstanding, map[string][]string{"da50bbdd-e80c-4fd7-a27b-f0c2275e3f07": {"b6885800-f454-4f19-9c60-ff725aa2d51a"}}) {
+		t.Errorf("Expected the outstanding return key, got %v", events[1].Outstanding)
+	}
+	if err := wdb.MergeData(ctx, step.ID, "b6885800-f454-4f19-9c60-ff725aa2d51a", `{"ng_per_ul": 30}`); err != nil {
+		t.Fatalf("Failed to upload result: %v", err)
+	}
+	if err := runner.ContinueStep(ctx, step.ID); err != nil {
+		t.Fatalf("Failed to continue step: %v", err)
+	}
+	events = waitForEvents(6)
+	want := []string{EventStepCreated, EventStepNeedsData, EventStepCompleted, EventStepCreated, EventStepCompleted, EventProtocolCompleted}
+	if got := eventNames(events); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected events %v, got %v", want, got)
+	}
+	if events[2].Step.ID != step.ID || events[5].Step.StepComment != "Got 30 ng/uL" {
+		t.Errorf("Expected the first step to complete, then the protocol, got %+v", events[2:])
+	}
+
+	// A protocol failing straight away.
+	historyID, _, err = wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	if err := runner.StartProtocol(ctx, historyID, `function main() error("boom") end`); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	events = waitForEvents(9)
+	want = []string{EventStepCreated, EventStepFailed, EventProtocolFailed}
+	if got := eventNames(events[6:]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected events %v, got %v", want, got)
+	}
+
+	// Every delivery is logged, once the sender has recorded the last one.
+	var deliveries []WebhookDelivery
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		deliveries = webhookDeliveries(t, app, webhook)
+		if len(deliveries) == 9 && deliveries[0].Status != DeliveryPending {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for 9 deliveries, got %+v", deliveries)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	for _, delivery := range deliveries {
+		if delivery.Status != DeliveryDelivered || delivery.DeliveredAt == nil || len(delivery.Log) != 1 || *delivery.Log[0].ResponseCode != http.StatusOK {
+			t.Errorf("Expected a delivery on the first attempt, got %+v", delivery)
+		}
+	}
+
+	// Removed webhooks are sent nothing more.
+	req := httptest.NewRequest("DELETE", fmt.Sprintf("/webhooks/test-project-1/%d", webhook.ID), nil)
+	req.SetPathValue("projectID", "test-project-1")
+	req.SetPathValue("webhookID", fmt.Sprint(webhook.ID))
+	rec := httptest.NewRecorder()
+	app.WebhookHandler(rec, req)
+	if rec.Code != http.StatusNoContent {
+		t.Errorf("Expected the webhook to be removed, got %d", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	app.WebhookHandler(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected removing it again to find nothing, got %d", rec.Code)
+	}
+	if err := runner.StartProtocol(ctx, historyID, `function main() error("boom") end`); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+	if deliveries := webhookDeliveries(t, app, webhook); len(deliveries) != 9 {
+		t.Errorf("Expected no more deliveries, got %d", len(deliveries))
+	}
+
+	// Webhooks must be absolute http URLs, for projects which exist.
+	req = httptest.NewRequest("POST", "/webhooks/test-project-1", strings.NewReader(`{"url": "ftp://example.com"}`))
+	req.SetPathValue("projectID", "test-project-1")
+	rec = httptest.NewRecorder()
+	app.WebhooksHandler(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("Expected an invalid URL to be rejected, got %d", rec.Code)
+	}
+	req = httptest.NewRequest("GET", "/webhooks/test-project-2", nil)
+	req.SetPathValue("projectID", "test-project-2")
+	rec = httptest.NewRecorder()
+	app.WebhooksHandler(rec, req)
+	if rec.Code != http.StatusNotFound {
+		t.Errorf("Expected an unknown project not to be found, got %d", rec.Code)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	dbPath := "test_webhook_retries.db"
+	db, wdb := MakeTestDatabase(dbPath)
+	defer db.Close()
+	defer os.Remove(dbPath)
+	defer os.Remove(dbPath + "-wal")
+	defer os.Remove(dbPath + "-shm")
+
+	ctx := context.Background()
+	if err := wdb.CreateProject(ctx, "test-project-1"); err != nil {
+		t.Fatalf("Failed to create project: %v", err)
+	}
+	historyID, _, err := wdb.AddMessageHistory(ctx, "test-project-1", "test Message")
+	if err != nil {
+		t.Fatalf("Failed to create message history: %v", err)
+	}
+	app := &App{DB: db, WDB: wdb}
+	flaky := newWebhookReceiver(t, "", 2)
+	defer flaky.Close()
+	down := newWebhookReceiver(t, "", -1)
+	defer down.Close()
+	flakyWebhook := registerWebhook(t, app, "test-project-1", fmt.Sprintf(`{"url": %q}`, flaky.URL))
+	downWebhook := registerWebhook(t, app, "test-project-1", fmt.Sprintf(`{"url": %q}`, down.URL))
+	if len(flakyWebhook.Secret) != 64 {
+		t.Errorf("Expected a secret to be generated, got %q", flakyWebhook.Secret)
+	}
+	flaky.secret, down.secret = flakyWebhook.Secret, downWebhook.Secret
+
+	// A step with status 3 has just the one event.
+	runner := NewProtocolRunner(wdb)
+	if err := runner.StartProtocol(ctx, historyID, robotProtocol); err != nil {
+		t.Fatalf("Failed to start protocol: %v", err)
+	}
+
+	// The sender is driven by hand, on a clock of its own.
+	now := time.Now()
+	sender := NewWebhookSender(wdb, db)
+	sender.MaxAttempts = 3
+	sender.Now = func() time.Time { return now }
+	deliver := func(advance time.Duration) {
+		t.Helper()
+		now = now.Add(advance)
+		if err := sender.deliverDue(ctx); err != nil {
+			t.Fatalf("Failed to deliver: %v", err)
+		}
+	}
+	attempts := func(webhook Webhook) (string, int64) {
+		t.Helper()
+		deliveries := webhookDeliveries(t, app, webhook)
+		if len(deliveries) != 1 {
+			t.Fatalf("Expected one delivery, got %+v", deliveries)
+		}
+		return deliveries[0].Status, deliveries[0].Attempts
+	}
+
+	// Failed deliveries are retried after 10s, then 20s.
+	deliver(0)
+	deliver(9 * time.Second)
+	if status, count := attempts(flakyWebhook); status != DeliveryPending || count != 1 {
+		t.Errorf("Expected one attempt before the backoff, got %s after %d", status, count)
+	}
+	deliver(time.Second)
+	deliver(19 * time.Second)
+	if status, count := attempts(flakyWebhook); status != DeliveryPending || count != 2 {
+		t.Errorf("Expected two attempts before the backoff doubles, got %s after %d", status, count)
+	}
+	deliver(time.Second)
+	if status, count := attempts(flakyWebhook); status != DeliveryDelivered || count != 3 {
+		t.Errorf("Expected the third attempt to deliver, got %s after %d", status, count)
+	}
+	log := webhookDeliveries(t, app, flakyWebhook)[0].Log
+	if len(log) != 3 || *log[0].ResponseCode != 500 || !strings.Contains(log[0].Error, "500") || *log[2].ResponseCode != 200 || log[2].Error != "" {
+		t.Errorf("Expected every attempt to be logged, got %+v", log)
+	}
+	if events := flaky.received(); len(events) != 1 || events[0].Event != EventStepCreated {
+		t.Errorf("Expected one step.created event, got %+v", events)
+	}
+
+	// Deliveries are given up on after MaxAttempts.
+	if status, count := attempts(downWebhook); status != DeliveryFailed || count != 3 {
+		t.Errorf("Expected the delivery to fail after 3 attempts, got %s after %d", status, count)
+	}
+	deliver(time.Hour)
+	if _, count := attempts(downWebhook); count != 3 {
+		t.Errorf("Expected no more attempts, got %d", count)
+	}
+}